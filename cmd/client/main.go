@@ -3,19 +3,32 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/unownone/shipitd/internal/client"
 	"github.com/unownone/shipitd/internal/config"
 	"github.com/unownone/shipitd/internal/logger"
+	"github.com/unownone/shipitd/internal/proxy"
+	"github.com/unownone/shipitd/internal/security"
 )
 
 var (
 	cfgFile string
 	verbose bool
+
+	// Flags of auth cert request
+	certCommonName string
+	certRequestOut string
+
+	// Set at build time through -ldflags
+	Version   = "dev"
+	BuildTime = "unknown"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -69,6 +82,33 @@ var authTestCmd = &cobra.Command{
 	Run:   runAuthTest,
 }
 
+// authCertCmd represents the auth cert command
+var authCertCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Manage the data plane client certificate",
+	Long: `Manage the client certificate presented to the data plane, stored where
+auth.client_cert and auth.client_key point to.`,
+}
+
+// authCertRequestCmd represents the auth cert request command
+var authCertRequestCmd = &cobra.Command{
+	Use:   "request",
+	Short: "Generate a private key and a certificate signing request",
+	Long: `Generate a new private key, store it at auth.client_key and write a
+certificate signing request for it to have signed by the ShipIt server's CA.`,
+	Run: runAuthCertRequest,
+}
+
+// authCertInstallCmd represents the auth cert install command
+var authCertInstallCmd = &cobra.Command{
+	Use:   "install <certificate.pem>",
+	Short: "Install a signed client certificate",
+	Long: `Check that a signed certificate matches the private key from "auth cert request"
+and store it at auth.client_cert. A running client picks it up on its next connection.`,
+	Args: cobra.ExactArgs(1),
+	Run:  runAuthCertInstall,
+}
+
 // tunnelsCmd represents the tunnels command
 var tunnelsCmd = &cobra.Command{
 	Use:   "tunnels",
@@ -140,6 +180,11 @@ func init() {
 
 	// Add auth subcommands
 	authCmd.AddCommand(authTestCmd)
+	authCmd.AddCommand(authCertCmd)
+	authCertCmd.AddCommand(authCertRequestCmd)
+	authCertCmd.AddCommand(authCertInstallCmd)
+	authCertRequestCmd.Flags().StringVar(&certCommonName, "common-name", "", "common name of the certificate (default is the hostname)")
+	authCertRequestCmd.Flags().StringVar(&certRequestOut, "out", "", "file to write the request to (default is stdout)")
 
 	// Add tunnels subcommands
 	tunnelsCmd.AddCommand(tunnelsListCmd)
@@ -152,6 +197,8 @@ func init() {
 }
 
 func main() {
+	client.ClientVersion = Version
+
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
@@ -176,6 +223,7 @@ func runStart(cmd *cobra.Command, args []string) {
 
 	// Create tunnel manager
 	tunnelManager := client.NewTunnelManager(cfg, log)
+	tunnelManager.SetForwarder(proxy.NewDispatcher(tunnelManager.GetConnectionPool(), log))
 
 	// Start tunnels from configuration
 	for _, tunnelConfig := range cfg.Tunnels {
@@ -249,11 +297,30 @@ func runStatus(cmd *cobra.Command, args []string) {
 	fmt.Println("ShipIt Client Daemon Status")
 	fmt.Println("============================")
 	fmt.Printf("Total Tunnels: %d\n", stats["total_tunnels"])
+	if pool, ok := stats["connection_pool"].(map[string]interface{}); ok {
+		if endpoint, ok := pool["endpoint"].(client.Endpoint); ok {
+			if endpoint.RTT > 0 {
+				fmt.Printf("Endpoint: %s (handshake %s)\n", endpoint.Addr, endpoint.RTT.Round(time.Millisecond))
+			} else {
+				fmt.Printf("Endpoint: %s\n", endpoint.Addr)
+			}
+		}
+	}
 
 	if tunnels, ok := stats["tunnels"].(map[string]interface{}); ok {
 		for tunnelID, tunnelInfo := range tunnels {
 			if info, ok := tunnelInfo.(map[string]interface{}); ok {
 				fmt.Printf("Tunnel %s: %s\n", tunnelID, info["state"])
+				if publicURL, ok := info["public_url"].(string); ok && publicURL != "" {
+					fmt.Printf("  Public URL: %s\n", publicURL)
+				}
+				if attempts, ok := info["reconnect_attempts"].(int); ok && attempts > 0 {
+					fmt.Printf("  Reconnect attempt: %d of %d\n", attempts, cfg.Connection.MaxReconnectAttempts)
+				}
+				if traffic, ok := info["traffic"].(client.TunnelCountersSnapshot); ok {
+					fmt.Printf("  Active: %d, Requests: %d, In: %d bytes, Out: %d bytes, Errors: %d\n",
+						traffic.ActiveConns, traffic.TotalRequests, traffic.BytesIn, traffic.BytesOut, traffic.Errors)
+				}
 			}
 		}
 	}
@@ -290,6 +357,94 @@ func runAuthTest(cmd *cobra.Command, args []string) {
 	fmt.Printf("Auth Type: %s\n", tokenInfo.AuthType)
 }
 
+func runAuthCertRequest(cmd *cobra.Command, args []string) {
+	// Load configuration
+	cfg, err := config.LoadConfig(cfgFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+	_, keyRef := clientCertRefs(cfg)
+
+	commonName := certCommonName
+	if commonName == "" {
+		if commonName, err = os.Hostname(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get hostname, pass --common-name: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	keyPEM, csrPEM, err := security.GenerateCertificateRequest(commonName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to generate certificate request: %v\n", err)
+		os.Exit(1)
+	}
+	if err := security.WritePEM(keyRef, keyPEM); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to store private key: %v\n", err)
+		os.Exit(1)
+	}
+
+	if certRequestOut == "" {
+		os.Stdout.Write(csrPEM)
+	} else if err := os.WriteFile(certRequestOut, csrPEM, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write certificate request: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Private key stored at %s\n", keyRef)
+	fmt.Fprintln(os.Stderr, "Have the request signed, then run 'shipitd auth cert install <certificate.pem>'.")
+}
+
+func runAuthCertInstall(cmd *cobra.Command, args []string) {
+	// Load configuration
+	cfg, err := config.LoadConfig(cfgFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+	certRef, keyRef := clientCertRefs(cfg)
+
+	certPEM, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read certificate: %v\n", err)
+		os.Exit(1)
+	}
+	keyPEM, err := security.ReadPEM(keyRef)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read private key, run 'shipitd auth cert request' first: %v\n", err)
+		os.Exit(1)
+	}
+	cert, err := security.VerifyKeyPair(certPEM, keyPEM)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Refusing to install certificate: %v\n", err)
+		os.Exit(1)
+	}
+	if err := security.WritePEM(certRef, certPEM); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to store certificate: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Client certificate installed!")
+	fmt.Printf("Subject: %s\n", cert.Subject)
+	fmt.Printf("Issuer: %s\n", cert.Issuer)
+	fmt.Printf("Expires: %s\n", cert.NotAfter.Format("2006-01-02 15:04:05"))
+	fmt.Printf("Stored at: %s\n", certRef)
+	if cfg.Auth.ClientCert == "" {
+		fmt.Println("\nAdd these lines to the auth section of your configuration to use it:")
+		fmt.Printf("  client_cert: %q\n", certRef)
+		fmt.Printf("  client_key: %q\n", keyRef)
+	}
+}
+
+// clientCertRefs returns where the client certificate and its key are stored,
+// the default files when the configuration does not say
+func clientCertRefs(cfg *config.Config) (certRef, keyRef string) {
+	if cfg.Auth.ClientCert != "" {
+		return cfg.Auth.ClientCert, cfg.Auth.ClientKey
+	}
+	return config.GetClientCertPath(), config.GetClientKeyPath()
+}
+
 func runTunnelsList(cmd *cobra.Command, args []string) {
 	// Load configuration
 	cfg, err := config.LoadConfig(cfgFile)
@@ -347,12 +502,44 @@ func runConfigShow(cmd *cobra.Command, args []string) {
 	fmt.Printf("API Port: %d\n", cfg.Server.APIPort)
 	fmt.Printf("Data Plane Port: %d\n", cfg.Server.DataPlanePort)
 	fmt.Printf("TLS Verify: %t\n", cfg.Server.TLSVerify)
+	fmt.Printf("Transport: %s\n", cfg.Server.Transport)
+	if len(cfg.Server.Endpoints) > 0 {
+		fmt.Printf("Endpoints: %s\n", strings.Join(cfg.Server.Endpoints, ", "))
+	}
+	if cfg.Server.CAFile != "" {
+		fmt.Printf("CA File: %s\n", cfg.Server.CAFile)
+	}
+	if len(cfg.Server.PinnedSPKISHA256) > 0 {
+		fmt.Printf("Pinned Keys: %s\n", strings.Join(cfg.Server.PinnedSPKISHA256, ", "))
+	}
 	fmt.Printf("API Key: %s...\n", cfg.Auth.APIKey[:10])
 	fmt.Printf("Auto Refresh: %t\n", cfg.Auth.AutoRefresh)
+	if cfg.Auth.ClientCert != "" {
+		fmt.Printf("Client Certificate: %s\n", cfg.Auth.ClientCert)
+		fmt.Printf("Client Key: %s\n", cfg.Auth.ClientKey)
+	}
 	fmt.Printf("Pool Size: %d\n", cfg.Connection.PoolSize)
 	fmt.Printf("Heartbeat Interval: %s\n", cfg.Connection.HeartbeatInterval)
+	fmt.Printf("Heartbeat Max Missed: %d\n", cfg.Connection.HeartbeatMaxMissed)
 	fmt.Printf("Reconnect Interval: %s\n", cfg.Connection.ReconnectInterval)
+	fmt.Printf("Reconnect Multiplier: %g\n", cfg.Connection.ReconnectMultiplier)
+	fmt.Printf("Reconnect Max Interval: %s\n", cfg.Connection.ReconnectMaxInterval)
+	fmt.Printf("Reconnect Reset After: %s\n", cfg.Connection.ReconnectResetAfter)
 	fmt.Printf("Max Reconnect Attempts: %d\n", cfg.Connection.MaxReconnectAttempts)
+	fmt.Printf("Max Frame Size: %d\n", cfg.Connection.MaxFrameSize)
+	fmt.Printf("Ack Timeout: %s\n", cfg.Connection.AckTimeout)
+	fmt.Printf("Drain Timeout: %s\n", cfg.Connection.DrainTimeout)
+	if cfg.Connection.SessionFile != "" {
+		fmt.Printf("Session File: %s\n", cfg.Connection.SessionFile)
+	}
+	if cfg.Connection.Proxy != "" {
+		outboundProxy := cfg.Connection.Proxy
+		// The password of the proxy is not printed
+		if proxyURL, err := url.Parse(outboundProxy); err == nil {
+			outboundProxy = proxyURL.Redacted()
+		}
+		fmt.Printf("Proxy: %s\n", outboundProxy)
+	}
 	fmt.Printf("Log Level: %s\n", cfg.Logging.Level)
 	fmt.Printf("Log Format: %s\n", cfg.Logging.Format)
 	if cfg.Logging.File != "" {
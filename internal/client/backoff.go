@@ -0,0 +1,127 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBackoffBase is the delay ceiling of the first attempt
+	DefaultBackoffBase = 5 * time.Second
+	// DefaultBackoffMultiplier is the factor the delay ceiling grows by with every attempt
+	DefaultBackoffMultiplier = 2.0
+	// DefaultBackoffMax caps the delay ceiling
+	DefaultBackoffMax = 2 * time.Minute
+	// DefaultBackoffMaxAttempts is the number of attempts before giving up
+	DefaultBackoffMaxAttempts = 10
+	// DefaultBackoffResetAfter is how long a connection must stay up before the attempt budget is restored
+	DefaultBackoffResetAfter = time.Minute
+)
+
+// Backoff is an exponential backoff policy with full jitter. Attempt n waits a
+// random delay between zero and min(max, base * multiplier^(n-1)), so clients
+// that lost the same server do not all come back at once. Attempts count across
+// reconnects until a connection stays up for the stable period, so a flapping
+// connection still runs out of attempts.
+type Backoff struct {
+	mu          sync.Mutex
+	base        time.Duration
+	multiplier  float64
+	max         time.Duration
+	maxAttempts int
+	resetAfter  time.Duration
+	attempts    int
+	connectedAt time.Time
+}
+
+// NewBackoff creates a backoff policy, zero values fall back to the defaults
+func NewBackoff(base time.Duration, multiplier float64, max time.Duration, maxAttempts int, resetAfter time.Duration) *Backoff {
+	if base <= 0 {
+		base = DefaultBackoffBase
+	}
+	if multiplier < 1 {
+		multiplier = DefaultBackoffMultiplier
+	}
+	if max < base {
+		max = base
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultBackoffMaxAttempts
+	}
+	if resetAfter <= 0 {
+		resetAfter = DefaultBackoffResetAfter
+	}
+
+	return &Backoff{
+		base:        base,
+		multiplier:  multiplier,
+		max:         max,
+		maxAttempts: maxAttempts,
+		resetAfter:  resetAfter,
+	}
+}
+
+// Next starts the next attempt and returns how long to wait before it, or
+// false once every attempt is used up
+func (b *Backoff) Next() (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A connection that stayed up for the stable period earns a fresh budget
+	if !b.connectedAt.IsZero() {
+		if time.Since(b.connectedAt) >= b.resetAfter {
+			b.attempts = 0
+		}
+		b.connectedAt = time.Time{}
+	}
+
+	if b.attempts >= b.maxAttempts {
+		return 0, false
+	}
+	b.attempts++
+
+	return time.Duration(rand.Int63n(int64(b.ceiling(b.attempts)) + 1)), true
+}
+
+// ceiling returns the largest delay of an attempt
+func (b *Backoff) ceiling(attempt int) time.Duration {
+	ceiling := float64(b.base) * math.Pow(b.multiplier, float64(attempt-1))
+	if ceiling > float64(b.max) {
+		return b.max
+	}
+	return time.Duration(ceiling)
+}
+
+// Connected records that an attempt succeeded, the attempt count is reset once
+// the connection has lasted the stable period
+func (b *Backoff) Connected() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.connectedAt = time.Now()
+}
+
+// Attempts returns the number of attempts made since the budget was last restored
+func (b *Backoff) Attempts() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.connectedAt.IsZero() && time.Since(b.connectedAt) >= b.resetAfter {
+		return 0
+	}
+	return b.attempts
+}
+
+// MaxAttempts returns the attempt budget
+func (b *Backoff) MaxAttempts() int {
+	return b.maxAttempts
+}
+
+// Reset restores the full attempt budget
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts = 0
+	b.connectedAt = time.Time{}
+}
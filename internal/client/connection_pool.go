@@ -2,120 +2,256 @@ package client
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unownone/shipitd/internal/config"
 	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/pkg/types"
 	"github.com/sirupsen/logrus"
 )
 
-// Connection represents a TLS connection to the server
+// Connection is one data plane connection of the pool, with the router
+// reading it and the backoff governing its replacement
 type Connection struct {
-	ID         string
-	Conn       net.Conn
-	Reader     *protocol.Reader
-	Writer     *protocol.Writer
-	IsHealthy  bool
-	LastUsed   time.Time
-	CreatedAt  time.Time
-	mu         sync.RWMutex
+	ID        string
+	Client    *DataPlaneClient
+	Router    *MessageRouter
+	IsHealthy bool
+	LastUsed  time.Time
+	CreatedAt time.Time
+	tunnels   atomic.Int64
+	backoff   *Backoff
+	mu        sync.RWMutex
 }
 
-// ConnectionPool manages multiple TLS connections to the server
+// InFlight returns the load on the connection, the tunnels assigned to it plus its open streams
+func (c *Connection) InFlight() int {
+	inFlight := int(c.tunnels.Load())
+	if streams := c.Client.GetStreams(); streams != nil {
+		inFlight += streams.NumStreams()
+	}
+	return inFlight
+}
+
+// healthy returns whether the connection may be handed out
+func (c *Connection) healthy() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.IsHealthy
+}
+
+// ConnectionPool spreads the data plane over several connections to the
+// server. Tunnels are assigned to the healthy connection with the least load
+// in flight, and unhealthy connections are replaced in the background.
 type ConnectionPool struct {
-	serverAddr string
-	tlsConfig  *tls.Config
-	poolSize   int
-	logger     *logrus.Logger
-	connections []*Connection
-	roundRobin int
-	mu         sync.RWMutex
-	ctx        context.Context
-	cancel     context.CancelFunc
+	config         *config.Config
+	endpoints      *EndpointSelector
+	dialer         Dialer
+	transport      Transport
+	credentials    CredentialSource
+	poolSize       int
+	healthInterval time.Duration
+	logger         *logrus.Logger
+	connections    []*Connection
+	assignments    map[string]*Connection
+	replacing      map[string]bool
+	roundRobin     int
+	nextID         uint64
+	connectHandler func(conn *Connection)
+	retryHandler   func(old *Connection, attempt int, err error)
+	replaceHandler func(old, replacement *Connection)
+	monitorOnce    sync.Once
+	mu             sync.RWMutex
+	ctx            context.Context
+	cancel         context.CancelFunc
 }
 
 // NewConnectionPool creates a new connection pool
 func NewConnectionPool(cfg *config.Config, logger *logrus.Logger) *ConnectionPool {
-	// Create TLS configuration
-	tlsConfig := &tls.Config{
-		MinVersion:         tls.VersionTLS12,
-		ServerName:         cfg.Server.Domain,
-		InsecureSkipVerify: !cfg.Server.TLSVerify,
-	}
-
 	ctx, cancel := context.WithCancel(context.Background())
 
+	poolSize := cfg.Connection.PoolSize
+	if poolSize <= 0 {
+		poolSize = 1
+	}
+	// Connections are checked as often as they are probed with heartbeats
+	healthInterval := cfg.Connection.HeartbeatInterval
+	if healthInterval <= 0 {
+		healthInterval = protocol.DefaultHeartbeatInterval
+	}
+	// Shared by every connection, so the client certificate is loaded once
+	transport := NewTransport(cfg, newDataPlaneTLSConfig(cfg), logger)
+
 	return &ConnectionPool{
-		serverAddr:  fmt.Sprintf("%s:%d", cfg.Server.Domain, cfg.Server.DataPlanePort),
-		tlsConfig:   tlsConfig,
-		poolSize:    cfg.Connection.PoolSize,
-		logger:      logger,
-		connections: make([]*Connection, 0, cfg.Connection.PoolSize),
-		ctx:         ctx,
-		cancel:      cancel,
+		config:         cfg,
+		endpoints:      NewEndpointSelector(cfg, transport, logger),
+		dialer:         NewDialer(cfg),
+		transport:      transport,
+		poolSize:       poolSize,
+		healthInterval: healthInterval,
+		logger:         logger,
+		connections:    make([]*Connection, 0, poolSize),
+		assignments:    make(map[string]*Connection),
+		replacing:      make(map[string]bool),
+		ctx:            ctx,
+		cancel:         cancel,
 	}
 }
 
-// Initialize creates the initial connection pool
+// SetConnectHandler sets the function called for every new connection once it
+// joined the pool, for example to start reading it
+func (cp *ConnectionPool) SetConnectHandler(handler func(conn *Connection)) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.connectHandler = handler
+}
+
+// SetDialer sets the dialer new connections are opened with
+func (cp *ConnectionPool) SetDialer(dialer Dialer) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.dialer = dialer
+	cp.endpoints.SetDialer(dialer)
+}
+
+// SetTransport sets the transport new connections are opened with
+func (cp *ConnectionPool) SetTransport(transport Transport) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.transport = transport
+	cp.endpoints.SetTransport(transport)
+}
+
+// SetCredentialSource sets where the credentials new connections authenticate with come from
+func (cp *ConnectionPool) SetCredentialSource(credentials CredentialSource) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.credentials = credentials
+}
+
+// SetRetryHandler sets the function called before every attempt to replace an
+// unhealthy connection, with the error of the previous attempt. Once the
+// attempts ran out, or right away when the server refused the credentials, it
+// is called with attempt 0 and the connection leaves the pool.
+func (cp *ConnectionPool) SetRetryHandler(handler func(old *Connection, attempt int, err error)) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.retryHandler = handler
+}
+
+// SetReplaceHandler sets the function called once a replacement took the place
+// of an unhealthy connection
+func (cp *ConnectionPool) SetReplaceHandler(handler func(old, replacement *Connection)) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.replaceHandler = handler
+}
+
+// Initialize fills the pool up to its size and starts health monitoring. It
+// fails only when no connection at all could be established.
 func (cp *ConnectionPool) Initialize() error {
 	cp.logger.WithFields(logrus.Fields{
-		"server_addr": cp.serverAddr,
-		"pool_size":   cp.poolSize,
+		"endpoints": len(cp.endpoints.Endpoints()),
+		"pool_size": cp.poolSize,
 	}).Info("Initializing connection pool")
 
-	for i := 0; i < cp.poolSize; i++ {
-		conn, err := cp.createConnection()
+	var lastErr error
+	for i := cp.GetConnectionCount(); i < cp.poolSize; i++ {
+		conn, err := cp.createConnection(cp.newBackoff())
 		if err != nil {
 			cp.logger.WithError(err).Error("Failed to create connection")
+			lastErr = err
+			// The other connections would be refused the same credentials
+			if errors.Is(err, protocol.ErrAuthFailed) {
+				break
+			}
 			continue
 		}
 		cp.addConnection(conn)
+		cp.notifyConnect(conn)
+	}
+
+	if cp.GetConnectionCount() == 0 {
+		return fmt.Errorf("failed to connect to data plane: %w", lastErr)
 	}
 
 	// Start health monitoring
-	go cp.monitorHealth()
+	cp.monitorOnce.Do(func() {
+		go cp.monitorHealth()
+	})
 
 	return nil
 }
 
-// createConnection creates a new TLS connection
-func (cp *ConnectionPool) createConnection() (*Connection, error) {
-	// Establish TCP connection
-	conn, err := net.DialTimeout("tcp", cp.serverAddr, 30*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("failed to establish TCP connection: %w", err)
-	}
+// newBackoff creates the backoff policy for replacing a connection
+func (cp *ConnectionPool) newBackoff() *Backoff {
+	return NewBackoff(
+		cp.config.Connection.ReconnectInterval,
+		cp.config.Connection.ReconnectMultiplier,
+		cp.config.Connection.ReconnectMaxInterval,
+		cp.config.Connection.MaxReconnectAttempts,
+		cp.config.Connection.ReconnectResetAfter,
+	)
+}
 
-	// Perform TLS handshake
-	tlsConn := tls.Client(conn, cp.tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+// createConnection connects a new data plane client and sets up the router reading it
+func (cp *ConnectionPool) createConnection(backoff *Backoff) (*Connection, error) {
+	cp.mu.RLock()
+	credentials := cp.credentials
+	if credentials == nil {
+		credentials = apiKeyCredentials(cp.config.Auth.APIKey)
 	}
+	// Connections share one selector, so they move to another endpoint together,
+	// and one transport, which remembers for every connection which one works
+	dataPlane := newSharedDataPlaneClient(cp.config, cp.endpoints, cp.dialer, cp.transport, credentials, cp.logger)
+	cp.mu.RUnlock()
+	if err := dataPlane.Connect(); err != nil {
+		dataPlane.Stop()
+		return nil, err
+	}
+
+	router := NewMessageRouter(dataPlane, dataPlane, cp.logger)
+	router.SetStreamHandler(dataPlane.HandleStreamFrame)
+
+	cp.mu.Lock()
+	cp.nextID++
+	id := fmt.Sprintf("conn_%d", cp.nextID)
+	cp.mu.Unlock()
 
 	connection := &Connection{
-		ID:        fmt.Sprintf("conn_%d", time.Now().UnixNano()),
-		Conn:      tlsConn,
-		Reader:    protocol.NewReader(tlsConn, cp.logger),
-		Writer:    protocol.NewWriter(tlsConn, cp.logger),
+		ID:        id,
+		Client:    dataPlane,
+		Router:    router,
 		IsHealthy: true,
 		LastUsed:  time.Now(),
 		CreatedAt: time.Now(),
+		backoff:   backoff,
 	}
+	backoff.Connected()
 
 	cp.logger.WithFields(logrus.Fields{
 		"connection_id": connection.ID,
-		"server_addr":   cp.serverAddr,
-		"tls_version":   tlsConn.ConnectionState().Version,
+		"server_addr":   dataPlane.GetServerAddr(),
 	}).Debug("Created new connection")
 
 	return connection, nil
 }
 
+// notifyConnect calls the connect handler, if any
+func (cp *ConnectionPool) notifyConnect(conn *Connection) {
+	cp.mu.RLock()
+	connectHandler := cp.connectHandler
+	cp.mu.RUnlock()
+
+	if connectHandler != nil {
+		connectHandler(conn)
+	}
+}
+
 // addConnection adds a connection to the pool
 func (cp *ConnectionPool) addConnection(conn *Connection) {
 	cp.mu.Lock()
@@ -125,30 +261,48 @@ func (cp *ConnectionPool) addConnection(conn *Connection) {
 	cp.logger.WithField("connection_id", conn.ID).Debug("Added connection to pool")
 }
 
-// GetConnection returns a healthy connection from the pool
+// GetConnection returns the healthy connection with the least load in flight.
+// Equally loaded connections take turns.
 func (cp *ConnectionPool) GetConnection() (*Connection, error) {
-	cp.mu.RLock()
-	defer cp.mu.RUnlock()
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
 
 	if len(cp.connections) == 0 {
 		return nil, fmt.Errorf("no connections available in pool")
 	}
 
-	// Round-robin selection
-	cp.roundRobin = (cp.roundRobin + 1) % len(cp.connections)
-	conn := cp.connections[cp.roundRobin]
-
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
+	var selected *Connection
+	selectedIndex := 0
+	for i := 1; i <= len(cp.connections); i++ {
+		index := (cp.roundRobin + i) % len(cp.connections)
+		conn := cp.connections[index]
+		if !conn.healthy() {
+			continue
+		}
+		if selected == nil || conn.InFlight() < selected.InFlight() {
+			selected = conn
+			selectedIndex = index
+		}
+	}
 
-	if !conn.IsHealthy {
-		return nil, fmt.Errorf("connection %s is not healthy", conn.ID)
+	if selected == nil {
+		return nil, fmt.Errorf("no healthy connections available in pool")
 	}
+	cp.roundRobin = selectedIndex
 
-	conn.LastUsed = time.Now()
-	cp.logger.WithField("connection_id", conn.ID).Debug("Selected connection from pool")
+	selected.mu.Lock()
+	selected.LastUsed = time.Now()
+	selected.mu.Unlock()
+	cp.logger.WithField("connection_id", selected.ID).Debug("Selected connection from pool")
 
-	return conn, nil
+	return selected, nil
+}
+
+// GetConnections returns every connection in the pool, healthy or not
+func (cp *ConnectionPool) GetConnections() []*Connection {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	return append([]*Connection(nil), cp.connections...)
 }
 
 // GetHealthyConnections returns all healthy connections
@@ -158,69 +312,216 @@ func (cp *ConnectionPool) GetHealthyConnections() []*Connection {
 
 	var healthy []*Connection
 	for _, conn := range cp.connections {
-		conn.mu.RLock()
-		if conn.IsHealthy {
+		if conn.healthy() {
 			healthy = append(healthy, conn)
 		}
-		conn.mu.RUnlock()
 	}
 
 	return healthy
 }
 
-// MarkConnectionUnhealthy marks a connection as unhealthy
-func (cp *ConnectionPool) MarkConnectionUnhealthy(connID string) {
+// Assign records that a tunnel is registered on conn, replies for the tunnel
+// are sent on that connection from then on
+func (cp *ConnectionPool) Assign(tunnelID string, conn *Connection) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if previous, exists := cp.assignments[tunnelID]; exists {
+		previous.tunnels.Add(-1)
+	}
+	cp.assignments[tunnelID] = conn
+	conn.tunnels.Add(1)
+}
+
+// Unassign forgets the connection of a tunnel
+func (cp *ConnectionPool) Unassign(tunnelID string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if previous, exists := cp.assignments[tunnelID]; exists {
+		previous.tunnels.Add(-1)
+		delete(cp.assignments, tunnelID)
+	}
+}
+
+// GetAssignedConnection returns the connection a tunnel is assigned to, or nil
+func (cp *ConnectionPool) GetAssignedConnection(tunnelID string) *Connection {
 	cp.mu.RLock()
 	defer cp.mu.RUnlock()
+	return cp.assignments[tunnelID]
+}
 
-	for _, conn := range cp.connections {
-		if conn.ID == connID {
-			conn.mu.Lock()
-			conn.IsHealthy = false
-			conn.mu.Unlock()
-			cp.logger.WithField("connection_id", connID).Warn("Marked connection as unhealthy")
+// MarkConnectionUnhealthy takes a connection out of rotation, closes it and
+// starts replacing it in the background
+func (cp *ConnectionPool) MarkConnectionUnhealthy(connID string) {
+	cp.mu.Lock()
+	var conn *Connection
+	for _, candidate := range cp.connections {
+		if candidate.ID == connID {
+			conn = candidate
 			break
 		}
 	}
+	if conn == nil || cp.replacing[connID] || cp.ctx.Err() != nil {
+		cp.mu.Unlock()
+		return
+	}
+	cp.replacing[connID] = true
+	cp.mu.Unlock()
+
+	conn.mu.Lock()
+	conn.IsHealthy = false
+	conn.mu.Unlock()
+	cp.logger.WithField("connection_id", connID).Warn("Marked connection as unhealthy")
+
+	// Whoever reads the connection sees it fail and stops
+	conn.Client.Disconnect()
+
+	go cp.replace(conn)
+}
+
+// replace replaces an unhealthy connection with backoff until it succeeds,
+// the attempts run out or the pool is closed
+func (cp *ConnectionPool) replace(old *Connection) {
+	defer func() {
+		cp.mu.Lock()
+		delete(cp.replacing, old.ID)
+		cp.mu.Unlock()
+	}()
+
+	var lastErr error
+	for {
+		// Retrying credentials the server refused cannot succeed
+		if errors.Is(lastErr, protocol.ErrAuthFailed) {
+			cp.giveUp(old, fmt.Errorf("giving up replacing connection %s: %w", old.ID, lastErr))
+			return
+		}
+
+		delay, ok := old.backoff.Next()
+		if !ok {
+			cp.giveUp(old, fmt.Errorf("giving up replacing connection %s after %d attempts: %w", old.ID, old.backoff.MaxAttempts(), lastErr))
+			return
+		}
+
+		attempt := old.backoff.Attempts()
+		cp.notifyRetry(old, attempt, lastErr)
+		cp.logger.WithFields(logrus.Fields{
+			"connection_id": old.ID,
+			"attempt":       attempt,
+			"max_attempts":  old.backoff.MaxAttempts(),
+			"delay":         delay,
+		}).Info("Waiting before replacing connection")
+
+		select {
+		case <-cp.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if _, lastErr = cp.ReplaceConnection(old.ID); lastErr == nil {
+			return
+		}
+		cp.logger.WithError(lastErr).WithFields(logrus.Fields{
+			"connection_id": old.ID,
+			"attempt":       attempt,
+		}).Warn("Failed to replace connection")
+	}
 }
 
-// ReplaceConnection replaces an unhealthy connection with a new one
-func (cp *ConnectionPool) ReplaceConnection(oldConnID string) error {
+// giveUp stops replacing a connection and takes it out of the pool
+func (cp *ConnectionPool) giveUp(old *Connection, err error) {
+	cp.logger.WithError(err).Error("Failed to replace connection")
+	cp.removeConnection(old)
+	cp.notifyRetry(old, 0, err)
+}
+
+// notifyRetry calls the retry handler, if any
+func (cp *ConnectionPool) notifyRetry(old *Connection, attempt int, err error) {
+	cp.mu.RLock()
+	retryHandler := cp.retryHandler
+	cp.mu.RUnlock()
+
+	if retryHandler != nil {
+		retryHandler(old, attempt, err)
+	}
+}
+
+// removeConnection takes a connection out of the pool for good
+func (cp *ConnectionPool) removeConnection(old *Connection) {
 	cp.mu.Lock()
 	defer cp.mu.Unlock()
 
-	// Find and remove the old connection
 	for i, conn := range cp.connections {
+		if conn == old {
+			cp.connections = append(cp.connections[:i], cp.connections[i+1:]...)
+			break
+		}
+	}
+}
+
+// ReplaceConnection replaces a connection with a new one and returns the
+// replacement. The old connection keeps its slot until the new one is ready.
+func (cp *ConnectionPool) ReplaceConnection(oldConnID string) (*Connection, error) {
+	cp.mu.RLock()
+	var old *Connection
+	for _, conn := range cp.connections {
 		if conn.ID == oldConnID {
-			// Close the old connection
-			if err := conn.Conn.Close(); err != nil {
-				cp.logger.WithError(err).Warn("Error closing old connection")
-			}
+			old = conn
+			break
+		}
+	}
+	cp.mu.RUnlock()
 
-			// Create a new connection
-			newConn, err := cp.createConnection()
-			if err != nil {
-				cp.logger.WithError(err).Error("Failed to create replacement connection")
-				return err
-			}
+	if old == nil {
+		return nil, fmt.Errorf("connection %s not found in pool", oldConnID)
+	}
 
-			// Replace the connection
-			cp.connections[i] = newConn
-			cp.logger.WithFields(logrus.Fields{
-				"old_connection_id": oldConnID,
-				"new_connection_id": newConn.ID,
-			}).Info("Replaced unhealthy connection")
+	// The replacement inherits the attempt budget, a flapping slot still runs out
+	newConn, err := cp.createConnection(old.backoff)
+	if err != nil {
+		cp.logger.WithError(err).Error("Failed to create replacement connection")
+		return nil, err
+	}
 
-			return nil
+	cp.mu.Lock()
+	replaced := false
+	for i, conn := range cp.connections {
+		if conn == old {
+			cp.connections[i] = newConn
+			replaced = true
+			break
 		}
 	}
+	replaceHandler := cp.replaceHandler
+	cp.mu.Unlock()
+
+	if !replaced {
+		newConn.Client.Stop()
+		return nil, fmt.Errorf("connection %s left the pool while it was replaced", oldConnID)
+	}
+
+	// Close the old connection
+	old.mu.Lock()
+	old.IsHealthy = false
+	old.mu.Unlock()
+	old.Client.Stop()
+
+	cp.logger.WithFields(logrus.Fields{
+		"old_connection_id": oldConnID,
+		"new_connection_id": newConn.ID,
+	}).Info("Replaced unhealthy connection")
+
+	cp.notifyConnect(newConn)
+	if replaceHandler != nil {
+		replaceHandler(old, newConn)
+	}
 
-	return fmt.Errorf("connection %s not found in pool", oldConnID)
+	return newConn, nil
 }
 
-// monitorHealth monitors the health of all connections
+// monitorHealth checks the health of all connections every health interval
 func (cp *ConnectionPool) monitorHealth() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(cp.healthInterval)
 	defer ticker.Stop()
 
 	for {
@@ -234,35 +535,124 @@ func (cp *ConnectionPool) monitorHealth() {
 	}
 }
 
-// checkConnectionsHealth checks the health of all connections
+// checkConnectionsHealth marks connections that stopped answering as unhealthy,
+// which replaces them. A connection that delivered a frame within the last
+// health interval is alive, an idle one has to answer a ping in time.
 func (cp *ConnectionPool) checkConnectionsHealth() {
-	cp.mu.RLock()
-	connections := make([]*Connection, len(cp.connections))
-	copy(connections, cp.connections)
-	cp.mu.RUnlock()
+	var wg sync.WaitGroup
+	for _, conn := range cp.GetHealthyConnections() {
+		wg.Add(1)
+		go func(conn *Connection) {
+			defer wg.Done()
+			if err := cp.checkConnectionHealth(conn); err != nil {
+				cp.logger.WithError(err).WithField("connection_id", conn.ID).Warn("Connection health check failed")
+				cp.MarkConnectionUnhealthy(conn.ID)
+			}
+		}(conn)
+	}
+	wg.Wait()
+}
 
-	for _, conn := range connections {
-		conn.mu.RLock()
-		if !conn.IsHealthy {
-			conn.mu.RUnlock()
-			continue
+// checkConnectionHealth returns why a connection is no longer healthy, or nil
+func (cp *ConnectionPool) checkConnectionHealth(conn *Connection) error {
+	if !conn.Client.IsConnected() {
+		return fmt.Errorf("connection closed")
+	}
+
+	if idle := time.Since(conn.Client.LastSeen()); idle < cp.healthInterval {
+		return nil
+	}
+
+	rtt, err := conn.Client.Ping(cp.healthInterval)
+	if errors.Is(err, ErrPingUnsupported) {
+		// Without heartbeat echoes only a closed connection is known to be dead
+		return nil
+	}
+	if err != nil {
+		// A connection that can move to a new network path gets to before it is replaced
+		if migrateErr := conn.Client.Migrate(cp.healthInterval); migrateErr != nil {
+			return err
 		}
-		conn.mu.RUnlock()
+		if rtt, err = conn.Client.Ping(cp.healthInterval); err != nil {
+			return err
+		}
+	}
+
+	cp.logger.WithFields(logrus.Fields{
+		"connection_id": conn.ID,
+		"rtt":           rtt,
+	}).Debug("Idle connection answered ping")
+	return nil
+}
 
-		// Check if connection is still alive by trying to read from it
-		conn.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-		_, err := conn.Conn.Read(make([]byte, 1))
-		conn.Conn.SetReadDeadline(time.Time{})
+// sender returns the client replies for a tunnel go through, the tunnel's own
+// connection or the least loaded one for connection-level messages
+func (cp *ConnectionPool) sender(tunnelID string) (*DataPlaneClient, error) {
+	if conn := cp.GetAssignedConnection(tunnelID); conn != nil {
+		return conn.Client, nil
+	}
 
-		if err != nil {
-			cp.logger.WithFields(logrus.Fields{
-				"connection_id": conn.ID,
-				"error":         err,
-			}).Warn("Connection health check failed")
+	conn, err := cp.GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	return conn.Client, nil
+}
+
+// SendDataResponse sends a data response on the tunnel's connection
+func (cp *ConnectionPool) SendDataResponse(tunnelID string, payload *types.DataResponsePayload) error {
+	dataPlane, err := cp.sender(tunnelID)
+	if err != nil {
+		return err
+	}
+	return dataPlane.SendDataResponse(tunnelID, payload)
+}
+
+// SendDataChunk sends one chunk of a streamed response body on the tunnel's connection
+func (cp *ConnectionPool) SendDataChunk(tunnelID string, payload *types.DataChunkPayload) error {
+	dataPlane, err := cp.sender(tunnelID)
+	if err != nil {
+		return err
+	}
+	return dataPlane.SendDataChunk(tunnelID, payload)
+}
+
+// SendError sends an error message on the tunnel's connection
+func (cp *ConnectionPool) SendError(tunnelID string, code, message, details string) error {
+	dataPlane, err := cp.sender(tunnelID)
+	if err != nil {
+		return err
+	}
+	return dataPlane.SendError(tunnelID, code, message, details)
+}
+
+// SendConnectionClose sends a connection close message on the tunnel's connection
+func (cp *ConnectionPool) SendConnectionClose(tunnelID, connectionID, reason string) error {
+	dataPlane, err := cp.sender(tunnelID)
+	if err != nil {
+		return err
+	}
+	return dataPlane.SendConnectionClose(tunnelID, connectionID, reason)
+}
 
-			cp.MarkConnectionUnhealthy(conn.ID)
+// SendHeartbeat sends a heartbeat reporting the traffic counters of a tunnel on its connection
+func (cp *ConnectionPool) SendHeartbeat(tunnelID string, counters TunnelCountersSnapshot) error {
+	dataPlane, err := cp.sender(tunnelID)
+	if err != nil {
+		return err
+	}
+	return dataPlane.SendHeartbeat(tunnelID, counters)
+}
+
+// Supports returns whether the connections negotiated a capability, they all
+// talk to the same server so any healthy one answers for the pool
+func (cp *ConnectionPool) Supports(capability types.Capability) bool {
+	for _, conn := range cp.GetHealthyConnections() {
+		if conn.Client.GetNegotiation() != nil {
+			return conn.Client.Supports(capability)
 		}
 	}
+	return false
 }
 
 // GetStats returns connection pool statistics
@@ -273,6 +663,7 @@ func (cp *ConnectionPool) GetStats() map[string]interface{} {
 	total := len(cp.connections)
 	healthy := 0
 	unhealthy := 0
+	connections := make(map[string]interface{}, total)
 
 	for _, conn := range cp.connections {
 		conn.mu.RLock()
@@ -281,6 +672,21 @@ func (cp *ConnectionPool) GetStats() map[string]interface{} {
 		} else {
 			unhealthy++
 		}
+		connections[conn.ID] = map[string]interface{}{
+			"endpoint":           conn.Client.GetServerAddr(),
+			"transport":          conn.Client.GetTransportName(),
+			"healthy":            conn.IsHealthy,
+			"in_flight":          conn.InFlight(),
+			"tunnels":            conn.tunnels.Load(),
+			"reconnect_attempts": conn.backoff.Attempts(),
+			"created_at":         conn.CreatedAt,
+			"last_used":          conn.LastUsed,
+			"last_seen":          conn.Client.LastSeen(),
+			"router":             conn.Router.GetStats(),
+			"compression":        conn.Client.GetCompressionStats(),
+			"delivery":           conn.Client.GetDeliveryStats(),
+			"heartbeat":          conn.Client.GetHeartbeatStats(),
+		}
 		conn.mu.RUnlock()
 	}
 
@@ -288,26 +694,57 @@ func (cp *ConnectionPool) GetStats() map[string]interface{} {
 		"total_connections":     total,
 		"healthy_connections":   healthy,
 		"unhealthy_connections": unhealthy,
-		"pool_size":            cp.poolSize,
-		"round_robin_index":    cp.roundRobin,
+		"pool_size":             cp.poolSize,
+		"round_robin_index":     cp.roundRobin,
+		"endpoint":              cp.endpoints.Selected(),
+		"endpoints":             cp.endpoints.Endpoints(),
+		"connections":           connections,
 	}
 }
 
+// GetEndpointSelector returns the selector picking the endpoint new connections go to
+func (cp *ConnectionPool) GetEndpointSelector() *EndpointSelector {
+	return cp.endpoints
+}
+
+// GoAway tells the server on every connection that this client is going away
+// and waits up to the drain timeout for the streams in flight to finish
+func (cp *ConnectionPool) GoAway(reason string) error {
+	// Size the results from the same snapshot that is iterated, the pool may change meanwhile
+	connections := cp.GetConnections()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(connections))
+
+	for _, conn := range connections {
+		wg.Add(1)
+		go func(conn *Connection) {
+			defer wg.Done()
+			if err := conn.Client.GoAway(reason, conn.Client.GetDrainTimeout()); err != nil {
+				errs <- fmt.Errorf("connection %s: %w", conn.ID, err)
+			}
+		}(conn)
+	}
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
 // Close closes all connections in the pool
 func (cp *ConnectionPool) Close() error {
 	cp.logger.Info("Closing connection pool")
 	cp.cancel()
 
 	cp.mu.Lock()
-	defer cp.mu.Unlock()
+	connections := cp.connections
+	cp.connections = nil
+	cp.assignments = make(map[string]*Connection)
+	cp.mu.Unlock()
 
-	for _, conn := range cp.connections {
-		if err := conn.Conn.Close(); err != nil {
-			cp.logger.WithError(err).Warn("Error closing connection")
-		}
+	for _, conn := range connections {
+		conn.Client.Stop()
 	}
 
-	cp.connections = cp.connections[:0]
 	cp.logger.Info("Connection pool closed")
 
 	return nil
@@ -322,17 +759,5 @@ func (cp *ConnectionPool) GetConnectionCount() int {
 
 // GetHealthyConnectionCount returns the number of healthy connections
 func (cp *ConnectionPool) GetHealthyConnectionCount() int {
-	cp.mu.RLock()
-	defer cp.mu.RUnlock()
-
-	healthy := 0
-	for _, conn := range cp.connections {
-		conn.mu.RLock()
-		if conn.IsHealthy {
-			healthy++
-		}
-		conn.mu.RUnlock()
-	}
-
-	return healthy
-} 
\ No newline at end of file
+	return len(cp.GetHealthyConnections())
+}
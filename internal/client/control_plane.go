@@ -4,14 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/unownone/shipitd/internal/config"
+	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/pkg/types"
 	"github.com/sirupsen/logrus"
 )
 
+// dataPlaneTokenMargin is how long before it expires a data plane token is replaced
+const dataPlaneTokenMargin = 30 * time.Second
+
+// ErrDataPlaneTokensUnsupported is returned when the server does not issue data plane tokens
+var ErrDataPlaneTokensUnsupported = errors.New("server does not issue data plane tokens")
+
 // TokenInfo represents authentication token information
 type TokenInfo struct {
 	Valid    bool   `json:"valid"`
@@ -19,6 +29,12 @@ type TokenInfo struct {
 	AuthType string `json:"auth_type"`
 }
 
+// DataPlaneToken is a short-lived credential data plane connections authenticate with
+type DataPlaneToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
 // CreateTunnelRequest represents a tunnel creation request
 type CreateTunnelRequest struct {
 	Protocol   string `json:"protocol"`
@@ -35,8 +51,11 @@ type Tunnel struct {
 	Status     string    `json:"status"`
 	Subdomain  string    `json:"subdomain,omitempty"`
 	LocalPort  int       `json:"local_port"`
+	PublicPort int       `json:"public_port,omitempty"`
 	CreatedAt  time.Time `json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
+	// ResumeToken is presented when the tunnel is registered on the data plane, it is issued there
+	ResumeToken string `json:"-"`
 }
 
 // TunnelList represents a list of tunnels
@@ -50,14 +69,26 @@ type ControlPlaneClient struct {
 	apiKey     string
 	httpClient *http.Client
 	logger     *logrus.Logger
+	tokenMu    sync.Mutex
+	token      *DataPlaneToken
+	noTokens   bool
 }
 
 // NewControlPlaneClient creates a new control plane client
 func NewControlPlaneClient(cfg *config.Config, logger *logrus.Logger) *ControlPlaneClient {
+	// The API key is never sent to an unverified server, tls_verify only relaxes
+	// the data plane. The request URL names the host to verify.
+	tlsConfig := newServerTLSConfig(cfg)
+	tlsConfig.InsecureSkipVerify = false
+	tlsConfig.ServerName = ""
+
 	// Create HTTP client with timeouts
 	httpClient := &http.Client{
 		Timeout: 30 * time.Second,
 		Transport: &http.Transport{
+			// The dialer goes through the configured proxy, the transport must not add its own
+			DialContext:         NewDialer(cfg).DialContext,
+			TLSClientConfig:     tlsConfig,
 			MaxIdleConns:        10,
 			IdleConnTimeout:     30 * time.Second,
 			DisableCompression:  true,
@@ -72,6 +103,11 @@ func NewControlPlaneClient(cfg *config.Config, logger *logrus.Logger) *ControlPl
 	}
 }
 
+// SetDialer sets the dialer connections to the API are opened with
+func (c *ControlPlaneClient) SetDialer(dialer Dialer) {
+	c.httpClient.Transport.(*http.Transport).DialContext = dialer.DialContext
+}
+
 // SetBaseURL sets the base URL for the client (useful for testing)
 func (c *ControlPlaneClient) SetBaseURL(baseURL string) {
 	c.baseURL = baseURL
@@ -115,6 +151,75 @@ func (c *ControlPlaneClient) ValidateToken(ctx context.Context) (*TokenInfo, err
 	return &tokenInfo, nil
 }
 
+// IssueDataPlaneToken asks the server for a short-lived data plane token
+func (c *ControlPlaneClient) IssueDataPlaneToken(ctx context.Context) (*DataPlaneToken, error) {
+	url := fmt.Sprintf("%s/auth/data-plane-token", c.baseURL)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
+	req.Header.Set("Content-Type", "application/json")
+
+	c.logger.WithField("url", url).Debug("Requesting data plane token")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request data plane token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+	case http.StatusNotFound:
+		return nil, ErrDataPlaneTokensUnsupported
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return nil, fmt.Errorf("%w: API key refused with status %d", protocol.ErrAuthFailed, resp.StatusCode)
+	default:
+		return nil, fmt.Errorf("data plane token request failed with status: %d", resp.StatusCode)
+	}
+
+	var token DataPlaneToken
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to decode data plane token: %w", err)
+	}
+
+	return &token, nil
+}
+
+// DataPlaneCredentials returns the credentials a data plane connection
+// authenticates with. That is a token of the server, issued again shortly
+// before the last one expires, or the API key when the server issues none or
+// cannot be reached. An API key the server refused fails with protocol.ErrAuthFailed.
+func (c *ControlPlaneClient) DataPlaneCredentials(ctx context.Context) (*types.AuthPayload, error) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+
+	apiKey := &types.AuthPayload{Method: types.AuthMethodAPIKey, Credential: c.apiKey}
+	if c.noTokens {
+		return apiKey, nil
+	}
+
+	if c.token == nil || time.Until(c.token.ExpiresAt) < dataPlaneTokenMargin {
+		token, err := c.IssueDataPlaneToken(ctx)
+		switch {
+		case errors.Is(err, protocol.ErrAuthFailed):
+			return nil, err
+		case errors.Is(err, ErrDataPlaneTokensUnsupported):
+			c.noTokens = true
+			return apiKey, nil
+		case err != nil:
+			c.logger.WithError(err).Warn("Failed to get data plane token, authenticating with the API key")
+			return apiKey, nil
+		}
+		c.token = token
+	}
+
+	return &types.AuthPayload{Method: types.AuthMethodToken, Credential: c.token.Token}, nil
+}
+
 // GetTokenInfo gets detailed information about the API key
 func (c *ControlPlaneClient) GetTokenInfo(ctx context.Context) (*TokenInfo, error) {
 	url := fmt.Sprintf("%s/auth/token/info", c.baseURL)
@@ -185,6 +290,8 @@ func (c *ControlPlaneClient) CreateTunnel(ctx context.Context, req *CreateTunnel
 	if err := json.NewDecoder(resp.Body).Decode(&tunnel); err != nil {
 		return nil, fmt.Errorf("failed to decode tunnel response: %w", err)
 	}
+	// Frames carry the ID in binary and read it back lowercase, so keep it that way
+	tunnel.ID = types.NormalizeTunnelID(tunnel.ID)
 
 	c.logger.WithFields(logrus.Fields{
 		"tunnel_id":  tunnel.ID,
@@ -0,0 +1,64 @@
+package client
+
+import "sync/atomic"
+
+// TunnelCounters counts the traffic of one tunnel. The proxies forwarding the
+// tunnel update it while heartbeats and stats read it, so every counter is atomic.
+// Bytes in flow from the server to the local service, bytes out the other way.
+type TunnelCounters struct {
+	activeConns   atomic.Int64
+	totalRequests atomic.Uint64
+	bytesIn       atomic.Uint64
+	bytesOut      atomic.Uint64
+	errors        atomic.Uint64
+}
+
+// TunnelCountersSnapshot is a point in time copy of TunnelCounters
+type TunnelCountersSnapshot struct {
+	ActiveConns   int64  `json:"active_conns"`
+	TotalRequests uint64 `json:"total_requests"`
+	BytesIn       uint64 `json:"bytes_in"`
+	BytesOut      uint64 `json:"bytes_out"`
+	Errors        uint64 `json:"errors"`
+}
+
+// ConnectionOpened counts a connection, stream or request in flight to the local service
+func (c *TunnelCounters) ConnectionOpened() {
+	c.activeConns.Add(1)
+}
+
+// ConnectionClosed counts the end of a connection counted by ConnectionOpened
+func (c *TunnelCounters) ConnectionClosed() {
+	c.activeConns.Add(-1)
+}
+
+// AddRequest counts an HTTP request or a TCP connection forwarded to the local service
+func (c *TunnelCounters) AddRequest() {
+	c.totalRequests.Add(1)
+}
+
+// AddBytesIn counts bytes forwarded to the local service
+func (c *TunnelCounters) AddBytesIn(n int) {
+	c.bytesIn.Add(uint64(n))
+}
+
+// AddBytesOut counts bytes sent back to the server
+func (c *TunnelCounters) AddBytesOut(n int) {
+	c.bytesOut.Add(uint64(n))
+}
+
+// AddError counts a request or connection that failed on the way to or from the local service
+func (c *TunnelCounters) AddError() {
+	c.errors.Add(1)
+}
+
+// Snapshot returns the current counter values
+func (c *TunnelCounters) Snapshot() TunnelCountersSnapshot {
+	return TunnelCountersSnapshot{
+		ActiveConns:   c.activeConns.Load(),
+		TotalRequests: c.totalRequests.Load(),
+		BytesIn:       c.bytesIn.Load(),
+		BytesOut:      c.bytesOut.Load(),
+		Errors:        c.errors.Load(),
+	}
+}
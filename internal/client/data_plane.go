@@ -3,89 +3,328 @@ package client
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/unownone/shipitd/internal/config"
 	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/internal/security"
 	"github.com/unownone/shipitd/pkg/types"
 	"github.com/sirupsen/logrus"
 )
 
+// ClientVersion is reported to the server in the protocol handshake
+var ClientVersion = "dev"
+
+const (
+	// DefaultDrainTimeout bounds how long in-flight streams may take once a connection goes away
+	DefaultDrainTimeout = 30 * time.Second
+	// drainPollInterval is how often a draining connection is checked for open streams
+	drainPollInterval = 50 * time.Millisecond
+)
+
+// ErrPingUnsupported is returned by Ping when the server does not echo heartbeats
+var ErrPingUnsupported = errors.New("server does not echo heartbeats")
+
+// CredentialSource hands out the credentials data plane connections authenticate with
+type CredentialSource interface {
+	DataPlaneCredentials(ctx context.Context) (*types.AuthPayload, error)
+}
+
+// apiKeyCredentials authenticates every connection with the API key
+type apiKeyCredentials string
+
+// DataPlaneCredentials returns the API key
+func (k apiKeyCredentials) DataPlaneCredentials(context.Context) (*types.AuthPayload, error) {
+	return &types.AuthPayload{Method: types.AuthMethodAPIKey, Credential: string(k)}, nil
+}
+
 // DataPlaneClient handles TLS protocol communication with the ShipIt server
 type DataPlaneClient struct {
-	serverAddr string
-	tlsConfig  *tls.Config
-	logger     *logrus.Logger
-	conn       net.Conn
-	reader     *protocol.Reader
-	writer     *protocol.Writer
-	mu         sync.RWMutex
-	connected  bool
-	ctx        context.Context
-	cancel     context.CancelFunc
+	serverAddr        string
+	endpoints         *EndpointSelector
+	dialer            Dialer
+	transport         Transport
+	credentials       CredentialSource
+	serverVerified    bool
+	transportName     string
+	logger            *logrus.Logger
+	conn              net.Conn
+	reader            *protocol.Reader
+	writer            *protocol.Writer
+	negotiation       *protocol.Negotiation
+	session           *protocol.Session
+	streams           StreamAcceptor
+	compression       *protocol.CompressionStats
+	maxFrame          int
+	outbox            *protocol.Outbox
+	dedup             *protocol.Deduplicator
+	dedupSession      string
+	duplicates        atomic.Uint64
+	ackTimeout        time.Duration
+	monitorOnce       sync.Once
+	tunnels           map[string]*Tunnel
+	drainTimeout      time.Duration
+	heartbeats        *protocol.HeartbeatMonitor
+	heartbeatInterval time.Duration
+	pongs             map[uint64]chan time.Duration
+	pongMu            sync.Mutex
+	lastSeen          atomic.Int64
+	handoffHandler    func()
+	handingOff        bool
+	handedOff         *dataPlaneConn
+	mu                sync.RWMutex
+	connected         bool
+	ctx               context.Context
+	cancel            context.CancelFunc
 }
 
 // NewDataPlaneClient creates a new data plane client
 func NewDataPlaneClient(cfg *config.Config, logger *logrus.Logger) *DataPlaneClient {
-	// Create TLS configuration
-	tlsConfig := &tls.Config{
-		MinVersion:         tls.VersionTLS12,
-		ServerName:         cfg.Server.Domain,
-		InsecureSkipVerify: !cfg.Server.TLSVerify,
-	}
+	transport := NewTransport(cfg, newDataPlaneTLSConfig(cfg), logger)
+
+	return newSharedDataPlaneClient(cfg, NewEndpointSelector(cfg, transport, logger), NewDialer(cfg),
+		transport, apiKeyCredentials(cfg.Auth.APIKey), logger)
+}
 
+// newSharedDataPlaneClient creates a data plane client around an endpoint
+// selector, dialer, transport and credential source it may share with other
+// clients. The TLS configuration and client certificate come with the
+// selector and transport.
+func newSharedDataPlaneClient(cfg *config.Config, endpoints *EndpointSelector, dialer Dialer, transport Transport, credentials CredentialSource, logger *logrus.Logger) *DataPlaneClient {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	ackTimeout := cfg.Connection.AckTimeout
+	if ackTimeout <= 0 {
+		ackTimeout = protocol.DefaultAckTimeout
+	}
+	drainTimeout := cfg.Connection.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = DefaultDrainTimeout
+	}
+	heartbeatInterval := cfg.Connection.HeartbeatInterval
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = protocol.DefaultHeartbeatInterval
+	}
+	heartbeatMaxMissed := cfg.Connection.HeartbeatMaxMissed
+	if heartbeatMaxMissed <= 0 {
+		heartbeatMaxMissed = protocol.DefaultHeartbeatMaxMissed
+	}
+
 	return &DataPlaneClient{
-		serverAddr: fmt.Sprintf("%s:%d", cfg.Server.Domain, cfg.Server.DataPlanePort),
-		tlsConfig:  tlsConfig,
-		logger:     logger,
-		ctx:        ctx,
-		cancel:     cancel,
+		endpoints:         endpoints,
+		dialer:            dialer,
+		transport:         transport,
+		credentials:       credentials,
+		serverVerified:    verifiesServer(cfg),
+		logger:            logger,
+		compression:       &protocol.CompressionStats{},
+		maxFrame:          maxFrameSize(cfg),
+		outbox:            protocol.NewOutbox(ackTimeout, protocol.DefaultMaxRetransmits),
+		dedup:             protocol.NewDeduplicator(protocol.DefaultDedupWindow),
+		ackTimeout:        ackTimeout,
+		tunnels:           make(map[string]*Tunnel),
+		drainTimeout:      drainTimeout,
+		heartbeats:        protocol.NewHeartbeatMonitor(heartbeatMaxMissed),
+		heartbeatInterval: heartbeatInterval,
+		pongs:             make(map[uint64]chan time.Duration),
+		ctx:               ctx,
+		cancel:            cancel,
+	}
+}
+
+// newDataPlaneTLSConfig creates the TLS configuration of data plane
+// connections, the server name is set per endpoint. With auth.client_cert
+// set, every handshake presents the client certificate as it is at the time.
+func newDataPlaneTLSConfig(cfg *config.Config) *tls.Config {
+	tlsConfig := newServerTLSConfig(cfg)
+	if cfg.Auth.ClientCert != "" {
+		tlsConfig.GetClientCertificate = security.NewClientCertificate(cfg.Auth.ClientCert, cfg.Auth.ClientKey).GetClientCertificate
 	}
+	return tlsConfig
 }
 
 // Connect establishes a TLS connection to the server
 func (d *DataPlaneClient) Connect() error {
 	d.mu.Lock()
-	defer d.mu.Unlock()
-
 	if d.connected {
+		d.mu.Unlock()
 		return fmt.Errorf("already connected")
 	}
 
-	d.logger.WithField("server_addr", d.serverAddr).Info("Connecting to data plane")
+	d.logger.WithField("endpoints", len(d.endpoints.Endpoints())).Info("Connecting to data plane")
 
-	// Establish TCP connection
-	conn, err := net.DialTimeout("tcp", d.serverAddr, 30*time.Second)
+	conn, err := d.dial()
 	if err != nil {
-		return fmt.Errorf("failed to establish TCP connection: %w", err)
+		d.mu.Unlock()
+		return err
 	}
+	outstanding := d.install(conn)
+	d.mu.Unlock()
 
-	// Perform TLS handshake
-	tlsConn := tls.Client(conn, d.tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
-		conn.Close()
-		return fmt.Errorf("TLS handshake failed: %w", err)
-	}
+	d.resendOutstanding(conn.writer, outstanding)
 
-	d.conn = tlsConn
-	d.reader = protocol.NewReader(tlsConn, d.logger)
-	d.writer = protocol.NewWriter(tlsConn, d.logger)
-	d.connected = true
+	d.monitorOnce.Do(func() {
+		go d.monitorAcks()
+		go d.monitorHeartbeats()
+	})
 
 	d.logger.WithFields(logrus.Fields{
-		"server_addr": d.serverAddr,
-		"tls_version": tlsConn.ConnectionState().Version,
-		"cipher_suite": tlsConn.ConnectionState().CipherSuite,
+		"server_addr": conn.addr,
+		"transport": conn.transport,
+		"tls_version": conn.tlsState.Version,
+		"cipher_suite": conn.tlsState.CipherSuite,
+		"protocol_version": conn.negotiation.Version,
+		"compression": conn.negotiation.Compression,
 	}).Info("Successfully connected to data plane")
 
 	return nil
 }
 
+// dataPlaneConn is one established and negotiated data plane connection
+type dataPlaneConn struct {
+	addr        string
+	transport   string
+	conn        net.Conn
+	tlsState    tls.ConnectionState
+	reader      *protocol.Reader
+	writer      *protocol.Writer
+	negotiation *protocol.Negotiation
+	session     *protocol.Session
+	streams     StreamAcceptor
+	// dedup remembers the message IDs of the server session the connection belongs to
+	dedup *protocol.Deduplicator
+	// readDone is closed once reads moved on from a connection replaced after a GOAWAY
+	readDone chan struct{}
+}
+
+// dial connects to the selected endpoint, a failed attempt counts towards
+// failing over to the next one
+func (d *DataPlaneClient) dial() (*dataPlaneConn, error) {
+	endpoint := d.endpoints.Current()
+
+	dialed, err := d.dialEndpoint(endpoint)
+	if err != nil {
+		// Every endpoint refuses credentials the server does not accept, and
+		// the API key is held back from every unverified endpoint
+		if !errors.Is(err, protocol.ErrAuthFailed) && !errors.Is(err, ErrUnverifiedServer) {
+			d.endpoints.Failed(endpoint.Addr, err)
+		}
+		return nil, err
+	}
+	d.endpoints.Succeeded(endpoint.Addr)
+
+	return dialed, nil
+}
+
+// dialEndpoint opens a connection to an endpoint over the transport and runs the protocol handshake
+func (d *DataPlaneClient) dialEndpoint(endpoint Endpoint) (*dataPlaneConn, error) {
+	conn, err := d.transport.Dial(d.ctx, d.dialer, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := protocol.NewReader(conn, d.logger)
+	writer := protocol.NewWriter(conn, d.logger)
+	reader.SetMaxFrameSize(d.maxFrame)
+	// Compression counters survive reconnects
+	reader.SetCompressionStats(d.compression)
+	writer.SetCompressionStats(d.compression)
+
+	// Agree on the protocol version before anything else is sent
+	negotiation, err := protocol.ClientHandshake(reader, writer, newHello(), d.logger)
+	if err != nil {
+		writer.Close()
+		return nil, fmt.Errorf("protocol handshake failed: %w", err)
+	}
+
+	// Prove who the client is before any tunnel is registered, when the server asks for it
+	if negotiation.Supports(types.CapabilityAuth) {
+		auth, err := d.credentials.DataPlaneCredentials(d.ctx)
+		if err != nil {
+			writer.Close()
+			return nil, fmt.Errorf("failed to get data plane credentials: %w", err)
+		}
+		// WebSocket connections are always verified, the others only when configured to be
+		verified := d.serverVerified || conn.Transport == config.TransportWebSocket
+		if auth.Method == types.AuthMethodAPIKey && !verified {
+			writer.Close()
+			return nil, ErrUnverifiedServer
+		}
+		if err := protocol.ClientAuthenticate(reader, writer, auth); err != nil {
+			writer.Close()
+			return nil, err
+		}
+	}
+
+	dialed := &dataPlaneConn{
+		addr:        conn.Addr,
+		transport:   conn.Transport,
+		conn:        conn,
+		tlsState:    conn.TLSState,
+		reader:      reader,
+		writer:      writer,
+		negotiation: negotiation,
+		streams:     conn.Streams,
+	}
+	// Transports with streams of their own carry tunnel streams without a session
+	if dialed.streams == nil && negotiation.Supports(types.CapabilityMultiplexing) {
+		dialed.session = protocol.NewSession(writer, true, d.logger)
+		dialed.streams = sessionStreams{dialed.session}
+	}
+	return dialed, nil
+}
+
+// install makes conn the current connection and returns the messages that
+// were in flight on the last one, to be resent once d.mu is released. Callers
+// must hold d.mu.
+func (d *DataPlaneClient) install(conn *dataPlaneConn) []*types.Message {
+	d.serverAddr = conn.addr
+	d.transportName = conn.transport
+	d.conn = conn.conn
+	d.reader = conn.reader
+	d.writer = conn.writer
+	d.negotiation = conn.negotiation
+	d.session = conn.session
+	d.streams = conn.streams
+	d.connected = true
+
+	// Message IDs are only unique within a server session, a new session starts
+	// from an empty window so its IDs are not taken for duplicates of the last one
+	if conn.negotiation.SessionID == "" || conn.negotiation.SessionID != d.dedupSession {
+		d.dedup = protocol.NewDeduplicator(protocol.DefaultDedupWindow)
+		d.dedupSession = conn.negotiation.SessionID
+	}
+	conn.dedup = d.dedup
+
+	// Heartbeats sent on the last connection are never echoed on this one
+	d.heartbeats.Reset()
+	d.lastSeen.Store(time.Now().UnixNano())
+
+	return d.outstanding(conn.writer, conn.negotiation)
+}
+
+// current returns the current connection. Callers must hold d.mu.
+func (d *DataPlaneClient) current() *dataPlaneConn {
+	return &dataPlaneConn{
+		addr:        d.serverAddr,
+		transport:   d.transportName,
+		conn:        d.conn,
+		reader:      d.reader,
+		writer:      d.writer,
+		negotiation: d.negotiation,
+		session:     d.session,
+		streams:     d.streams,
+		dedup:       d.dedup,
+	}
+}
+
 // Disconnect closes the connection to the server
 func (d *DataPlaneClient) Disconnect() error {
 	d.mu.Lock()
@@ -97,16 +336,33 @@ func (d *DataPlaneClient) Disconnect() error {
 
 	d.logger.Info("Disconnecting from data plane")
 
-	if d.conn != nil {
-		if err := d.conn.Close(); err != nil {
+	// Closing the writer stops its goroutine and closes the connection
+	if d.writer != nil {
+		if err := d.writer.Close(); err != nil {
 			d.logger.WithError(err).Warn("Error closing connection")
 		}
 	}
 
+	// A connection still draining after a GOAWAY goes down with the current one
+	if d.handedOff != nil {
+		d.handedOff.writer.Close()
+		if d.handedOff.streams != nil {
+			d.handedOff.streams.Close()
+		}
+		close(d.handedOff.readDone)
+	}
+
 	d.connected = false
+	d.handedOff = nil
 	d.conn = nil
 	d.reader = nil
 	d.writer = nil
+	d.negotiation = nil
+	if d.streams != nil {
+		d.streams.Close()
+	}
+	d.session = nil
+	d.streams = nil
 
 	return nil
 }
@@ -127,45 +383,479 @@ func (d *DataPlaneClient) RegisterTunnel(tunnel *Tunnel) error {
 	}
 	d.mu.RUnlock()
 
+	// Anything but a UUID cannot be framed, catch it before the server sees a mangled ID
+	if err := types.ValidateTunnelID(tunnel.ID); err != nil {
+		return fmt.Errorf("cannot register tunnel: %w", err)
+	}
+
 	payload := &types.TunnelRegistrationPayload{
 		Protocol:      tunnel.Protocol,
 		LocalPort:     tunnel.LocalPort,
 		Subdomain:     tunnel.Subdomain,
 		MaxConnections: 10, // Default value, could be configurable
 	}
+	// A resumed tunnel asks for the public port it had before
+	if tunnel.PublicPort > 0 {
+		publicPort := tunnel.PublicPort
+		payload.PublicPort = &publicPort
+	}
+	if d.Supports(types.CapabilitySessionResume) {
+		payload.ResumeToken = tunnel.ResumeToken
+	}
 
 	d.logger.WithFields(logrus.Fields{
 		"tunnel_id":  tunnel.ID,
 		"protocol":   tunnel.Protocol,
 		"local_port": tunnel.LocalPort,
 		"subdomain":  tunnel.Subdomain,
+		"resuming":   payload.ResumeToken != "",
 	}).Info("Registering tunnel with server")
 
-	return d.writer.WriteTunnelRegistration(tunnel.ID, payload)
+	// Remembered so a replacement connection can register it again
+	d.mu.Lock()
+	d.tunnels[tunnel.ID] = tunnel
+	d.mu.Unlock()
+
+	// Only the newest registration of a tunnel needs to reach the server
+	d.outbox.Supersede(types.MessageTypeTunnelRegistration, tunnel.ID)
+	return d.sendReliable(types.MessageTypeTunnelRegistration, tunnel.ID, payload)
+}
+
+// handleRegistered keeps the resumption token the server issued for a tunnel,
+// so a replacement connection presents it when registering the tunnel again
+func (d *DataPlaneClient) handleRegistered(message *types.Message) {
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return
+	}
+	registered := parsed.(*types.TunnelRegisteredPayload)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	tunnel, exists := d.tunnels[message.TunnelID]
+	if !exists {
+		return
+	}
+	// Registered tunnels are shared with the caller, so they are copied rather than changed
+	updated := *tunnel
+	updated.ResumeToken = registered.ResumeToken
+	if registered.PublicURL != "" {
+		updated.PublicURL = registered.PublicURL
+	}
+	if registered.Subdomain != "" {
+		updated.Subdomain = registered.Subdomain
+	}
+	if registered.PublicPort > 0 {
+		updated.PublicPort = registered.PublicPort
+	}
+	d.tunnels[message.TunnelID] = &updated
+}
+
+// ForgetTunnel stops registering a tunnel on replacement connections
+func (d *DataPlaneClient) ForgetTunnel(tunnelID string) {
+	d.mu.Lock()
+	delete(d.tunnels, tunnelID)
+	d.mu.Unlock()
+
+	d.outbox.Supersede(types.MessageTypeTunnelRegistration, tunnelID)
+}
+
+// SetHandoffHandler sets the function called once a replacement connection
+// took over after a GOAWAY, for example to accept streams on its session
+func (d *DataPlaneClient) SetHandoffHandler(handler func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handoffHandler = handler
+}
+
+// GoAway tells the server this client is going away and waits up to timeout
+// for the streams in flight on the connection to finish. New streams are
+// refused from then on.
+func (d *DataPlaneClient) GoAway(reason string, timeout time.Duration) error {
+	d.mu.RLock()
+	if !d.connected {
+		d.mu.RUnlock()
+		return nil
+	}
+	conn := d.current()
+	d.mu.RUnlock()
+
+	if conn.negotiation.Supports(types.CapabilityGoAway) {
+		if err := conn.writer.WriteGoAway(&types.GoAwayPayload{
+			Reason:       reason,
+			DrainTimeout: timeout.Milliseconds(),
+		}); err != nil {
+			return fmt.Errorf("failed to send goaway: %w", err)
+		}
+	}
+
+	// Without streams nothing tracks in-flight work on the connection
+	if conn.streams == nil {
+		return nil
+	}
+	conn.streams.Drain()
+
+	d.logger.WithFields(logrus.Fields{
+		"reason":  reason,
+		"streams": conn.streams.NumStreams(),
+		"timeout": timeout,
+	}).Info("Draining data plane connection")
+
+	if !d.waitDrained(conn, timeout, nil) {
+		d.logger.WithField("streams", conn.streams.NumStreams()).Warn("Drain timeout passed with streams in flight")
+	}
+	return nil
+}
+
+// handleGoAway starts handing off to a replacement connection when the server
+// is going away. Reads stay on the old connection until it closes, so the
+// goroutine reading it never waits for the replacement to be dialed.
+func (d *DataPlaneClient) handleGoAway(writer *protocol.Writer, message *types.Message) {
+	reason := ""
+	timeout := d.drainTimeout
+	if parsed, err := message.ParsePayload(); err == nil {
+		goAway := parsed.(*types.GoAwayPayload)
+		reason = goAway.Reason
+		// The server closes the connection after its own deadline, never wait longer
+		if requested := time.Duration(goAway.DrainTimeout) * time.Millisecond; requested > 0 && requested < timeout {
+			timeout = requested
+		}
+	}
+
+	// A second GOAWAY on a connection that is already handing off changes nothing
+	d.mu.Lock()
+	if !d.connected || d.writer != writer || d.handingOff {
+		d.mu.Unlock()
+		return
+	}
+	d.handingOff = true
+	old := d.current()
+	d.mu.Unlock()
+
+	d.logger.WithFields(logrus.Fields{
+		"reason":  reason,
+		"timeout": timeout,
+	}).Info("Server is going away, handing off to a new connection")
+
+	if old.streams != nil {
+		old.streams.Drain()
+	}
+
+	go d.handoff(old, timeout)
+}
+
+// handoff dials the replacement for a connection the server is taking away,
+// moves the tunnels over and drains the old connection
+func (d *DataPlaneClient) handoff(old *dataPlaneConn, timeout time.Duration) {
+	// The old connection stays usable until the replacement is ready
+	replacement, err := d.dial()
+	if err != nil {
+		d.mu.Lock()
+		d.handingOff = false
+		d.mu.Unlock()
+		d.logger.WithError(err).Error("Failed to open replacement connection, draining the current one")
+		return
+	}
+
+	d.mu.Lock()
+	d.handingOff = false
+	if !d.connected || d.writer != old.writer {
+		d.mu.Unlock()
+		replacement.writer.Close()
+		return
+	}
+	outstanding := d.install(replacement)
+	old.readDone = make(chan struct{})
+	d.handedOff = old
+	tunnels := make([]*Tunnel, 0, len(d.tunnels))
+	for _, tunnel := range d.tunnels {
+		tunnels = append(tunnels, tunnel)
+	}
+	handoffHandler := d.handoffHandler
+	d.mu.Unlock()
+
+	d.resendOutstanding(replacement.writer, outstanding)
+	for _, tunnel := range tunnels {
+		if err := d.RegisterTunnel(tunnel); err != nil {
+			d.logger.WithError(err).WithField("tunnel_id", tunnel.ID).Error("Failed to register tunnel on replacement connection")
+		}
+	}
+
+	if handoffHandler != nil {
+		handoffHandler()
+	}
+
+	d.drain(old, timeout)
 }
 
-// SendHeartbeat sends a heartbeat message to the server
-func (d *DataPlaneClient) SendHeartbeat(tunnelID string, activeConns, totalRequests int) error {
+// drain waits until the streams of a connection that was handed off finished,
+// the server closed it or the timeout passed, then closes it
+func (d *DataPlaneClient) drain(conn *dataPlaneConn, timeout time.Duration) {
+	if !d.waitDrained(conn, timeout, conn.readDone) {
+		d.logger.WithField("streams", numStreams(conn)).Warn("Drain timeout passed, closing connection with streams in flight")
+	}
+
+	if err := conn.writer.Flush(); err != nil {
+		d.logger.WithError(err).Debug("Failed to flush draining connection")
+	}
+	conn.writer.Close()
+	if conn.streams != nil {
+		conn.streams.Close()
+	}
+
+	d.logger.Info("Drained data plane connection closed")
+}
+
+// waitDrained waits until the streams of conn finished or closed is closed and
+// returns false when the timeout passed first. Without streams only closed
+// or the timeout end the wait.
+func (d *DataPlaneClient) waitDrained(conn *dataPlaneConn, timeout time.Duration, closed <-chan struct{}) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if conn.streams != nil && conn.streams.NumStreams() == 0 {
+			return true
+		}
+
+		select {
+		case <-closed:
+			return true
+		case <-deadline.C:
+			return false
+		case <-d.ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// SendHeartbeat sends a heartbeat message reporting the traffic counters of a tunnel to the server
+func (d *DataPlaneClient) SendHeartbeat(tunnelID string, counters TunnelCountersSnapshot) error {
 	d.mu.RLock()
 	if !d.connected {
 		d.mu.RUnlock()
 		return fmt.Errorf("not connected to server")
 	}
+	writer := d.writer
 	d.mu.RUnlock()
 
 	payload := &types.HeartbeatPayload{
 		Timestamp:     time.Now().Unix(),
-		ActiveConns:   activeConns,
-		TotalRequests: totalRequests,
+		ActiveConns:   int(counters.ActiveConns),
+		TotalRequests: int(counters.TotalRequests),
+		BytesIn:       counters.BytesIn,
+		BytesOut:      counters.BytesOut,
+		Errors:        counters.Errors,
 	}
 
 	d.logger.WithFields(logrus.Fields{
 		"tunnel_id":     tunnelID,
-		"active_conns":  activeConns,
-		"total_requests": totalRequests,
+		"active_conns":  counters.ActiveConns,
+		"total_requests": counters.TotalRequests,
 	}).Debug("Sending heartbeat")
 
-	return d.writer.WriteHeartbeat(tunnelID, payload)
+	return writer.WriteHeartbeat(tunnelID, payload)
+}
+
+// monitorHeartbeats probes the connection with a heartbeat every heartbeat
+// interval and closes it once the server stopped echoing them, the read loop
+// then fails and the connection is reestablished
+func (d *DataPlaneClient) monitorHeartbeats() {
+	ticker := time.NewTicker(d.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.RLock()
+		connected := d.connected
+		writer := d.writer
+		negotiation := d.negotiation
+		serverAddr := d.serverAddr
+		d.mu.RUnlock()
+		if !connected || !negotiation.Supports(types.CapabilityHeartbeatEcho) {
+			continue
+		}
+
+		nonce, dead := d.heartbeats.Probe(time.Now())
+		if dead && d.Migrate(d.heartbeatInterval) == nil {
+			// The server answered on a new path, heartbeats start over there
+			continue
+		}
+		if dead {
+			d.logger.WithFields(logrus.Fields{
+				"missed":      d.heartbeats.Stats().Missed,
+				"server_addr": serverAddr,
+			}).Warn("Server stopped echoing heartbeats, closing connection")
+			writer.Close()
+			continue
+		}
+
+		message, err := writer.Encode(types.MessageTypeHeartbeat, "", &types.HeartbeatPayload{
+			Timestamp: time.Now().Unix(),
+			Nonce:     nonce,
+		})
+		if err != nil {
+			d.logger.WithError(err).Error("Failed to create heartbeat message")
+			continue
+		}
+
+		// A write stuck on a dead connection counts as a missed heartbeat
+		if err := writer.WriteMessageWithTimeout(message, d.heartbeatInterval); err != nil {
+			d.logger.WithError(err).Warn("Failed to send heartbeat")
+		}
+	}
+}
+
+// handleHeartbeat answers a heartbeat carrying a nonce and measures the round
+// trip of echoes to our own heartbeats
+func (d *DataPlaneClient) handleHeartbeat(writer *protocol.Writer, message *types.Message) {
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return
+	}
+	heartbeat := parsed.(*types.HeartbeatPayload)
+	if heartbeat.Nonce == 0 {
+		return
+	}
+
+	if heartbeat.Echo {
+		if rtt, ok := d.heartbeats.Echo(heartbeat.Nonce, time.Now()); ok {
+			d.logger.WithFields(logrus.Fields{
+				"nonce": heartbeat.Nonce,
+				"rtt":   rtt,
+			}).Debug("Received heartbeat echo")
+			d.deliverPongs(heartbeat.Nonce, rtt)
+		}
+		return
+	}
+
+	// The echo is queued, the read path never waits for the connection to take a write
+	if err := writer.QueueHeartbeat(message.TunnelID, &types.HeartbeatPayload{
+		Timestamp: time.Now().Unix(),
+		Nonce:     heartbeat.Nonce,
+		Echo:      true,
+	}); err != nil {
+		d.logger.WithError(err).Warn("Failed to echo heartbeat")
+	}
+}
+
+// Ping probes the connection with a connection-level heartbeat and waits up to
+// timeout for its echo, the pong, returning the round trip time. The echo is
+// processed by whoever reads the connection.
+func (d *DataPlaneClient) Ping(timeout time.Duration) (time.Duration, error) {
+	d.mu.RLock()
+	if !d.connected {
+		d.mu.RUnlock()
+		return 0, fmt.Errorf("not connected to server")
+	}
+	writer := d.writer
+	negotiation := d.negotiation
+	d.mu.RUnlock()
+
+	if !negotiation.Supports(types.CapabilityHeartbeatEcho) {
+		return 0, ErrPingUnsupported
+	}
+
+	nonce, dead := d.heartbeats.Probe(time.Now())
+	if dead {
+		return 0, fmt.Errorf("server stopped echoing heartbeats")
+	}
+
+	pong := make(chan time.Duration, 1)
+	d.pongMu.Lock()
+	d.pongs[nonce] = pong
+	d.pongMu.Unlock()
+	defer func() {
+		d.pongMu.Lock()
+		delete(d.pongs, nonce)
+		d.pongMu.Unlock()
+	}()
+
+	if err := writer.WriteHeartbeat("", &types.HeartbeatPayload{
+		Timestamp: time.Now().Unix(),
+		Nonce:     nonce,
+	}); err != nil {
+		return 0, fmt.Errorf("failed to send ping: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case rtt := <-pong:
+		return rtt, nil
+	case <-timer.C:
+		return 0, fmt.Errorf("no pong within %s", timeout)
+	case <-d.ctx.Done():
+		return 0, fmt.Errorf("data plane client stopped")
+	}
+}
+
+// Migrate moves the connection to a new local address and waits up to
+// timeout for the server to answer there, so a connection that went quiet
+// after a network change carries on instead of being reestablished. Returns
+// ErrMigrationUnsupported unless the transport is QUIC.
+func (d *DataPlaneClient) Migrate(timeout time.Duration) error {
+	d.mu.RLock()
+	if !d.connected {
+		d.mu.RUnlock()
+		return fmt.Errorf("not connected to server")
+	}
+	conn, ok := d.conn.(*TransportConn)
+	serverAddr := d.serverAddr
+	d.mu.RUnlock()
+	if !ok {
+		return ErrMigrationUnsupported
+	}
+
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+	if err := conn.Migrate(ctx); err != nil {
+		return fmt.Errorf("failed to migrate connection: %w", err)
+	}
+
+	// Heartbeats lost on the old path say nothing about the new one
+	d.heartbeats.Reset()
+	d.lastSeen.Store(time.Now().UnixNano())
+
+	d.logger.WithFields(logrus.Fields{
+		"server_addr": serverAddr,
+		"local_addr":  conn.LocalAddr(),
+	}).Info("Migrated data plane connection to a new network path")
+	return nil
+}
+
+// deliverPongs answers the pings waiting for nonce or an older one, an echo
+// proves the heartbeats sent before it were read too
+func (d *DataPlaneClient) deliverPongs(nonce uint64, rtt time.Duration) {
+	d.pongMu.Lock()
+	defer d.pongMu.Unlock()
+
+	for pending, pong := range d.pongs {
+		if pending <= nonce {
+			pong <- rtt
+			delete(d.pongs, pending)
+		}
+	}
+}
+
+// LastSeen returns when the last frame arrived from the server
+func (d *DataPlaneClient) LastSeen() time.Time {
+	return time.Unix(0, d.lastSeen.Load())
+}
+
+// GetHeartbeatStats returns the heartbeat counters and the measured round trip time and jitter
+func (d *DataPlaneClient) GetHeartbeatStats() protocol.HeartbeatStats {
+	return d.heartbeats.Stats()
 }
 
 // SendDataResponse sends a data response to the server
@@ -175,6 +865,7 @@ func (d *DataPlaneClient) SendDataResponse(tunnelID string, payload *types.DataR
 		d.mu.RUnlock()
 		return fmt.Errorf("not connected to server")
 	}
+	writer := d.writer
 	d.mu.RUnlock()
 
 	d.logger.WithFields(logrus.Fields{
@@ -185,16 +876,46 @@ func (d *DataPlaneClient) SendDataResponse(tunnelID string, payload *types.DataR
 		"data_size":     len(payload.Data),
 	}).Debug("Sending data response")
 
-	return d.writer.WriteDataResponse(tunnelID, payload)
+	return writer.WriteDataResponse(tunnelID, payload)
+}
+
+// SendDataChunk sends one chunk of a streamed response body to the server
+func (d *DataPlaneClient) SendDataChunk(tunnelID string, payload *types.DataChunkPayload) error {
+	d.mu.RLock()
+	if !d.connected {
+		d.mu.RUnlock()
+		return fmt.Errorf("not connected to server")
+	}
+	writer := d.writer
+	d.mu.RUnlock()
+
+	d.logger.WithFields(logrus.Fields{
+		"tunnel_id":  tunnelID,
+		"request_id": payload.RequestID,
+		"sequence":   payload.Sequence,
+		"data_size":  len(payload.Data),
+		"end":        payload.End,
+	}).Trace("Sending data chunk")
+
+	return writer.WriteDataChunk(tunnelID, payload)
 }
 
-// SendError sends an error message to the server
+// Supports returns whether the current connection negotiated a capability
+func (d *DataPlaneClient) Supports(capability types.Capability) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.negotiation != nil && d.negotiation.Supports(capability)
+}
+
+// SendError queues an error message for the server. It does not wait for the
+// write, so it is safe to call from the goroutine reading the connection.
 func (d *DataPlaneClient) SendError(tunnelID string, code, message, details string) error {
 	d.mu.RLock()
 	if !d.connected {
 		d.mu.RUnlock()
 		return fmt.Errorf("not connected to server")
 	}
+	writer := d.writer
 	d.mu.RUnlock()
 
 	payload := &types.ErrorPayload{
@@ -210,7 +931,7 @@ func (d *DataPlaneClient) SendError(tunnelID string, code, message, details stri
 		"details":   details,
 	}).Warn("Sending error message")
 
-	return d.writer.WriteError(tunnelID, payload)
+	return writer.QueueError(tunnelID, payload)
 }
 
 // SendAcknowledge sends an acknowledgment message to the server
@@ -220,6 +941,7 @@ func (d *DataPlaneClient) SendAcknowledge(tunnelID, messageID, status string) er
 		d.mu.RUnlock()
 		return fmt.Errorf("not connected to server")
 	}
+	writer := d.writer
 	d.mu.RUnlock()
 
 	payload := &types.AcknowledgePayload{
@@ -233,7 +955,7 @@ func (d *DataPlaneClient) SendAcknowledge(tunnelID, messageID, status string) er
 		"status":     status,
 	}).Debug("Sending acknowledgment")
 
-	return d.writer.WriteAcknowledge(tunnelID, payload)
+	return writer.WriteAcknowledge(tunnelID, payload)
 }
 
 // SendConnectionClose sends a connection close message to the server
@@ -256,31 +978,273 @@ func (d *DataPlaneClient) SendConnectionClose(tunnelID, connectionID, reason str
 		"reason":        reason,
 	}).Debug("Sending connection close")
 
-	return d.writer.WriteConnectionClose(tunnelID, payload)
+	return d.sendReliable(types.MessageTypeConnectionClose, tunnelID, payload)
 }
 
-// ReadMessage reads a message from the server
-func (d *DataPlaneClient) ReadMessage() (*types.Message, error) {
+// sendReliable sends a message that has to survive a flaky link. When the
+// server acknowledges messages it gets an ID and stays in the outbox until the
+// acknowledgment arrives, otherwise it is sent once like any other message.
+func (d *DataPlaneClient) sendReliable(msgType types.MessageType, tunnelID string, payload interface{}) error {
 	d.mu.RLock()
 	if !d.connected {
 		d.mu.RUnlock()
-		return nil, fmt.Errorf("not connected to server")
+		return fmt.Errorf("not connected to server")
 	}
+	writer := d.writer
+	reliable := d.negotiation.Supports(types.CapabilityReliableDelivery)
 	d.mu.RUnlock()
 
-	return d.reader.ReadMessage()
+	message, err := writer.Encode(msgType, tunnelID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create message: %w", err)
+	}
+
+	// Tracked before writing, so a failed write is retried like a lost one
+	if reliable {
+		d.outbox.Track(message)
+	}
+	return writer.WriteMessage(message)
+}
+
+// outstanding returns the unacknowledged messages to send again on a new
+// connection, re-encoded for it, or drops them when it does not negotiate
+// reliable delivery. Callers must hold d.mu.
+func (d *DataPlaneClient) outstanding(writer *protocol.Writer, negotiation *protocol.Negotiation) []*types.Message {
+	if !negotiation.Supports(types.CapabilityReliableDelivery) {
+		if dropped := d.outbox.Len(); dropped > 0 {
+			d.logger.WithField("messages", dropped).Warn("Server does not acknowledge messages, dropping outstanding ones")
+			d.outbox.Clear()
+		}
+		return nil
+	}
+
+	pending := d.outbox.Pending()
+	messages := pending[:0]
+	for _, message := range pending {
+		// The new connection may have negotiated a different payload encoding or layout
+		if message.Encoding != writer.GetEncoding() || message.Capabilities != writer.GetCapabilities() {
+			if err := reencode(message, writer); err != nil {
+				d.logger.WithError(err).WithField("message_id", message.ID).Warn("Failed to re-encode outstanding message")
+				continue
+			}
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// resendOutstanding sends messages that were in flight when the last connection
+// dropped again on a new one. It waits for the writes, so callers must not hold d.mu.
+func (d *DataPlaneClient) resendOutstanding(writer *protocol.Writer, messages []*types.Message) {
+	for _, message := range messages {
+		if err := writer.WriteMessage(message); err != nil {
+			d.logger.WithError(err).WithField("message_id", message.ID).Warn("Failed to resend outstanding message")
+		}
+	}
+}
+
+// monitorAcks sends reliable messages again once their ack timeout passed and
+// gives up on them after the last retransmission
+func (d *DataPlaneClient) monitorAcks() {
+	ticker := time.NewTicker(d.ackTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// While disconnected the messages wait for resendOutstanding
+		d.mu.RLock()
+		connected := d.connected
+		writer := d.writer
+		d.mu.RUnlock()
+		if !connected {
+			continue
+		}
+
+		retransmit, expired := d.outbox.Due(time.Now())
+		for _, message := range retransmit {
+			d.logger.WithFields(logrus.Fields{
+				"message_id":   message.ID,
+				"message_type": message.Type,
+				"tunnel_id":    message.TunnelID,
+			}).Debug("Retransmitting unacknowledged message")
+			if err := writer.WriteMessage(message); err != nil {
+				d.logger.WithError(err).WithField("message_id", message.ID).Warn("Failed to retransmit message")
+			}
+		}
+		for _, message := range expired {
+			d.logger.WithFields(logrus.Fields{
+				"message_id":   message.ID,
+				"message_type": message.Type,
+				"tunnel_id":    message.TunnelID,
+			}).Error("Message was never acknowledged, giving up")
+		}
+	}
+}
+
+// acknowledge answers a reliable message from the server and returns whether
+// it is a duplicate that was already handed on
+func (d *DataPlaneClient) acknowledge(conn *dataPlaneConn, message *types.Message) bool {
+	duplicate := conn.dedup.Seen(message.ID)
+
+	status := types.AckStatusReceived
+	if duplicate {
+		d.duplicates.Add(1)
+		status = types.AckStatusDuplicate
+	}
+	if err := conn.writer.QueueAcknowledge(message.TunnelID, &types.AcknowledgePayload{
+		MessageID: strconv.FormatUint(message.ID, 10),
+		Status:    status,
+	}); err != nil {
+		d.logger.WithError(err).WithField("message_id", message.ID).Warn("Failed to acknowledge message")
+	}
+
+	return duplicate
+}
+
+// handleAck removes the message an acknowledgment refers to from the outbox
+func (d *DataPlaneClient) handleAck(message *types.Message) {
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return
+	}
+
+	// Acknowledgments of anything but a numeric message ID predate reliable delivery
+	id, err := strconv.ParseUint(parsed.(*types.AcknowledgePayload).MessageID, 10, 64)
+	if err != nil {
+		return
+	}
+	if d.outbox.Ack(id) {
+		d.logger.WithField("message_id", id).Debug("Message acknowledged")
+	}
+}
+
+// reencode converts the payload of a message to the encoding and layout of another connection
+func reencode(message *types.Message, writer *protocol.Writer) error {
+	payload, err := message.ParsePayload()
+	if err != nil {
+		return err
+	}
+	encoded, err := writer.Encode(message.Type, message.TunnelID, payload)
+	if err != nil {
+		return err
+	}
+	message.Payload = encoded.Payload
+	message.Encoding = encoded.Encoding
+	message.Capabilities = encoded.Capabilities
+	return nil
+}
+
+// GetDeliveryStats returns the counters of reliable delivery since the client was created
+func (d *DataPlaneClient) GetDeliveryStats() protocol.DeliveryStats {
+	stats := d.outbox.Stats()
+	stats.Duplicates = d.duplicates.Load()
+	return stats
+}
+
+// ReadMessage reads a message from the server. After a GOAWAY it keeps reading
+// the old connection until that closes, then moves on to the replacement.
+func (d *DataPlaneClient) ReadMessage() (*types.Message, error) {
+	return d.read(func(reader *protocol.Reader) (*types.Message, error) {
+		return reader.ReadMessage()
+	})
 }
 
 // ReadMessageWithTimeout reads a message with a timeout
 func (d *DataPlaneClient) ReadMessageWithTimeout(timeout time.Duration) (*types.Message, error) {
-	d.mu.RLock()
-	if !d.connected {
+	return d.read(func(reader *protocol.Reader) (*types.Message, error) {
+		return reader.ReadMessageWithTimeout(timeout)
+	})
+}
+
+// read reads the next message to hand on from the connection reads are on
+func (d *DataPlaneClient) read(read func(*protocol.Reader) (*types.Message, error)) (*types.Message, error) {
+	for {
+		d.mu.RLock()
+		if !d.connected {
+			d.mu.RUnlock()
+			return nil, fmt.Errorf("not connected to server")
+		}
+		conn := d.handedOff
+		if conn == nil {
+			conn = d.current()
+		}
+		d.mu.RUnlock()
+
+		message, err := d.receive(conn, func() (*types.Message, error) {
+			return read(conn.reader)
+		})
+
+		// The connection may have been handed off while the read was waiting
+		d.mu.RLock()
+		handedOff := d.handedOff
 		d.mu.RUnlock()
-		return nil, fmt.Errorf("not connected to server")
+		if handedOff == nil || handedOff.writer != conn.writer {
+			return message, err
+		}
+		conn = handedOff
+
+		if err != nil {
+			// Timeouts and refused frames leave the connection usable
+			if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, protocol.ErrNotNegotiated) {
+				return nil, err
+			}
+			d.mu.Lock()
+			if d.handedOff == conn {
+				d.handedOff = nil
+				close(conn.readDone)
+			}
+			d.mu.Unlock()
+			continue
+		}
+
+		// Stream frames of the old connection belong to its own session
+		if types.IsStreamMessage(message.Type) && conn.session != nil {
+			if err := conn.session.HandleFrame(message); err != nil {
+				d.logger.WithError(err).Warn("Failed to handle stream frame")
+			}
+			protocol.ReleasePayload(message)
+			continue
+		}
+		return message, nil
 	}
-	d.mu.RUnlock()
+}
 
-	return d.reader.ReadMessageWithTimeout(timeout)
+// receive reads messages until one has to be handed on, processing
+// acknowledgments and acknowledging reliable messages along the way
+func (d *DataPlaneClient) receive(conn *dataPlaneConn, read func() (*types.Message, error)) (*types.Message, error) {
+	writer := conn.writer
+	for {
+		message, err := read()
+		if err != nil {
+			return nil, err
+		}
+		d.lastSeen.Store(time.Now().UnixNano())
+
+		if message.Type == types.MessageTypeAcknowledge {
+			d.handleAck(message)
+		}
+		if message.Type == types.MessageTypeHeartbeat {
+			d.handleHeartbeat(writer, message)
+		}
+		if message.Type == types.MessageTypeTunnelRegistered {
+			d.handleRegistered(message)
+		}
+		// The GOAWAY is handed on too, the handoff runs on its own goroutine
+		if message.Type == types.MessageTypeGoAway {
+			d.handleGoAway(writer, message)
+		}
+
+		// Reliable messages are acknowledged every time they arrive but handed on once
+		if message.ID == 0 || !d.acknowledge(conn, message) {
+			return message, nil
+		}
+		d.logger.WithField("message_id", message.ID).Debug("Dropping duplicate message")
+	}
 }
 
 // ReadMessageAsync reads messages asynchronously
@@ -291,13 +1255,15 @@ func (d *DataPlaneClient) ReadMessageAsync(messageChan chan<- *types.Message, er
 		errorChan <- fmt.Errorf("not connected to server")
 		return
 	}
+	reader := d.reader
 	d.mu.RUnlock()
 
-	d.reader.ReadMessageAsync(messageChan, errorChan)
+	reader.ReadMessageAsync(messageChan, errorChan)
 }
 
-// StartHeartbeat starts sending periodic heartbeat messages
-func (d *DataPlaneClient) StartHeartbeat(tunnelID string, interval time.Duration) {
+// StartHeartbeat starts sending periodic heartbeat messages for a tunnel,
+// each reporting the traffic counters returned by counters
+func (d *DataPlaneClient) StartHeartbeat(tunnelID string, interval time.Duration, counters func() TunnelCountersSnapshot) {
 	go func() {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
@@ -308,7 +1274,7 @@ func (d *DataPlaneClient) StartHeartbeat(tunnelID string, interval time.Duration
 				d.logger.Info("Heartbeat stopped due to context cancellation")
 				return
 			case <-ticker.C:
-				if err := d.SendHeartbeat(tunnelID, 0, 0); err != nil {
+				if err := d.SendHeartbeat(tunnelID, counters()); err != nil {
 					d.logger.WithError(err).Error("Failed to send heartbeat")
 				}
 			}
@@ -330,7 +1296,128 @@ func (d *DataPlaneClient) GetConnection() net.Conn {
 	return d.conn
 }
 
-// GetServerAddr returns the server address
+// GetNegotiation returns the protocol version and capabilities agreed with the server
+func (d *DataPlaneClient) GetNegotiation() *protocol.Negotiation {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.negotiation
+}
+
+// GetSession returns the stream session of the connection, or nil when the
+// server does not support multiplexing
+func (d *DataPlaneClient) GetSession() *protocol.Session {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.session
+}
+
+// GetStreams returns what accepts the tunnel streams the server opens on the
+// connection, or nil when the connection carries none
+func (d *DataPlaneClient) GetStreams() StreamAcceptor {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.streams
+}
+
+// sessionStreams accepts the streams of a Session
+type sessionStreams struct {
+	*protocol.Session
+}
+
+// AcceptStream waits for the peer to open a stream on the session
+func (s sessionStreams) AcceptStream() (protocol.TunnelStream, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// numStreams returns the number of open streams of a connection
+func numStreams(conn *dataPlaneConn) int {
+	if conn.streams == nil {
+		return 0
+	}
+	return conn.streams.NumStreams()
+}
+
+// HandleStreamFrame hands a stream frame read from the connection to its session
+func (d *DataPlaneClient) HandleStreamFrame(message *types.Message) {
+	session := d.GetSession()
+	if session == nil {
+		d.logger.WithField("message_type", message.Type).Warn("Stream frame without a stream session")
+		return
+	}
+
+	if err := session.HandleFrame(message); err != nil {
+		d.logger.WithError(err).Warn("Failed to handle stream frame")
+	}
+
+	// The session copied what it needs, the frame buffer can be reused
+	protocol.ReleasePayload(message)
+}
+
+// newHello builds the hello this client opens every data plane connection with
+func newHello() *types.HelloPayload {
+	return &types.HelloPayload{
+		ProtocolVersion:    types.ProtocolVersion,
+		MinProtocolVersion: types.MinProtocolVersion,
+		ClientVersion:      ClientVersion,
+		Capabilities:       protocol.SupportedCapabilities,
+		Compression:        protocol.CompressorNames(),
+	}
+}
+
+// maxFrameSize returns the configured max frame size, or the protocol default when unset
+func maxFrameSize(cfg *config.Config) int {
+	if cfg.Connection.MaxFrameSize > 0 {
+		return cfg.Connection.MaxFrameSize
+	}
+	return protocol.DefaultMaxFrameSize
+}
+
+// GetCompressionStats returns the payload bytes before and after compression since the client was created
+func (d *DataPlaneClient) GetCompressionStats() protocol.CompressionSnapshot {
+	return d.compression.Snapshot()
+}
+
+// GetDrainTimeout returns how long in-flight streams may take once a connection goes away
+func (d *DataPlaneClient) GetDrainTimeout() time.Duration {
+	return d.drainTimeout
+}
+
+// GetServerAddr returns the address of the endpoint the client is connected to
 func (d *DataPlaneClient) GetServerAddr() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	return d.serverAddr
+}
+
+// SetDialer sets the dialer connections to the server are opened with
+func (d *DataPlaneClient) SetDialer(dialer Dialer) {
+	d.dialer = dialer
+	d.endpoints.SetDialer(dialer)
+}
+
+// SetCredentialSource sets where the credentials new connections authenticate with come from
+func (d *DataPlaneClient) SetCredentialSource(credentials CredentialSource) {
+	d.credentials = credentials
+}
+
+// SetTransport sets the transport connections to the server are opened with
+func (d *DataPlaneClient) SetTransport(transport Transport) {
+	d.transport = transport
+	d.endpoints.SetTransport(transport)
+}
+
+// GetTransportName returns the name of the transport of the current connection
+func (d *DataPlaneClient) GetTransportName() string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.transportName
+}
+
+// GetEndpointSelector returns the selector picking the endpoint to connect to
+func (d *DataPlaneClient) GetEndpointSelector() *EndpointSelector {
+	return d.endpoints
 } 
\ No newline at end of file
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/unownone/shipitd/internal/config"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// DefaultDialTimeout bounds opening a connection, proxy handshake included
+const DefaultDialTimeout = 30 * time.Second
+
+// Dialer opens the outbound connections of the control and data plane
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewDialer creates the dialer for connection.proxy. Empty follows
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY, "direct" ignores them, and a proxy URL
+// sends every connection through that proxy.
+func NewDialer(cfg *config.Config) Dialer {
+	timeout := cfg.Connection.ConnectionTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+	direct := &net.Dialer{Timeout: timeout}
+
+	switch cfg.Connection.Proxy {
+	case "":
+		return &proxyDialer{direct: direct, timeout: timeout, proxyFor: proxyFromEnvironment()}
+	case config.ProxyDirect:
+		return direct
+	}
+
+	proxyURL, err := url.Parse(cfg.Connection.Proxy)
+	return &proxyDialer{
+		direct:  direct,
+		timeout: timeout,
+		proxyFor: func(string) (*url.URL, error) {
+			return proxyURL, err
+		},
+	}
+}
+
+// proxyFromEnvironment picks the proxy for an address from the environment.
+// Every outbound connection of the client carries TLS, so the address is
+// looked up like an HTTPS request.
+func proxyFromEnvironment() func(addr string) (*url.URL, error) {
+	proxyFunc := httpproxy.FromEnvironment().ProxyFunc()
+	return func(addr string) (*url.URL, error) {
+		return proxyFunc(&url.URL{Scheme: "https", Host: addr})
+	}
+}
+
+// proxyDialer connects through an HTTP CONNECT or SOCKS5 proxy, or directly
+// when there is no proxy for the address
+type proxyDialer struct {
+	direct   *net.Dialer
+	timeout  time.Duration
+	proxyFor func(addr string) (*url.URL, error)
+}
+
+// DialContext connects to addr through the proxy for it
+func (p *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyURL, err := p.proxyFor(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy: %w", err)
+	}
+	if proxyURL == nil {
+		return p.direct.DialContext(ctx, network, addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return p.dialConnect(ctx, proxyURL, addr)
+	case "socks5", "socks5h":
+		return p.dialSOCKS5(ctx, proxyURL, network, addr)
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request
+func (p *proxyDialer) dialConnect(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	conn, err := p.direct.DialContext(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyURL.Host, err)
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{MinVersion: tls.VersionTLS12, ServerName: proxyURL.Hostname()})
+	}
+
+	deadline := time.Now().Add(p.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %w", proxyURL.Host, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy %s: %w", proxyURL.Host, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyURL.Host, addr, response.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Bytes the server sent right after the response were read along with it
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 connects to addr through a SOCKS5 proxy, the proxy resolves the host
+func (p *proxyDialer) dialSOCKS5(ctx context.Context, proxyURL *url.URL, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr(proxyURL), auth, p.direct)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %w", err)
+	}
+
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect through SOCKS5 proxy %s: %w", proxyURL.Host, err)
+	}
+	return conn, nil
+}
+
+// proxyAddr returns the host:port of a proxy, with the default port of its scheme
+func proxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+
+	port := "1080"
+	switch proxyURL.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// bufferedConn is a connection whose first bytes were already read into reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads the buffered bytes first
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,285 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/internal/config"
+)
+
+const (
+	// DefaultEndpointMaxFailures is the number of failed connection attempts in a row after which the next endpoint is tried
+	DefaultEndpointMaxFailures = 3
+	// DefaultEndpointProbeTimeout bounds the connection measured to rank an endpoint
+	DefaultEndpointProbeTimeout = 5 * time.Second
+)
+
+// Endpoint is a data plane server the client can connect to
+type Endpoint struct {
+	Addr string `json:"addr"`
+	// ServerName is the name the endpoint's certificate is verified against
+	ServerName string `json:"server_name"`
+	// RTT is the time opening a connection through the transport took when measured last, zero when the endpoint was unreachable
+	RTT time.Duration `json:"rtt"`
+	// Failures counts the failed connection attempts in a row
+	Failures  int    `json:"failures"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// EndpointSelector ranks data plane endpoints by the time opening a connection
+// to them through the transport takes and hands out the fastest one. After
+// maxFailures failed connection attempts in a row it fails over to the next
+// one, and once every endpoint failed they are measured again.
+type EndpointSelector struct {
+	endpoints   []*Endpoint
+	current     int
+	measured    bool
+	measuring   chan struct{}
+	maxFailures int
+	transport   Transport
+	dialer      Dialer
+	timeout     time.Duration
+	logger      *logrus.Logger
+	mu          sync.Mutex
+}
+
+// endpointProbe is the outcome of measuring one endpoint
+type endpointProbe struct {
+	rtt time.Duration
+	err error
+}
+
+// NewEndpointSelector creates a selector for server.endpoints, or for the
+// server domain and data plane port when no endpoints are configured.
+// Endpoints are measured through transport, the one connections use.
+func NewEndpointSelector(cfg *config.Config, transport Transport, logger *logrus.Logger) *EndpointSelector {
+	entries := cfg.Server.Endpoints
+	if len(entries) == 0 {
+		entries = []string{cfg.Server.Domain}
+	}
+
+	endpoints := make([]*Endpoint, 0, len(entries))
+	for _, entry := range entries {
+		endpoints = append(endpoints, parseEndpoint(entry, cfg.Server.Domain, cfg.Server.DataPlanePort))
+	}
+
+	return &EndpointSelector{
+		endpoints:   endpoints,
+		maxFailures: DefaultEndpointMaxFailures,
+		transport:   transport,
+		dialer:      NewDialer(cfg),
+		timeout:     DefaultEndpointProbeTimeout,
+		logger:      logger,
+		// A single endpoint has nothing to be ranked against, and WebSocket
+		// connections go to the control plane host instead
+		measured: len(endpoints) == 1 || cfg.Server.Transport == config.TransportWebSocket,
+	}
+}
+
+// parseEndpoint turns an endpoint entry into an address. Entries are
+// host:port, a host using the data plane port, or a region name such as "eu"
+// that expands to a subdomain of the server domain.
+func parseEndpoint(entry, domain string, port int) *Endpoint {
+	host, portText, err := net.SplitHostPort(entry)
+	if err != nil {
+		host = entry
+		portText = strconv.Itoa(port)
+	}
+	if !strings.ContainsAny(host, ".:") && host != "localhost" && domain != "" {
+		host = fmt.Sprintf("%s.%s", host, domain)
+	}
+
+	return &Endpoint{
+		Addr:       net.JoinHostPort(host, portText),
+		ServerName: host,
+	}
+}
+
+// SetDialer sets the dialer endpoints are probed with
+func (s *EndpointSelector) SetDialer(dialer Dialer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dialer = dialer
+}
+
+// SetTransport sets the transport endpoints are probed through
+func (s *EndpointSelector) SetTransport(transport Transport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transport = transport
+}
+
+// Current returns the endpoint to connect to, measuring all of them first
+// when they have not been ranked yet. Callers arriving while a measurement
+// runs wait for it instead of starting another one.
+func (s *EndpointSelector) Current() Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.measured {
+		if s.measuring != nil {
+			measuring := s.measuring
+			s.mu.Unlock()
+			<-measuring
+			s.mu.Lock()
+			continue
+		}
+		s.measure()
+	}
+	return *s.endpoints[s.current]
+}
+
+// Selected returns the endpoint connections currently go to without measuring
+func (s *EndpointSelector) Selected() Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.endpoints[s.current]
+}
+
+// Endpoints returns every endpoint, fastest first
+func (s *EndpointSelector) Endpoints() []Endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	endpoints := make([]Endpoint, len(s.endpoints))
+	for i, endpoint := range s.endpoints {
+		endpoints[i] = *endpoint
+	}
+	return endpoints
+}
+
+// Succeeded records a connection established to addr
+func (s *EndpointSelector) Succeeded(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if endpoint := s.find(addr); endpoint != nil {
+		endpoint.Failures = 0
+		endpoint.LastError = ""
+	}
+}
+
+// Failed records a failed connection attempt to addr and fails over to the
+// next endpoint once the current one failed maxFailures times in a row
+func (s *EndpointSelector) Failed(addr string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	endpoint := s.find(addr)
+	if endpoint == nil {
+		return
+	}
+	endpoint.Failures++
+	endpoint.LastError = err.Error()
+
+	if endpoint != s.endpoints[s.current] || endpoint.Failures < s.maxFailures || len(s.endpoints) == 1 {
+		return
+	}
+
+	endpoint.Failures = 0
+	s.current = (s.current + 1) % len(s.endpoints)
+	// Every endpoint had its turn, conditions may have changed since they were ranked
+	if s.current == 0 {
+		s.measured = false
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"failed_endpoint": addr,
+		"endpoint":        s.endpoints[s.current].Addr,
+		"error":           err,
+	}).Warn("Failing over to the next data plane endpoint")
+}
+
+// find returns the endpoint with addr. Callers must hold s.mu.
+func (s *EndpointSelector) find(addr string) *Endpoint {
+	for _, endpoint := range s.endpoints {
+		if endpoint.Addr == addr {
+			return endpoint
+		}
+	}
+	return nil
+}
+
+// measure connects to every endpoint at once and ranks them by the time that
+// took, unreachable endpoints last. Callers must hold s.mu, it is released
+// while the probes run so the selector stays usable.
+func (s *EndpointSelector) measure() {
+	measuring := make(chan struct{})
+	s.measuring = measuring
+	endpoints := make([]Endpoint, len(s.endpoints))
+	for i, endpoint := range s.endpoints {
+		endpoints[i] = *endpoint
+	}
+	transport, dialer := s.transport, s.dialer
+	s.mu.Unlock()
+
+	probes := make([]endpointProbe, len(endpoints))
+	var wg sync.WaitGroup
+	for i := range endpoints {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			probes[i].rtt, probes[i].err = s.probe(transport, dialer, endpoints[i])
+		}(i)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	s.measuring = nil
+	close(measuring)
+
+	for i, probe := range probes {
+		endpoint := s.find(endpoints[i].Addr)
+		if endpoint == nil {
+			continue
+		}
+		endpoint.RTT, endpoint.LastError = probe.rtt, ""
+		if probe.err != nil {
+			endpoint.LastError = probe.err.Error()
+		}
+	}
+
+	sort.SliceStable(s.endpoints, func(i, j int) bool {
+		a, b := s.endpoints[i], s.endpoints[j]
+		if (a.RTT == 0) != (b.RTT == 0) {
+			return a.RTT != 0
+		}
+		return a.RTT < b.RTT
+	})
+	s.current = 0
+	s.measured = true
+
+	fields := logrus.Fields{}
+	for _, endpoint := range s.endpoints {
+		fields[endpoint.Addr] = endpoint.RTT
+	}
+	s.logger.WithFields(fields).Info("Ranked data plane endpoints by connection RTT")
+}
+
+// probe returns how long opening a connection to an endpoint through the
+// transport takes. Falling back to WebSocket would measure the control plane
+// host instead of the endpoint, so an automatic transport probes directly.
+func (s *EndpointSelector) probe(transport Transport, dialer Dialer, endpoint Endpoint) (time.Duration, error) {
+	if auto, ok := transport.(*autoTransport); ok {
+		transport = auto.direct
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := transport.Dial(ctx, dialer, endpoint)
+	if err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.Close()
+	return rtt, nil
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// DataForwarder forwards data plane traffic for active tunnels to their local services.
+// It lives outside this package (see internal/proxy) and is attached with SetForwarder.
+type DataForwarder interface {
+	// AddTunnel prepares forwarding for a registered tunnel
+	AddTunnel(tunnel *Tunnel) error
+	// RemoveTunnel releases everything held for a tunnel
+	RemoveTunnel(tunnelID string)
+	// HandleDataForward forwards a data forward payload to the tunnel's local service
+	HandleDataForward(tunnelID string, payload *types.DataForwardPayload)
+	// HandleDataChunk delivers one chunk of a streamed request body
+	HandleDataChunk(tunnelID string, payload *types.DataChunkPayload)
+	// HandleConnectionClose closes a forwarded connection on the tunnel
+	HandleConnectionClose(tunnelID string, payload *types.ConnectionClosePayload)
+	// HandleStream serves a stream opened by the server until it is done
+	HandleStream(stream protocol.TunnelStream)
+	// GetTunnelCounters returns the traffic counters of a tunnel, or nil when it has no proxy
+	GetTunnelCounters(tunnelID string) *TunnelCounters
+}
+
+// ResponseSender sends forwarding results back to the server over the data plane
+type ResponseSender interface {
+	SendDataResponse(tunnelID string, payload *types.DataResponsePayload) error
+	SendDataChunk(tunnelID string, payload *types.DataChunkPayload) error
+	SendError(tunnelID string, code, message, details string) error
+	SendConnectionClose(tunnelID, connectionID, reason string) error
+	// Supports returns whether the connection negotiated a capability
+	Supports(capability types.Capability) bool
+}
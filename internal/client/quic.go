@@ -0,0 +1,360 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/unownone/shipitd/internal/config"
+	"github.com/unownone/shipitd/internal/protocol"
+)
+
+const (
+	// QUICProtocol is the ALPN protocol data plane QUIC connections negotiate
+	QUICProtocol = "shipit-data-plane"
+	// quicKeepAlivePeriod keeps NAT bindings of an idle QUIC connection open
+	quicKeepAlivePeriod = 15 * time.Second
+	// quicMaxIncomingStreams is the number of tunnel streams the server may have open at once
+	quicMaxIncomingStreams = 1024
+	// quicStreamHeaderTimeout bounds reading the header of a stream the server opened
+	quicStreamHeaderTimeout = 10 * time.Second
+)
+
+// Application error codes of QUIC connections and streams. QUIC carries a
+// code only, so the reason passed to Reset is not sent.
+const (
+	quicCodeNoError   quic.ApplicationErrorCode = 0
+	quicCodeStopped   quic.StreamErrorCode      = 0
+	quicCodeReset     quic.StreamErrorCode      = 1
+	quicCodeGoingAway quic.StreamErrorCode      = 2
+)
+
+// quicTransport connects to the data plane port of an endpoint over QUIC. The
+// frames travel on the first stream the client opens, every tunnel stream is
+// a QUIC stream of its own opened by the server. QUIC runs over UDP, so the
+// outbound proxy is not used.
+type quicTransport struct {
+	tlsConfig *tls.Config
+	config    *quic.Config
+}
+
+// newQUICTransport creates a QUIC transport
+func newQUICTransport(tlsConfig *tls.Config) *quicTransport {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.NextProtos = []string{QUICProtocol}
+
+	return &quicTransport{
+		tlsConfig: tlsConfig,
+		config: &quic.Config{
+			KeepAlivePeriod:    quicKeepAlivePeriod,
+			MaxIncomingStreams: quicMaxIncomingStreams,
+		},
+	}
+}
+
+// Name returns the name of the transport
+func (t *quicTransport) Name() string {
+	return config.TransportQUIC
+}
+
+// Dial opens a QUIC connection to the endpoint and the stream frames are sent on
+func (t *quicTransport) Dial(ctx context.Context, dialer Dialer, endpoint Endpoint) (*TransportConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", endpoint.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", endpoint.Addr, err)
+	}
+
+	path, err := newQUICPath()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := t.tlsConfig.Clone()
+	tlsConfig.ServerName = endpoint.ServerName
+	conn, err := path.transport.Dial(ctx, addr, tlsConfig, t.config)
+	if err != nil {
+		path.close()
+		return nil, fmt.Errorf("QUIC handshake failed: %w", err)
+	}
+
+	control, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(quicCodeNoError, "")
+		path.close()
+		return nil, fmt.Errorf("failed to open control stream: %w", err)
+	}
+
+	return &TransportConn{
+		Conn:      &quicConn{Stream: control, conn: conn, paths: []*quicPath{path}},
+		Transport: t.Name(),
+		Addr:      endpoint.Addr,
+		TLSState:  conn.ConnectionState().TLS,
+		Streams:   newQUICStreams(conn),
+	}, nil
+}
+
+// quicPath is a local UDP socket a QUIC connection can send from
+type quicPath struct {
+	socket    *net.UDPConn
+	transport *quic.Transport
+}
+
+// newQUICPath opens a UDP socket on a random local port
+func newQUICPath() (*quicPath, error) {
+	socket, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %w", err)
+	}
+	return &quicPath{socket: socket, transport: &quic.Transport{Conn: socket}}, nil
+}
+
+// close stops the transport and closes the socket, the transport does not close a socket it was given
+func (p *quicPath) close() {
+	p.transport.Close()
+	p.socket.Close()
+}
+
+// quicConn is the control stream of a QUIC connection, the one the frames
+// are read from and written to. Closing it closes the connection.
+type quicConn struct {
+	*quic.Stream
+	conn   *quic.Conn
+	mu     sync.Mutex
+	paths  []*quicPath
+	closed bool
+}
+
+// LocalAddr returns the local address of the connection
+func (c *quicConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the server
+func (c *quicConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the connection with every stream on it and its UDP sockets
+func (c *quicConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	c.conn.CloseWithError(quicCodeNoError, "")
+	for _, path := range c.paths {
+		path.close()
+	}
+	return nil
+}
+
+// Migrate moves the connection to a new local UDP socket once the server
+// answered on it, for example after the network changed. Sockets used before
+// stay open until the connection closes, packets still in flight to them are
+// not lost.
+func (c *quicConn) Migrate(ctx context.Context) error {
+	path, err := newQUICPath()
+	if err != nil {
+		return err
+	}
+
+	migration, err := c.conn.AddPath(path.transport)
+	if err != nil {
+		path.close()
+		return fmt.Errorf("failed to add path: %w", err)
+	}
+	if err := migration.Probe(ctx); err != nil {
+		migration.Close()
+		path.close()
+		return fmt.Errorf("new path did not validate: %w", err)
+	}
+	if err := migration.Switch(); err != nil {
+		migration.Close()
+		path.close()
+		return fmt.Errorf("failed to switch path: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		path.close()
+		return net.ErrClosed
+	}
+	c.paths = append(c.paths, path)
+	return nil
+}
+
+// quicStreams hands out the streams the server opens on a QUIC connection
+type quicStreams struct {
+	conn      *quic.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	draining  chan struct{}
+	drainOnce sync.Once
+	open      atomic.Int64
+}
+
+// newQUICStreams creates the acceptor of a QUIC connection
+func newQUICStreams(conn *quic.Conn) *quicStreams {
+	ctx, cancel := context.WithCancel(conn.Context())
+	return &quicStreams{
+		conn:     conn,
+		ctx:      ctx,
+		cancel:   cancel,
+		draining: make(chan struct{}),
+	}
+}
+
+// AcceptStream waits for the server to open a stream and reads its header.
+// Streams with a broken header are reset and skipped.
+func (s *quicStreams) AcceptStream() (protocol.TunnelStream, error) {
+	for {
+		stream, err := s.conn.AcceptStream(s.ctx)
+		if err != nil {
+			if s.isDraining() {
+				return nil, protocol.ErrSessionDraining
+			}
+			return nil, protocol.ErrSessionClosed
+		}
+
+		stream.SetReadDeadline(time.Now().Add(quicStreamHeaderTimeout))
+		tunnelID, metadata, err := protocol.ReadStreamHeader(stream)
+		stream.SetReadDeadline(time.Time{})
+		if err != nil {
+			stream.CancelRead(quicCodeReset)
+			stream.CancelWrite(quicCodeReset)
+			continue
+		}
+
+		s.open.Add(1)
+		return &quicStream{Stream: stream, streams: s, tunnelID: tunnelID, metadata: metadata}, nil
+	}
+}
+
+// NumStreams returns the number of accepted streams not closed or reset yet
+func (s *quicStreams) NumStreams() int {
+	return int(s.open.Load())
+}
+
+// Drain refuses the streams the server opens from then on, the open ones carry on
+func (s *quicStreams) Drain() {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+		s.cancel()
+		go s.refuse()
+	})
+}
+
+// Close fails waiting and future AcceptStream calls
+func (s *quicStreams) Close() {
+	s.cancel()
+}
+
+// isDraining returns whether Drain was called
+func (s *quicStreams) isDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// refuse resets every stream the server opens until the connection closes
+func (s *quicStreams) refuse() {
+	for {
+		stream, err := s.conn.AcceptStream(s.conn.Context())
+		if err != nil {
+			return
+		}
+		stream.CancelRead(quicCodeGoingAway)
+		stream.CancelWrite(quicCodeGoingAway)
+	}
+}
+
+// quicStream is a tunnel stream carried by a QUIC stream of its own
+type quicStream struct {
+	*quic.Stream
+	streams    *quicStreams
+	tunnelID   string
+	metadata   []byte
+	finishOnce sync.Once
+}
+
+// ID returns the QUIC stream ID
+func (st *quicStream) ID() uint32 {
+	return uint32(st.StreamID())
+}
+
+// TunnelID returns the tunnel the stream belongs to
+func (st *quicStream) TunnelID() string {
+	return st.tunnelID
+}
+
+// Metadata returns the metadata sent with the stream header
+func (st *quicStream) Metadata() []byte {
+	return st.metadata
+}
+
+// LocalAddr returns the local address of the connection
+func (st *quicStream) LocalAddr() net.Addr {
+	return st.streams.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the server qualified by the stream ID,
+// every stream of a connection shares the server address otherwise
+func (st *quicStream) RemoteAddr() net.Addr {
+	return quicStreamAddr{conn: st.streams.conn.RemoteAddr(), id: st.StreamID()}
+}
+
+// quicStreamAddr is the net.Addr of a QUIC stream
+type quicStreamAddr struct {
+	conn net.Addr
+	id   quic.StreamID
+}
+
+// Network returns the network of the connection
+func (a quicStreamAddr) Network() string {
+	return a.conn.Network()
+}
+
+// String returns the connection address and the stream ID
+func (a quicStreamAddr) String() string {
+	return fmt.Sprintf("%s/%d", a.conn, a.id)
+}
+
+// CloseWrite sends FIN, the server reads io.EOF once it drained the stream
+func (st *quicStream) CloseWrite() error {
+	return st.Stream.Close()
+}
+
+// Close half-closes the stream and stops reading from it
+func (st *quicStream) Close() error {
+	st.finish()
+	st.CancelRead(quicCodeStopped)
+	return st.Stream.Close()
+}
+
+// Reset aborts the stream in both directions
+func (st *quicStream) Reset(reason string) error {
+	st.finish()
+	st.CancelRead(quicCodeReset)
+	st.CancelWrite(quicCodeReset)
+	return nil
+}
+
+// finish stops counting the stream as open
+func (st *quicStream) finish() {
+	st.finishOnce.Do(func() {
+		st.streams.open.Add(-1)
+	})
+}
@@ -0,0 +1,217 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// tunnelQueueSize is the number of messages buffered per tunnel before the
+// router starts rejecting messages for it
+const tunnelQueueSize = 256
+
+// MessageHandler handles a message routed to it
+type MessageHandler func(message *types.Message)
+
+// MessageReader reads messages from a data plane connection
+type MessageReader interface {
+	ReadMessage() (*types.Message, error)
+}
+
+// MessageRouter owns the single read loop of a data plane connection and
+// routes every message by tunnel ID to the handler registered for that tunnel.
+// Each tunnel gets its own queue so a slow tunnel cannot stall the others.
+type MessageRouter struct {
+	reader            MessageReader
+	sender            ResponseSender
+	logger            *logrus.Logger
+	routes            map[string]*route
+	connectionHandler MessageHandler
+	streamHandler     MessageHandler
+	mu                sync.RWMutex
+}
+
+// route is a registered tunnel handler and its message queue
+type route struct {
+	handler MessageHandler
+	queue   chan *types.Message
+	done    chan struct{}
+}
+
+// NewMessageRouter creates a router reading from reader and replying through sender
+func NewMessageRouter(reader MessageReader, sender ResponseSender, logger *logrus.Logger) *MessageRouter {
+	return &MessageRouter{
+		reader: reader,
+		sender: sender,
+		logger: logger,
+		routes: make(map[string]*route),
+	}
+}
+
+// Register registers the handler for a tunnel, replacing any previous one
+func (r *MessageRouter) Register(tunnelID string, handler MessageHandler) {
+	rt := &route{
+		handler: handler,
+		queue:   make(chan *types.Message, tunnelQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	if previous, exists := r.routes[tunnelID]; exists {
+		close(previous.done)
+	}
+	r.routes[tunnelID] = rt
+	r.mu.Unlock()
+
+	go rt.run()
+
+	r.logger.WithField("tunnel_id", tunnelID).Debug("Registered tunnel route")
+}
+
+// Unregister removes the handler for a tunnel
+func (r *MessageRouter) Unregister(tunnelID string) {
+	r.mu.Lock()
+	rt, exists := r.routes[tunnelID]
+	delete(r.routes, tunnelID)
+	r.mu.Unlock()
+
+	if exists {
+		close(rt.done)
+		r.logger.WithField("tunnel_id", tunnelID).Debug("Unregistered tunnel route")
+	}
+}
+
+// SetConnectionHandler sets the handler for messages that carry no tunnel ID
+func (r *MessageRouter) SetConnectionHandler(handler MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connectionHandler = handler
+}
+
+// SetStreamHandler sets the handler for stream multiplexing frames. They bypass
+// the tunnel queues because stream flow control already bounds them.
+func (r *MessageRouter) SetStreamHandler(handler MessageHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streamHandler = handler
+}
+
+// IsRegistered returns whether a tunnel has a registered handler
+func (r *MessageRouter) IsRegistered(tunnelID string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, exists := r.routes[tunnelID]
+	return exists
+}
+
+// Run reads and routes messages until the connection fails or ctx is cancelled.
+// It returns nil when ctx was cancelled and the read error otherwise.
+func (r *MessageRouter) Run(ctx context.Context) error {
+	for {
+		message, err := r.reader.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// The refused frame was consumed, the connection itself is still usable
+			if errors.Is(err, protocol.ErrNotNegotiated) {
+				r.logger.WithError(err).Warn("Ignoring frame outside the negotiated protocol")
+				continue
+			}
+			// The oversized payload is still on the wire, tell the peer why we hang up
+			if errors.Is(err, protocol.ErrFrameTooLarge) {
+				if sendErr := r.sender.SendError("", types.ErrorCodeFrameTooLarge, "Frame exceeds max frame size", err.Error()); sendErr != nil {
+					r.logger.WithError(sendErr).Warn("Failed to report oversized frame")
+				}
+			}
+			return err
+		}
+
+		r.Route(message)
+	}
+}
+
+// Route delivers a single message to the handler of its tunnel
+func (r *MessageRouter) Route(message *types.Message) {
+	r.mu.RLock()
+	rt, exists := r.routes[message.TunnelID]
+	connectionHandler := r.connectionHandler
+	streamHandler := r.streamHandler
+	r.mu.RUnlock()
+
+	if types.IsStreamMessage(message.Type) && streamHandler != nil {
+		streamHandler(message)
+		return
+	}
+
+	if message.TunnelID == "" {
+		if connectionHandler != nil {
+			connectionHandler(message)
+		} else {
+			r.logger.WithField("message_type", message.Type).Debug("Dropping connection-level message")
+		}
+		return
+	}
+
+	if !exists {
+		r.logger.WithFields(logrus.Fields{
+			"tunnel_id":    message.TunnelID,
+			"message_type": message.Type,
+		}).Warn("Message for unknown tunnel")
+		r.reject(message, types.ErrorCodeUnknownTunnel, "Tunnel is not registered on this connection")
+		return
+	}
+
+	select {
+	case rt.queue <- message:
+	case <-rt.done:
+		r.reject(message, types.ErrorCodeUnknownTunnel, "Tunnel is not registered on this connection")
+	default:
+		r.logger.WithField("tunnel_id", message.TunnelID).Warn("Tunnel queue full, rejecting message")
+		r.reject(message, types.ErrorCodeTunnelBusy, "Tunnel is not keeping up with incoming messages")
+	}
+}
+
+// GetStats returns router statistics
+func (r *MessageRouter) GetStats() map[string]interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	queued := make(map[string]int, len(r.routes))
+	for tunnelID, rt := range r.routes {
+		queued[tunnelID] = len(rt.queue)
+	}
+
+	return map[string]interface{}{
+		"routes":          len(r.routes),
+		"queued_messages": queued,
+	}
+}
+
+// reject replies to the server with an error for a message that could not be routed
+func (r *MessageRouter) reject(message *types.Message, code, reason string) {
+	// Never answer an error with an error, that could loop forever
+	if message.Type == types.MessageTypeError {
+		return
+	}
+
+	if err := r.sender.SendError(message.TunnelID, code, reason, ""); err != nil {
+		r.logger.WithError(err).Error("Failed to send routing error")
+	}
+}
+
+// run delivers queued messages to the handler in order
+func (rt *route) run() {
+	for {
+		select {
+		case <-rt.done:
+			return
+		case message := <-rt.queue:
+			rt.handler(message)
+		}
+	}
+}
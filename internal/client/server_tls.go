@@ -0,0 +1,146 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/unownone/shipitd/internal/config"
+)
+
+// ErrPinMismatch is returned when no certificate of the server matches server.pinned_spki_sha256
+var ErrPinMismatch = errors.New("server certificate does not match any pinned public key")
+
+// ErrUnverifiedServer is returned instead of sending the API key to a data plane server that is not verified
+var ErrUnverifiedServer = errors.New("refusing to send the API key to an unverified server, set server.tls_verify, server.ca_file or server.pinned_spki_sha256")
+
+// newServerTLSConfig creates the TLS configuration every connection to the
+// ShipIt server is verified with. Certificates are checked against
+// server.ca_file in place of the system roots when it is set, and against
+// server.pinned_spki_sha256 when pins are set, whether tls_verify is on or not.
+// With tls_verify off only the host name goes unchecked when ca_file is set.
+// The control plane turns verification back on for itself.
+func newServerTLSConfig(cfg *config.Config) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.Server.Domain,
+		InsecureSkipVerify: !cfg.Server.TLSVerify,
+	}
+
+	var setupErr error
+	if cfg.Server.CAFile != "" {
+		tlsConfig.RootCAs, setupErr = loadCAFile(cfg.Server.CAFile)
+	}
+
+	pins := make(map[string]bool, len(cfg.Server.PinnedSPKISHA256))
+	for _, pin := range cfg.Server.PinnedSPKISHA256 {
+		digest, err := config.ParseSPKIPin(pin)
+		if err != nil && setupErr == nil {
+			setupErr = fmt.Errorf("invalid pin %q: %w", pin, err)
+		}
+		pins[string(digest)] = true
+	}
+
+	// Skipping verification must not skip the CA the user asked to trust
+	verifyChain := tlsConfig.InsecureSkipVerify && cfg.Server.CAFile != ""
+	if setupErr == nil && len(pins) == 0 && !verifyChain {
+		return tlsConfig
+	}
+
+	roots := tlsConfig.RootCAs
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		// A broken CA bundle or pin fails every connection instead of silently trusting less
+		if setupErr != nil {
+			return setupErr
+		}
+		if verifyChain && len(state.VerifiedChains) == 0 {
+			chains, err := verifyCAChain(state, roots)
+			if err != nil {
+				return err
+			}
+			state.VerifiedChains = chains
+		}
+		if len(pins) == 0 {
+			return nil
+		}
+		return verifyPins(state, pins)
+	}
+	return tlsConfig
+}
+
+// verifiesServer reports whether connections checked with newServerTLSConfig
+// make sure of who the server is, through tls_verify, ca_file or pins
+func verifiesServer(cfg *config.Config) bool {
+	return cfg.Server.TLSVerify || cfg.Server.CAFile != "" || len(cfg.Server.PinnedSPKISHA256) > 0
+}
+
+// loadCAFile reads the PEM certificates of a CA bundle
+func loadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM certificates in CA file %s", path)
+	}
+	return pool, nil
+}
+
+// verifyCAChain verifies the chain the server presented against the CA
+// bundle without checking the host name, for connections with tls_verify off
+func verifyCAChain(state tls.ConnectionState, roots *x509.CertPool) ([][]*x509.Certificate, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", state.ServerName)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("server certificate not signed by CA file: %w", err)
+	}
+	return chains, nil
+}
+
+// verifyPins accepts a connection when the public key of a certificate the
+// server presented, or of one in the chain it was verified with, is pinned
+func verifyPins(state tls.ConnectionState, pins map[string]bool) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: %s presented no certificate", ErrPinMismatch, state.ServerName)
+	}
+
+	certs := state.PeerCertificates
+	for _, chain := range state.VerifiedChains {
+		certs = append(certs[:len(certs):len(certs)], chain...)
+	}
+	for _, cert := range certs {
+		if pins[string(spkiDigest(cert))] {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s presented a certificate for %s with public key %s",
+		ErrPinMismatch, state.ServerName, state.PeerCertificates[0].Subject, SPKIPin(state.PeerCertificates[0]))
+}
+
+// spkiDigest returns the SHA-256 digest of a certificate's subject public key info
+func spkiDigest(cert *x509.Certificate) []byte {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return digest[:]
+}
+
+// SPKIPin returns the pin of a certificate's public key as server.pinned_spki_sha256 takes it
+func SPKIPin(cert *x509.Certificate) string {
+	return "sha256/" + base64.StdEncoding.EncodeToString(spkiDigest(cert))
+}
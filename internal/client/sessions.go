@@ -0,0 +1,154 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TunnelSession is what a tunnel needs to come back with the same tunnel ID,
+// subdomain and public port after a reconnect or a restart
+type TunnelSession struct {
+	TunnelID    string    `json:"tunnel_id"`
+	Protocol    string    `json:"protocol"`
+	PublicURL   string    `json:"public_url,omitempty"`
+	Subdomain   string    `json:"subdomain,omitempty"`
+	PublicPort  int       `json:"public_port,omitempty"`
+	ResumeToken string    `json:"resume_token"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SessionStore keeps the resumption sessions of tunnels by tunnel name. With a
+// path they are written to a file readable by the owner only, so they survive
+// restarts of the daemon; without one they live in memory.
+type SessionStore struct {
+	path     string
+	sessions map[string]*TunnelSession
+	logger   *logrus.Logger
+	mu       sync.Mutex
+}
+
+// NewSessionStore creates a session store backed by path and loads the sessions saved in it
+func NewSessionStore(path string, logger *logrus.Logger) *SessionStore {
+	store := &SessionStore{
+		path:     expandHome(path),
+		sessions: make(map[string]*TunnelSession),
+		logger:   logger,
+	}
+
+	if err := store.load(); err != nil {
+		// A broken file only costs the old public URLs, tunnels are created afresh
+		logger.WithError(err).WithField("path", store.path).Warn("Failed to load tunnel sessions")
+	}
+
+	return store
+}
+
+// Get returns the session of a tunnel, or nil when it has none
+func (s *SessionStore) Get(name string) *TunnelSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[name]
+	if !exists {
+		return nil
+	}
+	copied := *session
+	return &copied
+}
+
+// Save stores the session of a tunnel
+func (s *SessionStore) Save(name string, session *TunnelSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *session
+	copied.UpdatedAt = time.Now()
+	s.sessions[name] = &copied
+	return s.write()
+}
+
+// Delete forgets the session of a tunnel
+func (s *SessionStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.sessions[name]; !exists {
+		return nil
+	}
+	delete(s.sessions, name)
+	return s.write()
+}
+
+// Persistent returns whether sessions are written to a file and survive a restart
+func (s *SessionStore) Persistent() bool {
+	return s.path != ""
+}
+
+// load reads the sessions saved in the file, a missing file holds none
+func (s *SessionStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read session file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &s.sessions); err != nil {
+		s.sessions = make(map[string]*TunnelSession)
+		return fmt.Errorf("failed to parse session file: %w", err)
+	}
+	return nil
+}
+
+// write replaces the file with the current sessions. Callers must hold s.mu.
+func (s *SessionStore) write() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.sessions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal sessions: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	// Written next to the file and renamed over it, so a crash never leaves half a file
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace session file: %w", err)
+	}
+	return nil
+}
+
+// expandHome replaces a leading ~ in path with the home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,376 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/internal/config"
+	"github.com/unownone/shipitd/internal/protocol"
+)
+
+const (
+	// WebSocketPath is where the control plane host accepts data plane WebSocket connections
+	WebSocketPath = "/api/v1/data-plane"
+	// WebSocketSubprotocol is the subprotocol data plane WebSocket connections negotiate
+	WebSocketSubprotocol = "shipit-data-plane"
+)
+
+// Transport opens the connections data plane frames travel over. The frames
+// are the same on every transport, a connection is a plain byte stream the
+// protocol Reader and Writer work on.
+type Transport interface {
+	// Name returns the name of the transport as used in server.transport
+	Name() string
+	// Dial opens a connection for an endpoint through dialer
+	Dial(ctx context.Context, dialer Dialer, endpoint Endpoint) (*TransportConn, error)
+}
+
+// TransportConn is a connection opened by a transport
+type TransportConn struct {
+	net.Conn
+	// Transport is the name of the transport that opened the connection
+	Transport string
+	// Addr is the address the connection goes to
+	Addr     string
+	TLSState tls.ConnectionState
+	// Streams hands out the streams native to the transport, nil when tunnel
+	// streams are multiplexed over the connection by a protocol Session
+	Streams StreamAcceptor
+}
+
+// StreamAcceptor hands out the tunnel streams the server opens on a connection
+type StreamAcceptor interface {
+	// AcceptStream waits for the next stream, failing once the connection closed
+	AcceptStream() (protocol.TunnelStream, error)
+	// NumStreams returns the number of streams not closed yet
+	NumStreams() int
+	// Drain refuses streams opened from then on
+	Drain()
+	// Close fails waiting and future AcceptStream calls
+	Close()
+}
+
+// Migrator is implemented by connections that can move to a new local
+// address without being reestablished
+type Migrator interface {
+	Migrate(ctx context.Context) error
+}
+
+// ErrMigrationUnsupported is returned when migrating a connection whose transport cannot migrate
+var ErrMigrationUnsupported = errors.New("transport does not support connection migration")
+
+// Migrate moves the connection to a new local address
+func (c *TransportConn) Migrate(ctx context.Context) error {
+	migrator, ok := c.Conn.(Migrator)
+	if !ok {
+		return ErrMigrationUnsupported
+	}
+	return migrator.Migrate(ctx)
+}
+
+// NewTransport creates the transport for server.transport
+func NewTransport(cfg *config.Config, tlsConfig *tls.Config, logger *logrus.Logger) Transport {
+	switch cfg.Server.Transport {
+	case config.TransportTLS:
+		return &tlsTransport{tlsConfig: tlsConfig}
+	case config.TransportWebSocket:
+		return newWebSocketTransport(cfg, tlsConfig)
+	case config.TransportQUIC:
+		return newQUICTransport(tlsConfig)
+	}
+
+	return &autoTransport{
+		direct:   &tlsTransport{tlsConfig: tlsConfig},
+		fallback: newWebSocketTransport(cfg, tlsConfig),
+		logger:   logger,
+	}
+}
+
+// tlsTransport connects to the data plane port of an endpoint over TLS
+type tlsTransport struct {
+	tlsConfig *tls.Config
+}
+
+// Name returns the name of the transport
+func (t *tlsTransport) Name() string {
+	return config.TransportTLS
+}
+
+// Dial opens a TLS connection to the endpoint
+func (t *tlsTransport) Dial(ctx context.Context, dialer Dialer, endpoint Endpoint) (*TransportConn, error) {
+	// Establish TCP connection, through the proxy if there is one
+	conn, err := dialer.DialContext(ctx, "tcp", endpoint.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish TCP connection: %w", err)
+	}
+
+	// Perform TLS handshake
+	tlsConfig := t.tlsConfig.Clone()
+	tlsConfig.ServerName = endpoint.ServerName
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	return &TransportConn{
+		Conn:      tlsConn,
+		Transport: t.Name(),
+		Addr:      endpoint.Addr,
+		TLSState:  tlsConn.ConnectionState(),
+	}, nil
+}
+
+// webSocketTransport carries the frames as binary WebSocket messages to the
+// control plane host, for networks that only let HTTPS through
+type webSocketTransport struct {
+	url       string
+	host      string
+	tlsConfig *tls.Config
+	header    http.Header
+	timeout   time.Duration
+}
+
+// newWebSocketTransport creates a WebSocket transport to the control plane host.
+// The upgrade carries the API key, so like the control plane the host is always
+// verified, tls_verify only relaxes connections to the data plane port.
+func newWebSocketTransport(cfg *config.Config, tlsConfig *tls.Config) *webSocketTransport {
+	host := net.JoinHostPort(cfg.Server.Domain, strconv.Itoa(cfg.Server.APIPort))
+
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.InsecureSkipVerify = false
+	tlsConfig.ServerName = cfg.Server.Domain
+
+	timeout := cfg.Connection.ConnectionTimeout
+	if timeout <= 0 {
+		timeout = DefaultDialTimeout
+	}
+
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", cfg.Auth.APIKey))
+
+	return &webSocketTransport{
+		url:       fmt.Sprintf("wss://%s%s", host, WebSocketPath),
+		host:      host,
+		tlsConfig: tlsConfig,
+		header:    header,
+		timeout:   timeout,
+	}
+}
+
+// Name returns the name of the transport
+func (t *webSocketTransport) Name() string {
+	return config.TransportWebSocket
+}
+
+// Dial opens a WebSocket connection to the control plane host, the endpoint is not used
+func (t *webSocketTransport) Dial(ctx context.Context, dialer Dialer, endpoint Endpoint) (*TransportConn, error) {
+	httpClient := &http.Client{
+		// Bounds the upgrade only, not the connection
+		Timeout: t.timeout,
+		Transport: &http.Transport{
+			DialContext:     dialer.DialContext,
+			TLSClientConfig: t.tlsConfig,
+		},
+	}
+
+	ws, response, err := websocket.Dial(ctx, t.url, &websocket.DialOptions{
+		HTTPClient:   httpClient,
+		HTTPHeader:   t.header,
+		Subprotocols: []string{WebSocketSubprotocol},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket handshake failed: %w", err)
+	}
+
+	conn := &TransportConn{
+		Conn:      newWebSocketConn(websocket.NetConn(ctx, ws, websocket.MessageBinary)),
+		Transport: t.Name(),
+		Addr:      t.host,
+	}
+	if response.TLS != nil {
+		conn.TLSState = *response.TLS
+	}
+	return conn, nil
+}
+
+// webSocketReadSize is the most a background read of a WebSocket connection takes at once
+const webSocketReadSize = 32 * 1024
+
+// webSocketConn keeps a WebSocket connection usable after a read deadline
+// passed, like a TLS connection. The WebSocket library closes a connection
+// whose read is cut short, so reads run in the background and a deadline only
+// ends the wait for them.
+type webSocketConn struct {
+	net.Conn
+	results   chan webSocketRead
+	done      chan struct{}
+	closeOnce sync.Once
+	readMu    sync.Mutex
+	pending   []byte
+	err       error
+	mu        sync.Mutex
+	deadline  time.Time
+	changed   chan struct{}
+}
+
+// webSocketRead is the outcome of one background read
+type webSocketRead struct {
+	data []byte
+	err  error
+}
+
+// newWebSocketConn wraps a WebSocket connection and starts reading it
+func newWebSocketConn(conn net.Conn) *webSocketConn {
+	c := &webSocketConn{
+		Conn:    conn,
+		results: make(chan webSocketRead),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop reads the connection until it fails and hands every read to Read
+func (c *webSocketConn) readLoop() {
+	for {
+		buf := make([]byte, webSocketReadSize)
+		n, err := c.Conn.Read(buf)
+		select {
+		case c.results <- webSocketRead{data: buf[:n], err: err}:
+		case <-c.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read returns data read in the background, waiting for it until the read deadline
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		c.mu.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+
+		select {
+		case result := <-c.results:
+			c.pending, c.err = result.data, result.err
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-changed:
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets when waiting in Read gives up, a Read already waiting picks it up
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// Close closes the connection and stops the background reads
+func (c *webSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+// autoTransport dials directly and falls back to WebSocket when that fails.
+// Whichever worked last is tried first, so a network that blocks the data
+// plane port does not cost a failed dial on every reconnect.
+type autoTransport struct {
+	direct         Transport
+	fallback       Transport
+	preferFallback bool
+	logger         *logrus.Logger
+	mu             sync.Mutex
+}
+
+// Name returns the name of the transport
+func (t *autoTransport) Name() string {
+	return config.TransportAuto
+}
+
+// Dial opens a connection with the preferred transport, then with the other one
+func (t *autoTransport) Dial(ctx context.Context, dialer Dialer, endpoint Endpoint) (*TransportConn, error) {
+	t.mu.Lock()
+	first, second := t.direct, t.fallback
+	if t.preferFallback {
+		first, second = second, first
+	}
+	t.mu.Unlock()
+
+	conn, err := first.Dial(ctx, dialer, endpoint)
+	if err == nil {
+		return conn, nil
+	}
+
+	conn, secondErr := second.Dial(ctx, dialer, endpoint)
+	if secondErr != nil {
+		return nil, fmt.Errorf("%w (%s transport: %v)", err, second.Name(), secondErr)
+	}
+
+	t.mu.Lock()
+	t.preferFallback = second == t.fallback
+	t.mu.Unlock()
+
+	t.logger.WithFields(logrus.Fields{
+		"transport": second.Name(),
+		"failed":    first.Name(),
+		"error":     err,
+	}).Warn("Data plane transport failed, switched to the other one")
+
+	return conn, nil
+}
@@ -2,11 +2,13 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/unownone/shipitd/internal/config"
+	"github.com/unownone/shipitd/internal/protocol"
 	"github.com/unownone/shipitd/pkg/types"
 	"github.com/sirupsen/logrus"
 )
@@ -20,47 +22,88 @@ const (
 	TunnelStateConnecting   TunnelState = "connecting"
 	TunnelStateRegistering  TunnelState = "registering"
 	TunnelStateActive       TunnelState = "active"
+	TunnelStateReconnecting TunnelState = "reconnecting"
 	TunnelStateError        TunnelState = "error"
 	TunnelStateDisconnected TunnelState = "disconnected"
 )
 
 // TunnelInfo represents detailed tunnel information
 type TunnelInfo struct {
-	Tunnel     *Tunnel
-	State      TunnelState
-	Error      error
-	CreatedAt  time.Time
-	UpdatedAt  time.Time
-	mu         sync.RWMutex
+	Tunnel *Tunnel
+	State  TunnelState
+	Error  error
+	// ReconnectAttempts is the attempt in progress while the tunnel is reconnecting
+	ReconnectAttempts int
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+	connection        *Connection
+	tunnelConfig      *config.TunnelConfig
+	session           *TunnelSession
+	mu                sync.RWMutex
 }
 
 // TunnelManager orchestrates tunnel lifecycle and coordinates between control and data planes
 type TunnelManager struct {
-	controlPlane *ControlPlaneClient
-	dataPlane    *DataPlaneClient
+	controlPlane   *ControlPlaneClient
 	connectionPool *ConnectionPool
-	config       *config.Config
-	logger       *logrus.Logger
-	tunnels      map[string]*TunnelInfo
-	mu           sync.RWMutex
-	ctx          context.Context
-	cancel       context.CancelFunc
+	forwarder      DataForwarder
+	sessions       *SessionStore
+	config         *config.Config
+	logger         *logrus.Logger
+	tunnels        map[string]*TunnelInfo
+	mu             sync.RWMutex
+	connMu         sync.Mutex
+	assignMu       sync.Mutex
+	ctx            context.Context
+	cancel         context.CancelFunc
 }
 
 // NewTunnelManager creates a new tunnel manager
 func NewTunnelManager(cfg *config.Config, logger *logrus.Logger) *TunnelManager {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &TunnelManager{
+	tm := &TunnelManager{
 		controlPlane:   NewControlPlaneClient(cfg, logger),
-		dataPlane:      NewDataPlaneClient(cfg, logger),
 		connectionPool: NewConnectionPool(cfg, logger),
+		sessions:       NewSessionStore(cfg.Connection.SessionFile, logger),
 		config:         cfg,
 		logger:         logger,
 		tunnels:        make(map[string]*TunnelInfo),
 		ctx:            ctx,
 		cancel:         cancel,
 	}
+	// Connections authenticate with short-lived tokens of the control plane
+	tm.connectionPool.SetCredentialSource(tm.controlPlane)
+	tm.connectionPool.SetConnectHandler(tm.serveConnection)
+	tm.connectionPool.SetRetryHandler(tm.handleReconnecting)
+	tm.connectionPool.SetReplaceHandler(tm.handleReplaced)
+
+	return tm
+}
+
+// SetForwarder sets the forwarder that carries data plane traffic to local services
+func (tm *TunnelManager) SetForwarder(forwarder DataForwarder) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.forwarder = forwarder
+}
+
+// GetConnectionPool returns the pool of data plane connections, it sends
+// replies for a tunnel on the connection the tunnel is registered on
+func (tm *TunnelManager) GetConnectionPool() *ConnectionPool {
+	return tm.connectionPool
+}
+
+// GetControlPlane returns the control plane client used by the tunnel manager
+func (tm *TunnelManager) GetControlPlane() *ControlPlaneClient {
+	return tm.controlPlane
+}
+
+// getForwarder returns the configured forwarder, if any
+func (tm *TunnelManager) getForwarder() DataForwarder {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.forwarder
 }
 
 // StartTunnel starts a tunnel with the given configuration
@@ -74,9 +117,10 @@ func (tm *TunnelManager) StartTunnel(tunnelConfig *config.TunnelConfig) error {
 
 	// Create tunnel info
 	tunnelInfo := &TunnelInfo{
-		State:     TunnelStateInitializing,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		State:        TunnelStateInitializing,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+		tunnelConfig: tunnelConfig,
 	}
 
 	// Start tunnel in background
@@ -94,13 +138,26 @@ func (tm *TunnelManager) runTunnel(tunnelConfig *config.TunnelConfig, tunnelInfo
 		}
 	}()
 
-	// Step 1: Create tunnel via control plane
+	// Step 1: Resume the tunnel of an earlier run, or create it via control plane
 	tm.updateTunnelState(tunnelInfo, TunnelStateCreating, nil)
-	
-	tunnel, err := tm.createTunnel(tunnelConfig)
-	if err != nil {
-		tm.updateTunnelState(tunnelInfo, TunnelStateError, err)
-		return
+
+	tunnel, session := tm.resumeTunnel(tunnelConfig)
+	if tunnel == nil {
+		created, err := tm.createTunnel(tunnelConfig)
+		if err != nil {
+			tm.updateTunnelState(tunnelInfo, TunnelStateError, err)
+			return
+		}
+		tunnel = created
+	}
+	tunnelInfo.session = session
+
+	// Fall back to the local configuration when the server does not echo it
+	if tunnel.LocalPort == 0 {
+		tunnel.LocalPort = tunnelConfig.LocalPort
+	}
+	if tunnel.Protocol == "" {
+		tunnel.Protocol = tunnelConfig.Protocol
 	}
 
 	tunnelInfo.Tunnel = tunnel
@@ -109,26 +166,137 @@ func (tm *TunnelManager) runTunnel(tunnelConfig *config.TunnelConfig, tunnelInfo
 	// Step 2: Connect to data plane
 	tm.updateTunnelState(tunnelInfo, TunnelStateConnecting, nil)
 	
-	if err := tm.dataPlane.Connect(); err != nil {
+	if err := tm.ensureConnected(); err != nil {
 		tm.updateTunnelState(tunnelInfo, TunnelStateError, err)
 		return
 	}
 
-	// Step 3: Register tunnel with data plane
+	// Step 3: Register tunnel on the least loaded connection
 	tm.updateTunnelState(tunnelInfo, TunnelStateRegistering, nil)
-	
-	if err := tm.dataPlane.RegisterTunnel(tunnel); err != nil {
+
+	if err := tm.assignTunnel(tunnelInfo); err != nil {
 		tm.updateTunnelState(tunnelInfo, TunnelStateError, err)
 		return
 	}
 
-	// Step 4: Start heartbeat
-	tm.dataPlane.StartHeartbeat(tunnel.ID, tm.config.Connection.HeartbeatInterval)
+	// Step 4: Attach the local service
+	if forwarder := tm.getForwarder(); forwarder != nil {
+		if err := forwarder.AddTunnel(tunnel); err != nil {
+			tm.updateTunnelState(tunnelInfo, TunnelStateError, err)
+			return
+		}
+	} else {
+		tm.logger.WithField("tunnel_id", tunnel.ID).Warn("No forwarder configured, traffic will not reach the local service")
+	}
 
-	// Step 5: Mark as active and start message processing
+	// Step 5: Start heartbeat
+	tm.startHeartbeat(tunnel.ID)
+
+	// Step 6: Mark as active, messages arrive through the router
 	tm.updateTunnelState(tunnelInfo, TunnelStateActive, nil)
-	
-	tm.processMessages(tunnel.ID)
+}
+
+// assignTunnel registers a tunnel on the healthy connection with the least
+// load in flight, routing its messages here first, and moves it off the
+// connection it was on before, if any
+func (tm *TunnelManager) assignTunnel(tunnelInfo *TunnelInfo) error {
+	tm.assignMu.Lock()
+	defer tm.assignMu.Unlock()
+
+	conn, err := tm.connectionPool.GetConnection()
+	if err != nil {
+		return err
+	}
+
+	tunnel := tunnelInfo.registration()
+	tunnelID := tunnel.ID
+	conn.Router.Register(tunnelID, func(message *types.Message) {
+		tm.handleMessage(tunnelID, message)
+	})
+
+	if err := conn.Client.RegisterTunnel(tunnel); err != nil {
+		conn.Router.Unregister(tunnelID)
+		return err
+	}
+	tm.connectionPool.Assign(tunnelID, conn)
+
+	tunnelInfo.mu.Lock()
+	previous := tunnelInfo.connection
+	tunnelInfo.connection = conn
+	tunnelInfo.mu.Unlock()
+
+	if previous != nil && previous != conn {
+		previous.Router.Unregister(tunnelID)
+		previous.Client.ForgetTunnel(tunnelID)
+	}
+
+	tm.logger.WithFields(logrus.Fields{
+		"tunnel_id":     tunnelID,
+		"connection_id": conn.ID,
+	}).Debug("Assigned tunnel to connection")
+
+	return nil
+}
+
+// registration returns the tunnel to register on the data plane, carrying the
+// resumption token and the public address of its session if it has one
+func (tunnelInfo *TunnelInfo) registration() *Tunnel {
+	tunnelInfo.mu.RLock()
+	defer tunnelInfo.mu.RUnlock()
+
+	tunnel := *tunnelInfo.Tunnel
+	if session := tunnelInfo.session; session != nil {
+		tunnel.ResumeToken = session.ResumeToken
+		tunnel.PublicURL = session.PublicURL
+		tunnel.Subdomain = session.Subdomain
+		tunnel.PublicPort = session.PublicPort
+	}
+	return &tunnel
+}
+
+// startHeartbeat reports the traffic counters of a tunnel on its connection
+// every heartbeat interval until the tunnel stops
+func (tm *TunnelManager) startHeartbeat(tunnelID string) {
+	interval := tm.config.Connection.HeartbeatInterval
+	if interval <= 0 {
+		interval = protocol.DefaultHeartbeatInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-tm.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if tm.getTunnel(tunnelID) == nil {
+				return
+			}
+			if err := tm.connectionPool.SendHeartbeat(tunnelID, tm.getTunnelCounters(tunnelID)); err != nil {
+				tm.logger.WithError(err).WithField("tunnel_id", tunnelID).Warn("Failed to send heartbeat")
+			}
+		}
+	}()
+}
+
+// getTunnelCounters returns the traffic counters the forwarder keeps for a tunnel
+func (tm *TunnelManager) getTunnelCounters(tunnelID string) TunnelCountersSnapshot {
+	return tunnelCounters(tm.getForwarder(), tunnelID)
+}
+
+// tunnelCounters returns the traffic counters a forwarder keeps for a tunnel
+func tunnelCounters(forwarder DataForwarder, tunnelID string) TunnelCountersSnapshot {
+	if forwarder == nil {
+		return TunnelCountersSnapshot{}
+	}
+	if counters := forwarder.GetTunnelCounters(tunnelID); counters != nil {
+		return counters.Snapshot()
+	}
+	return TunnelCountersSnapshot{}
 }
 
 // createTunnel creates a tunnel via the control plane
@@ -145,27 +313,104 @@ func (tm *TunnelManager) createTunnel(tunnelConfig *config.TunnelConfig) (*Tunne
 	return tm.controlPlane.CreateTunnel(ctx, req)
 }
 
-// processMessages processes incoming messages for a tunnel
-func (tm *TunnelManager) processMessages(tunnelID string) {
-	messageChan := make(chan *types.Message, 100)
-	errorChan := make(chan error, 10)
+// resumeTunnel returns the tunnel an earlier run left for tunnelConfig
+// together with its session, or nil when it has to be created afresh. The
+// server reclaims the tunnel ID, subdomain and public port once the tunnel is
+// registered with the session's token.
+func (tm *TunnelManager) resumeTunnel(tunnelConfig *config.TunnelConfig) (*Tunnel, *TunnelSession) {
+	session := tm.sessions.Get(tunnelConfig.Name)
+	if session == nil {
+		return nil, nil
+	}
+	// A tunnel that changed protocol cannot keep its public address
+	if session.Protocol != tunnelConfig.Protocol || types.ValidateTunnelID(session.TunnelID) != nil {
+		if err := tm.sessions.Delete(tunnelConfig.Name); err != nil {
+			tm.logger.WithError(err).Warn("Failed to forget tunnel session")
+		}
+		return nil, nil
+	}
+
+	tm.logger.WithFields(logrus.Fields{
+		"name":       tunnelConfig.Name,
+		"tunnel_id":  session.TunnelID,
+		"public_url": session.PublicURL,
+	}).Info("Resuming tunnel")
+
+	return &Tunnel{
+		ID:         types.NormalizeTunnelID(session.TunnelID),
+		Protocol:   tunnelConfig.Protocol,
+		PublicURL:  session.PublicURL,
+		Subdomain:  session.Subdomain,
+		LocalPort:  tunnelConfig.LocalPort,
+		PublicPort: session.PublicPort,
+	}, session
+}
 
-	// Start reading messages asynchronously
-	go tm.dataPlane.ReadMessageAsync(messageChan, errorChan)
+// ensureConnected fills the connection pool unless it already has a healthy
+// connection. All tunnels share the pool, so only the first caller actually dials.
+func (tm *TunnelManager) ensureConnected() error {
+	tm.connMu.Lock()
+	defer tm.connMu.Unlock()
+
+	if tm.connectionPool.GetHealthyConnectionCount() > 0 {
+		return nil
+	}
+
+	return tm.connectionPool.Initialize()
+}
+
+// serveConnection starts the goroutines serving a new pooled connection
+func (tm *TunnelManager) serveConnection(conn *Connection) {
+	conn.Client.SetHandoffHandler(func() {
+		tm.handleHandoff(conn)
+	})
+
+	go tm.processMessages(conn)
+
+	if streams := conn.Client.GetStreams(); streams != nil {
+		go tm.acceptStreams(streams)
+	}
+}
+
+// handleHandoff serves the replacement connection a pooled connection moved to after a GOAWAY.
+// The read loop carries on by itself, only the new streams need accepting.
+func (tm *TunnelManager) handleHandoff(conn *Connection) {
+	tm.logger.WithField("connection_id", conn.ID).Info("Data plane connection handed off")
+
+	if streams := conn.Client.GetStreams(); streams != nil {
+		go tm.acceptStreams(streams)
+	}
+}
 
+// acceptStreams hands every stream the server opens to the forwarder until the connection closes
+func (tm *TunnelManager) acceptStreams(streams StreamAcceptor) {
 	for {
-		select {
-		case <-tm.ctx.Done():
-			tm.logger.Info("Message processing stopped due to context cancellation")
-			return
-		case message := <-messageChan:
-			tm.handleMessage(tunnelID, message)
-		case err := <-errorChan:
-			tm.logger.WithError(err).Error("Error reading message")
-			tm.handleConnectionError(tunnelID, err)
+		stream, err := streams.AcceptStream()
+		if err != nil {
+			tm.logger.WithError(err).Debug("Stopped accepting streams")
 			return
 		}
+
+		forwarder := tm.getForwarder()
+		if forwarder == nil || tm.getTunnel(stream.TunnelID()) == nil {
+			tm.logger.WithField("tunnel_id", stream.TunnelID()).Warn("Stream for unknown tunnel")
+			stream.Reset(types.ErrorCodeUnknownTunnel)
+			continue
+		}
+
+		go forwarder.HandleStream(stream)
+	}
+}
+
+// processMessages runs the read loop of a pooled connection
+func (tm *TunnelManager) processMessages(conn *Connection) {
+	if err := conn.Router.Run(tm.ctx); err != nil {
+		tm.logger.WithError(err).WithField("connection_id", conn.ID).Error("Error reading message")
+		tm.handleConnectionError(conn, err)
+		return
 	}
+
+	tm.logger.Info("Message processing stopped due to context cancellation")
 }
 
 // handleMessage handles an incoming message
@@ -177,24 +422,103 @@ func (tm *TunnelManager) handleMessage(tunnelID string, message *types.Message)
 	}).Debug("Handling message")
 
 	switch message.Type {
+	case types.MessageTypeTunnelRegistered:
+		tm.handleRegistered(tunnelID, message)
 	case types.MessageTypeDataForward:
 		tm.handleDataForward(tunnelID, message)
+	case types.MessageTypeDataChunk:
+		tm.handleDataChunk(tunnelID, message)
 	case types.MessageTypeAcknowledge:
 		tm.handleAcknowledge(tunnelID, message)
 	case types.MessageTypeError:
 		tm.handleError(tunnelID, message)
 	case types.MessageTypeHeartbeat:
 		tm.handleHeartbeat(tunnelID, message)
+	case types.MessageTypeConnectionClose:
+		tm.handleConnectionClose(tunnelID, message)
 	default:
 		tm.logger.WithField("message_type", message.Type).Warn("Unknown message type")
 	}
 }
 
+// handleRegistered keeps the resumption token the server issued for a tunnel,
+// persisted so a restart of the daemon reclaims the same public address
+func (tm *TunnelManager) handleRegistered(tunnelID string, message *types.Message) {
+	payload, err := message.ParsePayload()
+	if err != nil {
+		tm.logger.WithError(err).Error("Failed to parse tunnel registered payload")
+		return
+	}
+
+	registered, ok := payload.(*types.TunnelRegisteredPayload)
+	if !ok {
+		tm.logger.Error("Invalid tunnel registered payload type")
+		return
+	}
+
+	tunnelInfo := tm.getTunnel(tunnelID)
+	if tunnelInfo == nil {
+		return
+	}
+
+	session := &TunnelSession{
+		TunnelID:    tunnelID,
+		Protocol:    tunnelInfo.Tunnel.Protocol,
+		PublicURL:   registered.PublicURL,
+		Subdomain:   registered.Subdomain,
+		PublicPort:  registered.PublicPort,
+		ResumeToken: registered.ResumeToken,
+	}
+	tunnelInfo.mu.Lock()
+	tunnelInfo.session = session
+	tunnelInfo.mu.Unlock()
+
+	tm.logger.WithFields(logrus.Fields{
+		"tunnel_id":  tunnelID,
+		"public_url": registered.PublicURL,
+		"resumed":    registered.Resumed,
+	}).Info("Tunnel registered")
+
+	if registered.ResumeToken == "" || tunnelInfo.tunnelConfig == nil {
+		return
+	}
+	if err := tm.sessions.Save(tunnelInfo.tunnelConfig.Name, session); err != nil {
+		tm.logger.WithError(err).WithField("tunnel_id", tunnelID).Warn("Failed to save tunnel session")
+	}
+}
+
+// handleResumeRejected creates a tunnel afresh once the server refused its
+// resumption token, for example because the token expired. The tunnel comes
+// back with a new tunnel ID and may get a different public address.
+func (tm *TunnelManager) handleResumeRejected(tunnelID string) {
+	tunnelInfo := tm.getTunnel(tunnelID)
+	if tunnelInfo == nil || tunnelInfo.tunnelConfig == nil {
+		return
+	}
+
+	tm.logger.WithFields(logrus.Fields{
+		"tunnel_id": tunnelID,
+		"name":      tunnelInfo.tunnelConfig.Name,
+	}).Warn("Server refused to resume tunnel, creating it again")
+
+	if err := tm.sessions.Delete(tunnelInfo.tunnelConfig.Name); err != nil {
+		tm.logger.WithError(err).Warn("Failed to forget tunnel session")
+	}
+	tm.releaseTunnel(tunnelID, tunnelInfo)
+
+	if err := tm.StartTunnel(tunnelInfo.tunnelConfig); err != nil {
+		tm.logger.WithError(err).WithField("tunnel_id", tunnelID).Error("Failed to restart tunnel")
+	}
+}
+
 // handleDataForward handles a data forward message
 func (tm *TunnelManager) handleDataForward(tunnelID string, message *types.Message) {
 	payload, err := message.ParsePayload()
 	if err != nil {
 		tm.logger.WithError(err).Error("Failed to parse data forward payload")
+		if sendErr := tm.connectionPool.SendError(tunnelID, types.ErrorCodeInvalidPayload, "Failed to parse data forward payload", err.Error()); sendErr != nil {
+			tm.logger.WithError(sendErr).Error("Failed to send error message")
+		}
 		return
 	}
 
@@ -212,8 +536,62 @@ func (tm *TunnelManager) handleDataForward(tunnelID string, message *types.Messa
 		"path":          dataForward.Path,
 	}).Debug("Handling data forward")
 
-	// TODO: Forward to local service and send response back
-	// This will be implemented when we add the proxy components
+	forwarder := tm.getForwarder()
+	if forwarder == nil {
+		if err := tm.connectionPool.SendError(tunnelID, types.ErrorCodeUnknownTunnel, "No forwarder configured for tunnel", dataForward.RequestID); err != nil {
+			tm.logger.WithError(err).Error("Failed to send error message")
+		}
+		return
+	}
+
+	forwarder.HandleDataForward(tunnelID, dataForward)
+}
+
+// handleDataChunk handles a chunk of a streamed request body
+func (tm *TunnelManager) handleDataChunk(tunnelID string, message *types.Message) {
+	payload, err := message.ParsePayload()
+	if err != nil {
+		tm.logger.WithError(err).Error("Failed to parse data chunk payload")
+		if sendErr := tm.connectionPool.SendError(tunnelID, types.ErrorCodeInvalidPayload, "Failed to parse data chunk payload", err.Error()); sendErr != nil {
+			tm.logger.WithError(sendErr).Error("Failed to send error message")
+		}
+		return
+	}
+
+	chunk, ok := payload.(*types.DataChunkPayload)
+	if !ok {
+		tm.logger.Error("Invalid data chunk payload type")
+		return
+	}
+
+	if forwarder := tm.getForwarder(); forwarder != nil {
+		forwarder.HandleDataChunk(tunnelID, chunk)
+	}
+}
+
+// handleConnectionClose handles a connection close message from the server
+func (tm *TunnelManager) handleConnectionClose(tunnelID string, message *types.Message) {
+	payload, err := message.ParsePayload()
+	if err != nil {
+		tm.logger.WithError(err).Error("Failed to parse connection close payload")
+		return
+	}
+
+	closePayload, ok := payload.(*types.ConnectionClosePayload)
+	if !ok {
+		tm.logger.Error("Invalid connection close payload type")
+		return
+	}
+
+	tm.logger.WithFields(logrus.Fields{
+		"tunnel_id":     tunnelID,
+		"connection_id": closePayload.ConnectionID,
+		"reason":        closePayload.Reason,
+	}).Debug("Received connection close")
+
+	if forwarder := tm.getForwarder(); forwarder != nil {
+		forwarder.HandleConnectionClose(tunnelID, closePayload)
+	}
 }
 
 // handleAcknowledge handles an acknowledgment message
@@ -257,6 +635,10 @@ func (tm *TunnelManager) handleError(tunnelID string, message *types.Message) {
 		"message":   errPayload.Message,
 		"details":   errPayload.Details,
 	}).Error("Received error from server")
+
+	if errPayload.Code == types.ErrorCodeInvalidResumeToken {
+		tm.handleResumeRejected(tunnelID)
+	}
 }
 
 // handleHeartbeat handles a heartbeat message
@@ -278,56 +660,101 @@ func (tm *TunnelManager) handleHeartbeat(tunnelID string, message *types.Message
 		"timestamp":     heartbeat.Timestamp,
 		"active_conns":  heartbeat.ActiveConns,
 		"total_requests": heartbeat.TotalRequests,
+		"nonce":         heartbeat.Nonce,
+		"echo":          heartbeat.Echo,
 	}).Debug("Received heartbeat")
 }
 
-// handleConnectionError handles connection errors
-func (tm *TunnelManager) handleConnectionError(tunnelID string, err error) {
-	tm.logger.WithFields(logrus.Fields{
-		"tunnel_id": tunnelID,
-		"error":     err,
-	}).Error("Connection error occurred")
+// handleConnectionError moves the tunnels of a failed connection to the other
+// healthy connections while the pool replaces it in the background
+func (tm *TunnelManager) handleConnectionError(conn *Connection, err error) {
+	tm.logger.WithError(err).WithField("connection_id", conn.ID).Error("Connection error occurred")
 
-	// Mark tunnel as disconnected
-	tm.updateTunnelStateByID(tunnelID, TunnelStateDisconnected, err)
+	tm.connectionPool.MarkConnectionUnhealthy(conn.ID)
 
-	// Attempt reconnection
-	go tm.reconnectTunnel(tunnelID)
+	for _, tunnelInfo := range tm.tunnelsOn(conn) {
+		if moveErr := tm.assignTunnel(tunnelInfo); moveErr != nil {
+			// No other connection is left, the tunnel waits for the replacement
+			tm.updateReconnectState(tunnelInfo, TunnelStateReconnecting, conn.backoff.Attempts(), err)
+			continue
+		}
+		tm.updateReconnectState(tunnelInfo, TunnelStateActive, 0, nil)
+	}
 }
 
-// reconnectTunnel attempts to reconnect a tunnel
-func (tm *TunnelManager) reconnectTunnel(tunnelID string) {
-	tm.logger.WithField("tunnel_id", tunnelID).Info("Attempting to reconnect tunnel")
+// handleReconnecting shows the attempts to replace a failed connection on the
+// tunnels waiting for it. Once the attempts ran out the tunnels move to
+// another connection if one is left, and fail otherwise. Refused credentials
+// fail the tunnels right away, every new connection would be refused too.
+func (tm *TunnelManager) handleReconnecting(old *Connection, attempt int, err error) {
+	authFailed := errors.Is(err, protocol.ErrAuthFailed)
+	if authFailed {
+		tm.logger.WithError(err).Error("Data plane refused the credentials, check the API key")
+	}
 
-	// Get tunnel info
-	tunnelInfo := tm.getTunnel(tunnelID)
-	if tunnelInfo == nil {
-		tm.logger.WithField("tunnel_id", tunnelID).Error("Tunnel not found for reconnection")
-		return
+	for _, tunnelInfo := range tm.tunnelsOn(old) {
+		if attempt > 0 {
+			tm.updateReconnectState(tunnelInfo, TunnelStateReconnecting, attempt, err)
+			continue
+		}
+		if authFailed {
+			tm.updateReconnectState(tunnelInfo, TunnelStateError, 0, err)
+			continue
+		}
+
+		if moveErr := tm.assignTunnel(tunnelInfo); moveErr != nil {
+			tm.updateReconnectState(tunnelInfo, TunnelStateError, 0, err)
+			continue
+		}
+		tm.updateReconnectState(tunnelInfo, TunnelStateActive, 0, nil)
 	}
+}
 
-	// Disconnect current connection
-	tm.dataPlane.Disconnect()
+// handleReplaced registers every tunnel left without a healthy connection on
+// the pool again once a failed connection was replaced
+func (tm *TunnelManager) handleReplaced(old, replacement *Connection) {
+	for _, tunnelInfo := range tm.ListTunnels() {
+		tunnelInfo.mu.RLock()
+		conn := tunnelInfo.connection
+		tunnelInfo.mu.RUnlock()
+		if conn == nil || conn.healthy() {
+			continue
+		}
 
-	// Wait before reconnecting
-	time.Sleep(tm.config.Connection.ReconnectInterval)
+		if err := tm.assignTunnel(tunnelInfo); err != nil {
+			tm.logger.WithError(err).WithField("tunnel_id", tunnelInfo.Tunnel.ID).Error("Failed to re-register tunnel")
+			tm.updateReconnectState(tunnelInfo, TunnelStateError, 0, err)
+			continue
+		}
 
-	// Attempt to reconnect
-	if err := tm.dataPlane.Connect(); err != nil {
-		tm.logger.WithError(err).Error("Failed to reconnect")
-		tm.updateTunnelState(tunnelInfo, TunnelStateError, err)
-		return
+		tm.updateReconnectState(tunnelInfo, TunnelStateActive, 0, nil)
+		tm.logger.WithFields(logrus.Fields{
+			"tunnel_id":     tunnelInfo.Tunnel.ID,
+			"connection_id": replacement.ID,
+		}).Info("Tunnel reconnected successfully")
 	}
+}
 
-	// Re-register tunnel
-	if err := tm.dataPlane.RegisterTunnel(tunnelInfo.Tunnel); err != nil {
-		tm.logger.WithError(err).Error("Failed to re-register tunnel")
-		tm.updateTunnelState(tunnelInfo, TunnelStateError, err)
-		return
+// tunnelsOn returns the tunnels assigned to a connection
+func (tm *TunnelManager) tunnelsOn(conn *Connection) []*TunnelInfo {
+	var tunnels []*TunnelInfo
+	for _, tunnelInfo := range tm.ListTunnels() {
+		tunnelInfo.mu.RLock()
+		if tunnelInfo.connection == conn {
+			tunnels = append(tunnels, tunnelInfo)
+		}
+		tunnelInfo.mu.RUnlock()
 	}
+	return tunnels
+}
 
-	tm.updateTunnelState(tunnelInfo, TunnelStateActive, nil)
-	tm.logger.WithField("tunnel_id", tunnelID).Info("Tunnel reconnected successfully")
+// updateReconnectState updates the state of a tunnel together with its reconnect attempt
+func (tm *TunnelManager) updateReconnectState(tunnelInfo *TunnelInfo, state TunnelState, attempt int, err error) {
+	tunnelInfo.mu.Lock()
+	tunnelInfo.ReconnectAttempts = attempt
+	tunnelInfo.mu.Unlock()
+
+	tm.updateTunnelState(tunnelInfo, state, err)
 }
 
 // updateTunnelState updates the state of a tunnel
@@ -339,8 +766,14 @@ func (tm *TunnelManager) updateTunnelState(tunnelInfo *TunnelInfo, state TunnelS
 	tunnelInfo.Error = err
 	tunnelInfo.UpdatedAt = time.Now()
 
+	// The tunnel is only known once the control plane has created it
+	tunnelID := ""
+	if tunnelInfo.Tunnel != nil {
+		tunnelID = tunnelInfo.Tunnel.ID
+	}
+
 	tm.logger.WithFields(logrus.Fields{
-		"tunnel_id": tunnelInfo.Tunnel.ID,
+		"tunnel_id": tunnelID,
 		"state":     state,
 		"error":     err,
 	}).Info("Tunnel state updated")
@@ -398,6 +831,34 @@ func (tm *TunnelManager) StopTunnel(tunnelID string) error {
 		tm.logger.WithError(err).Error("Failed to delete tunnel via control plane")
 	}
 
+	// A deleted tunnel cannot be resumed
+	if tunnelInfo.tunnelConfig != nil {
+		if err := tm.sessions.Delete(tunnelInfo.tunnelConfig.Name); err != nil {
+			tm.logger.WithError(err).Warn("Failed to forget tunnel session")
+		}
+	}
+
+	tm.releaseTunnel(tunnelID, tunnelInfo)
+
+	return nil
+}
+
+// releaseTunnel stops serving a tunnel on this client. The server keeps the
+// tunnel unless it was deleted via control plane.
+func (tm *TunnelManager) releaseTunnel(tunnelID string, tunnelInfo *TunnelInfo) {
+	// Stop routing its messages and detach the local service
+	tunnelInfo.mu.RLock()
+	conn := tunnelInfo.connection
+	tunnelInfo.mu.RUnlock()
+	if conn != nil {
+		conn.Router.Unregister(tunnelID)
+		conn.Client.ForgetTunnel(tunnelID)
+	}
+	tm.connectionPool.Unassign(tunnelID)
+	if forwarder := tm.getForwarder(); forwarder != nil {
+		forwarder.RemoveTunnel(tunnelID)
+	}
+
 	// Update state
 	tm.updateTunnelState(tunnelInfo, TunnelStateDisconnected, nil)
 
@@ -405,46 +866,77 @@ func (tm *TunnelManager) StopTunnel(tunnelID string) error {
 	tm.mu.Lock()
 	delete(tm.tunnels, tunnelID)
 	tm.mu.Unlock()
-
-	return nil
 }
 
-// Stop stops the tunnel manager
+// Stop stops the tunnel manager. The server is told with a GOAWAY first, so
+// requests in flight get up to the drain timeout to finish.
 func (tm *TunnelManager) Stop() {
 	tm.logger.Info("Stopping tunnel manager")
+
+	if err := tm.connectionPool.GoAway("client shutting down"); err != nil {
+		tm.logger.WithError(err).Warn("Failed to drain data plane connections")
+	}
 	tm.cancel()
 
-	// Stop all tunnels
-	for tunnelID := range tm.tunnels {
+	// Stop all tunnels. Tunnels with a saved session stay on the server, so
+	// the next start resumes them under the same public address.
+	for _, tunnelInfo := range tm.ListTunnels() {
+		tunnelID := tunnelInfo.Tunnel.ID
+		if tm.resumable(tunnelInfo) {
+			tm.releaseTunnel(tunnelID, tunnelInfo)
+			continue
+		}
 		tm.StopTunnel(tunnelID)
 	}
 
-	// Stop data plane
-	tm.dataPlane.Stop()
-
 	// Close connection pool
 	tm.connectionPool.Close()
 
 	tm.logger.Info("Tunnel manager stopped")
 }
 
+// resumable returns whether a tunnel has a session that survives a restart
+func (tm *TunnelManager) resumable(tunnelInfo *TunnelInfo) bool {
+	tunnelInfo.mu.RLock()
+	defer tunnelInfo.mu.RUnlock()
+	return tunnelInfo.session != nil && tunnelInfo.session.ResumeToken != "" && tm.sessions.Persistent()
+}
+
 // GetStats returns tunnel manager statistics
 func (tm *TunnelManager) GetStats() map[string]interface{} {
+	// Read before taking the lock, getForwarder takes it too
+	forwarder := tm.getForwarder()
+
 	tm.mu.RLock()
 	defer tm.mu.RUnlock()
 
 	stats := map[string]interface{}{
-		"total_tunnels": len(tm.tunnels),
-		"tunnels":       make(map[string]interface{}),
+		"total_tunnels":   len(tm.tunnels),
+		"tunnels":         make(map[string]interface{}),
+		"connection_pool": tm.connectionPool.GetStats(),
 	}
 
 	for tunnelID, tunnelInfo := range tm.tunnels {
 		tunnelInfo.mu.RLock()
+		connectionID := ""
+		if tunnelInfo.connection != nil {
+			connectionID = tunnelInfo.connection.ID
+		}
+		publicURL := ""
+		if tunnelInfo.session != nil {
+			publicURL = tunnelInfo.session.PublicURL
+		} else if tunnelInfo.Tunnel != nil {
+			publicURL = tunnelInfo.Tunnel.PublicURL
+		}
 		stats["tunnels"].(map[string]interface{})[tunnelID] = map[string]interface{}{
-			"state":     tunnelInfo.State,
-			"error":     tunnelInfo.Error,
-			"created_at": tunnelInfo.CreatedAt,
-			"updated_at": tunnelInfo.UpdatedAt,
+			"state":              tunnelInfo.State,
+			"public_url":         publicURL,
+			"connection_id":      connectionID,
+			"error":              tunnelInfo.Error,
+			"reconnect_attempts": tunnelInfo.ReconnectAttempts,
+			"created_at":         tunnelInfo.CreatedAt,
+			"updated_at":         tunnelInfo.UpdatedAt,
+			"traffic":            tunnelCounters(forwarder, tunnelID),
 		}
 		tunnelInfo.mu.RUnlock()
 	}
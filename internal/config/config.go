@@ -1,7 +1,11 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -23,16 +27,38 @@ type Config struct {
 
 // ServerConfig represents server connection settings
 type ServerConfig struct {
-	Domain         string `mapstructure:"domain" validate:"required"`
-	APIPort        int    `mapstructure:"api_port" validate:"required,min=1,max=65535"`
-	DataPlanePort  int    `mapstructure:"data_plane_port" validate:"required,min=1,max=65535"`
-	TLSVerify      bool   `mapstructure:"tls_verify"`
+	Domain         string   `mapstructure:"domain" validate:"required"`
+	APIPort        int      `mapstructure:"api_port" validate:"required,min=1,max=65535"`
+	DataPlanePort  int      `mapstructure:"data_plane_port" validate:"required,min=1,max=65535"`
+	TLSVerify      bool     `mapstructure:"tls_verify"`
+	Endpoints      []string `mapstructure:"endpoints" validate:"dive,required"`
+	Transport      string   `mapstructure:"transport" validate:"omitempty,oneof=auto tls websocket quic"`
+	// CAFile is a PEM bundle of the CAs server certificates are verified against instead of the system roots
+	CAFile string `mapstructure:"ca_file" validate:"omitempty,file"`
+	// PinnedSPKISHA256 lists SHA-256 digests of public keys, one of them must be in the server's certificate chain
+	PinnedSPKISHA256 []string `mapstructure:"pinned_spki_sha256" validate:"dive,spki_pin"`
 }
 
+// Data plane transports for server.transport
+const (
+	// TransportAuto connects over TLS and falls back to WebSocket when that fails
+	TransportAuto = "auto"
+	// TransportTLS connects to the data plane port over TLS
+	TransportTLS = "tls"
+	// TransportWebSocket connects over a WebSocket to the control plane host
+	TransportWebSocket = "websocket"
+	// TransportQUIC connects to the data plane port over QUIC, with a native stream per tunnel stream
+	TransportQUIC = "quic"
+)
+
 // AuthConfig represents authentication settings
 type AuthConfig struct {
 	APIKey      string `mapstructure:"api_key" validate:"required"`
 	AutoRefresh bool   `mapstructure:"auto_refresh"`
+	// ClientCert and ClientKey are the certificate presented to the data plane,
+	// each a PEM file path or "keyring:<account>"
+	ClientCert string `mapstructure:"client_cert" validate:"required_with=ClientKey"`
+	ClientKey  string `mapstructure:"client_key" validate:"required_with=ClientCert"`
 }
 
 // TunnelConfig represents a tunnel configuration
@@ -48,11 +74,23 @@ type TunnelConfig struct {
 type ConnectionConfig struct {
 	PoolSize              int           `mapstructure:"pool_size" validate:"min=1,max=100"`
 	HeartbeatInterval     time.Duration `mapstructure:"heartbeat_interval" validate:"min=5s,max=5m"`
+	HeartbeatMaxMissed    int           `mapstructure:"heartbeat_max_missed" validate:"min=1,max=100"`
 	ReconnectInterval     time.Duration `mapstructure:"reconnect_interval" validate:"min=1s,max=1m"`
+	ReconnectMultiplier   float64       `mapstructure:"reconnect_multiplier" validate:"min=1,max=10"`
+	ReconnectMaxInterval  time.Duration `mapstructure:"reconnect_max_interval" validate:"min=1s,max=1h"`
+	ReconnectResetAfter   time.Duration `mapstructure:"reconnect_reset_after" validate:"min=1s,max=1h"`
 	MaxReconnectAttempts  int           `mapstructure:"max_reconnect_attempts" validate:"min=1,max=100"`
 	ConnectionTimeout     time.Duration `mapstructure:"connection_timeout" validate:"min=5s,max=5m"`
+	MaxFrameSize          int           `mapstructure:"max_frame_size" validate:"min=65536,max=67108864"`
+	AckTimeout            time.Duration `mapstructure:"ack_timeout" validate:"min=100ms,max=5m"`
+	DrainTimeout          time.Duration `mapstructure:"drain_timeout" validate:"min=1s,max=10m"`
+	SessionFile           string        `mapstructure:"session_file"`
+	Proxy                 string        `mapstructure:"proxy" validate:"omitempty,proxy"`
 }
 
+// ProxyDirect as connection.proxy connects directly, ignoring the proxy environment variables
+const ProxyDirect = "direct"
+
 // LoggingConfig represents logging settings
 type LoggingConfig struct {
 	Level  string `mapstructure:"level" validate:"oneof=debug info warn error"`
@@ -67,6 +105,7 @@ func DefaultConfig() *Config {
 			Domain:        "your-shipit-server.com",
 			APIPort:       443,
 			DataPlanePort: 7223,
+			Transport:     TransportAuto,
 			TLSVerify:     true,
 		},
 		Auth: AuthConfig{
@@ -85,9 +124,17 @@ func DefaultConfig() *Config {
 		Connection: ConnectionConfig{
 			PoolSize:              10,
 			HeartbeatInterval:     30 * time.Second,
+			HeartbeatMaxMissed:    3,
 			ReconnectInterval:     5 * time.Second,
+			ReconnectMultiplier:   2,
+			ReconnectMaxInterval:  2 * time.Minute,
+			ReconnectResetAfter:   time.Minute,
 			MaxReconnectAttempts:  10,
 			ConnectionTimeout:     30 * time.Second,
+			MaxFrameSize:          16 * 1024 * 1024,
+			AckTimeout:            10 * time.Second,
+			DrainTimeout:          30 * time.Second,
+			SessionFile:           GetSessionPath(),
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
@@ -154,6 +201,7 @@ func setDefaults(v *viper.Viper) {
 	v.SetDefault("server.api_port", defaults.Server.APIPort)
 	v.SetDefault("server.data_plane_port", defaults.Server.DataPlanePort)
 	v.SetDefault("server.tls_verify", defaults.Server.TLSVerify)
+	v.SetDefault("server.transport", defaults.Server.Transport)
 	
 	// Auth defaults
 	v.SetDefault("auth.auto_refresh", defaults.Auth.AutoRefresh)
@@ -161,9 +209,18 @@ func setDefaults(v *viper.Viper) {
 	// Connection defaults
 	v.SetDefault("connection.pool_size", defaults.Connection.PoolSize)
 	v.SetDefault("connection.heartbeat_interval", defaults.Connection.HeartbeatInterval)
+	v.SetDefault("connection.heartbeat_max_missed", defaults.Connection.HeartbeatMaxMissed)
 	v.SetDefault("connection.reconnect_interval", defaults.Connection.ReconnectInterval)
+	v.SetDefault("connection.reconnect_multiplier", defaults.Connection.ReconnectMultiplier)
+	v.SetDefault("connection.reconnect_max_interval", defaults.Connection.ReconnectMaxInterval)
+	v.SetDefault("connection.reconnect_reset_after", defaults.Connection.ReconnectResetAfter)
 	v.SetDefault("connection.max_reconnect_attempts", defaults.Connection.MaxReconnectAttempts)
 	v.SetDefault("connection.connection_timeout", defaults.Connection.ConnectionTimeout)
+	v.SetDefault("connection.max_frame_size", defaults.Connection.MaxFrameSize)
+	v.SetDefault("connection.ack_timeout", defaults.Connection.AckTimeout)
+	v.SetDefault("connection.drain_timeout", defaults.Connection.DrainTimeout)
+	v.SetDefault("connection.session_file", defaults.Connection.SessionFile)
+	v.SetDefault("connection.proxy", defaults.Connection.Proxy)
 	
 	// Logging defaults
 	v.SetDefault("logging.level", defaults.Logging.Level)
@@ -173,9 +230,54 @@ func setDefaults(v *viper.Viper) {
 // validateConfig validates the configuration
 func validateConfig(config *Config) error {
 	validate := validator.New()
+	if err := validate.RegisterValidation("proxy", validateProxy); err != nil {
+		return fmt.Errorf("failed to register proxy validation: %w", err)
+	}
+	if err := validate.RegisterValidation("spki_pin", validateSPKIPin); err != nil {
+		return fmt.Errorf("failed to register pin validation: %w", err)
+	}
 	return validate.Struct(config)
 }
 
+// validateProxy accepts "direct" and http, https and socks5 proxy URLs
+func validateProxy(fl validator.FieldLevel) bool {
+	value := fl.Field().String()
+	if value == ProxyDirect {
+		return true
+	}
+
+	proxyURL, err := url.Parse(value)
+	if err != nil || proxyURL.Host == "" {
+		return false
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return true
+	}
+	return false
+}
+
+// validateSPKIPin accepts SHA-256 digests as ParseSPKIPin reads them
+func validateSPKIPin(fl validator.FieldLevel) bool {
+	_, err := ParseSPKIPin(fl.Field().String())
+	return err == nil
+}
+
+// ParseSPKIPin reads the SHA-256 digest of a public key pin, base64 or hex
+// encoded with an optional "sha256/" prefix
+func ParseSPKIPin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(pin, "sha256/")
+
+	digest, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil || len(digest) != sha256.Size {
+		digest, err = hex.DecodeString(pin)
+	}
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("not a base64 or hex SHA-256 digest")
+	}
+	return digest, nil
+}
+
 // SaveConfig saves configuration to file
 func SaveConfig(config *Config, configPath string) error {
 	// Create directory if it doesn't exist
@@ -191,10 +293,16 @@ func SaveConfig(config *Config, configPath string) error {
 			"api_port":         config.Server.APIPort,
 			"data_plane_port":  config.Server.DataPlanePort,
 			"tls_verify":       config.Server.TLSVerify,
+			"endpoints":        config.Server.Endpoints,
+			"transport":        config.Server.Transport,
+			"ca_file":          config.Server.CAFile,
+			"pinned_spki_sha256": config.Server.PinnedSPKISHA256,
 		},
 		"auth": map[string]interface{}{
 			"api_key":      config.Auth.APIKey,
 			"auto_refresh": config.Auth.AutoRefresh,
+			"client_cert":  config.Auth.ClientCert,
+			"client_key":   config.Auth.ClientKey,
 		},
 		"tunnels": func() []map[string]interface{} {
 			tunnels := make([]map[string]interface{}, len(config.Tunnels))
@@ -212,9 +320,18 @@ func SaveConfig(config *Config, configPath string) error {
 		"connection": map[string]interface{}{
 			"pool_size":               config.Connection.PoolSize,
 			"heartbeat_interval":      config.Connection.HeartbeatInterval,
+			"heartbeat_max_missed":    config.Connection.HeartbeatMaxMissed,
 			"reconnect_interval":      config.Connection.ReconnectInterval,
+			"reconnect_multiplier":    config.Connection.ReconnectMultiplier,
+			"reconnect_max_interval":  config.Connection.ReconnectMaxInterval,
+			"reconnect_reset_after":   config.Connection.ReconnectResetAfter,
 			"max_reconnect_attempts":  config.Connection.MaxReconnectAttempts,
 			"connection_timeout":      config.Connection.ConnectionTimeout,
+			"max_frame_size":          config.Connection.MaxFrameSize,
+			"ack_timeout":             config.Connection.AckTimeout,
+			"drain_timeout":           config.Connection.DrainTimeout,
+			"session_file":            config.Connection.SessionFile,
+			"proxy":                   config.Connection.Proxy,
 		},
 		"logging": map[string]interface{}{
 			"level":  config.Logging.Level,
@@ -242,6 +359,33 @@ func GetConfigPath() string {
 	return filepath.Join(home, ".shipitd", "config.yaml")
 }
 
+// GetSessionPath returns the default path of the file tunnel resumption tokens are kept in
+func GetSessionPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "./sessions.json"
+	}
+	return filepath.Join(home, ".shipitd", "sessions.json")
+}
+
+// GetClientCertPath returns the default path of the data plane client certificate
+func GetClientCertPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "./client.crt"
+	}
+	return filepath.Join(home, ".shipitd", "client.crt")
+}
+
+// GetClientKeyPath returns the default path of the data plane client certificate's private key
+func GetClientKeyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "./client.key"
+	}
+	return filepath.Join(home, ".shipitd", "client.key")
+}
+
 // CreateDefaultConfig creates a default configuration file
 func CreateDefaultConfig(configPath string) error {
 	config := DefaultConfig()
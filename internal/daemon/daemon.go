@@ -11,6 +11,7 @@ import (
 	"github.com/kardianos/service"
 	"github.com/unownone/shipitd/internal/client"
 	"github.com/unownone/shipitd/internal/config"
+	"github.com/unownone/shipitd/internal/proxy"
 	"github.com/sirupsen/logrus"
 )
 
@@ -42,6 +43,7 @@ func (ds *DaemonService) Start(s service.Service) error {
 	
 	// Initialize tunnel manager
 	ds.tunnelMgr = client.NewTunnelManager(ds.config, ds.logger)
+	ds.tunnelMgr.SetForwarder(proxy.NewDispatcher(ds.tunnelMgr.GetConnectionPool(), ds.logger))
 
 	// Start configured tunnels
 	for _, tunnelConfig := range ds.config.Tunnels {
@@ -69,7 +71,7 @@ func (ds *DaemonService) Stop(s service.Service) error {
 	// Cancel context to stop all goroutines
 	ds.cancel()
 
-	// Stop tunnel manager
+	// Stop tunnel manager, it sends GOAWAY and lets in-flight requests drain first
 	if ds.tunnelMgr != nil {
 		ds.tunnelMgr.Stop()
 	}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// ErrAuthFailed is returned when the server does not accept the credentials
+// of a connection. Trying again with the same credentials cannot succeed.
+var ErrAuthFailed = errors.New("data plane authentication failed")
+
+// ClientAuthenticate sends the credentials of the client right after the
+// handshake and waits for the server to acknowledge them
+func ClientAuthenticate(reader *Reader, writer *Writer, auth *types.AuthPayload) error {
+	message, err := types.NewAuthMessage(auth)
+	if err != nil {
+		return fmt.Errorf("failed to create auth message: %w", err)
+	}
+
+	if err := writer.WriteMessageWithTimeout(message, HandshakeTimeout); err != nil {
+		return fmt.Errorf("failed to send auth: %w", err)
+	}
+
+	reply, err := reader.ReadMessageWithTimeout(HandshakeTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to read auth acknowledgment: %w", err)
+	}
+
+	switch reply.Type {
+	case types.MessageTypeAcknowledge:
+		return nil
+	case types.MessageTypeError:
+		return authRejected(reply)
+	default:
+		return fmt.Errorf("unexpected message type %d during authentication", reply.Type)
+	}
+}
+
+// ServerAuthenticate waits for the credentials of a client and answers them
+// with an acknowledgment, or with an error frame when verify refuses them
+func ServerAuthenticate(reader *Reader, writer *Writer, verify func(auth *types.AuthPayload) error, logger *logrus.Logger) (*types.AuthPayload, error) {
+	message, err := reader.ReadMessageWithTimeout(HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auth: %w", err)
+	}
+
+	if message.Type != types.MessageTypeAuth {
+		return nil, fmt.Errorf("unexpected message type %d during authentication", message.Type)
+	}
+
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse auth: %w", err)
+	}
+	auth := parsed.(*types.AuthPayload)
+
+	if err := verify(auth); err != nil {
+		if writeErr := writer.WriteError("", &types.ErrorPayload{
+			Code:    types.ErrorCodeAuthenticationFailed,
+			Message: err.Error(),
+		}); writeErr != nil {
+			logger.WithError(writeErr).Warn("Failed to send authentication error")
+		}
+		return nil, fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+
+	if err := writer.WriteAcknowledge("", &types.AcknowledgePayload{Status: "ok"}); err != nil {
+		return nil, fmt.Errorf("failed to send auth acknowledgment: %w", err)
+	}
+
+	return auth, nil
+}
+
+// authRejected turns an error frame received in answer to the credentials into an error
+func authRejected(message *types.Message) error {
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return fmt.Errorf("server rejected authentication")
+	}
+
+	payload := parsed.(*types.ErrorPayload)
+	if payload.Code == types.ErrorCodeAuthenticationFailed {
+		return fmt.Errorf("%w: %s", ErrAuthFailed, payload.Message)
+	}
+	return fmt.Errorf("server rejected authentication: %s: %s", payload.Code, payload.Message)
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"sync"
+
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// pooledBufferSize is the capacity of pooled payload buffers, large enough for
+// a full stream DATA frame so steady-state stream traffic never allocates
+const pooledBufferSize = 64 * 1024
+
+// payloadPool recycles payload buffers between reads. It holds array pointers
+// so putting a buffer back does not allocate a slice header.
+var payloadPool = sync.Pool{
+	New: func() interface{} {
+		return new([pooledBufferSize]byte)
+	},
+}
+
+// getBuffer returns a buffer of length size, pooled when it fits a pooled buffer
+func getBuffer(size int) []byte {
+	if size > pooledBufferSize {
+		return make([]byte, size)
+	}
+	return payloadPool.Get().(*[pooledBufferSize]byte)[:size]
+}
+
+// putBuffer returns a buffer obtained from getBuffer to the pool
+func putBuffer(buffer []byte) {
+	if cap(buffer) != pooledBufferSize {
+		return
+	}
+	payloadPool.Put((*[pooledBufferSize]byte)(buffer[:pooledBufferSize]))
+}
+
+// ReleasePayload hands the payload of a message returned by Reader back for
+// reuse. Only call it once nothing references the payload anymore, parsed
+// binary payloads alias it.
+func ReleasePayload(message *types.Message) {
+	putBuffer(message.Payload)
+	message.Payload = nil
+}
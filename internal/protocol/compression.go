@@ -0,0 +1,229 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// DefaultCompressionThreshold is the payload size below which frames are sent uncompressed
+	DefaultCompressionThreshold = 1024
+)
+
+// Compressor compresses frame payloads with one algorithm. Implementations must
+// be safe for concurrent use.
+type Compressor interface {
+	// Name is the algorithm name exchanged in the handshake
+	Name() string
+	// Compress returns the compressed form of src
+	Compress(src []byte) ([]byte, error)
+	// Decompress returns the original payload, failing when it exceeds maxSize bytes
+	Decompress(src []byte, maxSize int) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{}
+	// compressorOrder is the preference order offered in the hello
+	compressorOrder []string
+)
+
+func init() {
+	RegisterCompressor(&zstdCompressor{})
+	RegisterCompressor(&gzipCompressor{})
+}
+
+// RegisterCompressor adds a compressor to the registry. Compressors registered
+// first are preferred, registering a name again replaces the implementation.
+func RegisterCompressor(compressor Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	name := compressor.Name()
+	if _, exists := compressors[name]; !exists {
+		compressorOrder = append(compressorOrder, name)
+	}
+	compressors[name] = compressor
+}
+
+// GetCompressor returns the registered compressor with the given name
+func GetCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	compressor, ok := compressors[name]
+	return compressor, ok
+}
+
+// CompressorNames returns the registered algorithms in order of preference
+func CompressorNames() []string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	return append([]string(nil), compressorOrder...)
+}
+
+// selectCompressor picks the first algorithm in the peer's preference list that is registered here
+func selectCompressor(offered []string) string {
+	for _, name := range offered {
+		if _, ok := GetCompressor(name); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// gzipCompressor implements gzip compression, writers are pooled between frames
+type gzipCompressor struct {
+	writers sync.Pool
+}
+
+func (c *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (c *gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(len(src) / 2)
+
+	writer, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		writer.Reset(&buf)
+	} else {
+		writer = gzip.NewWriter(&buf)
+	}
+	defer c.writers.Put(writer)
+
+	if _, err := writer.Write(src); err != nil {
+		return nil, fmt.Errorf("gzip compression failed: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("gzip compression failed: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("gzip decompression failed: %w", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, fmt.Errorf("gzip decompression failed: %w", err)
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// zstdCompressor implements zstd compression with a shared encoder and decoder,
+// both are safe for concurrent EncodeAll and DecodeAll calls
+type zstdCompressor struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (c *zstdCompressor) Name() string {
+	return "zstd"
+}
+
+// init creates the encoder and decoder on first use so unused algorithms cost nothing
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		if c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(MaxFrameSizeLimit))
+	})
+	return c.err
+}
+
+func (c *zstdCompressor) Compress(src []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, fmt.Errorf("zstd compression failed: %w", err)
+	}
+	return c.encoder.EncodeAll(src, make([]byte, 0, len(src)/2)), nil
+}
+
+func (c *zstdCompressor) Decompress(src []byte, maxSize int) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, fmt.Errorf("zstd decompression failed: %w", err)
+	}
+
+	// The decoder itself never grows past MaxFrameSizeLimit
+	data, err := c.decoder.DecodeAll(src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("zstd decompression failed: %w", err)
+	}
+	if len(data) > maxSize {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes", maxSize)
+	}
+	return data, nil
+}
+
+// CompressionStats counts payload bytes before and after compression. The
+// counters only move once compression was negotiated on the connection.
+type CompressionStats struct {
+	sentFrames     atomic.Uint64
+	sentBefore     atomic.Uint64
+	sentAfter      atomic.Uint64
+	receivedFrames atomic.Uint64
+	receivedBefore atomic.Uint64
+	receivedAfter  atomic.Uint64
+}
+
+// CompressionSnapshot is a point in time copy of CompressionStats. Before is
+// the uncompressed payload size and After the size on the wire.
+type CompressionSnapshot struct {
+	SentFrames     uint64 `json:"sent_frames"`
+	SentBefore     uint64 `json:"sent_bytes_before"`
+	SentAfter      uint64 `json:"sent_bytes_after"`
+	ReceivedFrames uint64 `json:"received_frames"`
+	ReceivedBefore uint64 `json:"received_bytes_before"`
+	ReceivedAfter  uint64 `json:"received_bytes_after"`
+}
+
+// recordSent counts an outgoing payload, frames counts only compressed ones
+func (s *CompressionStats) recordSent(before, after int, compressed bool) {
+	if compressed {
+		s.sentFrames.Add(1)
+	}
+	s.sentBefore.Add(uint64(before))
+	s.sentAfter.Add(uint64(after))
+}
+
+// recordReceived counts an incoming payload, frames counts only compressed ones
+func (s *CompressionStats) recordReceived(before, after int, compressed bool) {
+	if compressed {
+		s.receivedFrames.Add(1)
+	}
+	s.receivedBefore.Add(uint64(before))
+	s.receivedAfter.Add(uint64(after))
+}
+
+// Snapshot returns the current counter values
+func (s *CompressionStats) Snapshot() CompressionSnapshot {
+	return CompressionSnapshot{
+		SentFrames:     s.sentFrames.Load(),
+		SentBefore:     s.sentBefore.Load(),
+		SentAfter:      s.sentAfter.Load(),
+		ReceivedFrames: s.receivedFrames.Load(),
+		ReceivedBefore: s.receivedBefore.Load(),
+		ReceivedAfter:  s.receivedAfter.Load(),
+	}
+}
@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+const (
+	// DefaultAckTimeout is how long a reliable message waits for its acknowledgment before it is sent again
+	DefaultAckTimeout = 10 * time.Second
+	// DefaultMaxRetransmits is how often a reliable message is sent again before it is given up
+	DefaultMaxRetransmits = 5
+	// DefaultDedupWindow is the number of recently received message IDs remembered for deduplication
+	DefaultDedupWindow = 4096
+)
+
+// Outbox is the table of reliable messages sent but not yet acknowledged.
+// Message IDs increase monotonically for the lifetime of the outbox, so they
+// stay unique across reconnects and the peer can deduplicate retransmissions.
+type Outbox struct {
+	mu             sync.Mutex
+	nextID         uint64
+	pending        map[uint64]*pendingMessage
+	ackTimeout     time.Duration
+	maxRetransmits int
+	stats          DeliveryStats
+}
+
+// pendingMessage is a reliable message waiting for its acknowledgment
+type pendingMessage struct {
+	message  *types.Message
+	sentAt   time.Time
+	attempts int
+}
+
+// DeliveryStats counts what happened to reliable messages
+type DeliveryStats struct {
+	Outstanding   int    `json:"outstanding"`
+	Sent          uint64 `json:"sent"`
+	Acknowledged  uint64 `json:"acknowledged"`
+	Retransmitted uint64 `json:"retransmitted"`
+	Expired       uint64 `json:"expired"`
+	Duplicates    uint64 `json:"duplicates_received"`
+}
+
+// NewOutbox creates an empty outbox
+func NewOutbox(ackTimeout time.Duration, maxRetransmits int) *Outbox {
+	return &Outbox{
+		pending:        make(map[uint64]*pendingMessage),
+		ackTimeout:     ackTimeout,
+		maxRetransmits: maxRetransmits,
+	}
+}
+
+// Track assigns the next message ID to message and keeps it until it is acknowledged
+func (o *Outbox) Track(message *types.Message) uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.nextID++
+	message.ID = o.nextID
+	o.pending[message.ID] = &pendingMessage{message: message, sentAt: time.Now()}
+	o.stats.Sent++
+	return message.ID
+}
+
+// Supersede forgets unacknowledged messages of a type for a tunnel, for
+// messages such as registrations where only the newest one matters
+func (o *Outbox) Supersede(msgType types.MessageType, tunnelID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for id, pending := range o.pending {
+		if pending.message.Type == msgType && pending.message.TunnelID == tunnelID {
+			delete(o.pending, id)
+		}
+	}
+}
+
+// Ack removes an acknowledged message and returns whether it was outstanding
+func (o *Outbox) Ack(id uint64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, exists := o.pending[id]; !exists {
+		return false
+	}
+	delete(o.pending, id)
+	o.stats.Acknowledged++
+	return true
+}
+
+// Due returns the messages whose ack timeout passed and that should be sent
+// again, and removes and returns the ones that ran out of retransmissions
+func (o *Outbox) Due(now time.Time) (retransmit, expired []*types.Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for id, pending := range o.pending {
+		if now.Sub(pending.sentAt) < o.ackTimeout {
+			continue
+		}
+		if pending.attempts >= o.maxRetransmits {
+			delete(o.pending, id)
+			o.stats.Expired++
+			expired = append(expired, pending.message)
+			continue
+		}
+		pending.attempts++
+		pending.sentAt = now
+		o.stats.Retransmitted++
+		retransmit = append(retransmit, pending.message)
+	}
+
+	sortByID(retransmit)
+	sortByID(expired)
+	return retransmit, expired
+}
+
+// Pending returns every outstanding message in send order and restarts their
+// ack timers, used to send them again on a new connection
+func (o *Outbox) Pending() []*types.Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	messages := make([]*types.Message, 0, len(o.pending))
+	for _, pending := range o.pending {
+		pending.sentAt = now
+		messages = append(messages, pending.message)
+	}
+	o.stats.Retransmitted += uint64(len(messages))
+
+	sortByID(messages)
+	return messages
+}
+
+// Clear forgets every outstanding message
+func (o *Outbox) Clear() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = make(map[uint64]*pendingMessage)
+}
+
+// Len returns the number of outstanding messages
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// Stats returns the delivery counters, Duplicates is filled in by the receiving side
+func (o *Outbox) Stats() DeliveryStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	stats := o.stats
+	stats.Outstanding = len(o.pending)
+	return stats
+}
+
+// sortByID orders messages by ID, which is the order they were first sent in
+func sortByID(messages []*types.Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+}
+
+// Deduplicator remembers the most recent message IDs received from the peer
+// so retransmissions are acknowledged again but processed only once
+type Deduplicator struct {
+	mu         sync.Mutex
+	seen       map[uint64]struct{}
+	order      []uint64
+	next       int
+	duplicates uint64
+}
+
+// NewDeduplicator creates a deduplicator remembering the last window IDs
+func NewDeduplicator(window int) *Deduplicator {
+	return &Deduplicator{
+		seen:  make(map[uint64]struct{}, window),
+		order: make([]uint64, window),
+	}
+}
+
+// Seen records id and returns whether it was received before
+func (d *Deduplicator) Seen(id uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.seen[id]; exists {
+		d.duplicates++
+		return true
+	}
+
+	// Forget the oldest ID once the window is full
+	if evicted := d.order[d.next]; evicted != 0 {
+		delete(d.seen, evicted)
+	}
+	d.order[d.next] = id
+	d.next = (d.next + 1) % len(d.order)
+	d.seen[id] = struct{}{}
+	return false
+}
+
+// Duplicates returns how many duplicate IDs were seen
+func (d *Deduplicator) Duplicates() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.duplicates
+}
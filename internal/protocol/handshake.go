@@ -0,0 +1,232 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// HandshakeTimeout bounds how long either side waits for the peer's hello
+const HandshakeTimeout = 10 * time.Second
+
+// SupportedCapabilities are the optional features this implementation can speak
+const SupportedCapabilities = types.CapabilityCompression | types.CapabilityStreaming | types.CapabilityMultiplexing |
+	types.CapabilityBinaryPayload | types.CapabilityReliableDelivery | types.CapabilityGoAway | types.CapabilityHeartbeatEcho |
+	types.CapabilitySessionResume | types.CapabilityTrafficCounters | types.CapabilityAuth
+
+var (
+	// ErrVersionMismatch is returned when the peers share no protocol version
+	ErrVersionMismatch = errors.New("protocol version mismatch")
+	// ErrNotNegotiated is returned for frames the negotiated protocol does not allow
+	ErrNotNegotiated = errors.New("message type not negotiated")
+)
+
+// messageCapabilities lists the capability each optional message type needs
+var messageCapabilities = map[types.MessageType]types.Capability{
+	types.MessageTypeStreamOpen:       types.CapabilityMultiplexing,
+	types.MessageTypeStreamData:       types.CapabilityMultiplexing,
+	types.MessageTypeStreamFin:        types.CapabilityMultiplexing,
+	types.MessageTypeStreamReset:      types.CapabilityMultiplexing,
+	types.MessageTypeWindowUpdate:     types.CapabilityMultiplexing,
+	types.MessageTypeDataChunk:        types.CapabilityStreaming,
+	types.MessageTypeGoAway:           types.CapabilityGoAway,
+	types.MessageTypeTunnelRegistered: types.CapabilitySessionResume,
+	types.MessageTypeAuth:             types.CapabilityAuth,
+}
+
+// Negotiation is the outcome of a HELLO/HELLO_ACK exchange
+type Negotiation struct {
+	Version      uint8
+	Capabilities types.Capability
+	PeerVersion  string
+	// SessionID names the server session whose message IDs the connection carries, empty when the server names none
+	SessionID string
+	// Compression is the algorithm used for compressed frames when CapabilityCompression is set
+	Compression string
+}
+
+// Supports returns whether a capability was agreed on by both peers
+func (n *Negotiation) Supports(capability types.Capability) bool {
+	return n.Capabilities.Has(capability)
+}
+
+// Allows returns whether a message type may be sent on the negotiated connection
+func (n *Negotiation) Allows(msgType types.MessageType) bool {
+	// The handshake happens exactly once per connection
+	if msgType == types.MessageTypeHello || msgType == types.MessageTypeHelloAck {
+		return false
+	}
+
+	capability, optional := messageCapabilities[msgType]
+	return !optional || n.Supports(capability)
+}
+
+// ClientHandshake sends a hello and waits for the server to acknowledge it.
+// The connection downgrades to the server's version when it is one we still accept.
+func ClientHandshake(reader *Reader, writer *Writer, hello *types.HelloPayload, logger *logrus.Logger) (*Negotiation, error) {
+	message, err := types.NewHelloMessage(hello)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hello message: %w", err)
+	}
+
+	if err := writer.WriteMessageWithTimeout(message, HandshakeTimeout); err != nil {
+		return nil, fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	reply, err := reader.ReadMessageWithTimeout(HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello acknowledgment: %w", err)
+	}
+
+	switch reply.Type {
+	case types.MessageTypeHelloAck:
+	case types.MessageTypeError:
+		return nil, handshakeRejected(reply)
+	default:
+		return nil, fmt.Errorf("unexpected message type %d during handshake", reply.Type)
+	}
+
+	parsed, err := reply.ParsePayload()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hello acknowledgment: %w", err)
+	}
+	ack := parsed.(*types.HelloAckPayload)
+
+	if ack.ProtocolVersion < hello.MinProtocolVersion || ack.ProtocolVersion > hello.ProtocolVersion {
+		return nil, fmt.Errorf("%w: server selected version %d, client supports %d-%d",
+			ErrVersionMismatch, ack.ProtocolVersion, hello.MinProtocolVersion, hello.ProtocolVersion)
+	}
+
+	// Never trust the server to enable something we did not offer
+	negotiation := &Negotiation{
+		Version:      ack.ProtocolVersion,
+		Capabilities: ack.Capabilities & hello.Capabilities,
+		PeerVersion:  ack.ServerVersion,
+		SessionID:    ack.SessionID,
+	}
+
+	if negotiation.Supports(types.CapabilityCompression) {
+		if ack.Compression == "" {
+			negotiation.Capabilities &^= types.CapabilityCompression
+		} else if !offered(hello.Compression, ack.Compression) {
+			return nil, fmt.Errorf("server selected compression %q that was not offered", ack.Compression)
+		} else {
+			negotiation.Compression = ack.Compression
+		}
+	}
+
+	reader.SetNegotiation(negotiation)
+	writer.SetNegotiation(negotiation)
+
+	logger.WithFields(logrus.Fields{
+		"protocol_version": negotiation.Version,
+		"capabilities":     negotiation.Capabilities,
+		"server_version":   negotiation.PeerVersion,
+		"compression":      negotiation.Compression,
+	}).Info("Protocol handshake completed")
+
+	return negotiation, nil
+}
+
+// ServerHandshake waits for a client hello and answers it with the highest
+// version and the capabilities both sides support, or with an error frame.
+// sessionID names the space the server's message IDs are unique in.
+func ServerHandshake(reader *Reader, writer *Writer, serverVersion, sessionID string, capabilities types.Capability, logger *logrus.Logger) (*Negotiation, error) {
+	message, err := reader.ReadMessageWithTimeout(HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hello: %w", err)
+	}
+
+	if message.Type != types.MessageTypeHello {
+		return nil, fmt.Errorf("unexpected message type %d during handshake", message.Type)
+	}
+
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hello: %w", err)
+	}
+	hello := parsed.(*types.HelloPayload)
+
+	version := hello.ProtocolVersion
+	if version > types.ProtocolVersion {
+		version = types.ProtocolVersion
+	}
+
+	if version < types.MinProtocolVersion || version < hello.MinProtocolVersion {
+		details := fmt.Sprintf("client supports %d-%d, server supports %d-%d",
+			hello.MinProtocolVersion, hello.ProtocolVersion, types.MinProtocolVersion, types.ProtocolVersion)
+		if err := writer.WriteError("", &types.ErrorPayload{
+			Code:    types.ErrorCodeUnsupportedVersion,
+			Message: "No common protocol version",
+			Details: details,
+		}); err != nil {
+			logger.WithError(err).Warn("Failed to send handshake error")
+		}
+		return nil, fmt.Errorf("%w: %s", ErrVersionMismatch, details)
+	}
+
+	negotiation := &Negotiation{
+		Version:      version,
+		Capabilities: hello.Capabilities & capabilities,
+		PeerVersion:  hello.ClientVersion,
+		SessionID:    sessionID,
+	}
+
+	// Use the client's most preferred algorithm that is registered here
+	if negotiation.Supports(types.CapabilityCompression) {
+		negotiation.Compression = selectCompressor(hello.Compression)
+		if negotiation.Compression == "" {
+			negotiation.Capabilities &^= types.CapabilityCompression
+		}
+	}
+
+	ack, err := types.NewHelloAckMessage(&types.HelloAckPayload{
+		ProtocolVersion: negotiation.Version,
+		ServerVersion:   serverVersion,
+		SessionID:       sessionID,
+		Capabilities:    negotiation.Capabilities,
+		Compression:     negotiation.Compression,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hello acknowledgment: %w", err)
+	}
+
+	if err := writer.WriteMessageWithTimeout(ack, HandshakeTimeout); err != nil {
+		return nil, fmt.Errorf("failed to send hello acknowledgment: %w", err)
+	}
+
+	reader.SetNegotiation(negotiation)
+	writer.SetNegotiation(negotiation)
+
+	return negotiation, nil
+}
+
+// handshakeRejected turns an error frame received during the handshake into an error
+func handshakeRejected(message *types.Message) error {
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return fmt.Errorf("server rejected handshake")
+	}
+
+	payload := parsed.(*types.ErrorPayload)
+	if payload.Code == types.ErrorCodeUnsupportedVersion {
+		return fmt.Errorf("%w: %s", ErrVersionMismatch, payload.Details)
+	}
+	return fmt.Errorf("server rejected handshake: %s: %s", payload.Code, payload.Message)
+}
+
+// offered returns whether the selected compression is one we offered and can use
+func offered(names []string, selected string) bool {
+	if _, ok := GetCompressor(selected); !ok {
+		return false
+	}
+	for _, name := range names {
+		if name == selected {
+			return true
+		}
+	}
+	return false
+}
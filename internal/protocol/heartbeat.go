@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often a connection is probed with a heartbeat
+	DefaultHeartbeatInterval = 30 * time.Second
+	// DefaultHeartbeatMaxMissed is the number of unanswered heartbeats in a row after which the peer is considered dead
+	DefaultHeartbeatMaxMissed = 3
+)
+
+// HeartbeatMonitor matches heartbeat echoes to the heartbeats that were sent
+// and measures the round trip time. Each heartbeat carries a fresh nonce, so a
+// late echo is never mistaken for the answer to a newer heartbeat.
+type HeartbeatMonitor struct {
+	mu        sync.Mutex
+	nextNonce uint64
+	pending   map[uint64]time.Time
+	maxMissed int
+	stats     HeartbeatStats
+}
+
+// HeartbeatStats describes the liveness and latency of the peer. RTT is the
+// last round trip, SmoothedRTT its moving average and Jitter the mean
+// deviation between successive round trips.
+type HeartbeatStats struct {
+	Sent        uint64        `json:"sent"`
+	Echoed      uint64        `json:"echoed"`
+	Missed      int           `json:"missed"`
+	DeadPeers   uint64        `json:"dead_peers"`
+	RTT         time.Duration `json:"rtt_ns"`
+	SmoothedRTT time.Duration `json:"smoothed_rtt_ns"`
+	Jitter      time.Duration `json:"jitter_ns"`
+	LastEcho    time.Time     `json:"last_echo"`
+}
+
+// NewHeartbeatMonitor creates a monitor that declares the peer dead after maxMissed unanswered heartbeats
+func NewHeartbeatMonitor(maxMissed int) *HeartbeatMonitor {
+	return &HeartbeatMonitor{
+		pending:   make(map[uint64]time.Time),
+		maxMissed: maxMissed,
+	}
+}
+
+// Probe returns the nonce for the next heartbeat. Heartbeats still unanswered
+// when the next one is due count as missed; once maxMissed were missed in a
+// row Probe reports the peer dead instead, and the monitor starts over.
+func (m *HeartbeatMonitor) Probe(now time.Time) (nonce uint64, dead bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stats.Missed = len(m.pending)
+	if m.stats.Missed >= m.maxMissed {
+		m.pending = make(map[uint64]time.Time)
+		m.stats.DeadPeers++
+		return 0, true
+	}
+
+	m.nextNonce++
+	m.pending[m.nextNonce] = now
+	m.stats.Sent++
+	return m.nextNonce, false
+}
+
+// Echo records the echo of a heartbeat and returns its round trip time. Echoes
+// of unknown nonces, such as ones from a previous connection, are ignored.
+func (m *HeartbeatMonitor) Echo(nonce uint64, now time.Time) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sentAt, exists := m.pending[nonce]
+	if !exists {
+		return 0, false
+	}
+
+	// The peer is alive, heartbeats sent before this one no longer count as missed
+	for pending := range m.pending {
+		if pending <= nonce {
+			delete(m.pending, pending)
+		}
+	}
+	m.stats.Missed = 0
+
+	rtt := now.Sub(sentAt)
+	if m.stats.Echoed == 0 {
+		m.stats.SmoothedRTT = rtt
+	} else {
+		// Smoothing as in RFC 6298 and jitter as in RFC 3550
+		deviation := rtt - m.stats.RTT
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		m.stats.SmoothedRTT += (rtt - m.stats.SmoothedRTT) / 8
+		m.stats.Jitter += (deviation - m.stats.Jitter) / 16
+	}
+	m.stats.RTT = rtt
+	m.stats.Echoed++
+	m.stats.LastEcho = now
+	return rtt, true
+}
+
+// Reset forgets the heartbeats in flight, for a new connection to the peer
+func (m *HeartbeatMonitor) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.pending = make(map[uint64]time.Time)
+	m.stats.Missed = 0
+}
+
+// Stats returns the heartbeat counters and latency measurements
+func (m *HeartbeatMonitor) Stats() HeartbeatStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
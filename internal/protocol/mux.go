@@ -0,0 +1,669 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+const (
+	// DefaultStreamWindow is the receive credit every stream starts with
+	DefaultStreamWindow = 256 * 1024
+	// maxStreamFrameSize caps the data carried by a single stream DATA frame
+	maxStreamFrameSize = 32 * 1024
+	// acceptBacklog is the number of opened streams waiting for AcceptStream
+	acceptBacklog = 64
+	// maxStreamMetadata caps the metadata of a stream header
+	maxStreamMetadata = 64 * 1024
+)
+
+var (
+	// ErrSessionClosed is returned once the session or its connection is gone
+	ErrSessionClosed = errors.New("session closed")
+	// ErrStreamClosed is returned when using a stream after Close or CloseWrite
+	ErrStreamClosed = errors.New("stream closed")
+	// ErrStreamReset is returned when the peer aborted the stream
+	ErrStreamReset = errors.New("stream reset by peer")
+	// ErrSessionDraining is returned for new streams once the session drains after a GOAWAY
+	ErrSessionDraining = errors.New("session draining")
+)
+
+// Session multiplexes many streams over one data plane connection, similar to
+// yamux or HTTP/2. Each stream has its own credit window, so a slow consumer
+// only stalls its own stream. The session only writes; frames read by the
+// connection's single read loop are handed to HandleFrame.
+type Session struct {
+	writer    *Writer
+	logger    *logrus.Logger
+	nextID    uint32
+	streams   map[uint32]*Stream
+	accept    chan *Stream
+	done      chan struct{}
+	draining  chan struct{}
+	closeOnce sync.Once
+	drainOnce sync.Once
+	mu        sync.Mutex
+}
+
+// Stream is one bidirectional byte stream of a Session. It implements net.Conn.
+type Stream struct {
+	id       uint32
+	tunnelID string
+	metadata []byte
+	session  *Session
+
+	mu            sync.Mutex
+	recvBuf       bytes.Buffer
+	recvWindow    uint32
+	unacked       uint32
+	sendWindow    uint32
+	remoteFin     bool
+	localFin      bool
+	closed        bool
+	reset         bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+	writable      chan struct{}
+}
+
+// TunnelStream is a stream carrying one connection of a tunnel, either a
+// Stream of a Session or a stream native to the transport such as QUIC
+type TunnelStream interface {
+	net.Conn
+	// ID returns the stream ID
+	ID() uint32
+	// TunnelID returns the tunnel the stream belongs to
+	TunnelID() string
+	// Metadata returns the metadata the peer opened the stream with
+	Metadata() []byte
+	// CloseWrite sends FIN, the peer reads io.EOF once it drained the stream
+	CloseWrite() error
+	// Reset aborts the stream in both directions
+	Reset(reason string) error
+}
+
+// streamAddr is the net.Addr of a stream
+type streamAddr struct {
+	id uint32
+}
+
+// NewSession creates a session writing frames through writer. Clients open
+// odd stream IDs and servers even ones so both sides can open streams.
+func NewSession(writer *Writer, client bool, logger *logrus.Logger) *Session {
+	nextID := uint32(2)
+	if client {
+		nextID = 1
+	}
+
+	return &Session{
+		writer:   writer,
+		logger:   logger,
+		nextID:   nextID,
+		streams:  make(map[uint32]*Stream),
+		accept:   make(chan *Stream, acceptBacklog),
+		done:     make(chan struct{}),
+		draining: make(chan struct{}),
+	}
+}
+
+// OpenStream opens a new stream for a tunnel, metadata is passed to the peer with the OPEN frame
+func (s *Session) OpenStream(tunnelID string, metadata []byte) (*Stream, error) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	case <-s.draining:
+		s.mu.Unlock()
+		return nil, ErrSessionDraining
+	default:
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id, tunnelID, metadata)
+	// The accepting side always starts with the default window, OPEN advertises ours
+	stream.sendWindow = DefaultStreamWindow
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(types.MessageTypeStreamOpen, tunnelID, id, DefaultStreamWindow, metadata); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// AcceptStream waits for the peer to open a stream. Once the session drains
+// it still returns the streams opened before, then ErrSessionDraining.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.done:
+		return nil, ErrSessionClosed
+	case <-s.draining:
+		select {
+		case stream := <-s.accept:
+			return stream, nil
+		default:
+			return nil, ErrSessionDraining
+		}
+	}
+}
+
+// Drain stops the session from opening or accepting new streams, the open ones carry on
+func (s *Session) Drain() {
+	s.drainOnce.Do(func() {
+		close(s.draining)
+	})
+}
+
+// IsDraining returns whether Drain was called
+func (s *Session) IsDraining() bool {
+	select {
+	case <-s.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// HandleFrame applies a stream frame read from the connection. It never blocks
+// on a stream or on the connection, frames it answers with are queued, and the
+// credit window bounds how much each stream can buffer.
+func (s *Session) HandleFrame(message *types.Message) error {
+	var payload types.StreamPayload
+	if err := payload.UnmarshalBinary(message.Payload); err != nil {
+		return fmt.Errorf("invalid stream frame: %w", err)
+	}
+
+	if message.Type == types.MessageTypeStreamOpen {
+		return s.handleOpen(message.TunnelID, &payload)
+	}
+
+	s.mu.Lock()
+	stream, exists := s.streams[payload.StreamID]
+	s.mu.Unlock()
+
+	if !exists {
+		// Late frames for a stream we already forgot are expected, everything else gets reset
+		if message.Type == types.MessageTypeStreamData {
+			return s.queueFrame(types.MessageTypeStreamReset, message.TunnelID, payload.StreamID, 0, []byte("unknown stream"))
+		}
+		return nil
+	}
+
+	switch message.Type {
+	case types.MessageTypeStreamData:
+		if err := stream.receive(payload.Data); err != nil {
+			stream.abort(err.Error())
+			return err
+		}
+	case types.MessageTypeStreamFin:
+		stream.receiveFin()
+	case types.MessageTypeStreamReset:
+		stream.receiveReset()
+	case types.MessageTypeWindowUpdate:
+		stream.grant(payload.Window)
+	default:
+		return fmt.Errorf("unexpected stream frame type: %d", message.Type)
+	}
+
+	return nil
+}
+
+// Close resets every stream and stops accepting new ones
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.receiveReset()
+		}
+	})
+}
+
+// NumStreams returns the number of open streams
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// handleOpen registers a stream opened by the peer and queues it for AcceptStream
+func (s *Session) handleOpen(tunnelID string, payload *types.StreamPayload) error {
+	metadata := append([]byte(nil), payload.Data...)
+
+	if s.IsDraining() {
+		return s.queueFrame(types.MessageTypeStreamReset, tunnelID, payload.StreamID, 0, []byte("going away"))
+	}
+
+	s.mu.Lock()
+	if _, exists := s.streams[payload.StreamID]; exists || payload.StreamID%2 == s.nextID%2 {
+		s.mu.Unlock()
+		return s.queueFrame(types.MessageTypeStreamReset, tunnelID, payload.StreamID, 0, []byte("invalid stream id"))
+	}
+	stream := newStream(s, payload.StreamID, tunnelID, metadata)
+	stream.sendWindow = payload.Window
+	s.streams[payload.StreamID] = stream
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- stream:
+		return nil
+	default:
+		s.logger.WithField("stream_id", payload.StreamID).Warn("Accept backlog full, resetting stream")
+		stream.abort("accept backlog full")
+		return nil
+	}
+}
+
+// removeStream forgets a finished stream
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// writeFrame sends a single stream frame
+func (s *Session) writeFrame(msgType types.MessageType, tunnelID string, id, window uint32, data []byte) error {
+	message, err := types.NewStreamMessage(msgType, tunnelID, &types.StreamPayload{
+		StreamID: id,
+		Window:   window,
+		Data:     data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stream frame: %w", err)
+	}
+
+	return s.writer.WriteMessage(message)
+}
+
+// queueFrame queues a single stream frame without waiting for it to be
+// written, for frames sent while handling what the peer sent
+func (s *Session) queueFrame(msgType types.MessageType, tunnelID string, id, window uint32, data []byte) error {
+	message, err := types.NewStreamMessage(msgType, tunnelID, &types.StreamPayload{
+		StreamID: id,
+		Window:   window,
+		Data:     data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create stream frame: %w", err)
+	}
+
+	return s.writer.QueueMessage(message)
+}
+
+// creditWindow queues a WINDOW_UPDATE without waiting for it to be written
+func (s *Session) creditWindow(tunnelID string, id, credit uint32) error {
+	return s.queueFrame(types.MessageTypeWindowUpdate, tunnelID, id, credit, nil)
+}
+
+// newStream creates a stream with the default receive window
+func newStream(session *Session, id uint32, tunnelID string, metadata []byte) *Stream {
+	return &Stream{
+		id:         id,
+		tunnelID:   tunnelID,
+		metadata:   metadata,
+		session:    session,
+		recvWindow: DefaultStreamWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream ID
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// TunnelID returns the tunnel the stream belongs to
+func (st *Stream) TunnelID() string {
+	return st.tunnelID
+}
+
+// Metadata returns the metadata sent with the OPEN frame
+func (st *Stream) Metadata() []byte {
+	return st.metadata
+}
+
+// Read reads stream data, returning io.EOF after the peer's FIN
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+			credit := st.consume(uint32(n))
+			st.mu.Unlock()
+
+			if credit > 0 {
+				if err := st.session.creditWindow(st.tunnelID, st.id, credit); err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteFin:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.closed:
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes stream data, blocking while the peer has not granted enough credit
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		case st.localFin:
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := uint32(len(p) - written)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > maxStreamFrameSize {
+			n = maxStreamFrameSize
+		}
+		if n == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writable, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(types.MessageTypeStreamData, st.tunnelID, st.id, 0, p[written:written+int(n)]); err != nil {
+			return written, err
+		}
+		written += int(n)
+	}
+
+	return written, nil
+}
+
+// CloseWrite sends FIN, the peer reads io.EOF once it drained the stream
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.localFin || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localFin = true
+	finished := st.remoteFin
+	st.mu.Unlock()
+
+	if finished {
+		st.session.removeStream(st.id)
+	}
+
+	return st.session.writeFrame(types.MessageTypeStreamFin, st.tunnelID, st.id, 0, nil)
+}
+
+// Close half-closes the stream and stops reading from it
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	st.closed = true
+	st.recvBuf.Reset()
+	st.mu.Unlock()
+	st.notify(st.readable)
+
+	return st.CloseWrite()
+}
+
+// Reset aborts the stream in both directions
+func (st *Stream) Reset(reason string) error {
+	if !st.markReset() {
+		return nil
+	}
+	return st.session.writeFrame(types.MessageTypeStreamReset, st.tunnelID, st.id, 0, []byte(reason))
+}
+
+// abort resets the stream from the read path, queueing the RST instead of waiting for it
+func (st *Stream) abort(reason string) error {
+	if !st.markReset() {
+		return nil
+	}
+	return st.session.queueFrame(types.MessageTypeStreamReset, st.tunnelID, st.id, 0, []byte(reason))
+}
+
+// markReset stops the stream and forgets it, returning false when it was reset before
+func (st *Stream) markReset() bool {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return false
+	}
+	st.reset = true
+	st.mu.Unlock()
+
+	st.notify(st.readable)
+	st.notify(st.writable)
+	st.session.removeStream(st.id)
+	return true
+}
+
+// LocalAddr returns the stream address
+func (st *Stream) LocalAddr() net.Addr {
+	return streamAddr{id: st.id}
+}
+
+// RemoteAddr returns the stream address
+func (st *Stream) RemoteAddr() net.Addr {
+	return streamAddr{id: st.id}
+}
+
+// SetDeadline sets the read and write deadlines
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	st.notify(st.readable)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	st.notify(st.writable)
+	return nil
+}
+
+// receive buffers data from the peer, which must stay within the granted window
+func (st *Stream) receive(data []byte) error {
+	st.mu.Lock()
+	if uint32(len(data)) > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("stream %d exceeded its receive window", st.id)
+	}
+
+	// Data arriving after Close is dropped but credited back so the peer never stalls
+	if st.closed {
+		st.mu.Unlock()
+		if len(data) == 0 {
+			return nil
+		}
+		return st.session.creditWindow(st.tunnelID, st.id, uint32(len(data)))
+	}
+
+	st.recvWindow -= uint32(len(data))
+	st.recvBuf.Write(data)
+	st.mu.Unlock()
+
+	st.notify(st.readable)
+	return nil
+}
+
+// receiveFin records the peer's FIN
+func (st *Stream) receiveFin() {
+	st.mu.Lock()
+	st.remoteFin = true
+	finished := st.localFin
+	st.mu.Unlock()
+
+	if finished {
+		st.session.removeStream(st.id)
+	}
+	st.notify(st.readable)
+}
+
+// receiveReset records that the stream was aborted
+func (st *Stream) receiveReset() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+
+	st.session.removeStream(st.id)
+	st.notify(st.readable)
+	st.notify(st.writable)
+}
+
+// grant adds send credit from a WINDOW_UPDATE
+func (st *Stream) grant(credit uint32) {
+	st.mu.Lock()
+	st.sendWindow += credit
+	st.mu.Unlock()
+	st.notify(st.writable)
+}
+
+// consume accounts for n bytes handed to the reader and returns the credit to
+// grant back, batched to half the window to avoid a WINDOW_UPDATE per read.
+// Callers must hold st.mu.
+func (st *Stream) consume(n uint32) uint32 {
+	st.unacked += n
+	if st.unacked < DefaultStreamWindow/2 || st.remoteFin || st.closed {
+		return 0
+	}
+	credit := st.unacked
+	st.unacked = 0
+	st.recvWindow += credit
+	return credit
+}
+
+// wait blocks until ch is signalled, the deadline passes or the session closes
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.done:
+		return ErrSessionClosed
+	}
+}
+
+// notify wakes up a waiter without blocking
+func (st *Stream) notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Network returns the address network name
+func (a streamAddr) Network() string {
+	return "shipit-stream"
+}
+
+// String returns the address string form
+func (a streamAddr) String() string {
+	return fmt.Sprintf("stream-%d", a.id)
+}
+
+// WriteStreamHeader starts a transport native stream with the tunnel it
+// belongs to and its metadata, in place of the OPEN frame of a Session
+func WriteStreamHeader(w io.Writer, tunnelID string, metadata []byte) error {
+	if len(metadata) >= maxStreamMetadata {
+		return fmt.Errorf("stream metadata too large: %d bytes", len(metadata))
+	}
+	raw, err := types.ParseTunnelID(tunnelID)
+	if err != nil {
+		return fmt.Errorf("invalid tunnel ID: %w", err)
+	}
+
+	header := make([]byte, types.TunnelIDSize+2+len(metadata))
+	copy(header, raw[:])
+	binary.BigEndian.PutUint16(header[types.TunnelIDSize:], uint16(len(metadata)))
+	copy(header[types.TunnelIDSize+2:], metadata)
+
+	if _, err := w.Write(header); err != nil {
+		return fmt.Errorf("failed to write stream header: %w", err)
+	}
+	return nil
+}
+
+// ReadStreamHeader reads the header a transport native stream starts with and
+// returns the tunnel ID and metadata
+func ReadStreamHeader(r io.Reader) (string, []byte, error) {
+	header := make([]byte, types.TunnelIDSize+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, fmt.Errorf("failed to read stream header: %w", err)
+	}
+
+	var metadata []byte
+	if length := binary.BigEndian.Uint16(header[types.TunnelIDSize:]); length > 0 {
+		metadata = make([]byte, length)
+		if _, err := io.ReadFull(r, metadata); err != nil {
+			return "", nil, fmt.Errorf("failed to read stream metadata: %w", err)
+		}
+	}
+
+	return types.FormatTunnelID([types.TunnelIDSize]byte(header[:types.TunnelIDSize])), metadata, nil
+}
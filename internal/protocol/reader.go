@@ -3,6 +3,7 @@ package protocol
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -12,26 +13,49 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// frameHeaderSize is type(1) + tunnel_id(16) + payload_size(4)
+	frameHeaderSize = 21
+	// DefaultMaxFrameSize is the largest payload a reader accepts unless configured otherwise
+	DefaultMaxFrameSize = 16 * 1024 * 1024
+	// MaxFrameSizeLimit is the largest max frame size that may be configured
+	MaxFrameSizeLimit = 64 * 1024 * 1024
+)
+
+// ErrFrameTooLarge is returned when a frame announces a payload above the max frame size.
+// The payload is not consumed, so the connection cannot be used afterwards.
+var ErrFrameTooLarge = errors.New("frame too large")
+
 // Reader handles reading binary protocol messages from a connection
 type Reader struct {
-	conn   net.Conn
-	reader *bufio.Reader
-	logger *logrus.Logger
+	conn         net.Conn
+	reader       *bufio.Reader
+	logger       *logrus.Logger
+	negotiation  *Negotiation
+	header       [frameHeaderSize]byte
+	messageID    [types.MessageIDSize]byte
+	maxFrameSize int
+
+	compressor       Compressor
+	compressionStats *CompressionStats
 }
 
 // NewReader creates a new protocol reader
 func NewReader(conn net.Conn, logger *logrus.Logger) *Reader {
 	return &Reader{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
-		logger: logger,
+		conn:             conn,
+		reader:           bufio.NewReader(conn),
+		logger:           logger,
+		maxFrameSize:     DefaultMaxFrameSize,
+		compressionStats: &CompressionStats{},
 	}
 }
 
-// ReadMessage reads a complete message from the connection
+// ReadMessage reads a complete message from the connection. Payloads of stream
+// frames come from a pool, see ReleasePayload.
 func (r *Reader) ReadMessage() (*types.Message, error) {
 	// Read message header (21 bytes: type(1) + tunnel_id(16) + payload_size(4))
-	header := make([]byte, 21)
+	header := r.header[:]
 	_, err := io.ReadFull(r.reader, header)
 	if err != nil {
 		if err == io.EOF {
@@ -40,41 +64,95 @@ func (r *Reader) ReadMessage() (*types.Message, error) {
 		return nil, fmt.Errorf("failed to read message header: %w", err)
 	}
 
-	// Parse message type
-	msgType := types.MessageType(header[0])
+	// Parse message type and flags
+	var message types.Message
+	message.DecodeTypeByte(header[0])
+	msgType := message.Type
 
-	// Parse tunnel ID (16 bytes, trim null padding)
-	tunnelID := string(header[1:17])
-	tunnelID = string([]byte(tunnelID)[:len(tunnelID)-1]) // Remove null terminator
+	// Parse tunnel ID (16 raw UUID bytes)
+	tunnelID := types.FormatTunnelID([types.TunnelIDSize]byte(header[1:17]))
 
-	// Parse payload size
+	// Read the message ID that follows the header of reliable frames
+	if types.HasMessageID(header[0]) {
+		if _, err := io.ReadFull(r.reader, r.messageID[:]); err != nil {
+			return nil, fmt.Errorf("failed to read message ID: %w", err)
+		}
+		message.ID = binary.BigEndian.Uint64(r.messageID[:])
+	}
+
+	// Parse payload size, never trusting the peer with how much we allocate
 	payloadSize := binary.BigEndian.Uint32(header[17:21])
+	if uint64(payloadSize) > uint64(r.maxFrameSize) {
+		return nil, fmt.Errorf("%w: %d byte payload exceeds the %d byte limit", ErrFrameTooLarge, payloadSize, r.maxFrameSize)
+	}
 
-	// Read payload
+	// Read payload. Stream frames are released once the session copied their
+	// bytes and compressed payloads once expanded, so only those use the pool.
 	var payload []byte
-	if payloadSize > 0 {
+	if payloadSize > 0 && (types.IsStreamMessage(msgType) || message.Compressed) {
+		payload = getBuffer(int(payloadSize))
+	} else if payloadSize > 0 {
 		payload = make([]byte, payloadSize)
+	}
+	if payload != nil {
 		_, err = io.ReadFull(r.reader, payload)
 		if err != nil {
+			putBuffer(payload)
 			return nil, fmt.Errorf("failed to read message payload: %w", err)
 		}
 	}
 
-	// Create message
-	message := &types.Message{
-		Type:      msgType,
-		TunnelID:  tunnelID,
-		Payload:   payload,
-		Timestamp: time.Now(),
+	// Refuse frames the handshake did not agree on, the payload is consumed so the stream stays in sync
+	if r.negotiation != nil && !r.negotiation.Allows(msgType) {
+		putBuffer(payload)
+		return nil, fmt.Errorf("%w: %d", ErrNotNegotiated, msgType)
+	}
+	if r.negotiation != nil && message.Encoding == types.EncodingBinary && !r.negotiation.Supports(types.CapabilityBinaryPayload) {
+		putBuffer(payload)
+		return nil, fmt.Errorf("%w: binary payload", ErrNotNegotiated)
+	}
+	if r.negotiation != nil && message.ID != 0 && !r.negotiation.Supports(types.CapabilityReliableDelivery) {
+		putBuffer(payload)
+		return nil, fmt.Errorf("%w: message ID", ErrNotNegotiated)
+	}
+
+	if message.Compressed {
+		if r.compressor == nil {
+			putBuffer(payload)
+			return nil, fmt.Errorf("%w: compressed payload", ErrNotNegotiated)
+		}
+		// The compressed bytes are only needed until they are expanded
+		decompressed, err := r.compressor.Decompress(payload, r.maxFrameSize)
+		putBuffer(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress message payload: %w", err)
+		}
+		r.compressionStats.recordReceived(len(decompressed), int(payloadSize), true)
+		payload = decompressed
+		message.Compressed = false
+	} else if r.compressor != nil {
+		r.compressionStats.recordReceived(len(payload), len(payload), false)
 	}
 
-	r.logger.WithFields(logrus.Fields{
-		"message_type": msgType,
-		"tunnel_id":    tunnelID,
-		"payload_size": payloadSize,
-	}).Debug("Read message from connection")
+	// Complete message
+	message.TunnelID = tunnelID
+	message.Payload = payload
+	message.Timestamp = time.Now()
+	message.Capabilities = types.AllCapabilities
+	if r.negotiation != nil {
+		message.Capabilities = r.negotiation.Capabilities
+	}
 
-	return message, nil
+	// Skip building log fields per frame unless they are going to be printed
+	if r.logger.IsLevelEnabled(logrus.DebugLevel) {
+		r.logger.WithFields(logrus.Fields{
+			"message_type": msgType,
+			"tunnel_id":    tunnelID,
+			"payload_size": payloadSize,
+		}).Debug("Read message from connection")
+	}
+
+	return &message, nil
 }
 
 // ReadMessageWithTimeout reads a message with a timeout
@@ -122,6 +200,41 @@ func (r *Reader) ReadMessageAsync(messageChan chan<- *types.Message, errorChan c
 	}
 }
 
+// SetNegotiation applies the result of the handshake, it must be called before reads start
+func (r *Reader) SetNegotiation(negotiation *Negotiation) {
+	r.negotiation = negotiation
+
+	r.compressor = nil
+	if negotiation != nil && negotiation.Supports(types.CapabilityCompression) {
+		r.compressor, _ = GetCompressor(negotiation.Compression)
+	}
+}
+
+// SetMaxFrameSize sets the largest payload the reader accepts, also after decompression
+func (r *Reader) SetMaxFrameSize(size int) {
+	r.maxFrameSize = size
+}
+
+// GetMaxFrameSize returns the largest payload the reader accepts
+func (r *Reader) GetMaxFrameSize() int {
+	return r.maxFrameSize
+}
+
+// SetCompressionStats makes the reader count into shared stats, for example ones that outlive the connection
+func (r *Reader) SetCompressionStats(stats *CompressionStats) {
+	r.compressionStats = stats
+}
+
+// GetCompressionStats returns the compression counters of this reader
+func (r *Reader) GetCompressionStats() *CompressionStats {
+	return r.compressionStats
+}
+
+// GetNegotiation returns the result of the handshake, or nil before it completed
+func (r *Reader) GetNegotiation() *Negotiation {
+	return r.negotiation
+}
+
 // Close closes the underlying connection
 func (r *Reader) Close() error {
 	return r.conn.Close()
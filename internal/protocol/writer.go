@@ -1,76 +1,396 @@
 package protocol
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/unownone/shipitd/pkg/types"
 	"github.com/sirupsen/logrus"
 )
 
-// Writer handles writing binary protocol messages to a connection
+const (
+	// DefaultWriteQueueSize is the number of frames each priority queue holds before writers block
+	DefaultWriteQueueSize = 256
+	// writeBufferSize coalesces small frames up to the payload of one TLS record
+	writeBufferSize = 16 * 1024
+	// maxBatchFrames bounds how many queued frames are written before a requested flush happens
+	maxBatchFrames = 64
+	// closeFlushTimeout bounds how long Close spends writing the frames still queued
+	closeFlushTimeout = time.Second
+)
+
+var (
+	// ErrWriterClosed is returned for writes after the writer was closed or failed
+	ErrWriterClosed = errors.New("writer closed")
+	// ErrWriteTimeout is returned when a frame was not written in time
+	ErrWriteTimeout = errors.New("write timed out")
+)
+
+// Writer handles writing binary protocol messages to a connection. A single
+// goroutine owns the connection and writes the frames queued by any number of
+// callers. Control frames are queued apart from bulk data and jump ahead of it,
+// frames of one priority keep their order.
 type Writer struct {
-	conn   net.Conn
-	logger *logrus.Logger
+	conn         net.Conn
+	logger       *logrus.Logger
+	negotiation  *Negotiation
+	encoding     types.PayloadEncoding
+	capabilities types.Capability
+
+	compressor           Compressor
+	compressionThreshold int
+	compressionStats     *CompressionStats
+
+	buffer    *bufio.Writer
+	control   chan *queuedFrame
+	bulk      chan *queuedFrame
+	closing   chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	err       error
+}
+
+// queuedFrame is a serialized frame waiting for the writer goroutine. A frame
+// with a done channel is flushed and its result reported, data may be nil for
+// a bare flush.
+type queuedFrame struct {
+	data []byte
+	done chan error
 }
 
-// NewWriter creates a new protocol writer
+// NewWriter creates a new protocol writer and starts its writer goroutine,
+// which runs until Close is called or a write fails
 func NewWriter(conn net.Conn, logger *logrus.Logger) *Writer {
-	return &Writer{
-		conn:   conn,
-		logger: logger,
+	w := &Writer{
+		conn:                 conn,
+		logger:               logger,
+		capabilities:         types.AllCapabilities,
+		compressionThreshold: DefaultCompressionThreshold,
+		compressionStats:     &CompressionStats{},
+		buffer:               bufio.NewWriterSize(conn, writeBufferSize),
+		control:              make(chan *queuedFrame, DefaultWriteQueueSize),
+		bulk:                 make(chan *queuedFrame, DefaultWriteQueueSize),
+		closing:              make(chan struct{}),
+		stopped:              make(chan struct{}),
 	}
+	go w.run()
+	return w
 }
 
-// WriteMessage writes a message to the connection
+// WriteMessage writes a message to the connection and returns once it was
+// flushed. It blocks while the queue of its priority is full.
 func (w *Writer) WriteMessage(message *types.Message) error {
+	return w.send(message, nil)
+}
+
+// QueueMessage queues a message without waiting for it to be written, for frames
+// nobody waits on such as acknowledgments and window updates. The writer flushes
+// once its queues run empty, so queued frames share a TLS record with whatever
+// else is pending; a failed write is reported by the next call. It blocks while
+// the queue of its priority is full.
+func (w *Writer) QueueMessage(message *types.Message) error {
+	frame, err := w.frame(message)
+	if err != nil {
+		return err
+	}
+	return w.enqueue(w.queueFor(message.Type), &queuedFrame{data: frame.data}, nil)
+}
+
+// Flush writes every frame queued before it and returns once they reached the connection
+func (w *Writer) Flush() error {
+	done := make(chan error, 1)
+	if err := w.enqueue(w.bulk, &queuedFrame{done: done}, nil); err != nil {
+		return err
+	}
+	return w.wait(done, nil)
+}
+
+// serializedFrame is a message ready for the wire
+type serializedFrame struct {
+	message *types.Message
+	data    []byte
+}
+
+// frame checks a message against the negotiation, compresses and serializes it
+func (w *Writer) frame(message *types.Message) (*serializedFrame, error) {
+	// Never send the peer something the handshake did not agree on
+	if w.negotiation != nil && !w.negotiation.Allows(message.Type) {
+		return nil, fmt.Errorf("%w: %d", ErrNotNegotiated, message.Type)
+	}
+	if w.negotiation != nil && message.ID != 0 && !w.negotiation.Supports(types.CapabilityReliableDelivery) {
+		return nil, fmt.Errorf("%w: message ID", ErrNotNegotiated)
+	}
+
+	message, err := w.compress(message)
+	if err != nil {
+		return nil, err
+	}
+
 	// Serialize the message
 	data, err := message.Serialize()
 	if err != nil {
-		return fmt.Errorf("failed to serialize message: %w", err)
+		return nil, fmt.Errorf("failed to serialize message: %w", err)
 	}
 
-	// Write the message
-	_, err = w.conn.Write(data)
+	return &serializedFrame{message: message, data: data}, nil
+}
+
+// send queues a message and waits until it was flushed or the deadline fires
+func (w *Writer) send(message *types.Message, deadline <-chan time.Time) error {
+	frame, err := w.frame(message)
 	if err != nil {
-		return fmt.Errorf("failed to write message: %w", err)
+		return err
 	}
 
-	w.logger.WithFields(logrus.Fields{
-		"message_type": message.Type,
-		"tunnel_id":    message.TunnelID,
-		"payload_size": len(message.Payload),
-	}).Debug("Wrote message to connection")
+	done := make(chan error, 1)
+	if err := w.enqueue(w.queueFor(message.Type), &queuedFrame{data: frame.data, done: done}, deadline); err != nil {
+		return err
+	}
+	if err := w.wait(done, deadline); err != nil {
+		return err
+	}
+
+	if w.logger.IsLevelEnabled(logrus.DebugLevel) {
+		w.logger.WithFields(logrus.Fields{
+			"message_type": frame.message.Type,
+			"tunnel_id":    frame.message.TunnelID,
+			"payload_size": len(frame.message.Payload),
+			"compressed":   frame.message.Compressed,
+		}).Debug("Wrote message to connection")
+	}
 
 	return nil
 }
 
-// WriteMessageWithTimeout writes a message with a timeout
-func (w *Writer) WriteMessageWithTimeout(message *types.Message, timeout time.Duration) error {
-	// Set write deadline
-	err := w.conn.SetWriteDeadline(time.Now().Add(timeout))
-	if err != nil {
-		return fmt.Errorf("failed to set write deadline: %w", err)
+// queueFor returns the queue for frames of a type
+func (w *Writer) queueFor(msgType types.MessageType) chan *queuedFrame {
+	if isControlFrame(msgType) {
+		return w.control
 	}
+	return w.bulk
+}
 
-	err = w.WriteMessage(message)
-	if err != nil {
+// isControlFrame reports whether frames of a type jump ahead of queued bulk data.
+// Stream data and FIN stay in the bulk queue so a stream's bytes keep their order.
+func isControlFrame(msgType types.MessageType) bool {
+	switch msgType {
+	case types.MessageTypeHeartbeat,
+		types.MessageTypeConnectionClose,
+		types.MessageTypeError,
+		types.MessageTypeAcknowledge,
+		types.MessageTypeHello,
+		types.MessageTypeHelloAck,
+		types.MessageTypeAuth,
+		types.MessageTypeWindowUpdate,
+		types.MessageTypeStreamReset,
+		types.MessageTypeGoAway:
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueue hands a frame to the writer goroutine, blocking while the queue is full
+func (w *Writer) enqueue(queue chan *queuedFrame, item *queuedFrame, deadline <-chan time.Time) error {
+	// A stopped writer never drains its queues again
+	select {
+	case <-w.stopped:
+		return w.Err()
+	default:
+	}
+
+	select {
+	case queue <- item:
+		return nil
+	case <-w.stopped:
+		return w.Err()
+	case <-deadline:
+		return fmt.Errorf("%w: queue is full", ErrWriteTimeout)
+	}
+}
+
+// wait returns the result of a queued frame
+func (w *Writer) wait(done chan error, deadline <-chan time.Time) error {
+	select {
+	case err := <-done:
 		return err
+	case <-w.stopped:
+		// The frame may have been written right before the writer stopped
+		select {
+		case err := <-done:
+			return err
+		default:
+			return w.Err()
+		}
+	case <-deadline:
+		return ErrWriteTimeout
 	}
+}
+
+// run is the writer goroutine, the only one that writes to the connection
+func (w *Writer) run() {
+	defer close(w.stopped)
+
+	for {
+		var item *queuedFrame
+		select {
+		case item = <-w.control:
+		default:
+			select {
+			case item = <-w.control:
+			case item = <-w.bulk:
+			case <-w.closing:
+				w.drain()
+				w.fail(ErrWriterClosed)
+				return
+			}
+		}
+
+		if err := w.writeBatch(item); err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
 
-	// Clear write deadline
-	err = w.conn.SetWriteDeadline(time.Time{})
+// drain writes the frames that were queued when Close was called. Frames queued
+// after that are not waited for, writers still blocked get ErrWriterClosed.
+func (w *Writer) drain() {
+	for pending := len(w.control) + len(w.bulk); pending > 0; pending-- {
+		item := w.poll()
+		if item == nil {
+			return
+		}
+		if err := w.writeBatch(item); err != nil {
+			w.fail(err)
+			return
+		}
+	}
+}
+
+// writeBatch writes item and whatever else is queued into the buffer, so small
+// frames share a TLS record, and flushes once if any of them asked for it or
+// nothing else is queued
+func (w *Writer) writeBatch(item *queuedFrame) error {
+	var waiters []chan error
+	var err error
+	drained := false
+
+	for count := 1; ; count++ {
+		if item.data != nil && err == nil {
+			if _, writeErr := w.buffer.Write(item.data); writeErr != nil {
+				err = fmt.Errorf("failed to write message: %w", writeErr)
+			}
+		}
+		if item.done != nil {
+			waiters = append(waiters, item.done)
+		}
+
+		if count >= maxBatchFrames || err != nil {
+			break
+		}
+		if item = w.poll(); item == nil {
+			drained = true
+			break
+		}
+	}
+
+	if (len(waiters) > 0 || drained) && err == nil {
+		if flushErr := w.buffer.Flush(); flushErr != nil {
+			err = fmt.Errorf("failed to write message: %w", flushErr)
+		}
+	}
+	for _, done := range waiters {
+		done <- err
+	}
+	return err
+}
+
+// poll returns the next queued frame without blocking, control frames first
+func (w *Writer) poll() *queuedFrame {
+	select {
+	case item := <-w.control:
+		return item
+	default:
+	}
+	select {
+	case item := <-w.control:
+		return item
+	case item := <-w.bulk:
+		return item
+	default:
+		return nil
+	}
+}
+
+// fail records why the writer stopped
+func (w *Writer) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+// Err returns why the writer stopped, or nil while it is running
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// compress returns the message with its payload compressed when compression was
+// negotiated, the payload reaches the threshold and compressing actually saves bytes.
+// The caller's message is never modified.
+func (w *Writer) compress(message *types.Message) (*types.Message, error) {
+	if w.compressor == nil || message.Compressed {
+		return message, nil
+	}
+
+	before := len(message.Payload)
+	if before < w.compressionThreshold {
+		w.compressionStats.recordSent(before, before, false)
+		return message, nil
+	}
+
+	compressed, err := w.compressor.Compress(message.Payload)
 	if err != nil {
-		w.logger.WithError(err).Warn("Failed to clear write deadline")
+		return nil, fmt.Errorf("failed to compress message: %w", err)
+	}
+	if len(compressed) >= before {
+		w.compressionStats.recordSent(before, before, false)
+		return message, nil
 	}
 
-	return nil
+	w.compressionStats.recordSent(before, len(compressed), true)
+	frame := *message
+	frame.Payload = compressed
+	frame.Compressed = true
+	return &frame, nil
+}
+
+// WriteMessageWithTimeout writes a message and gives up when it was not flushed
+// within timeout. A frame that timed out while queued may still be written later.
+func (w *Writer) WriteMessageWithTimeout(message *types.Message, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	return w.send(message, timer.C)
+}
+
+// Encode creates a message in the payload encoding and binary layout negotiated for the connection
+func (w *Writer) Encode(msgType types.MessageType, tunnelID string, payload interface{}) (*types.Message, error) {
+	return types.NewNegotiatedMessage(msgType, tunnelID, payload, w.encoding, w.capabilities)
 }
 
 // WriteTunnelRegistration writes a tunnel registration message
 func (w *Writer) WriteTunnelRegistration(tunnelID string, payload *types.TunnelRegistrationPayload) error {
-	message, err := types.NewTunnelRegistrationMessage(tunnelID, payload)
+	message, err := w.Encode(types.MessageTypeTunnelRegistration, tunnelID, payload)
 	if err != nil {
 		return fmt.Errorf("failed to create tunnel registration message: %w", err)
 	}
@@ -78,9 +398,19 @@ func (w *Writer) WriteTunnelRegistration(tunnelID string, payload *types.TunnelR
 	return w.WriteMessage(message)
 }
 
+// WriteTunnelRegistered writes the answer to a tunnel registration
+func (w *Writer) WriteTunnelRegistered(tunnelID string, payload *types.TunnelRegisteredPayload) error {
+	message, err := w.Encode(types.MessageTypeTunnelRegistered, tunnelID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create tunnel registered message: %w", err)
+	}
+
+	return w.WriteMessage(message)
+}
+
 // WriteDataResponse writes a data response message
 func (w *Writer) WriteDataResponse(tunnelID string, payload *types.DataResponsePayload) error {
-	message, err := types.NewDataResponseMessage(tunnelID, payload)
+	message, err := w.Encode(types.MessageTypeDataResponse, tunnelID, payload)
 	if err != nil {
 		return fmt.Errorf("failed to create data response message: %w", err)
 	}
@@ -88,9 +418,19 @@ func (w *Writer) WriteDataResponse(tunnelID string, payload *types.DataResponseP
 	return w.WriteMessage(message)
 }
 
+// WriteDataChunk writes a data chunk message
+func (w *Writer) WriteDataChunk(tunnelID string, payload *types.DataChunkPayload) error {
+	message, err := w.Encode(types.MessageTypeDataChunk, tunnelID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create data chunk message: %w", err)
+	}
+
+	return w.WriteMessage(message)
+}
+
 // WriteHeartbeat writes a heartbeat message
 func (w *Writer) WriteHeartbeat(tunnelID string, payload *types.HeartbeatPayload) error {
-	message, err := types.NewHeartbeatMessage(tunnelID, payload)
+	message, err := w.Encode(types.MessageTypeHeartbeat, tunnelID, payload)
 	if err != nil {
 		return fmt.Errorf("failed to create heartbeat message: %w", err)
 	}
@@ -98,9 +438,19 @@ func (w *Writer) WriteHeartbeat(tunnelID string, payload *types.HeartbeatPayload
 	return w.WriteMessage(message)
 }
 
+// QueueHeartbeat queues a heartbeat message without waiting for it to be written
+func (w *Writer) QueueHeartbeat(tunnelID string, payload *types.HeartbeatPayload) error {
+	message, err := w.Encode(types.MessageTypeHeartbeat, tunnelID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create heartbeat message: %w", err)
+	}
+
+	return w.QueueMessage(message)
+}
+
 // WriteError writes an error message
 func (w *Writer) WriteError(tunnelID string, payload *types.ErrorPayload) error {
-	message, err := types.NewErrorMessage(tunnelID, payload)
+	message, err := w.Encode(types.MessageTypeError, tunnelID, payload)
 	if err != nil {
 		return fmt.Errorf("failed to create error message: %w", err)
 	}
@@ -108,9 +458,19 @@ func (w *Writer) WriteError(tunnelID string, payload *types.ErrorPayload) error
 	return w.WriteMessage(message)
 }
 
+// QueueError queues an error message without waiting for it to be written
+func (w *Writer) QueueError(tunnelID string, payload *types.ErrorPayload) error {
+	message, err := w.Encode(types.MessageTypeError, tunnelID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create error message: %w", err)
+	}
+
+	return w.QueueMessage(message)
+}
+
 // WriteAcknowledge writes an acknowledgment message
 func (w *Writer) WriteAcknowledge(tunnelID string, payload *types.AcknowledgePayload) error {
-	message, err := types.NewAcknowledgeMessage(tunnelID, payload)
+	message, err := w.Encode(types.MessageTypeAcknowledge, tunnelID, payload)
 	if err != nil {
 		return fmt.Errorf("failed to create acknowledgment message: %w", err)
 	}
@@ -118,9 +478,19 @@ func (w *Writer) WriteAcknowledge(tunnelID string, payload *types.AcknowledgePay
 	return w.WriteMessage(message)
 }
 
+// QueueAcknowledge queues an acknowledgment message without waiting for it to be written
+func (w *Writer) QueueAcknowledge(tunnelID string, payload *types.AcknowledgePayload) error {
+	message, err := w.Encode(types.MessageTypeAcknowledge, tunnelID, payload)
+	if err != nil {
+		return fmt.Errorf("failed to create acknowledgment message: %w", err)
+	}
+
+	return w.QueueMessage(message)
+}
+
 // WriteConnectionClose writes a connection close message
 func (w *Writer) WriteConnectionClose(tunnelID string, payload *types.ConnectionClosePayload) error {
-	message, err := types.NewConnectionCloseMessage(tunnelID, payload)
+	message, err := w.Encode(types.MessageTypeConnectionClose, tunnelID, payload)
 	if err != nil {
 		return fmt.Errorf("failed to create connection close message: %w", err)
 	}
@@ -128,8 +498,76 @@ func (w *Writer) WriteConnectionClose(tunnelID string, payload *types.Connection
 	return w.WriteMessage(message)
 }
 
-// Close closes the underlying connection
+// WriteGoAway writes a GOAWAY message for the whole connection
+func (w *Writer) WriteGoAway(payload *types.GoAwayPayload) error {
+	message, err := w.Encode(types.MessageTypeGoAway, "", payload)
+	if err != nil {
+		return fmt.Errorf("failed to create goaway message: %w", err)
+	}
+
+	return w.WriteMessage(message)
+}
+
+// SetNegotiation applies the result of the handshake, it must be called before writes start
+func (w *Writer) SetNegotiation(negotiation *Negotiation) {
+	w.negotiation = negotiation
+	w.capabilities = types.AllCapabilities
+	if negotiation != nil {
+		w.capabilities = negotiation.Capabilities
+	}
+
+	// Payloads stay JSON unless the peer understands the binary encoding
+	w.encoding = types.EncodingJSON
+	if negotiation != nil && negotiation.Supports(types.CapabilityBinaryPayload) {
+		w.encoding = types.EncodingBinary
+	}
+
+	w.compressor = nil
+	if negotiation != nil && negotiation.Supports(types.CapabilityCompression) {
+		w.compressor, _ = GetCompressor(negotiation.Compression)
+	}
+}
+
+// SetCompressionThreshold sets the payload size below which frames are sent uncompressed
+func (w *Writer) SetCompressionThreshold(threshold int) {
+	w.compressionThreshold = threshold
+}
+
+// SetCompressionStats makes the writer count into shared stats, for example ones that outlive the connection
+func (w *Writer) SetCompressionStats(stats *CompressionStats) {
+	w.compressionStats = stats
+}
+
+// GetCompressionStats returns the compression counters of this writer
+func (w *Writer) GetCompressionStats() *CompressionStats {
+	return w.compressionStats
+}
+
+// GetNegotiation returns the result of the handshake, or nil before it completed
+func (w *Writer) GetNegotiation() *Negotiation {
+	return w.negotiation
+}
+
+// GetEncoding returns the payload encoding used for outgoing messages
+func (w *Writer) GetEncoding() types.PayloadEncoding {
+	return w.encoding
+}
+
+// GetCapabilities returns the capabilities that select the binary layout of outgoing payloads
+func (w *Writer) GetCapabilities() types.Capability {
+	return w.capabilities
+}
+
+// Close writes the frames still queued, stops the writer goroutine and closes
+// the underlying connection. A peer that stops reading gets closeFlushTimeout
+// before the remaining frames are dropped.
 func (w *Writer) Close() error {
+	w.closeOnce.Do(func() {
+		// Also unblocks a write that is already stuck on the connection
+		w.conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		close(w.closing)
+	})
+	<-w.stopped
 	return w.conn.Close()
 }
 
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// chunkBodyLimit bounds how many bytes of a request body are buffered before
+// the local service reads them, which bounds the memory a large upload can use
+const chunkBodyLimit = 1 << 20
+
+// errChunkBodyOverflow aborts a body the local service does not read fast enough
+var errChunkBodyOverflow = errors.New("request body buffer overflowed")
+
+// chunkBody is a request body fed by DATA_CHUNK frames as they arrive. Pushing
+// never blocks, so a slow local service only holds back its own request.
+type chunkBody struct {
+	mu        sync.Mutex
+	chunks    [][]byte
+	buffered  int
+	ended     bool
+	err       error
+	next      uint32
+	current   []byte
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newChunkBody creates an empty chunk body
+func newChunkBody() *chunkBody {
+	return &chunkBody{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// push queues the next chunk. It returns true once the body is complete or
+// broken and must not be pushed to again, and errChunkBodyOverflow when the
+// chunk did not fit into the buffer.
+func (b *chunkBody) push(chunk *types.DataChunkPayload) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.signal()
+
+	select {
+	case <-b.done:
+		return true, nil
+	default:
+	}
+
+	if chunk.Sequence != b.next {
+		b.err = fmt.Errorf("body chunk %d out of order, expected %d", chunk.Sequence, b.next)
+		return true, nil
+	}
+	b.next++
+
+	if b.buffered+len(chunk.Data) > chunkBodyLimit {
+		b.err = errChunkBodyOverflow
+		return true, errChunkBodyOverflow
+	}
+	if len(chunk.Data) > 0 {
+		b.chunks = append(b.chunks, chunk.Data)
+		b.buffered += len(chunk.Data)
+	}
+
+	b.ended = chunk.End
+	return chunk.End, nil
+}
+
+// signal wakes a Read waiting for chunks
+func (b *chunkBody) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads the body, returning io.EOF after the end chunk
+func (b *chunkBody) Read(p []byte) (int, error) {
+	for len(b.current) == 0 {
+		b.mu.Lock()
+		switch {
+		case len(b.chunks) > 0:
+			b.current = b.chunks[0]
+			b.chunks[0] = nil
+			b.chunks = b.chunks[1:]
+			b.buffered -= len(b.current)
+		case b.err != nil:
+			err := b.err
+			b.mu.Unlock()
+			return 0, err
+		case b.ended:
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		b.mu.Unlock()
+
+		if len(b.current) > 0 {
+			break
+		}
+		select {
+		case <-b.ready:
+		case <-b.done:
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	n := copy(p, b.current)
+	b.current = b.current[n:]
+	return n, nil
+}
+
+// Close stops the body, failing a pending Read
+func (b *chunkBody) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+	return nil
+}
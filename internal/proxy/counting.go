@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"io"
+	"net"
+
+	"github.com/unownone/shipitd/internal/client"
+)
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.Reader
+	count func(n int)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count(n)
+	return n, err
+}
+
+// countingConn counts the bytes read from the server side of a connection as
+// bytes in and the bytes written to it as bytes out
+type countingConn struct {
+	net.Conn
+	counters *client.TunnelCounters
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.counters.AddBytesIn(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.counters.AddBytesOut(n)
+	return n, err
+}
@@ -0,0 +1,447 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/internal/client"
+	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// Dispatcher owns one HTTP or TCP proxy per active tunnel and forwards
+// data plane messages to them, sending the results back through a ResponseSender
+type Dispatcher struct {
+	sender      client.ResponseSender
+	logger      *logrus.Logger
+	httpProxies map[string]*HTTPProxy
+	tcpProxies  map[string]*TCPProxy
+	tcpStreams  map[string]*tcpStream
+	bodies      map[string]*chunkBody
+	streamSeq   atomic.Uint64
+	mutex       sync.RWMutex
+}
+
+// tcpStream is the client side of a TCP connection forwarded through the data plane.
+// Writes are queued so data reaches the local service in the order it arrived,
+// including data that arrives while the local service is still being dialed.
+type tcpStream struct {
+	tunnelID     string
+	connectionID string
+	mu           sync.Mutex
+	conn         net.Conn
+	writes       chan []byte
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewDispatcher creates a new dispatcher that replies through sender
+func NewDispatcher(sender client.ResponseSender, logger *logrus.Logger) *Dispatcher {
+	return &Dispatcher{
+		sender:      sender,
+		logger:      logger,
+		httpProxies: make(map[string]*HTTPProxy),
+		tcpProxies:  make(map[string]*TCPProxy),
+		tcpStreams:  make(map[string]*tcpStream),
+		bodies:      make(map[string]*chunkBody),
+	}
+}
+
+// AddTunnel creates the proxy for a tunnel based on its protocol
+func (d *Dispatcher) AddTunnel(tunnel *client.Tunnel) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	switch tunnel.Protocol {
+	case "http":
+		d.httpProxies[tunnel.ID] = NewHTTPProxy(tunnel.LocalPort, tunnel, d.logger)
+	case "tcp":
+		d.tcpProxies[tunnel.ID] = NewTCPProxy(tunnel.LocalPort, tunnel, d.logger)
+	default:
+		return fmt.Errorf("unsupported tunnel protocol: %s", tunnel.Protocol)
+	}
+
+	d.logger.WithFields(logrus.Fields{
+		"tunnel_id":  tunnel.ID,
+		"protocol":   tunnel.Protocol,
+		"local_port": tunnel.LocalPort,
+	}).Info("Added tunnel to dispatcher")
+
+	return nil
+}
+
+// RemoveTunnel drops the proxy for a tunnel and closes its connections
+func (d *Dispatcher) RemoveTunnel(tunnelID string) {
+	d.mutex.Lock()
+	tcpProxy := d.tcpProxies[tunnelID]
+	delete(d.httpProxies, tunnelID)
+	delete(d.tcpProxies, tunnelID)
+
+	var streams []*tcpStream
+	for key, stream := range d.tcpStreams {
+		if stream.tunnelID == tunnelID {
+			streams = append(streams, stream)
+			delete(d.tcpStreams, key)
+		}
+	}
+
+	var bodies []*chunkBody
+	for key, body := range d.bodies {
+		if strings.HasPrefix(key, tunnelID+"/") {
+			bodies = append(bodies, body)
+			delete(d.bodies, key)
+		}
+	}
+	d.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.close()
+	}
+	for _, body := range bodies {
+		body.Close()
+	}
+	if tcpProxy != nil {
+		tcpProxy.CloseAllConnections()
+	}
+
+	d.logger.WithField("tunnel_id", tunnelID).Info("Removed tunnel from dispatcher")
+}
+
+// HandleDataForward forwards a data forward payload to the tunnel's proxy
+func (d *Dispatcher) HandleDataForward(tunnelID string, payload *types.DataForwardPayload) {
+	d.mutex.RLock()
+	httpProxy := d.httpProxies[tunnelID]
+	tcpProxy := d.tcpProxies[tunnelID]
+	d.mutex.RUnlock()
+
+	switch {
+	case httpProxy != nil:
+		// Register a streamed body now so chunks that follow find it
+		var body *chunkBody
+		if payload.Streaming {
+			body = newChunkBody()
+			d.mutex.Lock()
+			d.bodies[streamKey(tunnelID, payload.RequestID)] = body
+			d.mutex.Unlock()
+		}
+		go d.serveHTTP(tunnelID, httpProxy, payload, body)
+	case tcpProxy != nil:
+		d.serveTCP(tunnelID, tcpProxy, payload)
+	default:
+		d.logger.WithField("tunnel_id", tunnelID).Warn("Data forward for unknown tunnel")
+		d.sendError(tunnelID, types.ErrorCodeUnknownTunnel, "Tunnel is not active on this client", payload.RequestID)
+	}
+}
+
+// HandleDataChunk feeds a chunk to the streamed body of its request. It never
+// blocks, a request whose local service falls too far behind is aborted alone.
+func (d *Dispatcher) HandleDataChunk(tunnelID string, payload *types.DataChunkPayload) {
+	key := streamKey(tunnelID, payload.RequestID)
+
+	d.mutex.RLock()
+	body, exists := d.bodies[key]
+	d.mutex.RUnlock()
+
+	if !exists {
+		d.logger.WithFields(logrus.Fields{
+			"tunnel_id":  tunnelID,
+			"request_id": payload.RequestID,
+		}).Warn("Body chunk for unknown request")
+		d.sendError(tunnelID, types.ErrorCodeUnknownRequest, "Request is not streaming a body", payload.RequestID)
+		return
+	}
+
+	finished, err := body.push(payload)
+	if err != nil {
+		d.logger.WithError(err).WithFields(logrus.Fields{
+			"tunnel_id":  tunnelID,
+			"request_id": payload.RequestID,
+		}).Warn("Aborting streamed request body")
+		d.sendError(tunnelID, types.ErrorCodeBodyOverflow, "Local service is not reading the request body", payload.RequestID)
+	}
+	if finished {
+		d.removeBody(key, body)
+	}
+}
+
+// HandleConnectionClose closes a forwarded TCP connection
+func (d *Dispatcher) HandleConnectionClose(tunnelID string, payload *types.ConnectionClosePayload) {
+	key := streamKey(tunnelID, payload.ConnectionID)
+
+	d.mutex.Lock()
+	stream, exists := d.tcpStreams[key]
+	delete(d.tcpStreams, key)
+	d.mutex.Unlock()
+
+	if !exists {
+		return
+	}
+
+	d.logger.WithFields(logrus.Fields{
+		"tunnel_id":     tunnelID,
+		"connection_id": payload.ConnectionID,
+		"reason":        payload.Reason,
+	}).Debug("Server closed forwarded connection")
+
+	stream.close()
+}
+
+// HandleStream serves a multiplexed stream with the proxy of its tunnel. HTTP
+// streams carry HTTP/1.1 requests, TCP streams carry the raw connection bytes.
+func (d *Dispatcher) HandleStream(stream protocol.TunnelStream) {
+	tunnelID := stream.TunnelID()
+
+	d.mutex.RLock()
+	httpProxy := d.httpProxies[tunnelID]
+	tcpProxy := d.tcpProxies[tunnelID]
+	d.mutex.RUnlock()
+
+	switch {
+	case httpProxy != nil:
+		if err := httpProxy.ServeStream(stream); err != nil {
+			d.logger.WithError(err).WithField("stream_id", stream.ID()).Debug("HTTP stream ended with error")
+		}
+	case tcpProxy != nil:
+		// Stream IDs restart with every session and QUIC streams share the server
+		// address, so neither is unique among the connections of a tunnel
+		connectionID := fmt.Sprintf("%s#%d", stream.RemoteAddr(), d.streamSeq.Add(1))
+		if err := tcpProxy.HandleConnection(connectionID, stream); err != nil {
+			d.logger.WithError(err).WithField("stream_id", stream.ID()).Error("Failed to open TCP connection")
+			stream.Reset(types.ErrorCodeLocalService)
+		}
+	default:
+		d.logger.WithField("tunnel_id", tunnelID).Warn("Stream for unknown tunnel")
+		stream.Reset(types.ErrorCodeUnknownTunnel)
+	}
+}
+
+// serveHTTP runs a request against the local service and sends the response back,
+// streaming it in chunks when the connection supports it
+func (d *Dispatcher) serveHTTP(tunnelID string, httpProxy *HTTPProxy, payload *types.DataForwardPayload, body *chunkBody) {
+	if body != nil {
+		defer func() {
+			body.Close()
+			d.removeBody(streamKey(tunnelID, payload.RequestID), body)
+		}()
+	}
+
+	if d.sender.Supports(types.CapabilityStreaming) {
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = body
+		}
+		if err := httpProxy.StreamRequest(payload, bodyReader, d.sender); err != nil {
+			d.logger.WithError(err).WithField("request_id", payload.RequestID).Error("HTTP proxy failed")
+		}
+		return
+	}
+
+	response, err := httpProxy.HandleRequest(payload)
+	if err != nil {
+		d.logger.WithError(err).WithField("request_id", payload.RequestID).Error("HTTP proxy failed")
+		d.sendError(tunnelID, types.ErrorCodeLocalService, "Failed to handle request", err.Error())
+		return
+	}
+
+	if err := d.sender.SendDataResponse(tunnelID, response); err != nil {
+		d.logger.WithError(err).WithField("request_id", payload.RequestID).Error("Failed to send data response")
+	}
+}
+
+// serveTCP writes forwarded bytes to the local connection, opening it on first use
+func (d *Dispatcher) serveTCP(tunnelID string, tcpProxy *TCPProxy, payload *types.DataForwardPayload) {
+	key := streamKey(tunnelID, payload.ConnectionID)
+
+	// The stream is registered before the local service is dialed, so data that
+	// follows queues behind it and other tunnels are not held up by a slow dial
+	d.mutex.Lock()
+	stream, exists := d.tcpStreams[key]
+	if !exists {
+		stream = &tcpStream{
+			tunnelID:     tunnelID,
+			connectionID: payload.ConnectionID,
+			writes:       make(chan []byte, 64),
+			done:         make(chan struct{}),
+		}
+		d.tcpStreams[key] = stream
+	}
+	d.mutex.Unlock()
+
+	if !exists {
+		go d.openTCPStream(stream, tcpProxy)
+	}
+
+	if len(payload.Data) > 0 {
+		stream.write(payload.Data)
+	}
+}
+
+// openTCPStream connects a pending stream to the local service through the TCP
+// proxy and starts pumping in both directions
+func (d *Dispatcher) openTCPStream(stream *tcpStream, tcpProxy *TCPProxy) {
+	serverSide, clientSide := net.Pipe()
+
+	if err := tcpProxy.HandleConnection(stream.connectionID, serverSide); err != nil {
+		clientSide.Close()
+
+		key := streamKey(stream.tunnelID, stream.connectionID)
+		d.mutex.Lock()
+		if d.tcpStreams[key] == stream {
+			delete(d.tcpStreams, key)
+		}
+		d.mutex.Unlock()
+		stream.close()
+
+		d.logger.WithError(err).WithField("connection_id", stream.connectionID).Error("Failed to open TCP connection")
+		d.sendError(stream.tunnelID, types.ErrorCodeLocalService, "Failed to connect to local service", err.Error())
+		return
+	}
+
+	// The server may have closed the connection while it was dialed
+	if !stream.attach(clientSide) {
+		clientSide.Close()
+		return
+	}
+
+	go stream.pumpWrites()
+	go d.pumpReads(stream)
+}
+
+// pumpReads sends bytes from the local service back to the server until the connection closes
+func (d *Dispatcher) pumpReads(stream *tcpStream) {
+	defer func() {
+		// Only tell the server when the close started on our side
+		key := streamKey(stream.tunnelID, stream.connectionID)
+		d.mutex.Lock()
+		localClose := d.tcpStreams[key] == stream
+		if localClose {
+			delete(d.tcpStreams, key)
+		}
+		d.mutex.Unlock()
+
+		stream.close()
+
+		if localClose {
+			if err := d.sender.SendConnectionClose(stream.tunnelID, stream.connectionID, "local connection closed"); err != nil {
+				d.logger.WithError(err).Debug("Failed to send connection close")
+			}
+		}
+	}()
+
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := stream.conn.Read(buffer)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buffer[:n])
+
+			response := &types.DataResponsePayload{
+				ConnectionID: stream.connectionID,
+				Data:         data,
+			}
+			if sendErr := d.sender.SendDataResponse(stream.tunnelID, response); sendErr != nil {
+				d.logger.WithError(sendErr).WithField("connection_id", stream.connectionID).Error("Failed to send TCP data")
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// removeBody forgets a streamed body unless it was already replaced
+func (d *Dispatcher) removeBody(key string, body *chunkBody) {
+	d.mutex.Lock()
+	if d.bodies[key] == body {
+		delete(d.bodies, key)
+	}
+	d.mutex.Unlock()
+}
+
+// sendError reports a forwarding failure to the server
+func (d *Dispatcher) sendError(tunnelID, code, message, details string) {
+	if err := d.sender.SendError(tunnelID, code, message, details); err != nil {
+		d.logger.WithError(err).Error("Failed to send error message")
+	}
+}
+
+// GetTunnelCounters returns the traffic counters kept by the proxy of a tunnel
+func (d *Dispatcher) GetTunnelCounters(tunnelID string) *client.TunnelCounters {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if httpProxy, exists := d.httpProxies[tunnelID]; exists {
+		return httpProxy.GetCounters()
+	}
+	if tcpProxy, exists := d.tcpProxies[tunnelID]; exists {
+		return tcpProxy.GetCounters()
+	}
+	return nil
+}
+
+// GetTunnelCount returns the number of tunnels with an active proxy
+func (d *Dispatcher) GetTunnelCount() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return len(d.httpProxies) + len(d.tcpProxies)
+}
+
+// write queues data for the local service, dropping it if the stream is closed
+func (s *tcpStream) write(data []byte) {
+	select {
+	case s.writes <- data:
+	case <-s.done:
+	}
+}
+
+// pumpWrites copies queued data into the pipe
+func (s *tcpStream) pumpWrites() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case data := <-s.writes:
+			if _, err := s.conn.Write(data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// attach sets the pipe of a stream once it is connected, failing when the stream was closed meanwhile
+func (s *tcpStream) attach(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	s.conn = conn
+	return true
+}
+
+// close closes the pipe, if it is connected yet, and stops the write pump
+func (s *tcpStream) close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		close(s.done)
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	})
+}
+
+// streamKey builds the map key for a forwarded TCP connection
+func streamKey(tunnelID, connectionID string) string {
+	return tunnelID + "/" + connectionID
+}
@@ -0,0 +1,557 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/internal/client"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// recordingSender captures everything the dispatcher sends back to the server
+type recordingSender struct {
+	responses    chan *types.DataResponsePayload
+	chunks       chan *types.DataChunkPayload
+	errors       chan string
+	closes       chan string
+	capabilities types.Capability
+}
+
+func newRecordingSender() *recordingSender {
+	return &recordingSender{
+		responses: make(chan *types.DataResponsePayload, 16),
+		chunks:    make(chan *types.DataChunkPayload, 256),
+		errors:    make(chan string, 16),
+		closes:    make(chan string, 16),
+	}
+}
+
+func (r *recordingSender) SendDataResponse(tunnelID string, payload *types.DataResponsePayload) error {
+	r.responses <- payload
+	return nil
+}
+
+func (r *recordingSender) SendDataChunk(tunnelID string, payload *types.DataChunkPayload) error {
+	chunk := *payload
+	chunk.Data = append([]byte(nil), payload.Data...)
+	r.chunks <- &chunk
+	return nil
+}
+
+func (r *recordingSender) Supports(capability types.Capability) bool {
+	return r.capabilities.Has(capability)
+}
+
+func (r *recordingSender) SendError(tunnelID string, code, message, details string) error {
+	r.errors <- code
+	return nil
+}
+
+func (r *recordingSender) SendConnectionClose(tunnelID, connectionID, reason string) error {
+	r.closes <- connectionID
+	return nil
+}
+
+func listenerPort(t *testing.T, addr net.Addr) int {
+	_, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatalf("Failed to parse address %s: %v", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("Failed to parse port %s: %v", portStr, err)
+	}
+	return port
+}
+
+func TestDispatcherForwardsHTTPRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer server.Close()
+
+	port := listenerPort(t, server.Listener.Addr())
+	sender := newRecordingSender()
+	dispatcher := NewDispatcher(sender, logrus.New())
+
+	tunnel := &client.Tunnel{ID: "http-tunnel", Protocol: "http", LocalPort: port}
+	if err := dispatcher.AddTunnel(tunnel); err != nil {
+		t.Fatalf("Expected no error adding tunnel, got %v", err)
+	}
+
+	dispatcher.HandleDataForward("http-tunnel", &types.DataForwardPayload{
+		ConnectionID: "conn-1",
+		RequestID:    "req-1",
+		Method:       "POST",
+		Path:         "/items",
+	})
+
+	select {
+	case response := <-sender.responses:
+		if response.RequestID != "req-1" {
+			t.Errorf("Expected request ID 'req-1', got %s", response.RequestID)
+		}
+		if response.StatusCode != http.StatusCreated {
+			t.Errorf("Expected status code %d, got %d", http.StatusCreated, response.StatusCode)
+		}
+		if string(response.Data) != "created" {
+			t.Errorf("Expected body 'created', got %q", response.Data)
+		}
+		if response.Headers["X-Path"] != "/items" {
+			t.Errorf("Expected X-Path '/items', got %s", response.Headers["X-Path"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for data response")
+	}
+}
+
+func TestDispatcherUnknownTunnel(t *testing.T) {
+	sender := newRecordingSender()
+	dispatcher := NewDispatcher(sender, logrus.New())
+
+	dispatcher.HandleDataForward("missing", &types.DataForwardPayload{RequestID: "req-1"})
+
+	select {
+	case code := <-sender.errors:
+		if code != types.ErrorCodeUnknownTunnel {
+			t.Errorf("Expected error code %s, got %s", types.ErrorCodeUnknownTunnel, code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for error message")
+	}
+}
+
+func TestDispatcherForwardsTCPData(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// Echo server standing in for the local service
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buffer := make([]byte, 1024)
+		n, _ := conn.Read(buffer)
+		conn.Write(buffer[:n])
+	}()
+
+	sender := newRecordingSender()
+	dispatcher := NewDispatcher(sender, logrus.New())
+
+	tunnel := &client.Tunnel{ID: "tcp-tunnel", Protocol: "tcp", LocalPort: listenerPort(t, listener.Addr())}
+	if err := dispatcher.AddTunnel(tunnel); err != nil {
+		t.Fatalf("Expected no error adding tunnel, got %v", err)
+	}
+
+	dispatcher.HandleDataForward("tcp-tunnel", &types.DataForwardPayload{
+		ConnectionID: "conn-1",
+		Data:         []byte("ping"),
+	})
+
+	select {
+	case response := <-sender.responses:
+		if response.ConnectionID != "conn-1" {
+			t.Errorf("Expected connection ID 'conn-1', got %s", response.ConnectionID)
+		}
+		if string(response.Data) != "ping" {
+			t.Errorf("Expected echoed data 'ping', got %q", response.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for TCP data")
+	}
+
+	select {
+	case connectionID := <-sender.closes:
+		if connectionID != "conn-1" {
+			t.Errorf("Expected close for 'conn-1', got %s", connectionID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for connection close")
+	}
+
+	dispatcher.RemoveTunnel("tcp-tunnel")
+	if dispatcher.GetTunnelCount() != 0 {
+		t.Errorf("Expected no tunnels after removal, got %d", dispatcher.GetTunnelCount())
+	}
+}
+
+func TestDispatcherReportsFailedTCPDial(t *testing.T) {
+	// Take a free port and close it again, so nothing listens on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	port := listenerPort(t, listener.Addr())
+	listener.Close()
+
+	sender := newRecordingSender()
+	dispatcher := NewDispatcher(sender, logrus.New())
+	if err := dispatcher.AddTunnel(&client.Tunnel{ID: "tcp-tunnel", Protocol: "tcp", LocalPort: port}); err != nil {
+		t.Fatalf("Expected no error adding tunnel, got %v", err)
+	}
+
+	// The dial runs in the background, the data is queued behind it
+	dispatcher.HandleDataForward("tcp-tunnel", &types.DataForwardPayload{ConnectionID: "conn-1", Data: []byte("ping")})
+	dispatcher.HandleDataForward("tcp-tunnel", &types.DataForwardPayload{ConnectionID: "conn-1", Data: []byte("pong")})
+
+	select {
+	case code := <-sender.errors:
+		if code != types.ErrorCodeLocalService {
+			t.Errorf("Expected error code %s, got %s", types.ErrorCodeLocalService, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for error message")
+	}
+
+	select {
+	case connectionID := <-sender.closes:
+		t.Errorf("Expected no close for a connection that never opened, got %s", connectionID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDispatcherStreamsHTTPBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Echo the upload back three times so the response spans several chunks
+		body, _ := io.ReadAll(r.Body)
+		for i := 0; i < 3; i++ {
+			w.Write(body)
+		}
+	}))
+	defer server.Close()
+
+	sender := newRecordingSender()
+	sender.capabilities = types.CapabilityStreaming
+	dispatcher := NewDispatcher(sender, logrus.New())
+
+	tunnel := &client.Tunnel{ID: "http-tunnel", Protocol: "http", LocalPort: listenerPort(t, server.Listener.Addr())}
+	if err := dispatcher.AddTunnel(tunnel); err != nil {
+		t.Fatalf("Expected no error adding tunnel, got %v", err)
+	}
+
+	upload := bytes.Repeat([]byte("x"), 3*responseChunkSize/2)
+	dispatcher.HandleDataForward("http-tunnel", &types.DataForwardPayload{
+		RequestID: "req-1",
+		Method:    "PUT",
+		Path:      "/artifact",
+		Streaming: true,
+	})
+	dispatcher.HandleDataChunk("http-tunnel", &types.DataChunkPayload{RequestID: "req-1", Sequence: 0, Data: upload[:responseChunkSize]})
+	dispatcher.HandleDataChunk("http-tunnel", &types.DataChunkPayload{RequestID: "req-1", Sequence: 1, Data: upload[responseChunkSize:], End: true})
+
+	select {
+	case response := <-sender.responses:
+		if !response.Streaming {
+			t.Error("Expected a streaming response head")
+		}
+		if len(response.Data) != 0 {
+			t.Errorf("Expected no inline body, got %d bytes", len(response.Data))
+		}
+		if response.StatusCode != http.StatusOK {
+			t.Errorf("Expected status code %d, got %d", http.StatusOK, response.StatusCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for response head")
+	}
+
+	var received []byte
+	for expected := uint32(0); ; expected++ {
+		select {
+		case chunk := <-sender.chunks:
+			if chunk.Sequence != expected {
+				t.Fatalf("Expected chunk %d, got %d", expected, chunk.Sequence)
+			}
+			if len(chunk.Data) > responseChunkSize {
+				t.Errorf("Expected chunks of at most %d bytes, got %d", responseChunkSize, len(chunk.Data))
+			}
+			received = append(received, chunk.Data...)
+			if !chunk.End {
+				continue
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for body chunks")
+		}
+		break
+	}
+
+	if !bytes.Equal(received, bytes.Repeat(upload, 3)) {
+		t.Errorf("Expected %d echoed bytes, got %d", 3*len(upload), len(received))
+	}
+}
+
+func TestDispatcherAbortsOverflowingBodyAlone(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	sender := newRecordingSender()
+	sender.capabilities = types.CapabilityStreaming
+	dispatcher := NewDispatcher(sender, logrus.New())
+	if err := dispatcher.AddTunnel(&client.Tunnel{ID: "http-tunnel", Protocol: "http", LocalPort: listenerPort(t, server.Listener.Addr())}); err != nil {
+		t.Fatalf("Expected no error adding tunnel, got %v", err)
+	}
+
+	for _, requestID := range []string{"big", "small"} {
+		dispatcher.HandleDataForward("http-tunnel", &types.DataForwardPayload{
+			RequestID: requestID,
+			Method:    "PUT",
+			Path:      "/upload",
+			Streaming: true,
+		})
+	}
+
+	// A chunk beyond the buffer aborts its request without waiting for the local service
+	pushed := make(chan struct{})
+	go func() {
+		dispatcher.HandleDataChunk("http-tunnel", &types.DataChunkPayload{RequestID: "big", Data: make([]byte, chunkBodyLimit+1)})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected pushing a chunk not to block")
+	}
+
+	select {
+	case code := <-sender.errors:
+		if code != types.ErrorCodeBodyOverflow {
+			t.Errorf("Expected error code %s, got %s", types.ErrorCodeBodyOverflow, code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for overflow error")
+	}
+
+	// The other request of the tunnel is not affected
+	dispatcher.HandleDataChunk("http-tunnel", &types.DataChunkPayload{RequestID: "small", Data: []byte("ok"), End: true})
+	var received []byte
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case chunk := <-sender.chunks:
+			if chunk.RequestID != "small" {
+				continue
+			}
+			received = append(received, chunk.Data...)
+			if !chunk.End {
+				continue
+			}
+		case <-deadline:
+			t.Fatal("Timed out waiting for the small request's response")
+		}
+		break
+	}
+	if string(received) != "ok" {
+		t.Errorf("Expected the small body echoed, got %q", received)
+	}
+}
+
+func TestDispatcherRejectsChunkForUnknownRequest(t *testing.T) {
+	sender := newRecordingSender()
+	dispatcher := NewDispatcher(sender, logrus.New())
+
+	dispatcher.HandleDataChunk("http-tunnel", &types.DataChunkPayload{RequestID: "missing", End: true})
+
+	select {
+	case code := <-sender.errors:
+		if code != types.ErrorCodeUnknownRequest {
+			t.Errorf("Expected error code %s, got %s", types.ErrorCodeUnknownRequest, code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for error message")
+	}
+}
+
+func TestDispatcherCountsHTTPTraffic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	port := listenerPort(t, server.Listener.Addr())
+
+	sender := newRecordingSender()
+	dispatcher := NewDispatcher(sender, logrus.New())
+	if err := dispatcher.AddTunnel(&client.Tunnel{ID: "http-tunnel", Protocol: "http", LocalPort: port}); err != nil {
+		t.Fatalf("Expected no error adding tunnel, got %v", err)
+	}
+
+	forward := func(requestID string) {
+		dispatcher.HandleDataForward("http-tunnel", &types.DataForwardPayload{
+			RequestID: requestID,
+			Method:    "POST",
+			Path:      "/",
+			Data:      []byte("payload"),
+		})
+		select {
+		case <-sender.responses:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for data response")
+		}
+	}
+
+	forward("req-1")
+	server.Close()
+	forward("req-2")
+
+	counters := dispatcher.GetTunnelCounters("http-tunnel").Snapshot()
+	if counters.TotalRequests != 2 {
+		t.Errorf("Expected 2 requests, got %d", counters.TotalRequests)
+	}
+	if counters.BytesIn != 14 {
+		t.Errorf("Expected 14 bytes in, got %d", counters.BytesIn)
+	}
+	if counters.BytesOut != 5 {
+		t.Errorf("Expected 5 bytes out, got %d", counters.BytesOut)
+	}
+	if counters.Errors != 1 {
+		t.Errorf("Expected 1 error for the unreachable service, got %d", counters.Errors)
+	}
+	if counters.ActiveConns != 0 {
+		t.Errorf("Expected no active connections, got %d", counters.ActiveConns)
+	}
+
+	if dispatcher.GetTunnelCounters("missing") != nil {
+		t.Error("Expected no counters for an unknown tunnel")
+	}
+}
+
+func TestDispatcherCountsTCPTraffic(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// Echo server that keeps the connection open until the client closes it
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	sender := newRecordingSender()
+	dispatcher := NewDispatcher(sender, logrus.New())
+	if err := dispatcher.AddTunnel(&client.Tunnel{ID: "tcp-tunnel", Protocol: "tcp", LocalPort: listenerPort(t, listener.Addr())}); err != nil {
+		t.Fatalf("Expected no error adding tunnel, got %v", err)
+	}
+
+	dispatcher.HandleDataForward("tcp-tunnel", &types.DataForwardPayload{ConnectionID: "conn-1", Data: []byte("ping")})
+	select {
+	case <-sender.responses:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for TCP data")
+	}
+
+	// The proxy counts a write once it returned, which may be after the data was forwarded
+	counters := dispatcher.GetTunnelCounters("tcp-tunnel")
+	waitForCounters := func(done func(snapshot client.TunnelCountersSnapshot) bool) client.TunnelCountersSnapshot {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			snapshot := counters.Snapshot()
+			if done(snapshot) || time.Now().After(deadline) {
+				return snapshot
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	snapshot := waitForCounters(func(snapshot client.TunnelCountersSnapshot) bool {
+		return snapshot.BytesOut == 4
+	})
+	if snapshot.ActiveConns != 1 || snapshot.TotalRequests != 1 {
+		t.Errorf("Expected 1 active connection out of 1, got %d of %d", snapshot.ActiveConns, snapshot.TotalRequests)
+	}
+	if snapshot.BytesIn != 4 || snapshot.BytesOut != 4 {
+		t.Errorf("Expected 4 bytes in each direction, got %d in and %d out", snapshot.BytesIn, snapshot.BytesOut)
+	}
+
+	dispatcher.HandleConnectionClose("tcp-tunnel", &types.ConnectionClosePayload{ConnectionID: "conn-1"})
+	snapshot = waitForCounters(func(snapshot client.TunnelCountersSnapshot) bool {
+		return snapshot.ActiveConns == 0
+	})
+	if snapshot.ActiveConns != 0 {
+		t.Errorf("Expected the closed connection to be counted as closed, got %d active", snapshot.ActiveConns)
+	}
+}
+
+var fixedStreamAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+
+// fixedStream is a tunnel stream that reports the same ID and address as every other
+type fixedStream struct {
+	net.Conn
+	tunnelID string
+}
+
+func (s *fixedStream) ID() uint32                { return 1 }
+func (s *fixedStream) TunnelID() string          { return s.tunnelID }
+func (s *fixedStream) Metadata() []byte          { return nil }
+func (s *fixedStream) RemoteAddr() net.Addr      { return fixedStreamAddr }
+func (s *fixedStream) CloseWrite() error         { return s.Close() }
+func (s *fixedStream) Reset(reason string) error { return s.Close() }
+
+func TestDispatcherKeepsStreamsWithSameIDApart(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	dispatcher := NewDispatcher(newRecordingSender(), logrus.New())
+	if err := dispatcher.AddTunnel(&client.Tunnel{ID: "tcp-tunnel", Protocol: "tcp", LocalPort: listenerPort(t, listener.Addr())}); err != nil {
+		t.Fatalf("Expected no error adding tunnel, got %v", err)
+	}
+
+	// Streams of two sessions, or of one QUIC connection, may look alike
+	var peers []net.Conn
+	for i := 0; i < 2; i++ {
+		serverSide, clientSide := net.Pipe()
+		defer serverSide.Close()
+		peers = append(peers, serverSide)
+		dispatcher.HandleStream(&fixedStream{Conn: clientSide, tunnelID: "tcp-tunnel"})
+	}
+
+	stats := dispatcher.tcpProxies["tcp-tunnel"].GetConnectionStats()
+	if stats["total_connections"] != 2 {
+		t.Fatalf("Expected 2 tracked connections, got %v", stats["total_connections"])
+	}
+
+	// Closing one stream must leave the other open and reachable
+	peers[0].Close()
+	peers[1].SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peers[1].Write([]byte("ping")); err != nil {
+		t.Fatalf("Expected the second stream to stay open, got %v", err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(peers[1], reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("Expected 'ping' echoed on the second stream, got %q (%v)", reply, err)
+	}
+}
@@ -1,11 +1,14 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,18 +17,22 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// responseChunkSize is the size of the DATA_CHUNK frames a streamed response body is split into
+const responseChunkSize = 32 * 1024
+
 // HTTPProxy handles HTTP request forwarding from ShipIt server to local services
 type HTTPProxy struct {
 	localPort int
 	tunnel    *client.Tunnel
 	logger    *logrus.Logger
 	client    *http.Client
+	counters  *client.TunnelCounters
 }
 
 // NewHTTPProxy creates a new HTTP proxy instance
 func NewHTTPProxy(localPort int, tunnel *client.Tunnel, logger *logrus.Logger) *HTTPProxy {
 	// Create HTTP client with reasonable timeouts
-	client := &http.Client{
+	httpClient := &http.Client{
 		Timeout: 30 * time.Second,
 		Transport: &http.Transport{
 			DialContext: (&net.Dialer{
@@ -42,7 +49,8 @@ func NewHTTPProxy(localPort int, tunnel *client.Tunnel, logger *logrus.Logger) *
 		localPort: localPort,
 		tunnel:    tunnel,
 		logger:    logger,
-		client:    client,
+		client:    httpClient,
+		counters:  &client.TunnelCounters{},
 	}
 }
 
@@ -60,11 +68,17 @@ func (hp *HTTPProxy) HandleRequest(req *types.DataForwardPayload) (*types.DataRe
 		"local_port":    hp.localPort,
 	}).Debug("Handling HTTP request")
 
+	hp.counters.AddRequest()
+	hp.counters.ConnectionOpened()
+	defer hp.counters.ConnectionClosed()
+	hp.counters.AddBytesIn(len(req.Data))
+
 	// Create HTTP request for local service
 	localURL := fmt.Sprintf("http://localhost:%d%s", hp.localPort, req.Path)
 	httpReq, err := http.NewRequest(req.Method, localURL, strings.NewReader(string(req.Data)))
 	if err != nil {
 		hp.logger.WithError(err).Error("Failed to create HTTP request")
+		hp.counters.AddError()
 		return hp.createErrorResponse(req, http.StatusInternalServerError, "Failed to create request"), nil
 	}
 
@@ -85,6 +99,7 @@ func (hp *HTTPProxy) HandleRequest(req *types.DataForwardPayload) (*types.DataRe
 	resp, err := hp.client.Do(httpReq)
 	if err != nil {
 		hp.logger.WithError(err).Error("Failed to forward request to local service")
+		hp.counters.AddError()
 		return hp.createErrorResponse(req, http.StatusBadGateway, "Failed to connect to local service"), nil
 	}
 	defer resp.Body.Close()
@@ -93,8 +108,10 @@ func (hp *HTTPProxy) HandleRequest(req *types.DataForwardPayload) (*types.DataRe
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		hp.logger.WithError(err).Error("Failed to read response body")
+		hp.counters.AddError()
 		return hp.createErrorResponse(req, http.StatusInternalServerError, "Failed to read response"), nil
 	}
+	hp.counters.AddBytesOut(len(body))
 
 	// Convert response headers
 	headers := make(map[string]string)
@@ -125,6 +142,212 @@ func (hp *HTTPProxy) HandleRequest(req *types.DataForwardPayload) (*types.DataRe
 	return response, nil
 }
 
+// StreamRequest forwards a request to the local service and streams the response
+// back as a DataResponsePayload head followed by DATA_CHUNK frames, so memory use
+// stays bounded whatever the body size. body carries a streamed request body, or
+// nil to use req.Data.
+func (hp *HTTPProxy) StreamRequest(req *types.DataForwardPayload, body io.Reader, sender client.ResponseSender) error {
+	startTime := time.Now()
+	tunnelID := hp.tunnel.ID
+
+	hp.counters.AddRequest()
+	hp.counters.ConnectionOpened()
+	defer hp.counters.ConnectionClosed()
+
+	// A bytes.Reader is left unwrapped so the request keeps its content length
+	if body == nil {
+		hp.counters.AddBytesIn(len(req.Data))
+		body = bytes.NewReader(req.Data)
+	} else {
+		body = &countingReader{Reader: body, count: hp.counters.AddBytesIn}
+	}
+
+	localURL := fmt.Sprintf("http://localhost:%d%s", hp.localPort, req.Path)
+	httpReq, err := http.NewRequest(req.Method, localURL, body)
+	if err != nil {
+		hp.logger.WithError(err).Error("Failed to create HTTP request")
+		hp.counters.AddError()
+		return sender.SendDataResponse(tunnelID, hp.createErrorResponse(req, http.StatusInternalServerError, "Failed to create request"))
+	}
+
+	// Copy headers from original request
+	for key, value := range req.Headers {
+		httpReq.Header.Set(key, value)
+	}
+	if length, err := strconv.ParseInt(httpReq.Header.Get("Content-Length"), 10, 64); err == nil {
+		httpReq.ContentLength = length
+	} else if req.Streaming {
+		httpReq.ContentLength = -1
+	}
+
+	// Set appropriate headers for local forwarding
+	httpReq.Header.Set("X-Forwarded-For", "127.0.0.1")
+	httpReq.Header.Set("X-Forwarded-Proto", "http")
+	if host, exists := req.Headers["Host"]; exists {
+		httpReq.Header.Set("X-Forwarded-Host", host)
+	}
+	httpReq.Header.Set("X-ShipIt-Tunnel", tunnelID)
+
+	// No client timeout here, a large download may legitimately take long
+	resp, err := hp.client.Transport.RoundTrip(httpReq)
+	if err != nil {
+		hp.logger.WithError(err).Error("Failed to forward request to local service")
+		hp.counters.AddError()
+		return sender.SendDataResponse(tunnelID, hp.createErrorResponse(req, http.StatusBadGateway, "Failed to connect to local service"))
+	}
+	defer resp.Body.Close()
+
+	// Convert response headers
+	headers := make(map[string]string)
+	for key, values := range resp.Header {
+		if len(values) > 0 {
+			headers[key] = values[0] // Take first value for simplicity
+		}
+	}
+
+	if err := sender.SendDataResponse(tunnelID, &types.DataResponsePayload{
+		ConnectionID: req.ConnectionID,
+		RequestID:    req.RequestID,
+		StatusCode:   resp.StatusCode,
+		Headers:      headers,
+		Streaming:    true,
+	}); err != nil {
+		return fmt.Errorf("failed to send response head: %w", err)
+	}
+
+	// The writer has sent a chunk before Read is called again, so one buffer is enough
+	buffer := make([]byte, responseChunkSize)
+	var sequence uint32
+	var total int64
+	for {
+		n, readErr := resp.Body.Read(buffer)
+		end := readErr == io.EOF
+
+		if n > 0 || end {
+			if err := sender.SendDataChunk(tunnelID, &types.DataChunkPayload{
+				ConnectionID: req.ConnectionID,
+				RequestID:    req.RequestID,
+				Sequence:     sequence,
+				Data:         buffer[:n],
+				End:          end,
+			}); err != nil {
+				return fmt.Errorf("failed to send response chunk: %w", err)
+			}
+			sequence++
+			total += int64(n)
+			hp.counters.AddBytesOut(n)
+		}
+
+		if end {
+			break
+		}
+		if readErr != nil {
+			hp.logger.WithError(readErr).Error("Failed to read response body")
+			hp.counters.AddError()
+			if err := sender.SendError(tunnelID, types.ErrorCodeLocalService, "Failed to read response", req.RequestID); err != nil {
+				hp.logger.WithError(err).Error("Failed to send error message")
+			}
+			return fmt.Errorf("failed to read response body: %w", readErr)
+		}
+	}
+
+	hp.logger.WithFields(logrus.Fields{
+		"request_id":    req.RequestID,
+		"connection_id": req.ConnectionID,
+		"status_code":   resp.StatusCode,
+		"duration_ms":   time.Since(startTime).Milliseconds(),
+		"response_size": total,
+		"chunks":        sequence,
+	}).Info("HTTP request completed")
+
+	return nil
+}
+
+// ServeStream proxies the HTTP/1.1 requests read from a multiplexed stream to the
+// local service and writes the responses back, streaming bodies in both directions
+func (hp *HTTPProxy) ServeStream(conn net.Conn) error {
+	defer conn.Close()
+
+	hp.counters.ConnectionOpened()
+	defer hp.counters.ConnectionClosed()
+	conn = &countingConn{Conn: conn, counters: hp.counters}
+
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read request: %w", err)
+		}
+
+		resp := hp.roundTrip(req)
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write response: %w", err)
+		}
+
+		if req.Close || resp.Close {
+			return nil
+		}
+	}
+}
+
+// roundTrip sends a request read from a stream to the local service. Redirects
+// are passed through to the visitor instead of being followed.
+func (hp *HTTPProxy) roundTrip(req *http.Request) *http.Response {
+	startTime := time.Now()
+	hp.counters.AddRequest()
+
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = fmt.Sprintf("localhost:%d", hp.localPort)
+
+	// Set appropriate headers for local forwarding
+	req.Header.Set("X-Forwarded-For", "127.0.0.1")
+	req.Header.Set("X-Forwarded-Proto", "http")
+	if req.Host != "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+	req.Header.Set("X-ShipIt-Tunnel", hp.tunnel.ID)
+
+	resp, err := hp.client.Transport.RoundTrip(req)
+	if err != nil {
+		hp.logger.WithError(err).Error("Failed to forward request to local service")
+		hp.counters.AddError()
+		return hp.createStreamErrorResponse(req, http.StatusBadGateway, "Failed to connect to local service")
+	}
+
+	hp.logger.WithFields(logrus.Fields{
+		"method":      req.Method,
+		"path":        req.URL.Path,
+		"status_code": resp.StatusCode,
+		"duration_ms": time.Since(startTime).Milliseconds(),
+	}).Info("HTTP request completed")
+
+	return resp
+}
+
+// createStreamErrorResponse creates an error response written to a stream
+func (hp *HTTPProxy) createStreamErrorResponse(req *http.Request, statusCode int, message string) *http.Response {
+	errorBody := fmt.Sprintf(`{"error": "%s", "status": %d}`, message, statusCode)
+
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+
+	return &http.Response{
+		StatusCode:    statusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(errorBody)),
+		ContentLength: int64(len(errorBody)),
+	}
+}
+
 // createErrorResponse creates an error response message
 func (hp *HTTPProxy) createErrorResponse(req *types.DataForwardPayload, statusCode int, message string) *types.DataResponsePayload {
 	errorBody := fmt.Sprintf(`{"error": "%s", "status": %d}`, message, statusCode)
@@ -173,4 +396,9 @@ func (hp *HTTPProxy) GetLocalURL() string {
 // GetTunnel returns the associated tunnel
 func (hp *HTTPProxy) GetTunnel() *client.Tunnel {
 	return hp.tunnel
+}
+
+// GetCounters returns the traffic counters of the tunnel
+func (hp *HTTPProxy) GetCounters() *client.TunnelCounters {
+	return hp.counters
 } 
\ No newline at end of file
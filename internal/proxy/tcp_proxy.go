@@ -17,6 +17,7 @@ type TCPProxy struct {
 	tunnel    *client.Tunnel
 	logger    *logrus.Logger
 	connections map[string]*TCPConnection
+	counters   *client.TunnelCounters
 	mutex      sync.RWMutex
 }
 
@@ -38,6 +39,7 @@ func NewTCPProxy(localPort int, tunnel *client.Tunnel, logger *logrus.Logger) *T
 		tunnel:       tunnel,
 		logger:       logger,
 		connections:  make(map[string]*TCPConnection),
+		counters:     &client.TunnelCounters{},
 	}
 }
 
@@ -49,10 +51,13 @@ func (tp *TCPProxy) HandleConnection(connectionID string, serverConn net.Conn) e
 		"remote_addr":   serverConn.RemoteAddr(),
 	}).Info("Handling new TCP connection")
 
+	tp.counters.AddRequest()
+
 	// Connect to local service
 	localConn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", tp.localPort), 10*time.Second)
 	if err != nil {
 		tp.logger.WithError(err).Error("Failed to connect to local service")
+		tp.counters.AddError()
 		serverConn.Close()
 		return fmt.Errorf("failed to connect to local service: %w", err)
 	}
@@ -72,9 +77,23 @@ func (tp *TCPProxy) HandleConnection(connectionID string, serverConn net.Conn) e
 	tp.connections[connectionID] = conn
 	tp.mutex.Unlock()
 
-	// Start bidirectional forwarding
-	go tp.forwardData(conn, serverConn, localConn, "server->local")
-	go tp.forwardData(conn, localConn, serverConn, "local->server")
+	// Start bidirectional forwarding, the connection stays active until both directions stopped
+	counted := &countingConn{Conn: serverConn, counters: tp.counters}
+	tp.counters.ConnectionOpened()
+	var pumps sync.WaitGroup
+	pumps.Add(2)
+	go func() {
+		defer pumps.Done()
+		tp.forwardData(conn, counted, localConn, "server->local")
+	}()
+	go func() {
+		defer pumps.Done()
+		tp.forwardData(conn, localConn, counted, "local->server")
+	}()
+	go func() {
+		pumps.Wait()
+		tp.counters.ConnectionClosed()
+	}()
 
 	tp.logger.WithField("connection_id", connectionID).Debug("TCP connection established")
 	return nil
@@ -237,6 +256,11 @@ func (tp *TCPProxy) GetTunnel() *client.Tunnel {
 	return tp.tunnel
 }
 
+// GetCounters returns the traffic counters of the tunnel
+func (tp *TCPProxy) GetCounters() *client.TunnelCounters {
+	return tp.counters
+}
+
 // CleanupInactiveConnections removes connections that have been inactive for too long
 func (tp *TCPProxy) CleanupInactiveConnections(maxIdleTime time.Duration) {
 	tp.mutex.Lock()
@@ -0,0 +1,182 @@
+package security
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+const (
+	// KeyringService is the keyring service certificate references are stored under
+	KeyringService = "shipitd"
+	// KeyringPrefix marks a certificate reference as a keyring entry instead of a file path
+	KeyringPrefix = "keyring:"
+	// DefaultCertificateReloadInterval is how often a client certificate is checked for rotation
+	DefaultCertificateReloadInterval = 30 * time.Second
+)
+
+// ReadPEM reads the PEM data a reference points to, a file path or
+// "keyring:<account>" for an entry of the shipitd keyring service
+func ReadPEM(ref string) ([]byte, error) {
+	if account, ok := strings.CutPrefix(ref, KeyringPrefix); ok {
+		data, err := keyring.Get(KeyringService, account)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keyring entry %s: %w", account, err)
+		}
+		return []byte(data), nil
+	}
+
+	data, err := os.ReadFile(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", ref, err)
+	}
+	return data, nil
+}
+
+// WritePEM stores PEM data where a reference points to, files are only readable by the owner
+func WritePEM(ref string, data []byte) error {
+	if account, ok := strings.CutPrefix(ref, KeyringPrefix); ok {
+		if err := keyring.Set(KeyringService, account, string(data)); err != nil {
+			return fmt.Errorf("failed to write keyring entry %s: %w", account, err)
+		}
+		return nil
+	}
+
+	if err := CreateSecureDirectory(filepath.Dir(ref)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(ref, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", ref, err)
+	}
+	return nil
+}
+
+// GenerateCertificateRequest creates an ECDSA P-256 private key and a
+// certificate signing request for it, both PEM encoded
+func GenerateCertificateRequest(commonName string) (keyPEM, csrPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encode key: %w", err)
+	}
+
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	csrPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	return keyPEM, csrPEM, nil
+}
+
+// ClientCertificate is the certificate a client presents in TLS handshakes.
+// It is read from its references on first use and read again once the
+// reload interval passed, so a rotated certificate is picked up by the next
+// handshake without a restart.
+type ClientCertificate struct {
+	certRef  string
+	keyRef   string
+	interval time.Duration
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certPEM  []byte
+	keyPEM   []byte
+	checked  time.Time
+}
+
+// NewClientCertificate creates a client certificate read from certRef and keyRef
+func NewClientCertificate(certRef, keyRef string) *ClientCertificate {
+	return &ClientCertificate{
+		certRef:  certRef,
+		keyRef:   keyRef,
+		interval: DefaultCertificateReloadInterval,
+	}
+}
+
+// SetReloadInterval sets how often the certificate is checked for rotation
+func (c *ClientCertificate) SetReloadInterval(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interval = interval
+}
+
+// Load returns the current certificate, reading it again when the reload
+// interval passed. When a rotated certificate cannot be read the previous one
+// is kept.
+func (c *ClientCertificate) Load() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert != nil && time.Since(c.checked) < c.interval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+
+	certPEM, err := ReadPEM(c.certRef)
+	if err == nil {
+		var keyPEM []byte
+		keyPEM, err = ReadPEM(c.keyRef)
+		if err == nil {
+			err = c.update(certPEM, keyPEM)
+		}
+	}
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	return c.cert, nil
+}
+
+// GetClientCertificate returns the current certificate, for tls.Config.GetClientCertificate
+func (c *ClientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Load()
+}
+
+// update parses the certificate when its PEM data changed. Callers must hold c.mu.
+func (c *ClientCertificate) update(certPEM, keyPEM []byte) error {
+	if c.cert != nil && bytes.Equal(certPEM, c.certPEM) && bytes.Equal(keyPEM, c.keyPEM) {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid certificate or key: %w", err)
+	}
+
+	c.cert = &cert
+	c.certPEM = certPEM
+	c.keyPEM = keyPEM
+	return nil
+}
+
+// VerifyKeyPair checks that a PEM certificate belongs to a PEM private key and
+// returns the parsed certificate
+func VerifyKeyPair(certPEM, keyPEM []byte) (*x509.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("certificate does not match the private key: %w", err)
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
@@ -6,17 +6,17 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/unownone/shipitd/internal/client"
 	"github.com/unownone/shipitd/internal/config"
 	"github.com/unownone/shipitd/pkg/types"
-	"github.com/sirupsen/logrus"
 )
 
 // BenchmarkMessageSerialization benchmarks message serialization
 func BenchmarkMessageSerialization(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		msg := types.NewMessage(types.MessageTypeTunnelRegistration, "test-tunnel", []byte("test-payload"))
+		msg := types.NewMessage(types.MessageTypeTunnelRegistration, tunnelA, []byte("test-payload"))
 		_, err := msg.Serialize()
 		if err != nil {
 			b.Fatal(err)
@@ -26,7 +26,7 @@ func BenchmarkMessageSerialization(b *testing.B) {
 
 // BenchmarkMessageDeserialization benchmarks message deserialization
 func BenchmarkMessageDeserialization(b *testing.B) {
-	msg := types.NewMessage(types.MessageTypeTunnelRegistration, "test-tunnel", []byte("test-payload"))
+	msg := types.NewMessage(types.MessageTypeTunnelRegistration, tunnelA, []byte("test-payload"))
 	data, err := msg.Serialize()
 	if err != nil {
 		b.Fatal(err)
@@ -76,7 +76,7 @@ func BenchmarkConnectionEstablishment(b *testing.B) {
 func BenchmarkDataForwarding(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		msg := types.NewMessage(types.MessageTypeDataForward, "test-tunnel", []byte("test-payload"))
+		msg := types.NewMessage(types.MessageTypeDataForward, tunnelA, []byte("test-payload"))
 		_, err := msg.Serialize()
 		if err != nil {
 			b.Fatal(err)
@@ -153,7 +153,7 @@ func BenchmarkHighThroughput(b *testing.B) {
 	for i := 0; i < 1000; i++ {
 		messages[i] = types.NewMessage(
 			types.MessageTypeDataForward,
-			fmt.Sprintf("tunnel-%d", i%10),
+			fmt.Sprintf("00000000-0000-4000-8000-%012d", i%10+1),
 			[]byte(fmt.Sprintf("data-%d", i)),
 		)
 	}
@@ -177,7 +177,7 @@ func BenchmarkMemoryLeakScenarios(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		// Create and discard objects to test garbage collection
 		for j := 0; j < 100; j++ {
-			msg := types.NewMessage(types.MessageTypeDataForward, "test-tunnel", []byte("test-data"))
+			msg := types.NewMessage(types.MessageTypeDataForward, tunnelA, []byte("test-data"))
 			_ = msg
 		}
 
@@ -294,4 +294,59 @@ func BenchmarkLoadTests(b *testing.B) {
 			}
 		}
 	})
-} 
\ No newline at end of file
+}
+
+// BenchmarkPayloadEncoding compares the JSON and binary payload encodings
+func BenchmarkPayloadEncoding(b *testing.B) {
+	encodings := []struct {
+		name     string
+		encoding types.PayloadEncoding
+	}{
+		{"JSON", types.EncodingJSON},
+		{"Binary", types.EncodingBinary},
+	}
+
+	for _, size := range []int{1024, 64 * 1024} {
+		payload := &types.DataForwardPayload{
+			ConnectionID: "conn-123",
+			RequestID:    "req-456",
+			Data:         make([]byte, size),
+			Headers: map[string]string{
+				"Host":         "myapp.shipit.dev",
+				"User-Agent":   "Mozilla/5.0",
+				"Content-Type": "application/octet-stream",
+			},
+			Method: "POST",
+			Path:   "/api/upload",
+		}
+
+		for _, e := range encodings {
+			b.Run(fmt.Sprintf("Encode/%s/%dB", e.name, size), func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if _, _, err := types.EncodePayload(payload, e.encoding); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(fmt.Sprintf("Decode/%s/%dB", e.name, size), func(b *testing.B) {
+				message, err := types.NewEncodedMessage(types.MessageTypeDataForward, tunnelA, payload, e.encoding)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := message.ParsePayload(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(len(message.Payload)), "wire-bytes")
+			})
+		}
+	}
+}
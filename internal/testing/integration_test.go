@@ -1,12 +1,38 @@
 package testing
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/unownone/shipitd/internal/client"
 	"github.com/unownone/shipitd/internal/config"
+	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/internal/proxy"
+	"github.com/unownone/shipitd/internal/security"
+	"github.com/unownone/shipitd/pkg/types"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -181,6 +207,100 @@ func TestIntegrationReconnectionLogic(t *testing.T) {
 	})
 }
 
+// TestReconnectBackoff tests the backoff policy used to reconnect the data plane
+func TestReconnectBackoff(t *testing.T) {
+	t.Run("JitteredDelaysGrowUpToCap", func(t *testing.T) {
+		ceilings := []time.Duration{
+			100 * time.Millisecond,
+			200 * time.Millisecond,
+			400 * time.Millisecond,
+			500 * time.Millisecond,
+			500 * time.Millisecond,
+		}
+
+		// Full jitter draws every delay between zero and the attempt's ceiling
+		largest := make([]time.Duration, len(ceilings))
+		for run := 0; run < 200; run++ {
+			backoff := client.NewBackoff(100*time.Millisecond, 2, 500*time.Millisecond, len(ceilings), time.Minute)
+			for i, ceiling := range ceilings {
+				delay, ok := backoff.Next()
+				require.True(t, ok)
+				assert.GreaterOrEqual(t, delay, time.Duration(0))
+				assert.LessOrEqual(t, delay, ceiling)
+				if delay > largest[i] {
+					largest[i] = delay
+				}
+			}
+		}
+
+		// The draws are not all bunched at the bottom of the range
+		for i, ceiling := range ceilings {
+			assert.Greater(t, largest[i], ceiling/2, "attempt %d", i+1)
+		}
+	})
+
+	t.Run("GivesUpAfterMaxAttempts", func(t *testing.T) {
+		backoff := client.NewBackoff(time.Millisecond, 2, time.Second, 3, time.Minute)
+
+		for attempt := 1; attempt <= 3; attempt++ {
+			_, ok := backoff.Next()
+			require.True(t, ok)
+			assert.Equal(t, attempt, backoff.Attempts())
+		}
+
+		_, ok := backoff.Next()
+		assert.False(t, ok)
+		assert.Equal(t, 3, backoff.Attempts())
+
+		backoff.Reset()
+		_, ok = backoff.Next()
+		assert.True(t, ok)
+		assert.Equal(t, 1, backoff.Attempts())
+	})
+
+	t.Run("FlappingConnectionKeepsCounting", func(t *testing.T) {
+		backoff := client.NewBackoff(time.Millisecond, 2, time.Second, 3, time.Minute)
+
+		// Connections that drop right away do not restore the budget
+		for attempt := 1; attempt <= 3; attempt++ {
+			_, ok := backoff.Next()
+			require.True(t, ok)
+			backoff.Connected()
+		}
+
+		_, ok := backoff.Next()
+		assert.False(t, ok)
+	})
+
+	t.Run("ResetsAfterStablePeriod", func(t *testing.T) {
+		backoff := client.NewBackoff(time.Millisecond, 2, time.Second, 3, 50*time.Millisecond)
+
+		for attempt := 1; attempt <= 3; attempt++ {
+			_, ok := backoff.Next()
+			require.True(t, ok)
+		}
+		backoff.Connected()
+		assert.Equal(t, 3, backoff.Attempts())
+
+		time.Sleep(60 * time.Millisecond)
+		assert.Equal(t, 0, backoff.Attempts())
+
+		delay, ok := backoff.Next()
+		require.True(t, ok)
+		assert.LessOrEqual(t, delay, time.Millisecond)
+		assert.Equal(t, 1, backoff.Attempts())
+	})
+
+	t.Run("DefaultsForZeroValues", func(t *testing.T) {
+		backoff := client.NewBackoff(0, 0, 0, 0, 0)
+		assert.Equal(t, client.DefaultBackoffMaxAttempts, backoff.MaxAttempts())
+
+		delay, ok := backoff.Next()
+		require.True(t, ok)
+		assert.LessOrEqual(t, delay, client.DefaultBackoffBase)
+	})
+}
+
 // TestIntegrationErrorHandling tests error handling scenarios
 func TestIntegrationErrorHandling(t *testing.T) {
 	mockServer := NewMockShipItServer(&MockServerConfig{
@@ -357,4 +477,2115 @@ func TestIntegrationEndToEnd(t *testing.T) {
 		require.NoError(t, err)
 		assert.Len(t, tunnels, 0)
 	})
-} 
\ No newline at end of file
+} 
+// channelReader feeds queued messages to a MessageRouter
+type channelReader struct {
+	messages chan *types.Message
+}
+
+func (c *channelReader) ReadMessage() (*types.Message, error) {
+	message, ok := <-c.messages
+	if !ok {
+		return nil, fmt.Errorf("connection closed by peer")
+	}
+	return message, nil
+}
+
+// errorRecorder records the error codes a MessageRouter sends back
+type errorRecorder struct {
+	codes chan string
+}
+
+func (e *errorRecorder) SendDataResponse(tunnelID string, payload *types.DataResponsePayload) error {
+	return nil
+}
+
+func (e *errorRecorder) SendDataChunk(tunnelID string, payload *types.DataChunkPayload) error {
+	return nil
+}
+
+func (e *errorRecorder) Supports(capability types.Capability) bool {
+	return false
+}
+
+func (e *errorRecorder) SendError(tunnelID string, code, message, details string) error {
+	e.codes <- tunnelID + ":" + code
+	return nil
+}
+
+func (e *errorRecorder) SendConnectionClose(tunnelID, connectionID, reason string) error {
+	return nil
+}
+
+// TestIntegrationMessageRouting tests demultiplexing of one connection by tunnel ID
+func TestIntegrationMessageRouting(t *testing.T) {
+	reader := &channelReader{messages: make(chan *types.Message, 16)}
+	sender := &errorRecorder{codes: make(chan string, 16)}
+	router := client.NewMessageRouter(reader, sender, logrus.New())
+
+	received := make(chan string, 16)
+	for _, tunnelID := range []string{tunnelA, tunnelB} {
+		tunnelID := tunnelID
+		router.Register(tunnelID, func(message *types.Message) {
+			received <- tunnelID + ":" + string(message.Payload)
+		})
+	}
+	router.SetConnectionHandler(func(message *types.Message) {
+		received <- "connection:" + string(message.Payload)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- router.Run(ctx)
+	}()
+
+	expect := func(t *testing.T, ch chan string, want string) {
+		t.Helper()
+		select {
+		case got := <-ch:
+			assert.Equal(t, want, got)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", want)
+		}
+	}
+
+	t.Run("RoutesByTunnelID", func(t *testing.T) {
+		reader.messages <- types.NewMessage(types.MessageTypeDataForward, tunnelB, []byte("1"))
+		expect(t, received, tunnelB+":1")
+		reader.messages <- types.NewMessage(types.MessageTypeDataForward, tunnelA, []byte("2"))
+		expect(t, received, tunnelA+":2")
+	})
+
+	t.Run("ConnectionLevelMessages", func(t *testing.T) {
+		reader.messages <- types.NewMessage(types.MessageTypeHeartbeat, "", []byte("3"))
+		expect(t, received, "connection:3")
+	})
+
+	t.Run("UnknownTunnel", func(t *testing.T) {
+		reader.messages <- types.NewMessage(types.MessageTypeDataForward, tunnelC, []byte("4"))
+		expect(t, sender.codes, tunnelC+":"+types.ErrorCodeUnknownTunnel)
+	})
+
+	t.Run("UnregisteredTunnel", func(t *testing.T) {
+		router.Unregister(tunnelA)
+		assert.False(t, router.IsRegistered(tunnelA))
+		reader.messages <- types.NewMessage(types.MessageTypeDataForward, tunnelA, []byte("5"))
+		expect(t, sender.codes, tunnelA+":"+types.ErrorCodeUnknownTunnel)
+	})
+
+	t.Run("ReadError", func(t *testing.T) {
+		close(reader.messages)
+		select {
+		case err := <-done:
+			assert.Error(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for router to stop")
+		}
+	})
+}
+
+// TestIntegrationOversizedFrame tests that the router reports an oversized frame to the peer and stops
+func TestIntegrationOversizedFrame(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	reader := protocol.NewReader(clientConn, logrus.New())
+	reader.SetMaxFrameSize(64 * 1024)
+	sender := &errorRecorder{codes: make(chan string, 1)}
+	router := client.NewMessageRouter(reader, sender, logrus.New())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- router.Run(context.Background())
+	}()
+
+	// A header announcing a 4 GB payload, nothing else follows
+	header := make([]byte, 21)
+	header[0] = byte(types.MessageTypeDataForward)
+	tunnelID, err := types.ParseTunnelID(tunnelA)
+	require.NoError(t, err)
+	copy(header[1:17], tunnelID[:])
+	binary.BigEndian.PutUint32(header[17:], 0xFFFFFFFF)
+	_, err = serverConn.Write(header)
+	require.NoError(t, err)
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, protocol.ErrFrameTooLarge)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for router to stop")
+	}
+	assert.Equal(t, ":"+types.ErrorCodeFrameTooLarge, <-sender.codes)
+}
+
+// TestIntegrationStreamForwarding tests HTTP and TCP tunnels served over multiplexed streams
+func TestIntegrationStreamForwarding(t *testing.T) {
+	clientSession, serverSession := sessionPeers(t)
+	dispatcher := proxy.NewDispatcher(&errorRecorder{codes: make(chan string, 16)}, logrus.New())
+
+	go func() {
+		for {
+			stream, err := clientSession.AcceptStream()
+			if err != nil {
+				return
+			}
+			go dispatcher.HandleStream(stream)
+		}
+	}()
+
+	t.Run("HTTPStream", func(t *testing.T) {
+		localService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Tunnel", r.Header.Get("X-ShipIt-Tunnel"))
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+		}))
+		defer localService.Close()
+
+		port, err := strconv.Atoi(localService.URL[strings.LastIndex(localService.URL, ":")+1:])
+		require.NoError(t, err)
+		require.NoError(t, dispatcher.AddTunnel(&client.Tunnel{ID: httpTunnel, Protocol: "http", LocalPort: port}))
+
+		stream, err := serverSession.OpenStream(httpTunnel, nil)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		request, err := http.NewRequest("POST", "http://app.example.com/upload", strings.NewReader("payload"))
+		require.NoError(t, err)
+		require.NoError(t, request.Write(stream))
+
+		response, err := http.ReadResponse(bufio.NewReader(stream), request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "POST /upload payload", string(body))
+		assert.Equal(t, httpTunnel, response.Header.Get("X-Tunnel"))
+	})
+
+	t.Run("TCPStream", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+
+		port := listener.Addr().(*net.TCPAddr).Port
+		require.NoError(t, dispatcher.AddTunnel(&client.Tunnel{ID: tcpTunnel, Protocol: "tcp", LocalPort: port}))
+
+		stream, err := serverSession.OpenStream(tcpTunnel, nil)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		_, err = stream.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		buffer := make([]byte, 4)
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(stream, buffer)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buffer))
+	})
+
+	t.Run("UnknownTunnel", func(t *testing.T) {
+		stream, err := serverSession.OpenStream(tunnelC, nil)
+		require.NoError(t, err)
+
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = stream.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, protocol.ErrStreamReset)
+	})
+}
+
+// newDataPlaneClient connects a data plane client to the mock server
+func newDataPlaneClient(t *testing.T, server *MockDataPlaneServer) *client.DataPlaneClient {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	dataPlane := client.NewDataPlaneClient(server.Config(), logger)
+	require.NoError(t, dataPlane.Connect())
+	t.Cleanup(func() {
+		dataPlane.Stop()
+		dataPlane.Disconnect()
+	})
+	return dataPlane
+}
+
+// nextReceived returns the next message of a type the server received
+func nextReceived(t *testing.T, server *MockDataPlaneServer, msgType types.MessageType) *types.Message {
+	deadline := time.After(3 * time.Second)
+	for {
+		select {
+		case message := <-server.Received():
+			if message.Type == msgType {
+				return message
+			}
+		case <-deadline:
+			t.Fatalf("Timed out waiting for message type %d", msgType)
+			return nil
+		}
+	}
+}
+
+// TestIntegrationReliableDelivery tests that registrations and connection closes survive a flaky link
+func TestIntegrationReliableDelivery(t *testing.T) {
+	waitOutstanding := func(t *testing.T, dataPlane *client.DataPlaneClient, outstanding int) {
+		// Acknowledgments are only processed while the client reads
+		go dataPlane.ReadMessageWithTimeout(time.Second)
+		assert.Eventually(t, func() bool {
+			return dataPlane.GetDeliveryStats().Outstanding == outstanding
+		}, 2*time.Second, 10*time.Millisecond)
+	}
+
+	t.Run("RegistrationAcknowledged", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane := newDataPlaneClient(t, server)
+
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: tunnelA, Protocol: "http", LocalPort: 3000}))
+		message := nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		assert.NotZero(t, message.ID)
+
+		waitOutstanding(t, dataPlane, 0)
+		assert.Equal(t, uint64(1), dataPlane.GetDeliveryStats().Acknowledged)
+	})
+
+	t.Run("RetransmittedAfterAckTimeout", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		server.SetAutoAck(false)
+		dataPlane := newDataPlaneClient(t, server)
+
+		require.NoError(t, dataPlane.SendConnectionClose(tunnelA, "conn-1", "done"))
+		first := nextReceived(t, server, types.MessageTypeConnectionClose)
+		again := nextReceived(t, server, types.MessageTypeConnectionClose)
+		assert.Equal(t, first.ID, again.ID)
+		assert.Equal(t, first.Payload, again.Payload)
+
+		require.NoError(t, server.Acknowledge(again))
+		waitOutstanding(t, dataPlane, 0)
+		assert.GreaterOrEqual(t, dataPlane.GetDeliveryStats().Retransmitted, uint64(1))
+	})
+
+	t.Run("ResentAfterReconnect", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		server.SetAutoAck(false)
+		dataPlane := newDataPlaneClient(t, server)
+
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: tunnelA, Protocol: "tcp", LocalPort: 22}))
+		lost := nextReceived(t, server, types.MessageTypeTunnelRegistration)
+
+		// The link drops before the acknowledgment made it back, the answer to
+		// the registration may still be read before the drop shows
+		server.DropConnections()
+		for err == nil {
+			_, err = dataPlane.ReadMessageWithTimeout(time.Second)
+		}
+		require.Error(t, err)
+		require.NoError(t, dataPlane.Disconnect())
+
+		server.SetAutoAck(true)
+		require.NoError(t, dataPlane.Connect())
+		resent := nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		assert.Equal(t, lost.ID, resent.ID)
+		assert.Equal(t, 2, server.Accepted())
+
+		waitOutstanding(t, dataPlane, 0)
+	})
+
+	t.Run("DuplicatesDeliveredOnce", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane := newDataPlaneClient(t, server)
+
+		message := types.NewMessage(types.MessageTypeConnectionClose, tunnelA, []byte(`{"connection_id":"conn-1"}`))
+		message.ID = 42
+		require.NoError(t, server.Send(message))
+		require.NoError(t, server.Send(message))
+		require.NoError(t, server.Send(types.NewMessage(types.MessageTypeHeartbeat, "", []byte(`{}`))))
+
+		received, err := dataPlane.ReadMessageWithTimeout(time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(42), received.ID)
+		received, err = dataPlane.ReadMessageWithTimeout(time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, types.MessageTypeHeartbeat, received.Type)
+
+		for _, status := range []string{types.AckStatusReceived, types.AckStatusDuplicate} {
+			ack := nextReceived(t, server, types.MessageTypeAcknowledge)
+			parsed, err := ack.ParsePayload()
+			require.NoError(t, err)
+			assert.Equal(t, "42", parsed.(*types.AcknowledgePayload).MessageID)
+			assert.Equal(t, status, parsed.(*types.AcknowledgePayload).Status)
+		}
+		assert.Equal(t, uint64(1), dataPlane.GetDeliveryStats().Duplicates)
+	})
+
+	t.Run("DuplicatesScopedToServerSession", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane := newDataPlaneClient(t, server)
+
+		deliver := func(expected string) {
+			message := types.NewMessage(types.MessageTypeConnectionClose, tunnelA, []byte(`{"connection_id":"conn-1"}`))
+			message.ID = 1
+			require.NoError(t, server.Send(message))
+			go dataPlane.ReadMessageWithTimeout(time.Second)
+
+			ack := nextReceived(t, server, types.MessageTypeAcknowledge)
+			parsed, err := ack.ParsePayload()
+			require.NoError(t, err)
+			assert.Equal(t, expected, parsed.(*types.AcknowledgePayload).Status)
+		}
+		reconnect := func() {
+			require.NoError(t, dataPlane.Disconnect())
+			require.NoError(t, dataPlane.Connect())
+		}
+
+		deliver(types.AckStatusReceived)
+
+		// A reconnect to the same session still recognizes the ID
+		reconnect()
+		deliver(types.AckStatusDuplicate)
+
+		// A restarted server numbers its messages from scratch
+		server.RestartSession()
+		reconnect()
+		deliver(types.AckStatusReceived)
+		assert.Equal(t, uint64(1), dataPlane.GetDeliveryStats().Duplicates)
+	})
+
+	t.Run("ExpiresAfterMaxRetransmits", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		server.SetAutoAck(false)
+		dataPlane := newDataPlaneClient(t, server)
+
+		require.NoError(t, dataPlane.SendConnectionClose(tunnelA, "conn-1", "done"))
+		for attempt := 0; attempt <= protocol.DefaultMaxRetransmits; attempt++ {
+			nextReceived(t, server, types.MessageTypeConnectionClose)
+		}
+
+		assert.Eventually(t, func() bool {
+			return dataPlane.GetDeliveryStats().Expired == 1
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Equal(t, 0, dataPlane.GetDeliveryStats().Outstanding)
+	})
+
+	t.Run("DisabledWithoutNegotiation", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(types.CapabilityMultiplexing)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane := newDataPlaneClient(t, server)
+
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: tunnelA, Protocol: "http", LocalPort: 3000}))
+		message := nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		assert.Zero(t, message.ID)
+		assert.Equal(t, 0, dataPlane.GetDeliveryStats().Outstanding)
+	})
+}
+
+// TestIntegrationGoAway tests that a GOAWAY hands tunnels off to a new connection
+// while the streams in flight finish on the old one
+func TestIntegrationGoAway(t *testing.T) {
+	// serveStreams answers every stream of a session with pong once it read ping
+	serveStreams := func(session *protocol.Session) {
+		for {
+			stream, err := session.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				buffer := make([]byte, 4)
+				if _, err := io.ReadFull(stream, buffer); err != nil {
+					return
+				}
+				stream.Write([]byte("pong"))
+				io.Copy(io.Discard, stream)
+			}()
+		}
+	}
+
+	pingPong := func(t *testing.T, stream *protocol.Stream) {
+		_, err := stream.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		buffer := make([]byte, 4)
+		stream.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = io.ReadFull(stream, buffer)
+		require.NoError(t, err)
+		assert.Equal(t, "pong", string(buffer))
+	}
+
+	t.Run("ServerHandoff", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane := newDataPlaneClient(t, server)
+
+		dataPlane.SetHandoffHandler(func() {
+			go serveStreams(dataPlane.GetSession())
+		})
+		go serveStreams(dataPlane.GetSession())
+		go func() {
+			for {
+				message, err := dataPlane.ReadMessage()
+				if err != nil {
+					return
+				}
+				if types.IsStreamMessage(message.Type) {
+					dataPlane.HandleStreamFrame(message)
+				}
+			}
+		}()
+
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: tunnelA, Protocol: "http", LocalPort: 3000}))
+		nextReceived(t, server, types.MessageTypeTunnelRegistration)
+
+		inFlight, err := server.OpenStream(tunnelA)
+		require.NoError(t, err)
+		pingPong(t, inFlight)
+
+		closed, err := server.GoAway("redeploy", 5*time.Second)
+		require.NoError(t, err)
+
+		// The tunnel is registered again on the replacement connection
+		reregistered := nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		assert.Equal(t, tunnelA, reregistered.TunnelID)
+		assert.Equal(t, 2, server.Accepted())
+
+		// The stream in flight keeps the old connection open
+		select {
+		case <-closed:
+			t.Fatal("Old connection closed with a stream in flight")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		require.NoError(t, inFlight.Close())
+		select {
+		case <-closed:
+		case <-time.After(3 * time.Second):
+			t.Fatal("Old connection not closed after its last stream finished")
+		}
+
+		// New streams go to the replacement connection
+		stream, err := server.OpenStream(tunnelA)
+		require.NoError(t, err)
+		defer stream.Close()
+		pingPong(t, stream)
+	})
+
+	t.Run("DisconnectClosesDrainingConnection", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane := newDataPlaneClient(t, server)
+
+		go serveStreams(dataPlane.GetSession())
+		go func() {
+			for {
+				message, err := dataPlane.ReadMessage()
+				if err != nil {
+					return
+				}
+				if types.IsStreamMessage(message.Type) {
+					dataPlane.HandleStreamFrame(message)
+				}
+			}
+		}()
+
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: tunnelA, Protocol: "http", LocalPort: 3000}))
+		nextReceived(t, server, types.MessageTypeTunnelRegistration)
+
+		inFlight, err := server.OpenStream(tunnelA)
+		require.NoError(t, err)
+		defer inFlight.Close()
+		pingPong(t, inFlight)
+
+		closed, err := server.GoAway("redeploy", 5*time.Second)
+		require.NoError(t, err)
+		nextReceived(t, server, types.MessageTypeTunnelRegistration)
+
+		// The stream in flight would keep the old connection open until the drain timeout
+		require.NoError(t, dataPlane.Disconnect())
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Disconnect left the draining connection open")
+		}
+	})
+
+	t.Run("KeepsReadingDuringHandoff", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane := newDataPlaneClient(t, server)
+
+		messages := make(chan *types.Message, 10)
+		go func() {
+			for {
+				message, err := dataPlane.ReadMessage()
+				if err != nil {
+					return
+				}
+				messages <- message
+			}
+		}()
+
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: tunnelA, Protocol: "http", LocalPort: 3000}))
+		nextReceived(t, server, types.MessageTypeTunnelRegistration)
+
+		// The replacement cannot finish its handshake yet
+		release := server.HoldHandshakes()
+		_, err = server.GoAway("redeploy", 5*time.Second)
+		require.NoError(t, err)
+		require.NoError(t, server.Send(types.NewMessage(types.MessageTypeDataForward, tunnelA, []byte(`{}`))))
+
+		var forwarded bool
+		for !forwarded {
+			select {
+			case message := <-messages:
+				forwarded = message.Type == types.MessageTypeDataForward
+			case <-time.After(2 * time.Second):
+				t.Fatal("Messages on the old connection wait for the replacement")
+			}
+		}
+		assert.Equal(t, 1, server.Accepted())
+
+		release()
+		reregistered := nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		assert.Equal(t, tunnelA, reregistered.TunnelID)
+		assert.Equal(t, 2, server.Accepted())
+	})
+
+	t.Run("ClientGoingAway", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane := newDataPlaneClient(t, server)
+
+		require.NoError(t, dataPlane.GoAway("client shutting down", time.Second))
+
+		message := nextReceived(t, server, types.MessageTypeGoAway)
+		parsed, err := message.ParsePayload()
+		require.NoError(t, err)
+		assert.Equal(t, "client shutting down", parsed.(*types.GoAwayPayload).Reason)
+		assert.Equal(t, int64(1000), parsed.(*types.GoAwayPayload).DrainTimeout)
+
+		_, err = dataPlane.GetSession().OpenStream(tunnelA, nil)
+		assert.ErrorIs(t, err, protocol.ErrSessionDraining)
+	})
+}
+
+// TestIntegrationHeartbeat tests heartbeat echoes and that a silent server is detected as dead
+func TestIntegrationHeartbeat(t *testing.T) {
+	newClient := func(t *testing.T, server *MockDataPlaneServer) (*client.DataPlaneClient, <-chan error) {
+		cfg := server.Config()
+		cfg.Connection.HeartbeatInterval = 50 * time.Millisecond
+		cfg.Connection.HeartbeatMaxMissed = 2
+
+		logger := logrus.New()
+		logger.SetLevel(logrus.ErrorLevel)
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		require.NoError(t, dataPlane.Connect())
+		t.Cleanup(dataPlane.Stop)
+
+		// Echoes are only processed while the client reads
+		readErr := make(chan error, 1)
+		go func() {
+			for {
+				if _, err := dataPlane.ReadMessage(); err != nil {
+					readErr <- err
+					return
+				}
+			}
+		}()
+		return dataPlane, readErr
+	}
+
+	t.Run("MeasuresRTT", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane, _ := newClient(t, server)
+
+		assert.Eventually(t, func() bool {
+			return dataPlane.GetHeartbeatStats().Echoed >= 3
+		}, 3*time.Second, 10*time.Millisecond)
+
+		stats := dataPlane.GetHeartbeatStats()
+		assert.Positive(t, stats.RTT)
+		assert.Positive(t, stats.SmoothedRTT)
+		assert.Equal(t, 0, stats.Missed)
+		assert.True(t, dataPlane.IsConnected())
+	})
+
+	t.Run("EchoesServerHeartbeats", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		newClient(t, server)
+
+		heartbeat, err := types.NewHeartbeatMessage(tunnelA, &types.HeartbeatPayload{Timestamp: time.Now().Unix(), Nonce: 7})
+		require.NoError(t, err)
+		require.NoError(t, server.Send(heartbeat))
+
+		for {
+			message := nextReceived(t, server, types.MessageTypeHeartbeat)
+			parsed, err := message.ParsePayload()
+			require.NoError(t, err)
+			if echo := parsed.(*types.HeartbeatPayload); echo.Echo {
+				assert.Equal(t, uint64(7), echo.Nonce)
+				assert.Equal(t, tunnelA, message.TunnelID)
+				break
+			}
+		}
+	})
+
+	t.Run("ReportsTunnelCounters", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane, _ := newClient(t, server)
+
+		counters := &client.TunnelCounters{}
+		counters.ConnectionOpened()
+		counters.AddRequest()
+		counters.AddBytesIn(128)
+		counters.AddBytesOut(2048)
+		counters.AddError()
+		dataPlane.StartHeartbeat(tunnelA, 50*time.Millisecond, counters.Snapshot)
+
+		for {
+			message := nextReceived(t, server, types.MessageTypeHeartbeat)
+			if message.TunnelID != tunnelA {
+				continue
+			}
+			parsed, err := message.ParsePayload()
+			require.NoError(t, err)
+			assert.Equal(t, &types.HeartbeatPayload{
+				Timestamp:     parsed.(*types.HeartbeatPayload).Timestamp,
+				ActiveConns:   1,
+				TotalRequests: 1,
+				BytesIn:       128,
+				BytesOut:      2048,
+				Errors:        1,
+			}, parsed)
+			break
+		}
+	})
+
+	t.Run("ClosesConnectionToSilentServer", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		server.SetEchoHeartbeats(false)
+		dataPlane, readErr := newClient(t, server)
+
+		select {
+		case err := <-readErr:
+			assert.Error(t, err)
+		case <-time.After(3 * time.Second):
+			t.Fatal("Connection to a server that stopped echoing heartbeats stayed open")
+		}
+		assert.Equal(t, uint64(1), dataPlane.GetHeartbeatStats().DeadPeers)
+	})
+
+	t.Run("PingWaitsForPong", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		dataPlane, _ := newClient(t, server)
+
+		rtt, err := dataPlane.Ping(time.Second)
+		require.NoError(t, err)
+		assert.Greater(t, rtt, time.Duration(0))
+
+		server.SetEchoHeartbeats(false)
+		_, err = dataPlane.Ping(30 * time.Millisecond)
+		assert.Error(t, err)
+	})
+
+	t.Run("DisabledWithoutNegotiation", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(types.CapabilityMultiplexing)
+		require.NoError(t, err)
+		defer server.Close()
+		server.SetEchoHeartbeats(false)
+		dataPlane, readErr := newClient(t, server)
+
+		select {
+		case err := <-readErr:
+			t.Fatalf("Connection closed without heartbeat echo negotiated: %v", err)
+		case <-time.After(300 * time.Millisecond):
+		}
+		assert.Zero(t, dataPlane.GetHeartbeatStats().Sent)
+
+		_, err = dataPlane.Ping(time.Second)
+		assert.ErrorIs(t, err, client.ErrPingUnsupported)
+	})
+}
+
+// TestIntegrationConnectionPool tests that the pool spreads tunnels over its
+// connections and replaces the ones that fail
+func TestIntegrationConnectionPool(t *testing.T) {
+	// A zero heartbeat interval leaves health checks at the default of 30s
+	newPool := func(t *testing.T, server *MockDataPlaneServer, size int, heartbeat time.Duration) *client.ConnectionPool {
+		logger := logrus.New()
+		logger.SetLevel(logrus.WarnLevel)
+		cfg := server.Config()
+		cfg.Connection.PoolSize = size
+		cfg.Connection.ReconnectInterval = 20 * time.Millisecond
+		cfg.Connection.MaxReconnectAttempts = 3
+		cfg.Connection.HeartbeatInterval = heartbeat
+		// Only the pool's own health checks notice a silent server
+		cfg.Connection.HeartbeatMaxMissed = 100
+
+		pool := client.NewConnectionPool(cfg, logger)
+		// Read every connection like the tunnel manager does, so failures are noticed
+		pool.SetConnectHandler(func(conn *client.Connection) {
+			go func() {
+				conn.Router.Run(context.Background())
+				pool.MarkConnectionUnhealthy(conn.ID)
+			}()
+		})
+		t.Cleanup(func() {
+			pool.Close()
+		})
+		return pool
+	}
+
+	t.Run("SpreadsTunnelsByLoad", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		pool := newPool(t, server, 3, 0)
+		require.NoError(t, pool.Initialize())
+		assert.Equal(t, 3, server.Accepted())
+
+		for i, tunnelID := range []string{tunnelA, tunnelB, tunnelC} {
+			conn, err := pool.GetConnection()
+			require.NoError(t, err)
+			assert.Zero(t, conn.InFlight(), "tunnel %d", i)
+			pool.Assign(tunnelID, conn)
+		}
+
+		// Every connection carries one tunnel, the next one goes anywhere
+		for _, conn := range pool.GetConnections() {
+			assert.Equal(t, 1, conn.InFlight())
+		}
+		assert.NotSame(t, pool.GetAssignedConnection(tunnelA), pool.GetAssignedConnection(tunnelB))
+
+		pool.Unassign(tunnelA)
+		conn, err := pool.GetConnection()
+		require.NoError(t, err)
+		assert.Zero(t, conn.InFlight())
+	})
+
+	t.Run("SkipsUnhealthyConnections", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		pool := newPool(t, server, 2, 0)
+		require.NoError(t, pool.Initialize())
+
+		unhealthy := pool.GetConnections()[0]
+		pool.MarkConnectionUnhealthy(unhealthy.ID)
+
+		for i := 0; i < 10; i++ {
+			conn, err := pool.GetConnection()
+			require.NoError(t, err)
+			assert.NotSame(t, unhealthy, conn)
+		}
+	})
+
+	t.Run("ReplacesUnhealthyConnections", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		pool := newPool(t, server, 2, 0)
+		replaced := make(chan [2]*client.Connection, 2)
+		pool.SetReplaceHandler(func(old, replacement *client.Connection) {
+			replaced <- [2]*client.Connection{old, replacement}
+		})
+		require.NoError(t, pool.Initialize())
+
+		failed := pool.GetConnections()[1]
+		pool.MarkConnectionUnhealthy(failed.ID)
+
+		select {
+		case pair := <-replaced:
+			assert.Same(t, failed, pair[0])
+			assert.True(t, pair[1].Client.IsConnected())
+		case <-time.After(3 * time.Second):
+			t.Fatal("Unhealthy connection was not replaced")
+		}
+		assert.Equal(t, 2, pool.GetHealthyConnectionCount())
+		assert.Equal(t, 3, server.Accepted())
+	})
+
+	t.Run("ReplacesConnectionsDroppedByServer", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		pool := newPool(t, server, 2, 0)
+		replaced := make(chan *client.Connection, 2)
+		pool.SetReplaceHandler(func(old, replacement *client.Connection) {
+			replaced <- replacement
+		})
+		require.NoError(t, pool.Initialize())
+
+		server.DropConnections()
+		for i := 0; i < 2; i++ {
+			select {
+			case <-replaced:
+			case <-time.After(3 * time.Second):
+				t.Fatal("Dropped connection was not replaced")
+			}
+		}
+		assert.Equal(t, 2, pool.GetHealthyConnectionCount())
+	})
+
+	t.Run("IdleConnectionsStayHealthy", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		pool := newPool(t, server, 2, 50*time.Millisecond)
+		require.NoError(t, pool.Initialize())
+
+		time.Sleep(300 * time.Millisecond)
+		assert.Equal(t, 2, pool.GetHealthyConnectionCount())
+		assert.Equal(t, 2, server.Accepted())
+
+		// Health checks never consume bytes of the frames that follow
+		for _, conn := range pool.GetConnections() {
+			require.NoError(t, conn.Client.RegisterTunnel(&client.Tunnel{ID: tunnelA, Protocol: "http", LocalPort: 3000}))
+			nextReceived(t, server, types.MessageTypeTunnelRegistration)
+			assert.WithinDuration(t, time.Now(), conn.Client.LastSeen(), 200*time.Millisecond)
+		}
+	})
+
+	t.Run("ReplacesConnectionsThatStopAnswering", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		pool := newPool(t, server, 1, 50*time.Millisecond)
+		replaced := make(chan *client.Connection, 4)
+		pool.SetReplaceHandler(func(old, replacement *client.Connection) {
+			replaced <- old
+		})
+		require.NoError(t, pool.Initialize())
+		silent := pool.GetConnections()[0]
+
+		server.SetEchoHeartbeats(false)
+		select {
+		case old := <-replaced:
+			assert.Same(t, silent, old)
+		case <-time.After(3 * time.Second):
+			t.Fatal("Connection that stopped answering pings was not replaced")
+		}
+	})
+
+	t.Run("GivesUpWhenServerIsGone", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		pool := newPool(t, server, 1, 0)
+		attempts := make(chan int, 10)
+		pool.SetRetryHandler(func(old *client.Connection, attempt int, err error) {
+			attempts <- attempt
+		})
+		require.NoError(t, pool.Initialize())
+
+		server.Close()
+		for _, expected := range []int{1, 2, 3, 0} {
+			select {
+			case attempt := <-attempts:
+				assert.Equal(t, expected, attempt)
+			case <-time.After(3 * time.Second):
+				t.Fatalf("Timed out waiting for attempt %d", expected)
+			}
+		}
+		assert.Zero(t, pool.GetConnectionCount())
+	})
+}
+
+// TestIntegrationTunnelManagerPool tests that the tunnel manager spreads
+// tunnels over the pool and registers them again when connections fail
+func TestIntegrationTunnelManagerPool(t *testing.T) {
+	controlPlane := NewMockShipItServer(&MockServerConfig{})
+	defer controlPlane.Close()
+	server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+	require.NoError(t, err)
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	cfg := server.Config()
+	cfg.Connection.PoolSize = 2
+	cfg.Connection.ReconnectInterval = 20 * time.Millisecond
+	cfg.Connection.MaxReconnectAttempts = 3
+
+	tunnelManager := client.NewTunnelManager(cfg, logger)
+	tunnelManager.GetControlPlane().SetBaseURL(controlPlane.URL() + "/api/v1")
+	defer tunnelManager.Stop()
+
+	// connectionsOf returns the connection of every tunnel once all of them are active
+	connectionsOf := func() map[string]string {
+		connections := make(map[string]string)
+		tunnels := tunnelManager.GetStats()["tunnels"].(map[string]interface{})
+		for tunnelID, info := range tunnels {
+			info := info.(map[string]interface{})
+			if info["state"] != client.TunnelStateActive {
+				return nil
+			}
+			connections[tunnelID] = info["connection_id"].(string)
+		}
+		if len(connections) != 2 {
+			return nil
+		}
+		return connections
+	}
+
+	for _, name := range []string{"web", "api"} {
+		require.NoError(t, tunnelManager.StartTunnel(&config.TunnelConfig{Name: name, Protocol: "http", LocalPort: 3000, Subdomain: name}))
+	}
+
+	var before map[string]string
+	require.Eventually(t, func() bool {
+		before = connectionsOf()
+		return before != nil
+	}, 3*time.Second, 10*time.Millisecond)
+
+	t.Run("SpreadsTunnels", func(t *testing.T) {
+		assert.Equal(t, 2, server.Accepted())
+		seen := make(map[string]bool)
+		for _, connectionID := range before {
+			seen[connectionID] = true
+		}
+		assert.Len(t, seen, 2)
+	})
+
+	t.Run("ReregistersAfterConnectionsDrop", func(t *testing.T) {
+		for range before {
+			nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		}
+
+		server.DropConnections()
+
+		// Both tunnels are registered again on replacement connections
+		for range before {
+			nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		}
+		require.Eventually(t, func() bool {
+			after := connectionsOf()
+			if after == nil {
+				return false
+			}
+			for tunnelID, connectionID := range after {
+				if connectionID == before[tunnelID] {
+					return false
+				}
+			}
+			return true
+		}, 3*time.Second, 10*time.Millisecond)
+
+		// The second replacement may still be connecting after both tunnels moved to the first
+		assert.Eventually(t, func() bool {
+			return server.Accepted() == 4
+		}, 3*time.Second, 10*time.Millisecond)
+	})
+}
+
+// TestIntegrationSessionResumption tests that a tunnel keeps its tunnel ID and
+// public URL through reconnects and restarts of the tunnel manager
+func TestIntegrationSessionResumption(t *testing.T) {
+	controlPlane := NewMockShipItServer(&MockServerConfig{})
+	defer controlPlane.Close()
+	server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+	require.NoError(t, err)
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	cfg := server.Config()
+	cfg.Connection.PoolSize = 1
+	cfg.Connection.ReconnectInterval = 20 * time.Millisecond
+	cfg.Connection.MaxReconnectAttempts = 3
+	cfg.Connection.SessionFile = filepath.Join(t.TempDir(), "sessions.json")
+	tunnelConfig := &config.TunnelConfig{Name: "webhooks", Protocol: "http", LocalPort: 3000, Subdomain: "hooks"}
+	const publicURL = "https://hooks.example.test"
+
+	start := func(t *testing.T) *client.TunnelManager {
+		tunnelManager := client.NewTunnelManager(cfg, logger)
+		tunnelManager.GetControlPlane().SetBaseURL(controlPlane.URL() + "/api/v1")
+		require.NoError(t, tunnelManager.StartTunnel(tunnelConfig))
+		return tunnelManager
+	}
+
+	// registered waits until the only tunnel is active under the public URL the data plane assigned
+	registered := func(t *testing.T, tunnelManager *client.TunnelManager) string {
+		tunnelID := ""
+		require.Eventually(t, func() bool {
+			tunnels := tunnelManager.GetStats()["tunnels"].(map[string]interface{})
+			for id, info := range tunnels {
+				info := info.(map[string]interface{})
+				tunnelID = id
+				return info["state"] == client.TunnelStateActive && info["public_url"] == publicURL
+			}
+			return false
+		}, 3*time.Second, 10*time.Millisecond)
+		return tunnelID
+	}
+
+	// presentedToken returns the resumption token of the next registration
+	presentedToken := func(t *testing.T) string {
+		parsed, err := nextReceived(t, server, types.MessageTypeTunnelRegistration).ParsePayload()
+		require.NoError(t, err)
+		return parsed.(*types.TunnelRegistrationPayload).ResumeToken
+	}
+
+	first := start(t)
+	assert.Empty(t, presentedToken(t))
+	tunnelID := registered(t, first)
+
+	t.Run("PresentsTokenAfterReconnect", func(t *testing.T) {
+		server.DropConnections()
+		assert.Equal(t, "resume-1", presentedToken(t))
+		assert.Equal(t, tunnelID, registered(t, first))
+	})
+
+	t.Run("ReclaimsTunnelAfterRestart", func(t *testing.T) {
+		creates := controlPlane.GetTunnelCalls()
+		first.Stop()
+
+		second := start(t)
+		defer second.Stop()
+		assert.Equal(t, "resume-1", presentedToken(t))
+		assert.Equal(t, tunnelID, registered(t, second))
+		assert.Equal(t, creates, controlPlane.GetTunnelCalls())
+
+		// Shutting down kept the tunnel on the server
+		_, err := second.GetControlPlane().GetTunnel(context.Background(), tunnelID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("CreatesTunnelAgainWhenTokenIsRefused", func(t *testing.T) {
+		server.RevokeResumeTokens()
+
+		third := start(t)
+		defer third.Stop()
+		assert.Equal(t, "resume-1", presentedToken(t))
+		assert.Empty(t, presentedToken(t))
+		assert.NotEqual(t, tunnelID, registered(t, third))
+	})
+}
+
+// newDelayedProxy forwards connections to target after a delay, like a far away server
+func newDelayedProxy(t *testing.T, target string, delay time.Duration) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				time.Sleep(delay)
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// TestIntegrationEndpoints tests that the client picks the endpoint with the
+// fastest handshake and fails over when it keeps failing
+func TestIntegrationEndpoints(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+
+	t.Run("ParsesEntries", func(t *testing.T) {
+		cfg := &config.Config{Server: config.ServerConfig{
+			Domain:        "example.test",
+			DataPlanePort: 7223,
+			Endpoints:     []string{"eu", "us.example.test:9000", "10.0.0.1"},
+		}}
+		transport := client.NewTransport(cfg, tlsConfig, logger)
+		var addrs []string
+		for _, endpoint := range client.NewEndpointSelector(cfg, transport, logger).Endpoints() {
+			addrs = append(addrs, endpoint.Addr)
+		}
+		assert.Equal(t, []string{"eu.example.test:7223", "us.example.test:9000", "10.0.0.1:7223"}, addrs)
+
+		cfg.Server.Endpoints = nil
+		assert.Equal(t, "example.test:7223", client.NewEndpointSelector(cfg, transport, logger).Current().Addr)
+	})
+
+	t.Run("PicksFastestHandshake", func(t *testing.T) {
+		near, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer near.Close()
+		far, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer far.Close()
+		farAddr := newDelayedProxy(t, far.Addr(), 100*time.Millisecond)
+
+		cfg := near.Config()
+		cfg.Server.Endpoints = []string{farAddr, near.Addr()}
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		require.NoError(t, dataPlane.Connect())
+		defer dataPlane.Stop()
+
+		assert.Equal(t, near.Addr(), dataPlane.GetServerAddr())
+		endpoints := dataPlane.GetEndpointSelector().Endpoints()
+		require.Len(t, endpoints, 2)
+		assert.Equal(t, near.Addr(), endpoints[0].Addr)
+		assert.Less(t, endpoints[0].RTT, endpoints[1].RTT)
+	})
+
+	t.Run("ProbesThroughTheTransport", func(t *testing.T) {
+		var addrs []string
+		for i := 0; i < 2; i++ {
+			server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+			require.NoError(t, err)
+			defer server.Close()
+			quicPort, err := server.StartQUIC()
+			require.NoError(t, err)
+			addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", quicPort))
+		}
+
+		// A TCP and TLS handshake would find nothing listening on the QUIC ports
+		cfg := &config.Config{Server: config.ServerConfig{Domain: "127.0.0.1", Endpoints: addrs, Transport: config.TransportQUIC}}
+		selector := client.NewEndpointSelector(cfg, client.NewTransport(cfg, tlsConfig, logger), logger)
+		selector.Current()
+		for _, endpoint := range selector.Endpoints() {
+			assert.NotZero(t, endpoint.RTT, endpoint.Addr)
+			assert.Empty(t, endpoint.LastError, endpoint.Addr)
+		}
+	})
+
+	t.Run("UsableWhileMeasuring", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		slowAddr := newDelayedProxy(t, server.Addr(), time.Second)
+
+		cfg := server.Config()
+		cfg.Server.Endpoints = []string{slowAddr, server.Addr()}
+		selector := client.NewEndpointSelector(cfg, client.NewTransport(cfg, tlsConfig, logger), logger)
+
+		measured := make(chan client.Endpoint, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				measured <- selector.Current()
+			}()
+		}
+
+		// The probes run without the lock, reading the endpoints does not wait for them
+		time.Sleep(100 * time.Millisecond)
+		start := time.Now()
+		selector.Endpoints()
+		selector.Succeeded(server.Addr())
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+		for i := 0; i < 2; i++ {
+			select {
+			case endpoint := <-measured:
+				assert.Equal(t, server.Addr(), endpoint.Addr)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for the measurement")
+			}
+		}
+	})
+
+	t.Run("SkipsUnreachableEndpoints", func(t *testing.T) {
+		server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer server.Close()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		unreachable := listener.Addr().String()
+		listener.Close()
+
+		cfg := server.Config()
+		cfg.Server.Endpoints = []string{unreachable, server.Addr()}
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		require.NoError(t, dataPlane.Connect())
+		defer dataPlane.Stop()
+
+		assert.Equal(t, server.Addr(), dataPlane.GetServerAddr())
+		endpoints := dataPlane.GetEndpointSelector().Endpoints()
+		assert.Zero(t, endpoints[1].RTT)
+		assert.NotEmpty(t, endpoints[1].LastError)
+	})
+
+	t.Run("FailsOverAfterRepeatedFailures", func(t *testing.T) {
+		primary, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer primary.Close()
+		secondary, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+		require.NoError(t, err)
+		defer secondary.Close()
+		secondaryAddr := newDelayedProxy(t, secondary.Addr(), 50*time.Millisecond)
+
+		cfg := primary.Config()
+		cfg.Server.Endpoints = []string{primary.Addr(), secondaryAddr}
+		cfg.Connection.PoolSize = 1
+		cfg.Connection.ReconnectInterval = 20 * time.Millisecond
+		cfg.Connection.MaxReconnectAttempts = 5
+		pool := client.NewConnectionPool(cfg, logger)
+		pool.SetConnectHandler(func(conn *client.Connection) {
+			go func() {
+				conn.Router.Run(context.Background())
+				pool.MarkConnectionUnhealthy(conn.ID)
+			}()
+		})
+		attempts := make(chan int, 10)
+		pool.SetRetryHandler(func(old *client.Connection, attempt int, err error) {
+			attempts <- attempt
+		})
+		replaced := make(chan *client.Connection, 1)
+		pool.SetReplaceHandler(func(old, replacement *client.Connection) {
+			replaced <- replacement
+		})
+		defer pool.Close()
+		require.NoError(t, pool.Initialize())
+		assert.Equal(t, primary.Addr(), pool.GetConnections()[0].Client.GetServerAddr())
+
+		primary.Close()
+		select {
+		case replacement := <-replaced:
+			assert.Equal(t, secondaryAddr, replacement.Client.GetServerAddr())
+		case <-time.After(5 * time.Second):
+			t.Fatal("Connection was not replaced on the next endpoint")
+		}
+		// Three attempts failed on the primary before the fourth went to the secondary
+		assert.Len(t, attempts, 4)
+
+		endpoint, ok := pool.GetStats()["endpoint"].(client.Endpoint)
+		require.True(t, ok)
+		assert.Equal(t, secondaryAddr, endpoint.Addr)
+	})
+}
+
+// TestIntegrationOutboundProxy tests that the control and data plane reach the
+// server through HTTP CONNECT and SOCKS5 proxies
+func TestIntegrationOutboundProxy(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+	require.NoError(t, err)
+	defer server.Close()
+
+	connect := func(cfg *config.Config) error {
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		return dataPlane.Connect()
+	}
+
+	t.Run("HTTPConnectWithBasicAuth", func(t *testing.T) {
+		proxyServer, err := NewMockHTTPProxy("user", "secret")
+		require.NoError(t, err)
+		defer proxyServer.Close()
+
+		cfg := server.Config()
+		cfg.Connection.Proxy = proxyServer.URL()
+		require.NoError(t, connect(cfg))
+		assert.Equal(t, []string{server.Addr()}, proxyServer.Targets())
+
+		controlPlane := NewMockShipItServer(&MockServerConfig{ValidAPIKeys: []string{"valid-key"}})
+		defer controlPlane.Close()
+		cfg.Auth.APIKey = "valid-key"
+		controlPlaneClient := client.NewControlPlaneClient(cfg, logger)
+		controlPlaneClient.SetBaseURL(controlPlane.URL() + "/api/v1")
+		_, err = controlPlaneClient.ValidateToken(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, strings.TrimPrefix(controlPlane.URL(), "http://"), proxyServer.Targets()[1])
+	})
+
+	t.Run("ReportsRefusedCredentials", func(t *testing.T) {
+		proxyServer, err := NewMockHTTPProxy("user", "secret")
+		require.NoError(t, err)
+		defer proxyServer.Close()
+
+		cfg := server.Config()
+		cfg.Connection.Proxy = strings.Replace(proxyServer.URL(), "secret", "wrong", 1)
+		err = connect(cfg)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "407")
+	})
+
+	t.Run("SOCKS5", func(t *testing.T) {
+		proxyServer, err := NewMockSOCKS5Proxy("user", "secret")
+		require.NoError(t, err)
+		defer proxyServer.Close()
+
+		cfg := server.Config()
+		cfg.Connection.Proxy = proxyServer.URL()
+		require.NoError(t, connect(cfg))
+		assert.Equal(t, []string{server.Addr()}, proxyServer.Targets())
+	})
+
+	t.Run("FollowsEnvironment", func(t *testing.T) {
+		proxyServer, err := NewMockHTTPProxy("", "")
+		require.NoError(t, err)
+		defer proxyServer.Close()
+		// The proxy resolves the made up names to the mock server
+		proxyServer.SetUpstream(server.Addr())
+		t.Setenv("HTTPS_PROXY", proxyServer.URL())
+		t.Setenv("NO_PROXY", "direct.example.test")
+
+		cfg := server.Config()
+		cfg.Server.Endpoints = []string{"shipit.example.test:7223"}
+		require.NoError(t, connect(cfg))
+		assert.Equal(t, []string{"shipit.example.test:7223"}, proxyServer.Targets())
+
+		cfg.Server.Endpoints = []string{"direct.example.test:7223"}
+		require.Error(t, connect(cfg))
+		cfg.Server.Endpoints = []string{"shipit.example.test:7223"}
+		cfg.Connection.Proxy = config.ProxyDirect
+		require.Error(t, connect(cfg))
+		assert.Len(t, proxyServer.Targets(), 1)
+	})
+}
+
+// TestIntegrationWebSocketTransport tests that the data plane works over a
+// WebSocket to the control plane host when the data plane port is blocked
+func TestIntegrationWebSocketTransport(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+	require.NoError(t, err)
+	defer server.Close()
+	webSocketPort := server.StartWebSocket()
+
+	// The control plane host is verified even with tls_verify off
+	caFile := filepath.Join(t.TempDir(), "server-ca.pem")
+	writeCertificate(t, caFile, server.Certificate())
+
+	// Nothing listens on the blocked data plane port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	blocked := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	newConfig := func(transport string, dataPlanePort int) *config.Config {
+		cfg := server.Config()
+		cfg.Server.Transport = transport
+		cfg.Server.APIPort = webSocketPort
+		cfg.Server.DataPlanePort = dataPlanePort
+		cfg.Server.CAFile = caFile
+		return cfg
+	}
+	connect := func(t *testing.T, cfg *config.Config) *client.DataPlaneClient {
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		require.NoError(t, dataPlane.Connect())
+		t.Cleanup(func() {
+			dataPlane.Stop()
+			dataPlane.Disconnect()
+		})
+		return dataPlane
+	}
+
+	t.Run("CarriesFrames", func(t *testing.T) {
+		dataPlane := connect(t, newConfig(config.TransportWebSocket, blocked))
+		assert.Equal(t, config.TransportWebSocket, dataPlane.GetTransportName())
+		assert.Equal(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(webSocketPort)), dataPlane.GetServerAddr())
+
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: httpTunnel, Protocol: "http", LocalPort: 3000}))
+		nextReceived(t, server, types.MessageTypeTunnelRegistration)
+
+		// A read that timed out leaves the connection usable, as on TLS
+		_, err := dataPlane.ReadMessageWithTimeout(50 * time.Millisecond)
+		for err == nil {
+			_, err = dataPlane.ReadMessageWithTimeout(50 * time.Millisecond)
+		}
+		// Larger than a single background read of the connection
+		payload, err := json.Marshal(&types.DataForwardPayload{
+			ConnectionID: "conn-1",
+			RequestID:    "req-1",
+			Method:       "POST",
+			Path:         "/upload",
+			Data:         []byte(strings.Repeat("x", 100*1024)),
+		})
+		require.NoError(t, err)
+		require.NoError(t, server.Send(types.NewMessage(types.MessageTypeDataForward, httpTunnel, payload)))
+
+		message, err := dataPlane.ReadMessageWithTimeout(3 * time.Second)
+		require.NoError(t, err)
+		parsed, err := message.ParsePayload()
+		require.NoError(t, err)
+		assert.Len(t, parsed.(*types.DataForwardPayload).Data, 100*1024)
+	})
+
+	t.Run("AutoFallsBackWhenDirectDialFails", func(t *testing.T) {
+		dataPlane := connect(t, newConfig(config.TransportAuto, blocked))
+		assert.Equal(t, config.TransportWebSocket, dataPlane.GetTransportName())
+	})
+
+	t.Run("AutoPrefersDirect", func(t *testing.T) {
+		dataPlane := connect(t, newConfig(config.TransportAuto, server.Port()))
+		assert.Equal(t, config.TransportTLS, dataPlane.GetTransportName())
+	})
+
+	t.Run("VerifiesTheHostDespiteTLSVerify", func(t *testing.T) {
+		cfg := newConfig(config.TransportWebSocket, blocked)
+		cfg.Server.CAFile = ""
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		err := dataPlane.Connect()
+		var unknownAuthority x509.UnknownAuthorityError
+		assert.ErrorAs(t, err, &unknownAuthority)
+	})
+
+	t.Run("TLSDoesNotFallBack", func(t *testing.T) {
+		dataPlane := client.NewDataPlaneClient(newConfig(config.TransportTLS, blocked), logger)
+		defer dataPlane.Stop()
+		require.Error(t, dataPlane.Connect())
+	})
+}
+
+// TestIntegrationQUICTransport tests data plane connections over QUIC with a native stream per tunnel stream
+func TestIntegrationQUICTransport(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+	require.NoError(t, err)
+	defer server.Close()
+	quicPort, err := server.StartQUIC()
+	require.NoError(t, err)
+
+	connect := func(t *testing.T) *client.DataPlaneClient {
+		cfg := server.Config()
+		cfg.Server.Transport = config.TransportQUIC
+		cfg.Server.DataPlanePort = quicPort
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		require.NoError(t, dataPlane.Connect())
+		t.Cleanup(func() {
+			dataPlane.Stop()
+			dataPlane.Disconnect()
+		})
+		return dataPlane
+	}
+
+	t.Run("CarriesFrames", func(t *testing.T) {
+		dataPlane := connect(t)
+		assert.Equal(t, config.TransportQUIC, dataPlane.GetTransportName())
+		assert.Nil(t, dataPlane.GetSession())
+
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: httpTunnel, Protocol: "http", LocalPort: 3000}))
+		registration := nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		assert.Equal(t, httpTunnel, registration.TunnelID)
+	})
+
+	t.Run("StreamsAreIndependent", func(t *testing.T) {
+		dataPlane := connect(t)
+		streams := dataPlane.GetStreams()
+		require.NotNil(t, streams)
+
+		first, err := server.OpenQUICStream(tunnelA, []byte("first"))
+		require.NoError(t, err)
+		defer first.Close()
+		second, err := server.OpenQUICStream(tunnelB, nil)
+		require.NoError(t, err)
+		defer second.Close()
+		// Only the second stream carries data, it must not wait for the first
+		_, err = second.Write([]byte("ping"))
+		require.NoError(t, err)
+
+		accepted := make(map[string]protocol.TunnelStream)
+		for len(accepted) < 2 {
+			stream, err := streams.AcceptStream()
+			require.NoError(t, err)
+			accepted[stream.TunnelID()] = stream
+		}
+		assert.Equal(t, []byte("first"), accepted[tunnelA].Metadata())
+		assert.Equal(t, 2, streams.NumStreams())
+		// Streams of one connection share the server address, the stream ID
+		// keeps them apart for connection keyed state such as the dispatcher
+		assert.NotEqual(t, accepted[tunnelA].RemoteAddr().String(), accepted[tunnelB].RemoteAddr().String())
+
+		buffer := make([]byte, 4)
+		accepted[tunnelB].SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = io.ReadFull(accepted[tunnelB], buffer)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buffer))
+
+		_, err = accepted[tunnelB].Write([]byte("pong"))
+		require.NoError(t, err)
+		require.NoError(t, accepted[tunnelB].CloseWrite())
+		second.SetReadDeadline(time.Now().Add(3 * time.Second))
+		reply, err := io.ReadAll(second)
+		require.NoError(t, err)
+		assert.Equal(t, "pong", string(reply))
+
+		accepted[tunnelB].Close()
+		accepted[tunnelA].Reset(types.ErrorCodeUnknownTunnel)
+		assert.Equal(t, 0, streams.NumStreams())
+
+		first.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err = first.Read(make([]byte, 1))
+		assert.Error(t, err)
+	})
+
+	t.Run("ServesTunnelStreams", func(t *testing.T) {
+		dataPlane := connect(t)
+		dispatcher := proxy.NewDispatcher(&errorRecorder{codes: make(chan string, 16)}, logger)
+		go func() {
+			for {
+				stream, err := dataPlane.GetStreams().AcceptStream()
+				if err != nil {
+					return
+				}
+				go dispatcher.HandleStream(stream)
+			}
+		}()
+
+		localService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+		}))
+		defer localService.Close()
+		port, err := strconv.Atoi(localService.URL[strings.LastIndex(localService.URL, ":")+1:])
+		require.NoError(t, err)
+		require.NoError(t, dispatcher.AddTunnel(&client.Tunnel{ID: httpTunnel, Protocol: "http", LocalPort: port}))
+
+		stream, err := server.OpenQUICStream(httpTunnel, nil)
+		require.NoError(t, err)
+		defer stream.Close()
+
+		request, err := http.NewRequest("GET", "http://app.example.com/status", nil)
+		require.NoError(t, err)
+		require.NoError(t, request.Write(stream))
+
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		response, err := http.ReadResponse(bufio.NewReader(stream), request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "GET /status", string(body))
+	})
+
+	t.Run("MigratesToNewPath", func(t *testing.T) {
+		dataPlane := connect(t)
+		// Acknowledgments and pongs are delivered while reading
+		go func() {
+			for {
+				if _, err := dataPlane.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+		require.NoError(t, dataPlane.RegisterTunnel(&client.Tunnel{ID: tcpTunnel, Protocol: "tcp", LocalPort: 5432}))
+		nextReceived(t, server, types.MessageTypeTunnelRegistration)
+		before := server.QUICRemoteAddr()
+
+		require.NoError(t, dataPlane.Migrate(3*time.Second))
+
+		// The server sees the new address once the client sends from it
+		_, err := dataPlane.Ping(3 * time.Second)
+		require.NoError(t, err)
+		assert.NotEqual(t, before.String(), server.QUICRemoteAddr().String())
+	})
+
+	t.Run("TLSConnectionsDoNotMigrate", func(t *testing.T) {
+		dataPlane := newDataPlaneClient(t, server)
+		assert.ErrorIs(t, dataPlane.Migrate(time.Second), client.ErrMigrationUnsupported)
+	})
+}
+
+// testCA is a certificate authority signing client certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// newTestCA creates a self-signed certificate authority
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// sign issues a client certificate for a PEM certificate signing request
+func (ca *testCA) sign(t *testing.T, csrPEM []byte) []byte {
+	block, _ := pem.Decode(csrPEM)
+	require.NotNil(t, block)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	require.NoError(t, err)
+	require.NoError(t, csr.CheckSignature())
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca.cert, csr.PublicKey, ca.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// issue generates a key like "auth cert request" and stores it with its signed certificate
+func (ca *testCA) issue(t *testing.T, commonName, certPath, keyPath string) {
+	keyPEM, csrPEM, err := security.GenerateCertificateRequest(commonName)
+	require.NoError(t, err)
+	require.NoError(t, security.WritePEM(keyPath, keyPEM))
+	require.NoError(t, security.WritePEM(certPath, ca.sign(t, csrPEM)))
+}
+
+// TestIntegrationClientCertificates tests data plane connections authenticated with a client certificate
+func TestIntegrationClientCertificates(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+	require.NoError(t, err)
+	defer server.Close()
+	ca := newTestCA(t)
+	server.RequireClientCertificates(ca.pool)
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	ca.issue(t, "laptop", certPath, keyPath)
+
+	newConfig := func() *config.Config {
+		cfg := server.Config()
+		cfg.Auth.ClientCert = certPath
+		cfg.Auth.ClientKey = keyPath
+		return cfg
+	}
+
+	t.Run("PresentsCertificate", func(t *testing.T) {
+		dataPlane := client.NewDataPlaneClient(newConfig(), logger)
+		defer dataPlane.Stop()
+		require.NoError(t, dataPlane.Connect())
+		defer dataPlane.Disconnect()
+
+		assert.Contains(t, server.ClientNames(), "laptop")
+	})
+
+	t.Run("PoolPresentsCertificate", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Connection.PoolSize = 2
+		pool := client.NewConnectionPool(cfg, logger)
+		defer pool.Close()
+		accepted := server.Accepted()
+
+		require.NoError(t, pool.Initialize())
+		assert.Equal(t, accepted+2, server.Accepted())
+	})
+
+	t.Run("RefusedWithoutCertificate", func(t *testing.T) {
+		dataPlane := client.NewDataPlaneClient(server.Config(), logger)
+		defer dataPlane.Stop()
+		require.Error(t, dataPlane.Connect())
+	})
+
+	t.Run("ReloadsRotatedCertificate", func(t *testing.T) {
+		rotatedCert := filepath.Join(dir, "rotated.crt")
+		rotatedKey := filepath.Join(dir, "rotated.key")
+		ca.issue(t, "before", rotatedCert, rotatedKey)
+
+		certificate := security.NewClientCertificate(rotatedCert, rotatedKey)
+		certificate.SetReloadInterval(0)
+		loaded, err := certificate.Load()
+		require.NoError(t, err)
+		assert.Equal(t, "before", loaded.Leaf.Subject.CommonName)
+
+		ca.issue(t, "after", rotatedCert, rotatedKey)
+		loaded, err = certificate.Load()
+		require.NoError(t, err)
+		assert.Equal(t, "after", loaded.Leaf.Subject.CommonName)
+
+		// A half written rotation keeps the certificate that worked
+		require.NoError(t, os.WriteFile(rotatedCert, []byte("not a certificate"), 0600))
+		loaded, err = certificate.Load()
+		require.NoError(t, err)
+		assert.Equal(t, "after", loaded.Leaf.Subject.CommonName)
+	})
+
+	t.Run("InstallChecksKeyPair", func(t *testing.T) {
+		certPEM, err := os.ReadFile(certPath)
+		require.NoError(t, err)
+		otherKey, _, err := security.GenerateCertificateRequest("other")
+		require.NoError(t, err)
+
+		_, err = security.VerifyKeyPair(certPEM, otherKey)
+		assert.Error(t, err)
+	})
+}
+
+// writeCertificate stores a certificate as a PEM CA file
+func writeCertificate(t *testing.T, path string, cert *x509.Certificate) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	require.NoError(t, os.WriteFile(path, data, 0600))
+}
+
+func TestIntegrationServerVerification(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+	require.NoError(t, err)
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "server-ca.pem")
+	writeCertificate(t, caFile, server.Certificate())
+
+	wrongPin := client.SPKIPin(newTestCA(t).cert)
+
+	newConfig := func() *config.Config {
+		cfg := server.Config()
+		cfg.Server.TLSVerify = true
+		cfg.Server.Transport = config.TransportTLS
+		return cfg
+	}
+
+	t.Run("TrustsCAFile", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Server.CAFile = caFile
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		require.NoError(t, dataPlane.Connect())
+		dataPlane.Disconnect()
+	})
+
+	t.Run("RefusedWithoutCAFile", func(t *testing.T) {
+		dataPlane := client.NewDataPlaneClient(newConfig(), logger)
+		defer dataPlane.Stop()
+		require.Error(t, dataPlane.Connect())
+	})
+
+	t.Run("CAFileWithoutTLSVerify", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Server.TLSVerify = false
+		cfg.Server.CAFile = caFile
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		require.NoError(t, dataPlane.Connect())
+		dataPlane.Disconnect()
+
+		// tls_verify off skips the host name, not the CA file
+		otherCAFile := filepath.Join(dir, "other-ca.pem")
+		writeCertificate(t, otherCAFile, newTestCA(t).cert)
+		cfg = newConfig()
+		cfg.Server.TLSVerify = false
+		cfg.Server.CAFile = otherCAFile
+		refused := client.NewDataPlaneClient(cfg, logger)
+		defer refused.Stop()
+		require.Error(t, refused.Connect())
+	})
+
+	t.Run("AcceptsPinnedKey", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Server.CAFile = caFile
+		cfg.Server.PinnedSPKISHA256 = []string{wrongPin, client.SPKIPin(server.Certificate())}
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		require.NoError(t, dataPlane.Connect())
+		dataPlane.Disconnect()
+	})
+
+	t.Run("RefusesPinMismatch", func(t *testing.T) {
+		cfg := newConfig()
+		cfg.Server.CAFile = caFile
+		cfg.Server.PinnedSPKISHA256 = []string{wrongPin}
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		err := dataPlane.Connect()
+		require.Error(t, err)
+		assert.ErrorIs(t, err, client.ErrPinMismatch)
+		assert.Contains(t, err.Error(), client.SPKIPin(server.Certificate()))
+	})
+
+	t.Run("PinsHexDigest", func(t *testing.T) {
+		digest := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+		cfg := newConfig()
+		cfg.Server.TLSVerify = false
+		cfg.Server.PinnedSPKISHA256 = []string{hex.EncodeToString(digest[:])}
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		require.NoError(t, dataPlane.Connect())
+		dataPlane.Disconnect()
+	})
+
+	t.Run("ControlPlane", func(t *testing.T) {
+		mockServer := NewMockShipItServer(&MockServerConfig{
+			ValidAPIKeys: []string{"test-api-key-123"},
+		})
+		defer mockServer.Close()
+		apiServer := httptest.NewTLSServer(http.HandlerFunc(mockServer.handleHTTP))
+		defer apiServer.Close()
+
+		apiCAFile := filepath.Join(dir, "api-ca.pem")
+		writeCertificate(t, apiCAFile, apiServer.Certificate())
+
+		cfg := newConfig()
+		cfg.Auth.APIKey = "test-api-key-123"
+		cfg.Server.CAFile = apiCAFile
+		controlPlane := client.NewControlPlaneClient(cfg, logger)
+		controlPlane.SetBaseURL(apiServer.URL + "/api/v1")
+		info, err := controlPlane.ValidateToken(context.Background())
+		require.NoError(t, err)
+		assert.True(t, info.Valid)
+
+		cfg.Server.PinnedSPKISHA256 = []string{wrongPin}
+		controlPlane = client.NewControlPlaneClient(cfg, logger)
+		controlPlane.SetBaseURL(apiServer.URL + "/api/v1")
+		_, err = controlPlane.ValidateToken(context.Background())
+		assert.ErrorIs(t, err, client.ErrPinMismatch)
+
+		// tls_verify does not turn verification off for the API key
+		cfg = newConfig()
+		cfg.Auth.APIKey = "test-api-key-123"
+		cfg.Server.TLSVerify = false
+		controlPlane = client.NewControlPlaneClient(cfg, logger)
+		controlPlane.SetBaseURL(apiServer.URL + "/api/v1")
+		_, err = controlPlane.ValidateToken(context.Background())
+		var unknownAuthority x509.UnknownAuthorityError
+		assert.ErrorAs(t, err, &unknownAuthority)
+	})
+
+	t.Run("ValidatesPins", func(t *testing.T) {
+		for pin, valid := range map[string]bool{
+			wrongPin:                                true,
+			strings.TrimPrefix(wrongPin, "sha256/"): true,
+			strings.Repeat("ab", sha256.Size):       true,
+			"sha256/too-short":                      false,
+			strings.Repeat("ab", sha256.Size-1):     false,
+		} {
+			_, err := config.ParseSPKIPin(pin)
+			assert.Equal(t, valid, err == nil, pin)
+		}
+	})
+}
+
+func TestIntegrationDataPlaneAuth(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+	server, err := NewMockDataPlaneServer(protocol.SupportedCapabilities)
+	require.NoError(t, err)
+	defer server.Close()
+
+	apiKey := types.AuthPayload{Method: types.AuthMethodAPIKey, Credential: "test-api-key-123"}
+	token := types.AuthPayload{Method: types.AuthMethodToken, Credential: "dpt_short_lived"}
+
+	newConfig := func() *config.Config {
+		cfg := server.Config()
+		cfg.Auth.APIKey = "test-api-key-123"
+		cfg.Connection.ReconnectInterval = 20 * time.Millisecond
+		cfg.Connection.MaxReconnectAttempts = 5
+		return cfg
+	}
+
+	t.Run("SendsAPIKey", func(t *testing.T) {
+		server.RequireCredentials(apiKey)
+		dataPlane := client.NewDataPlaneClient(newConfig(), logger)
+		defer dataPlane.Stop()
+		require.NoError(t, dataPlane.Connect())
+		defer dataPlane.Disconnect()
+
+		authenticated := server.Authenticated()
+		assert.Equal(t, apiKey, authenticated[len(authenticated)-1])
+	})
+
+	t.Run("SkippedWhenNotOffered", func(t *testing.T) {
+		legacy, err := NewMockDataPlaneServer(protocol.SupportedCapabilities &^ types.CapabilityAuth)
+		require.NoError(t, err)
+		defer legacy.Close()
+
+		cfg := legacy.Config()
+		cfg.Auth.APIKey = "test-api-key-123"
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		require.NoError(t, dataPlane.Connect())
+		defer dataPlane.Disconnect()
+
+		assert.Equal(t, 1, legacy.Accepted())
+		assert.Empty(t, legacy.Authenticated())
+		assert.False(t, dataPlane.Supports(types.CapabilityAuth))
+	})
+
+	t.Run("RefusesWrongAPIKey", func(t *testing.T) {
+		server.RequireCredentials(apiKey)
+		cfg := newConfig()
+		cfg.Auth.APIKey = "revoked-key"
+		dataPlane := client.NewDataPlaneClient(cfg, logger)
+		defer dataPlane.Stop()
+		err := dataPlane.Connect()
+		require.Error(t, err)
+		assert.ErrorIs(t, err, protocol.ErrAuthFailed)
+	})
+
+	t.Run("UsesControlPlaneToken", func(t *testing.T) {
+		server.RequireCredentials(token)
+		mockServer := NewMockShipItServer(&MockServerConfig{
+			ValidAPIKeys:   []string{"test-api-key-123"},
+			DataPlaneToken: token.Credential,
+		})
+		defer mockServer.Close()
+		controlPlane := client.NewControlPlaneClient(newConfig(), logger)
+		controlPlane.SetBaseURL(mockServer.URL() + "/api/v1")
+
+		for i := 0; i < 2; i++ {
+			dataPlane := client.NewDataPlaneClient(newConfig(), logger)
+			dataPlane.SetCredentialSource(controlPlane)
+			require.NoError(t, dataPlane.Connect())
+			dataPlane.Stop()
+		}
+		// The token is reused until it is about to expire
+		assert.Equal(t, 1, mockServer.GetTokenCalls())
+	})
+
+	t.Run("FallsBackToAPIKey", func(t *testing.T) {
+		server.RequireCredentials(apiKey)
+		mockServer := NewMockShipItServer(&MockServerConfig{ValidAPIKeys: []string{"test-api-key-123"}})
+		defer mockServer.Close()
+		controlPlane := client.NewControlPlaneClient(newConfig(), logger)
+		controlPlane.SetBaseURL(mockServer.URL() + "/api/v1")
+
+		dataPlane := client.NewDataPlaneClient(newConfig(), logger)
+		defer dataPlane.Stop()
+		dataPlane.SetCredentialSource(controlPlane)
+		require.NoError(t, dataPlane.Connect())
+	})
+
+	t.Run("HoldsAPIKeyFromUnverifiedServer", func(t *testing.T) {
+		server.RequireCredentials(apiKey)
+		unverified := func() *config.Config {
+			cfg := newConfig()
+			cfg.Server.PinnedSPKISHA256 = nil
+			cfg.Connection.MaxReconnectAttempts = 1
+			return cfg
+		}
+		authenticated := len(server.Authenticated())
+
+		dataPlane := client.NewDataPlaneClient(unverified(), logger)
+		defer dataPlane.Stop()
+		assert.ErrorIs(t, dataPlane.Connect(), client.ErrUnverifiedServer)
+		assert.Len(t, server.Authenticated(), authenticated)
+
+		// A short lived token is still sent
+		server.RequireCredentials(token)
+		mockServer := NewMockShipItServer(&MockServerConfig{
+			ValidAPIKeys:   []string{"test-api-key-123"},
+			DataPlaneToken: token.Credential,
+		})
+		defer mockServer.Close()
+		controlPlane := client.NewControlPlaneClient(unverified(), logger)
+		controlPlane.SetBaseURL(mockServer.URL() + "/api/v1")
+
+		tokenDataPlane := client.NewDataPlaneClient(unverified(), logger)
+		defer tokenDataPlane.Stop()
+		tokenDataPlane.SetCredentialSource(controlPlane)
+		require.NoError(t, tokenDataPlane.Connect())
+		authenticatedWith := server.Authenticated()
+		assert.Equal(t, token, authenticatedWith[len(authenticatedWith)-1])
+	})
+
+	t.Run("TokenRefusedForWrongAPIKey", func(t *testing.T) {
+		mockServer := NewMockShipItServer(&MockServerConfig{DataPlaneToken: token.Credential})
+		defer mockServer.Close()
+		controlPlane := client.NewControlPlaneClient(newConfig(), logger)
+		controlPlane.SetBaseURL(mockServer.URL() + "/api/v1")
+
+		_, err := controlPlane.DataPlaneCredentials(context.Background())
+		assert.ErrorIs(t, err, protocol.ErrAuthFailed)
+	})
+
+	t.Run("TunnelManagerStopsRetrying", func(t *testing.T) {
+		server.RequireCredentials(apiKey)
+		controlPlane := NewMockShipItServer(&MockServerConfig{})
+		defer controlPlane.Close()
+
+		tunnelManager := client.NewTunnelManager(newConfig(), logger)
+		tunnelManager.GetControlPlane().SetBaseURL(controlPlane.URL() + "/api/v1")
+		defer tunnelManager.Stop()
+
+		stateOf := func() (client.TunnelState, error) {
+			tunnels := tunnelManager.GetStats()["tunnels"].(map[string]interface{})
+			for _, info := range tunnels {
+				info := info.(map[string]interface{})
+				err, _ := info["error"].(error)
+				return info["state"].(client.TunnelState), err
+			}
+			return "", nil
+		}
+
+		require.NoError(t, tunnelManager.StartTunnel(&config.TunnelConfig{Name: "web", Protocol: "http", LocalPort: 3000}))
+		require.Eventually(t, func() bool {
+			state, _ := stateOf()
+			return state == client.TunnelStateActive
+		}, 3*time.Second, 10*time.Millisecond)
+
+		// The key is revoked while the tunnel is up
+		server.RequireCredentials(token)
+		refused := server.Refused()
+		server.DropConnections()
+
+		require.Eventually(t, func() bool {
+			state, _ := stateOf()
+			return state == client.TunnelStateError
+		}, 3*time.Second, 10*time.Millisecond)
+		_, err := stateOf()
+		assert.ErrorIs(t, err, protocol.ErrAuthFailed)
+
+		// No attempts are made after the refusal
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal(t, refused+1, server.Refused())
+		assert.Zero(t, tunnelManager.GetConnectionPool().GetConnectionCount())
+	})
+}
@@ -0,0 +1,601 @@
+package testing
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/quic-go/quic-go"
+	"github.com/sirupsen/logrus"
+	"github.com/unownone/shipitd/internal/client"
+	"github.com/unownone/shipitd/internal/config"
+	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// MockDataPlaneServer is a data plane server speaking the frame protocol over TLS
+type MockDataPlaneServer struct {
+	listener     net.Listener
+	certificates []tls.Certificate
+	webSocket    *httptest.Server
+	quic         *quic.Listener
+	capabilities types.Capability
+	logger       *logrus.Logger
+	received     chan *types.Message
+	mu           sync.Mutex
+	conns        []*mockDataPlaneConn
+	accepted     int
+	autoAck      bool
+	echo         bool
+	resumeTokens map[string]string
+	clientCAs    *x509.CertPool
+	clientNames  []string
+	credentials  []types.AuthPayload
+	authed       []types.AuthPayload
+	refused      int
+	issued       int
+	hold         chan struct{}
+	restarts     int
+	closed       bool
+}
+
+// mockDataPlaneConn is one client connection accepted by the mock server
+type mockDataPlaneConn struct {
+	conn    net.Conn
+	reader  *protocol.Reader
+	writer  *protocol.Writer
+	session *protocol.Session
+	quic    *quic.Conn
+	closed  chan struct{}
+}
+
+// NewMockDataPlaneServer starts a data plane server on a random local port that
+// negotiates the given capabilities
+func NewMockDataPlaneServer(capabilities types.Capability) (*MockDataPlaneServer, error) {
+	// Borrow the self-signed certificate httptest generates
+	certServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	certServer.StartTLS()
+	certificates := certServer.TLS.Certificates
+	certServer.Close()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	mock := &MockDataPlaneServer{
+		certificates: certificates,
+		capabilities: capabilities,
+		logger:       logger,
+		received:     make(chan *types.Message, 100),
+		autoAck:      true,
+		echo:         true,
+		resumeTokens: make(map[string]string),
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetConfigForClient: mock.tlsConfig})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	mock.listener = listener
+	go mock.acceptLoop()
+
+	return mock, nil
+}
+
+// Port returns the port the server listens on
+func (m *MockDataPlaneServer) Port() int {
+	return m.listener.Addr().(*net.TCPAddr).Port
+}
+
+// StartWebSocket also accepts connections over WebSocket on another port, like
+// the control plane host does, and returns that port
+func (m *MockDataPlaneServer) StartWebSocket() int {
+	mux := http.NewServeMux()
+	mux.HandleFunc(client.WebSocketPath, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols: []string{client.WebSocketSubprotocol},
+		})
+		if err != nil {
+			return
+		}
+		m.serve(websocket.NetConn(context.Background(), ws, websocket.MessageBinary))
+	})
+
+	server := httptest.NewUnstartedServer(mux)
+	server.TLS = &tls.Config{Certificates: m.certificates}
+	server.StartTLS()
+
+	m.mu.Lock()
+	m.webSocket = server
+	m.mu.Unlock()
+
+	return server.Listener.Addr().(*net.TCPAddr).Port
+}
+
+// StartQUIC also accepts connections over QUIC on a UDP port and returns it.
+// The first stream a client opens carries the frames, tunnel streams are
+// opened with OpenQUICStream.
+func (m *MockDataPlaneServer) StartQUIC() (int, error) {
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: m.certificates,
+		NextProtos:   []string{client.QUICProtocol},
+	}, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	m.mu.Lock()
+	m.quic = listener
+	m.mu.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				control, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					conn.CloseWithError(0, "")
+					return
+				}
+				m.serve(&mockQUICConn{Stream: control, conn: conn})
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.UDPAddr).Port, nil
+}
+
+// OpenQUICStream opens a tunnel stream to the client on the most recent QUIC connection
+func (m *MockDataPlaneServer) OpenQUICStream(tunnelID string, metadata []byte) (*quic.Stream, error) {
+	conn := m.latest()
+	if conn == nil || conn.quic == nil {
+		return nil, fmt.Errorf("no QUIC client connected")
+	}
+
+	stream, err := conn.quic.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if err := protocol.WriteStreamHeader(stream, tunnelID, metadata); err != nil {
+		stream.CancelWrite(0)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// QUICRemoteAddr returns the address the most recent QUIC client sends from
+func (m *MockDataPlaneServer) QUICRemoteAddr() net.Addr {
+	conn := m.latest()
+	if conn == nil || conn.quic == nil {
+		return nil
+	}
+	return conn.quic.RemoteAddr()
+}
+
+// Addr returns the host:port the server listens on
+func (m *MockDataPlaneServer) Addr() string {
+	return m.listener.Addr().String()
+}
+
+// Config returns a client configuration pointing at the server. The server
+// certificate is pinned rather than verified, its host name is not checked.
+func (m *MockDataPlaneServer) Config() *config.Config {
+	return &config.Config{
+		Server: config.ServerConfig{
+			Domain:           "127.0.0.1",
+			DataPlanePort:    m.Port(),
+			TLSVerify:        false,
+			PinnedSPKISHA256: []string{client.SPKIPin(m.Certificate())},
+		},
+		Connection: config.ConnectionConfig{
+			AckTimeout: 200 * time.Millisecond,
+		},
+	}
+}
+
+// Received returns the messages read from clients, acknowledgments included
+func (m *MockDataPlaneServer) Received() <-chan *types.Message {
+	return m.received
+}
+
+// SetAutoAck sets whether messages carrying an ID are acknowledged automatically
+func (m *MockDataPlaneServer) SetAutoAck(autoAck bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.autoAck = autoAck
+}
+
+// RestartSession makes later connections belong to a new server session, as
+// after a restart of the server, whose message IDs start over
+func (m *MockDataPlaneServer) RestartSession() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restarts++
+}
+
+// SetEchoHeartbeats sets whether heartbeats carrying a nonce are echoed, a
+// server that stops echoing looks like a dead peer to the client
+func (m *MockDataPlaneServer) SetEchoHeartbeats(echo bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.echo = echo
+}
+
+// RevokeResumeTokens forgets every resumption token issued so far, like a
+// server that lost its sessions or let them expire
+func (m *MockDataPlaneServer) RevokeResumeTokens() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.resumeTokens = make(map[string]string)
+}
+
+// Certificate returns the self-signed certificate the server presents
+func (m *MockDataPlaneServer) Certificate() *x509.Certificate {
+	return m.certificates[0].Leaf
+}
+
+// RequireClientCertificates makes TLS handshakes fail unless the client
+// presents a certificate signed by one of cas, nil accepts clients without one
+func (m *MockDataPlaneServer) RequireClientCertificates(cas *x509.CertPool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clientCAs = cas
+}
+
+// ClientNames returns the common names of the client certificates of accepted connections
+func (m *MockDataPlaneServer) ClientNames() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.clientNames...)
+}
+
+// RequireCredentials makes authentication fail unless the client presents one
+// of accepted, none accepts any credentials
+func (m *MockDataPlaneServer) RequireCredentials(accepted ...types.AuthPayload) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credentials = accepted
+}
+
+// Authenticated returns the credentials of the connections that authenticated
+func (m *MockDataPlaneServer) Authenticated() []types.AuthPayload {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]types.AuthPayload(nil), m.authed...)
+}
+
+// Refused returns the number of connections whose credentials were refused
+func (m *MockDataPlaneServer) Refused() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.refused
+}
+
+// verifyCredentials accepts the credentials of a connection when they are required ones
+func (m *MockDataPlaneServer) verifyCredentials(auth *types.AuthPayload) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.credentials == nil {
+		return nil
+	}
+	for _, accepted := range m.credentials {
+		if *auth == accepted {
+			return nil
+		}
+	}
+	m.refused++
+	return fmt.Errorf("invalid %s", auth.Method)
+}
+
+// tlsConfig returns the TLS configuration for a client connecting over TLS
+func (m *MockDataPlaneServer) tlsConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tlsConfig := &tls.Config{Certificates: m.certificates}
+	if m.clientCAs != nil {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = m.clientCAs
+	}
+	return tlsConfig, nil
+}
+
+// Accepted returns the number of connections that completed the handshake
+func (m *MockDataPlaneServer) Accepted() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accepted
+}
+
+// Send writes a message to the most recent client connection
+func (m *MockDataPlaneServer) Send(message *types.Message) error {
+	conn := m.latest()
+	if conn == nil {
+		return fmt.Errorf("no client connected")
+	}
+	return conn.writer.WriteMessage(message)
+}
+
+// Acknowledge acknowledges a message received from the client
+func (m *MockDataPlaneServer) Acknowledge(message *types.Message) error {
+	conn := m.latest()
+	if conn == nil {
+		return fmt.Errorf("no client connected")
+	}
+	return acknowledge(conn.writer, message)
+}
+
+// OpenStream opens a stream to the client on the most recent connection
+func (m *MockDataPlaneServer) OpenStream(tunnelID string) (*protocol.Stream, error) {
+	conn := m.latest()
+	if conn == nil || conn.session == nil {
+		return nil, fmt.Errorf("no multiplexed client connected")
+	}
+	return conn.session.OpenStream(tunnelID, nil)
+}
+
+// GoAway sends a GOAWAY on the most recent connection and returns a channel
+// closed once the client closed that connection
+func (m *MockDataPlaneServer) GoAway(reason string, timeout time.Duration) (<-chan struct{}, error) {
+	conn := m.latest()
+	if conn == nil {
+		return nil, fmt.Errorf("no client connected")
+	}
+	err := conn.writer.WriteGoAway(&types.GoAwayPayload{Reason: reason, DrainTimeout: timeout.Milliseconds()})
+	return conn.closed, err
+}
+
+// HoldHandshakes makes new connections wait before the handshake until the
+// returned function is called
+func (m *MockDataPlaneServer) HoldHandshakes() func() {
+	hold := make(chan struct{})
+	m.mu.Lock()
+	m.hold = hold
+	m.mu.Unlock()
+
+	return func() {
+		m.mu.Lock()
+		m.hold = nil
+		m.mu.Unlock()
+		close(hold)
+	}
+}
+
+// DropConnections closes every client connection without a goodbye, like a flaky link would
+func (m *MockDataPlaneServer) DropConnections() {
+	m.mu.Lock()
+	conns := m.conns
+	m.conns = nil
+	m.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.writer.Close()
+	}
+}
+
+// Close stops the server and closes every client connection
+func (m *MockDataPlaneServer) Close() {
+	m.mu.Lock()
+	m.closed = true
+	webSocket := m.webSocket
+	quicListener := m.quic
+	m.mu.Unlock()
+
+	m.listener.Close()
+	m.DropConnections()
+	if webSocket != nil {
+		webSocket.Close()
+	}
+	if quicListener != nil {
+		quicListener.Close()
+	}
+}
+
+// latest returns the most recent client connection
+func (m *MockDataPlaneServer) latest() *mockDataPlaneConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.conns) == 0 {
+		return nil
+	}
+	return m.conns[len(m.conns)-1]
+}
+
+// acceptLoop accepts client connections until the listener is closed
+func (m *MockDataPlaneServer) acceptLoop() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.serve(conn)
+	}
+}
+
+// serve runs the handshake and reads messages from one client connection
+func (m *MockDataPlaneServer) serve(conn net.Conn) {
+	m.mu.Lock()
+	hold := m.hold
+	sessionID := fmt.Sprintf("mock-%d", m.restarts)
+	m.mu.Unlock()
+	if hold != nil {
+		<-hold
+	}
+
+	reader := protocol.NewReader(conn, m.logger)
+	writer := protocol.NewWriter(conn, m.logger)
+
+	negotiation, err := protocol.ServerHandshake(reader, writer, "mock", sessionID, m.capabilities, m.logger)
+	if err != nil {
+		writer.Close()
+		return
+	}
+
+	var auth *types.AuthPayload
+	if negotiation.Supports(types.CapabilityAuth) {
+		auth, err = protocol.ServerAuthenticate(reader, writer, m.verifyCredentials, m.logger)
+		if err != nil {
+			writer.Close()
+			return
+		}
+	}
+
+	resume := negotiation.Supports(types.CapabilitySessionResume)
+	served := &mockDataPlaneConn{conn: conn, reader: reader, writer: writer, closed: make(chan struct{})}
+	if quicConn, ok := conn.(*mockQUICConn); ok {
+		// Tunnel streams are QUIC streams of their own
+		served.quic = quicConn.conn
+	} else if negotiation.Supports(types.CapabilityMultiplexing) {
+		served.session = protocol.NewSession(writer, false, m.logger)
+	}
+	defer close(served.closed)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		writer.Close()
+		return
+	}
+	m.conns = append(m.conns, served)
+	m.accepted++
+	if auth != nil {
+		m.authed = append(m.authed, *auth)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if peers := tlsConn.ConnectionState().PeerCertificates; len(peers) > 0 {
+			m.clientNames = append(m.clientNames, peers[0].Subject.CommonName)
+		}
+	}
+	m.mu.Unlock()
+
+	for {
+		message, err := reader.ReadMessage()
+		if err != nil {
+			writer.Close()
+			if served.session != nil {
+				served.session.Close()
+			}
+			return
+		}
+
+		if types.IsStreamMessage(message.Type) && served.session != nil {
+			served.session.HandleFrame(message)
+			continue
+		}
+
+		m.mu.Lock()
+		autoAck := m.autoAck
+		echo := m.echo
+		m.mu.Unlock()
+		if autoAck && message.ID != 0 {
+			acknowledge(writer, message)
+		}
+		if echo && message.Type == types.MessageTypeHeartbeat {
+			echoHeartbeat(writer, message)
+		}
+		if resume && message.Type == types.MessageTypeTunnelRegistration {
+			m.answerRegistration(writer, message)
+		}
+
+		select {
+		case m.received <- message:
+		default:
+			m.logger.Warn("Mock data plane dropped a received message")
+		}
+	}
+}
+
+// answerRegistration issues a resumption token for a registration, or refuses
+// the token it presents when the server never issued it for that tunnel
+func (m *MockDataPlaneServer) answerRegistration(writer *protocol.Writer, message *types.Message) error {
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return err
+	}
+	registration := parsed.(*types.TunnelRegistrationPayload)
+
+	m.mu.Lock()
+	token := registration.ResumeToken
+	resumed := token != ""
+	if resumed && m.resumeTokens[token] != message.TunnelID {
+		m.mu.Unlock()
+		return writer.WriteError(message.TunnelID, &types.ErrorPayload{
+			Code:    types.ErrorCodeInvalidResumeToken,
+			Message: "Unknown resumption token",
+		})
+	}
+	if !resumed {
+		m.issued++
+		token = fmt.Sprintf("resume-%d", m.issued)
+		m.resumeTokens[token] = message.TunnelID
+	}
+	m.mu.Unlock()
+
+	registered := &types.TunnelRegisteredPayload{
+		PublicURL:   fmt.Sprintf("https://%s.example.test", registration.Subdomain),
+		Subdomain:   registration.Subdomain,
+		ResumeToken: token,
+		Resumed:     resumed,
+	}
+	if registration.PublicPort != nil {
+		registered.PublicPort = *registration.PublicPort
+	}
+	return writer.WriteTunnelRegistered(message.TunnelID, registered)
+}
+
+// echoHeartbeat answers a heartbeat carrying a nonce with its echo
+func echoHeartbeat(writer *protocol.Writer, message *types.Message) error {
+	parsed, err := message.ParsePayload()
+	if err != nil {
+		return err
+	}
+	heartbeat := parsed.(*types.HeartbeatPayload)
+	if heartbeat.Nonce == 0 || heartbeat.Echo {
+		return nil
+	}
+	return writer.WriteHeartbeat(message.TunnelID, &types.HeartbeatPayload{
+		Timestamp: time.Now().Unix(),
+		Nonce:     heartbeat.Nonce,
+		Echo:      true,
+	})
+}
+
+// acknowledge writes the acknowledgment of a message carrying an ID
+func acknowledge(writer *protocol.Writer, message *types.Message) error {
+	return writer.WriteAcknowledge(message.TunnelID, &types.AcknowledgePayload{
+		MessageID: fmt.Sprintf("%d", message.ID),
+		Status:    types.AckStatusReceived,
+	})
+}
+
+// mockQUICConn is the stream a QUIC client sends frames on, closing it closes the connection
+type mockQUICConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+// LocalAddr returns the server address
+func (c *mockQUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the client address
+func (c *mockQUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the connection
+func (c *mockQUICConn) Close() error {
+	return c.conn.CloseWithError(0, "")
+}
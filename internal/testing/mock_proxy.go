@@ -0,0 +1,245 @@
+package testing
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// MockProxyServer is an outbound proxy speaking HTTP CONNECT or SOCKS5. It
+// records the address every tunnel asked for and can send all of them to one
+// upstream, so names that do not resolve can be used as targets.
+type MockProxyServer struct {
+	listener net.Listener
+	socks    bool
+	user     string
+	password string
+	mu       sync.Mutex
+	upstream string
+	targets  []string
+}
+
+// NewMockHTTPProxy starts an HTTP CONNECT proxy, credentials are required unless user is empty
+func NewMockHTTPProxy(user, password string) (*MockProxyServer, error) {
+	return newMockProxy(false, user, password)
+}
+
+// NewMockSOCKS5Proxy starts a SOCKS5 proxy, credentials are required unless user is empty
+func NewMockSOCKS5Proxy(user, password string) (*MockProxyServer, error) {
+	return newMockProxy(true, user, password)
+}
+
+// newMockProxy starts a proxy on a random local port
+func newMockProxy(socks bool, user, password string) (*MockProxyServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	mock := &MockProxyServer{listener: listener, socks: socks, user: user, password: password}
+	go mock.acceptLoop()
+
+	return mock, nil
+}
+
+// URL returns the proxy URL with credentials, if any
+func (m *MockProxyServer) URL() string {
+	scheme := "http"
+	if m.socks {
+		scheme = "socks5"
+	}
+	if m.user == "" {
+		return fmt.Sprintf("%s://%s", scheme, m.listener.Addr())
+	}
+	return fmt.Sprintf("%s://%s:%s@%s", scheme, m.user, m.password, m.listener.Addr())
+}
+
+// SetUpstream sends every tunnel to addr instead of the address asked for
+func (m *MockProxyServer) SetUpstream(addr string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.upstream = addr
+}
+
+// Targets returns the addresses tunnels were asked for, refused ones included
+func (m *MockProxyServer) Targets() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.targets...)
+}
+
+// Close stops the proxy
+func (m *MockProxyServer) Close() {
+	m.listener.Close()
+}
+
+// acceptLoop accepts client connections until the listener is closed
+func (m *MockProxyServer) acceptLoop() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		if m.socks {
+			go m.serveSOCKS5(conn)
+		} else {
+			go m.serveConnect(conn)
+		}
+	}
+}
+
+// record notes a requested target and returns where to connect for it
+func (m *MockProxyServer) record(target string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.targets = append(m.targets, target)
+	if m.upstream != "" {
+		return m.upstream
+	}
+	return target
+}
+
+// serveConnect answers one HTTP CONNECT request and pipes the tunnel
+func (m *MockProxyServer) serveConnect(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil || request.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return
+	}
+	target := m.record(request.Host)
+
+	if m.user != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(m.user + ":" + m.password))
+		if request.Header.Get("Proxy-Authorization") != "Basic "+credentials {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n")
+			return
+		}
+	}
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer upstream.Close()
+
+	io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	pipe(&bufferedReadConn{Conn: conn, reader: reader}, upstream)
+}
+
+// serveSOCKS5 answers one SOCKS5 CONNECT request and pipes the tunnel
+func (m *MockProxyServer) serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+
+	// Greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if m.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		if !m.authenticateSOCKS5(conn) {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	target := m.record(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(conn, upstream)
+}
+
+// authenticateSOCKS5 reads a username/password subnegotiation and checks it
+func (m *MockProxyServer) authenticateSOCKS5(conn net.Conn) bool {
+	version := make([]byte, 2)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return false
+	}
+	user := make([]byte, version[1])
+	io.ReadFull(conn, user)
+	length := make([]byte, 1)
+	io.ReadFull(conn, length)
+	password := make([]byte, length[0])
+	io.ReadFull(conn, password)
+
+	return string(user) == m.user && string(password) == m.password
+}
+
+// pipe copies both ways until either side closes
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// bufferedReadConn is a connection whose first bytes were already read into reader
+type bufferedReadConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Read reads the buffered bytes first
+func (c *bufferedReadConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
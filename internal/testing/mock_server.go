@@ -23,6 +23,8 @@ type MockShipItServer struct {
 	authCalls    int
 	tunnelCalls  int
 	tunnelCounter int
+	dataPlaneToken string
+	tokenCalls   int
 }
 
 // MockServerConfig holds configuration for the mock server
@@ -31,13 +33,16 @@ type MockServerConfig struct {
 	TLSPort        int
 	ValidAPIKeys   []string
 	DefaultTunnels []types.Tunnel
+	// DataPlaneToken is issued to clients asking for a data plane token, none are issued when empty
+	DataPlaneToken string
 }
 
 // NewMockShipItServer creates a new mock ShipIt server
 func NewMockShipItServer(config *MockServerConfig) *MockShipItServer {
 	mock := &MockShipItServer{
-		tunnels: make(map[string]*types.Tunnel),
-		apiKeys: make(map[string]string),
+		tunnels:        make(map[string]*types.Tunnel),
+		apiKeys:        make(map[string]string),
+		dataPlaneToken: config.DataPlaneToken,
 	}
 
 	// Initialize API keys
@@ -99,6 +104,13 @@ func (m *MockShipItServer) GetTunnelCalls() int {
 	return m.tunnelCalls
 }
 
+// GetTokenCalls returns the number of data plane token requests
+func (m *MockShipItServer) GetTokenCalls() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tokenCalls
+}
+
 // AddTunnel adds a tunnel to the mock server
 func (m *MockShipItServer) AddTunnel(tunnel *types.Tunnel) {
 	m.mu.Lock()
@@ -120,6 +132,8 @@ func (m *MockShipItServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/api/v1/auth/validate":
 		m.handleAuthValidate(w, r)
+	case "/api/v1/auth/data-plane-token":
+		m.handleDataPlaneToken(w, r)
 	case "/api/v1/tunnels":
 		m.handleTunnels(w, r)
 	default:
@@ -145,6 +159,29 @@ func (m *MockShipItServer) handleTLS(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleDataPlaneToken issues a data plane token to a client with a valid API key
+func (m *MockShipItServer) handleDataPlaneToken(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	m.tokenCalls++
+	token := m.dataPlaneToken
+	_, valid := m.apiKeys[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	m.mu.Unlock()
+
+	if token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if !valid {
+		http.Error(w, `{"error": "Invalid API key"}`, http.StatusUnauthorized)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": time.Now().Add(5 * time.Minute),
+	})
+}
+
 // handleAuthValidate handles authentication validation
 func (m *MockShipItServer) handleAuthValidate(w http.ResponseWriter, r *http.Request) {
 	m.mu.Lock()
@@ -241,7 +278,8 @@ func (m *MockShipItServer) handleCreateTunnel(w http.ResponseWriter, r *http.Req
 
 	m.mu.Lock()
 	m.tunnelCounter++
-	tunnelID := fmt.Sprintf("tunnel-%d-%d", time.Now().Unix(), m.tunnelCounter)
+	// Tunnel IDs are UUIDs, like the ones the real control plane issues
+	tunnelID := fmt.Sprintf("%08x-0000-4000-8000-%012x", time.Now().Unix(), m.tunnelCounter)
 	m.mu.Unlock()
 
 	tunnel := &types.Tunnel{
@@ -0,0 +1,1105 @@
+package testing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/unownone/shipitd/internal/protocol"
+	"github.com/unownone/shipitd/pkg/types"
+)
+
+// Tunnel IDs used by the tests, the wire format only carries UUIDs
+const (
+	tunnelA    = "3f2504e0-4f89-41d3-9a0c-0305e82c3301"
+	tunnelB    = "7c9e6679-7425-40de-944b-e07fc1f90ae7"
+	tunnelC    = "e4eaaaf2-d142-11e1-b3e4-080027620cdd"
+	httpTunnel = "a8098c1a-f86e-11da-bd1a-00112444be1e"
+	tcpTunnel  = "6fa459ea-ee8a-3ca4-894e-db77e160355e"
+)
+
+// protocolPeers returns a reader and writer for each end of an in-memory connection
+func protocolPeers(t *testing.T) (*protocol.Reader, *protocol.Writer, *protocol.Reader, *protocol.Writer) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	logger := logrus.New()
+	return protocol.NewReader(clientConn, logger), protocol.NewWriter(clientConn, logger),
+		protocol.NewReader(serverConn, logger), protocol.NewWriter(serverConn, logger)
+}
+
+// serverHandshakeResult carries the outcome of a server handshake run in a goroutine
+type serverHandshakeResult struct {
+	negotiation *protocol.Negotiation
+	err         error
+}
+
+func TestProtocolHandshake(t *testing.T) {
+	logger := logrus.New()
+
+	t.Run("NegotiatesVersionAndCapabilities", func(t *testing.T) {
+		clientReader, clientWriter, serverReader, serverWriter := protocolPeers(t)
+
+		result := make(chan serverHandshakeResult, 1)
+		go func() {
+			negotiation, err := protocol.ServerHandshake(serverReader, serverWriter, "server-1.0", "",
+				types.CapabilityStreaming, logger)
+			result <- serverHandshakeResult{negotiation, err}
+		}()
+
+		negotiation, err := protocol.ClientHandshake(clientReader, clientWriter, &types.HelloPayload{
+			ProtocolVersion:    types.ProtocolVersion,
+			MinProtocolVersion: types.MinProtocolVersion,
+			ClientVersion:      "client-1.0",
+			Capabilities:       types.CapabilityCompression | types.CapabilityStreaming,
+		}, logger)
+		require.NoError(t, err)
+		assert.Equal(t, types.ProtocolVersion, negotiation.Version)
+		assert.Equal(t, "server-1.0", negotiation.PeerVersion)
+		assert.True(t, negotiation.Supports(types.CapabilityStreaming))
+		assert.False(t, negotiation.Supports(types.CapabilityCompression))
+
+		server := <-result
+		require.NoError(t, server.err)
+		assert.Equal(t, "client-1.0", server.negotiation.PeerVersion)
+		assert.Equal(t, negotiation.Capabilities, server.negotiation.Capabilities)
+	})
+
+	t.Run("DowngradesToServerVersion", func(t *testing.T) {
+		clientReader, clientWriter, serverReader, serverWriter := protocolPeers(t)
+
+		go func() {
+			protocol.ServerHandshake(serverReader, serverWriter, "server-1.0", "", 0, logger)
+		}()
+
+		negotiation, err := protocol.ClientHandshake(clientReader, clientWriter, &types.HelloPayload{
+			ProtocolVersion:    types.ProtocolVersion + 1,
+			MinProtocolVersion: types.MinProtocolVersion,
+		}, logger)
+		require.NoError(t, err)
+		assert.Equal(t, types.ProtocolVersion, negotiation.Version)
+	})
+
+	t.Run("RefusesVersionMismatch", func(t *testing.T) {
+		clientReader, clientWriter, serverReader, serverWriter := protocolPeers(t)
+
+		result := make(chan serverHandshakeResult, 1)
+		go func() {
+			negotiation, err := protocol.ServerHandshake(serverReader, serverWriter, "server-1.0", "", 0, logger)
+			result <- serverHandshakeResult{negotiation, err}
+		}()
+
+		_, err := protocol.ClientHandshake(clientReader, clientWriter, &types.HelloPayload{
+			ProtocolVersion:    types.ProtocolVersion + 2,
+			MinProtocolVersion: types.ProtocolVersion + 1,
+		}, logger)
+		assert.ErrorIs(t, err, protocol.ErrVersionMismatch)
+		assert.ErrorIs(t, (<-result).err, protocol.ErrVersionMismatch)
+	})
+
+	t.Run("RefusesSecondHello", func(t *testing.T) {
+		_, clientWriter, _, _ := protocolPeers(t)
+		clientWriter.SetNegotiation(&protocol.Negotiation{Version: types.ProtocolVersion})
+
+		hello, err := types.NewHelloMessage(&types.HelloPayload{ProtocolVersion: types.ProtocolVersion})
+		require.NoError(t, err)
+		assert.ErrorIs(t, clientWriter.WriteMessage(hello), protocol.ErrNotNegotiated)
+	})
+}
+
+// sessionPeers connects a client and a server stream session over loopback TCP,
+// each side running the single read loop that feeds frames to its session
+func sessionPeers(t *testing.T) (*protocol.Session, *protocol.Session) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	serverConn, ok := <-accepted
+	require.True(t, ok)
+
+	logger := logrus.New()
+	negotiation := &protocol.Negotiation{Version: types.ProtocolVersion, Capabilities: types.CapabilityMultiplexing}
+
+	newPeer := func(conn net.Conn, client bool) *protocol.Session {
+		reader := protocol.NewReader(conn, logger)
+		writer := protocol.NewWriter(conn, logger)
+		reader.SetNegotiation(negotiation)
+		writer.SetNegotiation(negotiation)
+
+		session := protocol.NewSession(writer, client, logger)
+		go func() {
+			for {
+				message, err := reader.ReadMessage()
+				if err != nil {
+					session.Close()
+					return
+				}
+				session.HandleFrame(message)
+			}
+		}()
+		return session
+	}
+
+	clientSession := newPeer(clientConn, true)
+	serverSession := newPeer(serverConn, false)
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+		clientSession.Close()
+		serverSession.Close()
+	})
+
+	return clientSession, serverSession
+}
+
+func TestStreamMultiplexing(t *testing.T) {
+	t.Run("OpenWriteAndFin", func(t *testing.T) {
+		clientSession, serverSession := sessionPeers(t)
+
+		stream, err := serverSession.OpenStream(tunnelA, []byte("meta"))
+		require.NoError(t, err)
+
+		accepted, err := clientSession.AcceptStream()
+		require.NoError(t, err)
+		assert.Equal(t, stream.ID(), accepted.ID())
+		assert.Equal(t, tunnelA, accepted.TunnelID())
+		assert.Equal(t, []byte("meta"), accepted.Metadata())
+
+		_, err = stream.Write([]byte("hello"))
+		require.NoError(t, err)
+		require.NoError(t, stream.CloseWrite())
+
+		data, err := io.ReadAll(accepted)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+
+		// The other direction stays open after the half-close
+		_, err = accepted.Write([]byte("world"))
+		require.NoError(t, err)
+		require.NoError(t, accepted.Close())
+
+		data, err = io.ReadAll(stream)
+		require.NoError(t, err)
+		assert.Equal(t, "world", string(data))
+	})
+
+	t.Run("LargeTransferUsesWindowUpdates", func(t *testing.T) {
+		clientSession, serverSession := sessionPeers(t)
+
+		stream, err := clientSession.OpenStream(tunnelA, nil)
+		require.NoError(t, err)
+		accepted, err := serverSession.AcceptStream()
+		require.NoError(t, err)
+
+		payload := bytes.Repeat([]byte("0123456789abcdef"), 4*protocol.DefaultStreamWindow/16)
+		go func() {
+			stream.Write(payload)
+			stream.CloseWrite()
+		}()
+
+		data, err := io.ReadAll(accepted)
+		require.NoError(t, err)
+		assert.Equal(t, payload, data)
+	})
+
+	t.Run("SlowStreamDoesNotBlockOthers", func(t *testing.T) {
+		clientSession, serverSession := sessionPeers(t)
+
+		slow, err := serverSession.OpenStream(tunnelA, nil)
+		require.NoError(t, err)
+		fast, err := serverSession.OpenStream(tunnelB, nil)
+		require.NoError(t, err)
+
+		_, err = clientSession.AcceptStream()
+		require.NoError(t, err)
+		fastPeer, err := clientSession.AcceptStream()
+		require.NoError(t, err)
+
+		// Nobody reads the slow stream, so its writer stalls once the window is used up
+		slow.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = slow.Write(make([]byte, 2*protocol.DefaultStreamWindow))
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+		_, err = fast.Write([]byte("still flowing"))
+		require.NoError(t, err)
+
+		buffer := make([]byte, 64)
+		fastPeer.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := fastPeer.Read(buffer)
+		require.NoError(t, err)
+		assert.Equal(t, "still flowing", string(buffer[:n]))
+	})
+
+	t.Run("ResetAbortsBothSides", func(t *testing.T) {
+		clientSession, serverSession := sessionPeers(t)
+
+		stream, err := serverSession.OpenStream(tunnelA, nil)
+		require.NoError(t, err)
+		accepted, err := clientSession.AcceptStream()
+		require.NoError(t, err)
+
+		require.NoError(t, accepted.Reset("gone"))
+
+		stream.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = stream.Read(make([]byte, 1))
+		assert.ErrorIs(t, err, protocol.ErrStreamReset)
+	})
+
+	t.Run("RepliesDoNotWaitForTheConnection", func(t *testing.T) {
+		// Nobody reads the pipe yet, so every write waits until the test reads it
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			clientConn.Close()
+			serverConn.Close()
+		})
+		writer := protocol.NewWriter(clientConn, logrus.New())
+		defer writer.Close()
+		writer.SetNegotiation(&protocol.Negotiation{Version: types.ProtocolVersion, Capabilities: types.CapabilityMultiplexing})
+		session := protocol.NewSession(writer, true, logrus.New())
+		defer session.Close()
+
+		late, err := types.NewStreamMessage(types.MessageTypeStreamData, tunnelA, &types.StreamPayload{StreamID: 2, Data: []byte("late")})
+		require.NoError(t, err)
+		invalid, err := types.NewStreamMessage(types.MessageTypeStreamOpen, tunnelA, &types.StreamPayload{StreamID: 3, Window: protocol.DefaultStreamWindow})
+		require.NoError(t, err)
+
+		handled := make(chan struct{})
+		go func() {
+			defer close(handled)
+			assert.NoError(t, session.HandleFrame(late))
+			assert.NoError(t, session.HandleFrame(invalid))
+		}()
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("Expected HandleFrame to queue its resets instead of waiting for the connection")
+		}
+
+		reader := protocol.NewReader(serverConn, logrus.New())
+		reader.SetNegotiation(&protocol.Negotiation{Version: types.ProtocolVersion, Capabilities: types.CapabilityMultiplexing})
+		for _, id := range []uint32{2, 3} {
+			message, err := reader.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, types.MessageTypeStreamReset, message.Type)
+			var payload types.StreamPayload
+			require.NoError(t, payload.UnmarshalBinary(message.Payload))
+			assert.Equal(t, id, payload.StreamID)
+		}
+	})
+}
+
+func TestPayloadEncoding(t *testing.T) {
+	publicPort := 8443
+	payloads := map[types.MessageType]interface{}{
+		types.MessageTypeTunnelRegistration: &types.TunnelRegistrationPayload{
+			Protocol: "tcp", LocalPort: 5432, Subdomain: "db", PublicPort: &publicPort, MaxConnections: 10, ResumeToken: "resume-1",
+		},
+		types.MessageTypeTunnelRegistered: &types.TunnelRegisteredPayload{
+			PublicURL: "tcp://db.example.com:8443", Subdomain: "db", PublicPort: publicPort, ResumeToken: "resume-2", Resumed: true,
+		},
+		types.MessageTypeDataForward: &types.DataForwardPayload{
+			ConnectionID: "conn-1", RequestID: "req-1", Data: []byte{0, 1, 2, 0xff},
+			Headers: map[string]string{"Host": "app.example.com", "Accept": "*/*"}, Method: "POST", Path: "/upload",
+		},
+		types.MessageTypeDataResponse: &types.DataResponsePayload{
+			ConnectionID: "conn-1", RequestID: "req-1", Data: []byte("body"), StatusCode: 201,
+			Headers: map[string]string{"Content-Type": "text/plain"}, Streaming: true,
+		},
+		types.MessageTypeDataChunk:       &types.DataChunkPayload{RequestID: "req-1", Sequence: 7, Data: []byte("chunk"), End: true},
+		types.MessageTypeHeartbeat:       &types.HeartbeatPayload{Timestamp: 1704067200, ActiveConns: 3, TotalRequests: 42, BytesIn: 1 << 40, BytesOut: 512, Errors: 2, Nonce: 9, Echo: true},
+		types.MessageTypeError:           &types.ErrorPayload{Code: types.ErrorCodeLocalService, Message: "down", Details: "refused"},
+		types.MessageTypeAcknowledge:     &types.AcknowledgePayload{MessageID: "msg-1", Status: "ok"},
+		types.MessageTypeConnectionClose: &types.ConnectionClosePayload{ConnectionID: "conn-1", Reason: "done"},
+		types.MessageTypeGoAway:          &types.GoAwayPayload{Reason: "redeploy", DrainTimeout: 30000},
+	}
+
+	for msgType, payload := range payloads {
+		for _, encoding := range []types.PayloadEncoding{types.EncodingJSON, types.EncodingBinary} {
+			message, err := types.NewEncodedMessage(msgType, tunnelA, payload, encoding)
+			require.NoError(t, err)
+			assert.Equal(t, encoding, message.Encoding)
+
+			data, err := message.Serialize()
+			require.NoError(t, err)
+
+			var decoded types.Message
+			require.NoError(t, decoded.Deserialize(data))
+			assert.Equal(t, msgType, decoded.Type)
+			assert.Equal(t, encoding, decoded.Encoding)
+
+			parsed, err := decoded.ParsePayload()
+			require.NoError(t, err)
+			assert.Equal(t, payload, parsed, "message type %d, encoding %d", msgType, encoding)
+		}
+	}
+
+	t.Run("BinaryIsSmallerForBodies", func(t *testing.T) {
+		payload := &types.DataForwardPayload{RequestID: "req-1", Data: bytes.Repeat([]byte{0xAB}, 4096)}
+
+		jsonData, _, err := types.EncodePayload(payload, types.EncodingJSON)
+		require.NoError(t, err)
+		binaryData, _, err := types.EncodePayload(payload, types.EncodingBinary)
+		require.NoError(t, err)
+		assert.Less(t, len(binaryData), len(jsonData)*4/5)
+	})
+
+	t.Run("FallsBackToJSON", func(t *testing.T) {
+		message, err := types.NewEncodedMessage(types.MessageTypeHello, "", &types.HelloPayload{ProtocolVersion: 1}, types.EncodingBinary)
+		require.NoError(t, err)
+		assert.Equal(t, types.EncodingJSON, message.Encoding)
+	})
+
+	t.Run("RejectsTruncatedPayload", func(t *testing.T) {
+		message, err := types.NewEncodedMessage(types.MessageTypeDataForward, tunnelA, payloads[types.MessageTypeDataForward], types.EncodingBinary)
+		require.NoError(t, err)
+		message.Payload = message.Payload[:len(message.Payload)-3]
+
+		_, err = message.ParsePayload()
+		assert.Error(t, err)
+	})
+
+	t.Run("WriterUsesNegotiatedEncoding", func(t *testing.T) {
+		clientReader, clientWriter, serverReader, serverWriter := protocolPeers(t)
+		negotiation := &protocol.Negotiation{Version: types.ProtocolVersion, Capabilities: types.CapabilityBinaryPayload}
+		for _, peer := range []interface{ SetNegotiation(*protocol.Negotiation) }{clientReader, clientWriter, serverReader, serverWriter} {
+			peer.SetNegotiation(negotiation)
+		}
+
+		go clientWriter.WriteError(tunnelA, &types.ErrorPayload{Code: "CODE", Message: "message"})
+
+		message, err := serverReader.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, types.EncodingBinary, message.Encoding)
+
+		parsed, err := message.ParsePayload()
+		require.NoError(t, err)
+		assert.Equal(t, "CODE", parsed.(*types.ErrorPayload).Code)
+	})
+
+	t.Run("OptionalHeartbeatFieldsNeedCapabilities", func(t *testing.T) {
+		clientReader, clientWriter, serverReader, serverWriter := protocolPeers(t)
+		negotiation := &protocol.Negotiation{
+			Version:      types.ProtocolVersion,
+			Capabilities: types.CapabilityBinaryPayload | types.CapabilityHeartbeatEcho,
+		}
+		for _, peer := range []interface{ SetNegotiation(*protocol.Negotiation) }{clientReader, clientWriter, serverReader, serverWriter} {
+			peer.SetNegotiation(negotiation)
+		}
+
+		go clientWriter.WriteHeartbeat(tunnelA, &types.HeartbeatPayload{Timestamp: 1704067200, ActiveConns: 3, Nonce: 9, Echo: true, BytesIn: 128, Errors: 1})
+
+		message, err := serverReader.ReadMessage()
+		require.NoError(t, err)
+		// A peer without TrafficCounters never sees the counters, the nonce keeps its place
+		assert.Len(t, message.Payload, 3*8+9)
+
+		parsed, err := message.ParsePayload()
+		require.NoError(t, err)
+		assert.Equal(t, &types.HeartbeatPayload{Timestamp: 1704067200, ActiveConns: 3, Nonce: 9, Echo: true}, parsed)
+
+		// Without either capability the layout is the original one
+		base, _, err := types.EncodeNegotiatedPayload(&types.HeartbeatPayload{Nonce: 9, BytesIn: 128}, types.EncodingBinary, types.CapabilityBinaryPayload)
+		require.NoError(t, err)
+		assert.Len(t, base, 3*8)
+	})
+
+	t.Run("ResumeTokenNeedsSessionResume", func(t *testing.T) {
+		registration := &types.TunnelRegistrationPayload{Protocol: "http", LocalPort: 3000, MaxConnections: 10, ResumeToken: "resume-1"}
+		withToken, _, err := types.EncodeNegotiatedPayload(registration, types.EncodingBinary, types.CapabilityBinaryPayload|types.CapabilitySessionResume)
+		require.NoError(t, err)
+
+		message, err := types.NewNegotiatedMessage(types.MessageTypeTunnelRegistration, tunnelA, registration, types.EncodingBinary, types.CapabilityBinaryPayload)
+		require.NoError(t, err)
+		assert.Len(t, message.Payload, len(withToken)-4-len("resume-1"))
+
+		parsed, err := message.ParsePayload()
+		require.NoError(t, err)
+		assert.Empty(t, parsed.(*types.TunnelRegistrationPayload).ResumeToken)
+		assert.Equal(t, 3000, parsed.(*types.TunnelRegistrationPayload).LocalPort)
+	})
+}
+
+func TestCompression(t *testing.T) {
+	logger := logrus.New()
+	body := bytes.Repeat([]byte("<li class=\"item\">compressible html</li>\n"), 256)
+
+	for _, name := range []string{"zstd", "gzip"} {
+		t.Run("RoundTrip/"+name, func(t *testing.T) {
+			_, clientWriter, serverReader, _ := protocolPeers(t)
+			negotiation := &protocol.Negotiation{
+				Version:      types.ProtocolVersion,
+				Capabilities: types.CapabilityCompression,
+				Compression:  name,
+			}
+			clientWriter.SetNegotiation(negotiation)
+			serverReader.SetNegotiation(negotiation)
+
+			payload := &types.DataResponsePayload{RequestID: "req-1", StatusCode: 200, Data: body}
+			go clientWriter.WriteDataResponse(tunnelA, payload)
+
+			message, err := serverReader.ReadMessage()
+			require.NoError(t, err)
+			assert.False(t, message.Compressed)
+
+			parsed, err := message.ParsePayload()
+			require.NoError(t, err)
+			assert.Equal(t, body, parsed.(*types.DataResponsePayload).Data)
+
+			sent := clientWriter.GetCompressionStats().Snapshot()
+			received := serverReader.GetCompressionStats().Snapshot()
+			assert.Equal(t, uint64(1), sent.SentFrames)
+			assert.Less(t, sent.SentAfter, sent.SentBefore/4)
+			assert.Equal(t, sent.SentBefore, received.ReceivedBefore)
+			assert.Equal(t, sent.SentAfter, received.ReceivedAfter)
+		})
+	}
+
+	t.Run("SkipsFramesUnderThreshold", func(t *testing.T) {
+		_, clientWriter, serverReader, _ := protocolPeers(t)
+		negotiation := &protocol.Negotiation{
+			Version:      types.ProtocolVersion,
+			Capabilities: types.CapabilityCompression,
+			Compression:  "gzip",
+		}
+		clientWriter.SetNegotiation(negotiation)
+		serverReader.SetNegotiation(negotiation)
+
+		go clientWriter.WriteHeartbeat(tunnelA, &types.HeartbeatPayload{Timestamp: 1})
+
+		message, err := serverReader.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, types.MessageTypeHeartbeat, message.Type)
+
+		stats := clientWriter.GetCompressionStats().Snapshot()
+		assert.Zero(t, stats.SentFrames)
+		assert.Equal(t, stats.SentBefore, stats.SentAfter)
+	})
+
+	t.Run("RefusesCompressedFrameWhenNotNegotiated", func(t *testing.T) {
+		_, clientWriter, serverReader, _ := protocolPeers(t)
+		clientWriter.SetNegotiation(&protocol.Negotiation{
+			Version:      types.ProtocolVersion,
+			Capabilities: types.CapabilityCompression,
+			Compression:  "gzip",
+		})
+		serverReader.SetNegotiation(&protocol.Negotiation{Version: types.ProtocolVersion})
+
+		go clientWriter.WriteDataResponse(tunnelA, &types.DataResponsePayload{RequestID: "req-1", Data: body})
+
+		_, err := serverReader.ReadMessage()
+		assert.ErrorIs(t, err, protocol.ErrNotNegotiated)
+	})
+
+	t.Run("HandshakeSelectsClientPreference", func(t *testing.T) {
+		clientReader, clientWriter, serverReader, serverWriter := protocolPeers(t)
+
+		result := make(chan serverHandshakeResult, 1)
+		go func() {
+			negotiation, err := protocol.ServerHandshake(serverReader, serverWriter, "server-1.0", "",
+				protocol.SupportedCapabilities, logger)
+			result <- serverHandshakeResult{negotiation, err}
+		}()
+
+		negotiation, err := protocol.ClientHandshake(clientReader, clientWriter, &types.HelloPayload{
+			ProtocolVersion:    types.ProtocolVersion,
+			MinProtocolVersion: types.MinProtocolVersion,
+			Capabilities:       types.CapabilityCompression,
+			Compression:        []string{"brotli", "gzip", "zstd"},
+		}, logger)
+		require.NoError(t, err)
+		assert.True(t, negotiation.Supports(types.CapabilityCompression))
+		assert.Equal(t, "gzip", negotiation.Compression)
+
+		server := <-result
+		require.NoError(t, server.err)
+		assert.Equal(t, "gzip", server.negotiation.Compression)
+	})
+
+	t.Run("HandshakeWithoutCommonAlgorithm", func(t *testing.T) {
+		clientReader, clientWriter, serverReader, serverWriter := protocolPeers(t)
+
+		go func() {
+			protocol.ServerHandshake(serverReader, serverWriter, "server-1.0", "", protocol.SupportedCapabilities, logger)
+		}()
+
+		negotiation, err := protocol.ClientHandshake(clientReader, clientWriter, &types.HelloPayload{
+			ProtocolVersion:    types.ProtocolVersion,
+			MinProtocolVersion: types.MinProtocolVersion,
+			Capabilities:       types.CapabilityCompression,
+			Compression:        []string{"brotli"},
+		}, logger)
+		require.NoError(t, err)
+		assert.False(t, negotiation.Supports(types.CapabilityCompression))
+		assert.Empty(t, negotiation.Compression)
+	})
+}
+
+func TestFrameLimits(t *testing.T) {
+	writeFrame := func(conn net.Conn, typeByte byte, payload []byte) {
+		frame := make([]byte, 21+len(payload))
+		frame[0] = typeByte
+		binary.BigEndian.PutUint32(frame[17:21], uint32(len(payload)))
+		copy(frame[21:], payload)
+		conn.Write(frame)
+	}
+
+	t.Run("RefusesOversizedFrame", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		reader := protocol.NewReader(serverConn, logrus.New())
+		reader.SetMaxFrameSize(1024)
+
+		go writeFrame(clientConn, byte(types.MessageTypeDataForward), make([]byte, 1025))
+
+		_, err := reader.ReadMessage()
+		assert.ErrorIs(t, err, protocol.ErrFrameTooLarge)
+	})
+
+	t.Run("AcceptsFrameAtLimit", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		reader := protocol.NewReader(serverConn, logrus.New())
+		reader.SetMaxFrameSize(1024)
+
+		go writeFrame(clientConn, byte(types.MessageTypeDataForward), make([]byte, 1024))
+
+		message, err := reader.ReadMessage()
+		require.NoError(t, err)
+		assert.Len(t, message.Payload, 1024)
+	})
+
+	t.Run("RefusesDecompressionAboveLimit", func(t *testing.T) {
+		_, clientWriter, serverReader, _ := protocolPeers(t)
+		negotiation := &protocol.Negotiation{
+			Version:      types.ProtocolVersion,
+			Capabilities: types.CapabilityCompression,
+			Compression:  "zstd",
+		}
+		clientWriter.SetNegotiation(negotiation)
+		serverReader.SetNegotiation(negotiation)
+		serverReader.SetMaxFrameSize(64 * 1024)
+
+		// Compresses to a few hundred bytes, expands far past the limit
+		go clientWriter.WriteDataResponse(tunnelA, &types.DataResponsePayload{Data: make([]byte, 1024*1024)})
+
+		_, err := serverReader.ReadMessage()
+		assert.Error(t, err)
+	})
+
+	t.Run("ReleasedStreamPayloadsAreReused", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		reader := protocol.NewReader(serverConn, logrus.New())
+		payload := &types.StreamPayload{StreamID: 1, Data: bytes.Repeat([]byte("x"), 1024)}
+		data, err := payload.MarshalBinary()
+		require.NoError(t, err)
+
+		frame := make([]byte, 21+len(data))
+		frame[0] = byte(types.MessageTypeStreamData)
+		binary.BigEndian.PutUint32(frame[17:21], uint32(len(data)))
+		copy(frame[21:], data)
+		go func() {
+			for i := 0; i < 100; i++ {
+				clientConn.Write(frame)
+			}
+		}()
+
+		allocs := testing.AllocsPerRun(99, func() {
+			message, err := reader.ReadMessage()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			protocol.ReleasePayload(message)
+		})
+		// Only the message itself is allocated, the payload buffer comes from the pool
+		assert.LessOrEqual(t, allocs, 2.0)
+	})
+}
+
+func TestTunnelIDFraming(t *testing.T) {
+	// Golden frame: DataForward for tunnelA with a 2-byte payload
+	golden := []byte{
+		0x02,
+		0x3f, 0x25, 0x04, 0xe0, 0x4f, 0x89, 0x41, 0xd3, 0x9a, 0x0c, 0x03, 0x05, 0xe8, 0x2c, 0x33, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		'h', 'i',
+	}
+
+	t.Run("SerializeMatchesGolden", func(t *testing.T) {
+		data, err := types.NewMessage(types.MessageTypeDataForward, tunnelA, []byte("hi")).Serialize()
+		require.NoError(t, err)
+		assert.Equal(t, golden, data)
+	})
+
+	t.Run("DeserializeMatchesGolden", func(t *testing.T) {
+		var message types.Message
+		require.NoError(t, message.Deserialize(golden))
+		assert.Equal(t, tunnelA, message.TunnelID)
+		assert.Equal(t, types.MessageTypeDataForward, message.Type)
+		assert.Equal(t, []byte("hi"), message.Payload)
+	})
+
+	t.Run("WriterMatchesGolden", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		writer := protocol.NewWriter(clientConn, logrus.New())
+		go writer.WriteMessage(types.NewMessage(types.MessageTypeDataForward, tunnelA, []byte("hi")))
+
+		data := make([]byte, len(golden))
+		_, err := io.ReadFull(serverConn, data)
+		require.NoError(t, err)
+		assert.Equal(t, golden, data)
+	})
+
+	t.Run("ReaderMatchesGolden", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		reader := protocol.NewReader(serverConn, logrus.New())
+		go clientConn.Write(golden)
+
+		message, err := reader.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, tunnelA, message.TunnelID)
+		assert.Equal(t, []byte("hi"), message.Payload)
+	})
+
+	t.Run("ConnectionLevelFramesUseZeroBytes", func(t *testing.T) {
+		data, err := types.NewMessage(types.MessageTypeHeartbeat, "", nil).Serialize()
+		require.NoError(t, err)
+		assert.Equal(t, make([]byte, types.TunnelIDSize), data[1:17])
+
+		var message types.Message
+		require.NoError(t, message.Deserialize(data))
+		assert.Empty(t, message.TunnelID)
+	})
+
+	t.Run("RoundTripsEveryByte", func(t *testing.T) {
+		// Bytes that a string based encoding would mangle: NULs and the high bit
+		raw := [types.TunnelIDSize]byte{0x00, 0xff, 0x80, 0x00, 0x01, 0x00, 0x7f, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+		id := types.FormatTunnelID(raw)
+		assert.Equal(t, "00ff8000-0100-7f00-0000-000000000000", id)
+
+		parsed, err := types.ParseTunnelID(id)
+		require.NoError(t, err)
+		assert.Equal(t, raw, parsed)
+	})
+
+	t.Run("NormalizesUppercaseIDs", func(t *testing.T) {
+		upper, err := types.ParseTunnelID("3F2504E0-4F89-41D3-9A0C-0305E82C3301")
+		require.NoError(t, err)
+		lower, err := types.ParseTunnelID("3f2504e0-4f89-41d3-9a0c-0305e82c3301")
+		require.NoError(t, err)
+		assert.Equal(t, lower, upper)
+		assert.Equal(t, "3f2504e0-4f89-41d3-9a0c-0305e82c3301", types.FormatTunnelID(upper))
+		assert.Equal(t, "3f2504e0-4f89-41d3-9a0c-0305e82c3301", types.NormalizeTunnelID("3F2504E0-4F89-41D3-9A0C-0305E82C3301"))
+	})
+
+	t.Run("RejectsInvalidIDs", func(t *testing.T) {
+		for _, id := range []string{
+			"tunnel-a",
+			"3f2504e0-4f89-41d3-9a0c-0305e82c330",
+			"3f2504e0-4f89-41d3-9a0c-0305e82c33011",
+			"3f2504e04f89-41d3-9a0c-0305e82c33011",
+			"3f2504e0-4f89-41d3-9a0c-0305e82c330g",
+			"00000000-0000-0000-0000-000000000000",
+		} {
+			assert.ErrorIs(t, types.ValidateTunnelID(id), types.ErrInvalidTunnelID, id)
+
+			_, err := types.NewMessage(types.MessageTypeDataForward, id, nil).Serialize()
+			assert.ErrorIs(t, err, types.ErrInvalidTunnelID, id)
+		}
+		assert.ErrorIs(t, types.ValidateTunnelID(""), types.ErrInvalidTunnelID)
+	})
+}
+
+// TestReliableDelivery tests message IDs on the wire, the outbox and deduplication
+func TestReliableDelivery(t *testing.T) {
+	// Golden frame: ConnectionClose for tunnelA with message ID 7 and a 2-byte payload
+	golden := []byte{
+		0x24,
+		0x3f, 0x25, 0x04, 0xe0, 0x4f, 0x89, 0x41, 0xd3, 0x9a, 0x0c, 0x03, 0x05, 0xe8, 0x2c, 0x33, 0x01,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07,
+		'h', 'i',
+	}
+
+	t.Run("SerializeMatchesGolden", func(t *testing.T) {
+		message := types.NewMessage(types.MessageTypeConnectionClose, tunnelA, []byte("hi"))
+		message.ID = 7
+		data, err := message.Serialize()
+		require.NoError(t, err)
+		assert.Equal(t, golden, data)
+
+		var decoded types.Message
+		require.NoError(t, decoded.Deserialize(golden))
+		assert.Equal(t, uint64(7), decoded.ID)
+		assert.Equal(t, types.MessageTypeConnectionClose, decoded.Type)
+		assert.Equal(t, []byte("hi"), decoded.Payload)
+	})
+
+	t.Run("ReaderReadsID", func(t *testing.T) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+
+		reader := protocol.NewReader(serverConn, logrus.New())
+		go clientConn.Write(golden)
+
+		message, err := reader.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, uint64(7), message.ID)
+		assert.Equal(t, []byte("hi"), message.Payload)
+	})
+
+	t.Run("RefusedWithoutNegotiation", func(t *testing.T) {
+		clientReader, clientWriter, serverReader, serverWriter := protocolPeers(t)
+		hello := &types.HelloPayload{
+			ProtocolVersion:    types.ProtocolVersion,
+			MinProtocolVersion: types.MinProtocolVersion,
+			Capabilities:       types.CapabilityMultiplexing,
+		}
+
+		serverDone := make(chan error, 1)
+		go func() {
+			_, err := protocol.ServerHandshake(serverReader, serverWriter, "test", "", protocol.SupportedCapabilities, logrus.New())
+			serverDone <- err
+		}()
+		negotiation, err := protocol.ClientHandshake(clientReader, clientWriter, hello, logrus.New())
+		require.NoError(t, err)
+		require.NoError(t, <-serverDone)
+		assert.False(t, negotiation.Supports(types.CapabilityReliableDelivery))
+
+		message := types.NewMessage(types.MessageTypeConnectionClose, tunnelA, []byte("hi"))
+		message.ID = 1
+		assert.ErrorIs(t, clientWriter.WriteMessage(message), protocol.ErrNotNegotiated)
+
+		go serverWriter.GetConnection().Write(golden)
+		_, err = clientReader.ReadMessage()
+		assert.ErrorIs(t, err, protocol.ErrNotNegotiated)
+	})
+
+	t.Run("OutboxRetransmitsAndExpires", func(t *testing.T) {
+		outbox := protocol.NewOutbox(time.Second, 2)
+		first := types.NewMessage(types.MessageTypeTunnelRegistration, tunnelA, nil)
+		second := types.NewMessage(types.MessageTypeConnectionClose, tunnelA, nil)
+		assert.Equal(t, uint64(1), outbox.Track(first))
+		assert.Equal(t, uint64(2), outbox.Track(second))
+
+		retransmit, expired := outbox.Due(time.Now())
+		assert.Empty(t, retransmit)
+		assert.Empty(t, expired)
+
+		assert.True(t, outbox.Ack(2))
+		assert.False(t, outbox.Ack(2))
+
+		now := time.Now()
+		for attempt := 1; attempt <= 2; attempt++ {
+			now = now.Add(time.Second)
+			retransmit, expired = outbox.Due(now)
+			assert.Equal(t, []*types.Message{first}, retransmit)
+			assert.Empty(t, expired)
+		}
+		retransmit, expired = outbox.Due(now.Add(time.Second))
+		assert.Empty(t, retransmit)
+		assert.Equal(t, []*types.Message{first}, expired)
+
+		stats := outbox.Stats()
+		assert.Equal(t, 0, stats.Outstanding)
+		assert.Equal(t, uint64(2), stats.Sent)
+		assert.Equal(t, uint64(1), stats.Acknowledged)
+		assert.Equal(t, uint64(2), stats.Retransmitted)
+		assert.Equal(t, uint64(1), stats.Expired)
+	})
+
+	t.Run("OutboxSupersedesRegistrations", func(t *testing.T) {
+		outbox := protocol.NewOutbox(time.Second, 2)
+		outbox.Track(types.NewMessage(types.MessageTypeTunnelRegistration, tunnelA, nil))
+		outbox.Track(types.NewMessage(types.MessageTypeTunnelRegistration, tunnelB, nil))
+		outbox.Supersede(types.MessageTypeTunnelRegistration, tunnelA)
+		newest := types.NewMessage(types.MessageTypeTunnelRegistration, tunnelA, nil)
+		outbox.Track(newest)
+
+		pending := outbox.Pending()
+		require.Len(t, pending, 2)
+		assert.Equal(t, tunnelB, pending[0].TunnelID)
+		assert.Same(t, newest, pending[1])
+	})
+
+	t.Run("DeduplicatorWindow", func(t *testing.T) {
+		dedup := protocol.NewDeduplicator(2)
+		assert.False(t, dedup.Seen(1))
+		assert.True(t, dedup.Seen(1))
+		assert.False(t, dedup.Seen(2))
+		assert.False(t, dedup.Seen(3))
+		// 1 fell out of the window
+		assert.False(t, dedup.Seen(1))
+		assert.Equal(t, uint64(1), dedup.Duplicates())
+	})
+}
+
+// countingConn counts the Write calls reaching a connection
+type countingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// TestWriterQueue tests the single writer goroutine behind the Writer
+func TestWriterQueue(t *testing.T) {
+	pipe := func(t *testing.T) (*countingConn, *protocol.Reader) {
+		clientConn, serverConn := net.Pipe()
+		t.Cleanup(func() {
+			clientConn.Close()
+			serverConn.Close()
+		})
+		return &countingConn{Conn: clientConn}, protocol.NewReader(serverConn, logrus.New())
+	}
+
+	t.Run("ConcurrentWritesDoNotInterleave", func(t *testing.T) {
+		conn, reader := pipe(t)
+		writer := protocol.NewWriter(conn, logrus.New())
+		defer writer.Close()
+
+		const goroutines, frames = 20, 25
+		go func() {
+			for i := 0; i < goroutines; i++ {
+				go func(i int) {
+					payload := bytes.Repeat([]byte{byte(i)}, 100+i*500)
+					for j := 0; j < frames; j++ {
+						assert.NoError(t, writer.WriteMessage(types.NewMessage(types.MessageTypeDataForward, tunnelA, payload)))
+					}
+				}(i)
+			}
+		}()
+
+		counts := make(map[byte]int)
+		for n := 0; n < goroutines*frames; n++ {
+			message, err := reader.ReadMessage()
+			require.NoError(t, err)
+			id := message.Payload[0]
+			require.Equal(t, bytes.Repeat([]byte{id}, 100+int(id)*500), message.Payload)
+			counts[id]++
+		}
+		for i := 0; i < goroutines; i++ {
+			assert.Equal(t, frames, counts[byte(i)])
+		}
+	})
+
+	t.Run("ControlFramesJumpAhead", func(t *testing.T) {
+		conn, reader := pipe(t)
+		writer := protocol.NewWriter(conn, logrus.New())
+		defer writer.Close()
+
+		// Nobody reads yet, so the writer goroutine blocks on this frame
+		large := types.NewMessage(types.MessageTypeDataForward, tunnelA, make([]byte, 64*1024))
+		go writer.WriteMessage(large)
+		require.Eventually(t, func() bool { return conn.writes.Load() > 0 }, time.Second, time.Millisecond)
+
+		for i := 0; i < 3; i++ {
+			require.NoError(t, writer.QueueMessage(types.NewMessage(types.MessageTypeDataChunk, tunnelA, []byte{byte(i)})))
+		}
+		require.NoError(t, writer.QueueMessage(types.NewMessage(types.MessageTypeHeartbeat, "", []byte(`{}`))))
+		go writer.Flush()
+
+		var order []types.MessageType
+		for i := 0; i < 5; i++ {
+			message, err := reader.ReadMessage()
+			require.NoError(t, err)
+			order = append(order, message.Type)
+			if message.Type == types.MessageTypeDataChunk {
+				assert.Equal(t, []byte{byte(len(order) - 3)}, message.Payload)
+			}
+		}
+		assert.Equal(t, []types.MessageType{
+			types.MessageTypeDataForward,
+			types.MessageTypeHeartbeat,
+			types.MessageTypeDataChunk,
+			types.MessageTypeDataChunk,
+			types.MessageTypeDataChunk,
+		}, order)
+	})
+
+	t.Run("SmallFramesCoalesced", func(t *testing.T) {
+		conn, reader := pipe(t)
+		writer := protocol.NewWriter(conn, logrus.New())
+		defer writer.Close()
+
+		// Nobody reads yet, so the small frames queue up behind this one
+		large := types.NewMessage(types.MessageTypeDataForward, tunnelA, make([]byte, 64*1024))
+		go writer.WriteMessage(large)
+		require.Eventually(t, func() bool { return conn.writes.Load() > 0 }, time.Second, time.Millisecond)
+
+		for i := 0; i < 10; i++ {
+			require.NoError(t, writer.QueueMessage(types.NewMessage(types.MessageTypeDataChunk, tunnelA, []byte("chunk"))))
+		}
+
+		// Queued frames are flushed once the queue runs empty, without a Flush call
+		for i := 0; i < 11; i++ {
+			_, err := reader.ReadMessage()
+			require.NoError(t, err)
+		}
+		assert.Equal(t, int32(2), conn.writes.Load())
+	})
+
+	t.Run("CloseWritesQueuedFrames", func(t *testing.T) {
+		conn, reader := pipe(t)
+		writer := protocol.NewWriter(conn, logrus.New())
+
+		large := types.NewMessage(types.MessageTypeDataForward, tunnelA, make([]byte, 64*1024))
+		go writer.WriteMessage(large)
+		require.Eventually(t, func() bool { return conn.writes.Load() > 0 }, time.Second, time.Millisecond)
+		for i := 0; i < 3; i++ {
+			require.NoError(t, writer.QueueMessage(types.NewMessage(types.MessageTypeAcknowledge, tunnelA, []byte(`{}`))))
+		}
+
+		closed := make(chan error, 1)
+		go func() {
+			closed <- writer.Close()
+		}()
+		for i := 0; i < 4; i++ {
+			_, err := reader.ReadMessage()
+			require.NoError(t, err)
+		}
+		require.NoError(t, <-closed)
+	})
+
+	t.Run("FullQueueBlocks", func(t *testing.T) {
+		conn, reader := pipe(t)
+		writer := protocol.NewWriter(conn, logrus.New())
+		defer writer.Close()
+
+		const total = 4 * protocol.DefaultWriteQueueSize
+		var queued atomic.Int32
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < total; i++ {
+				assert.NoError(t, writer.QueueMessage(types.NewMessage(types.MessageTypeDataChunk, tunnelA, make([]byte, 1024))))
+				queued.Add(1)
+			}
+			assert.NoError(t, writer.Flush())
+		}()
+
+		// With nobody reading, the buffer and the queue fill up and writers wait
+		time.Sleep(100 * time.Millisecond)
+		assert.Less(t, queued.Load(), int32(total))
+
+		message := types.NewMessage(types.MessageTypeDataChunk, tunnelA, nil)
+		assert.ErrorIs(t, writer.WriteMessageWithTimeout(message, 20*time.Millisecond), protocol.ErrWriteTimeout)
+
+		for i := 0; i < total; i++ {
+			_, err := reader.ReadMessage()
+			require.NoError(t, err)
+		}
+		<-done
+		assert.Equal(t, int32(total), queued.Load())
+	})
+
+	t.Run("ClosedWriterRefusesWrites", func(t *testing.T) {
+		conn, _ := pipe(t)
+		writer := protocol.NewWriter(conn, logrus.New())
+		require.NoError(t, writer.Close())
+
+		err := writer.WriteMessage(types.NewMessage(types.MessageTypeHeartbeat, "", []byte(`{}`)))
+		assert.ErrorIs(t, err, protocol.ErrWriterClosed)
+		assert.ErrorIs(t, writer.Flush(), protocol.ErrWriterClosed)
+	})
+}
+
+// TestHeartbeatMonitor tests RTT measurement and dead peer detection
+func TestHeartbeatMonitor(t *testing.T) {
+	t.Run("MeasuresRoundTrips", func(t *testing.T) {
+		monitor := protocol.NewHeartbeatMonitor(3)
+		start := time.Now()
+
+		for i, rtt := range []time.Duration{40 * time.Millisecond, 60 * time.Millisecond, 40 * time.Millisecond} {
+			sentAt := start.Add(time.Duration(i) * time.Second)
+			nonce, dead := monitor.Probe(sentAt)
+			require.False(t, dead)
+			measured, ok := monitor.Echo(nonce, sentAt.Add(rtt))
+			require.True(t, ok)
+			assert.Equal(t, rtt, measured)
+		}
+
+		stats := monitor.Stats()
+		assert.Equal(t, uint64(3), stats.Sent)
+		assert.Equal(t, uint64(3), stats.Echoed)
+		assert.Equal(t, 40*time.Millisecond, stats.RTT)
+		assert.InDelta(t, float64(42*time.Millisecond), float64(stats.SmoothedRTT), float64(time.Millisecond))
+		// Two deviations of 20ms smoothed with a gain of 1/16
+		assert.InDelta(t, float64(2421875*time.Nanosecond), float64(stats.Jitter), float64(time.Microsecond))
+	})
+
+	t.Run("LateAndUnknownEchoesIgnored", func(t *testing.T) {
+		monitor := protocol.NewHeartbeatMonitor(3)
+		now := time.Now()
+		first, _ := monitor.Probe(now)
+		second, _ := monitor.Probe(now.Add(time.Second))
+		assert.Equal(t, 1, monitor.Stats().Missed)
+
+		// The newer echo answers for the older heartbeat too
+		_, ok := monitor.Echo(second, now.Add(1100*time.Millisecond))
+		assert.True(t, ok)
+		_, ok = monitor.Echo(first, now.Add(1200*time.Millisecond))
+		assert.False(t, ok)
+		_, ok = monitor.Echo(99, now)
+		assert.False(t, ok)
+		assert.Equal(t, 0, monitor.Stats().Missed)
+	})
+
+	t.Run("DeadAfterMaxMissed", func(t *testing.T) {
+		monitor := protocol.NewHeartbeatMonitor(2)
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			_, dead := monitor.Probe(now)
+			require.False(t, dead)
+		}
+		_, dead := monitor.Probe(now)
+		assert.True(t, dead)
+		assert.Equal(t, uint64(1), monitor.Stats().DeadPeers)
+
+		// Detection starts over, for example on the next connection
+		monitor.Reset()
+		_, dead = monitor.Probe(now)
+		assert.False(t, dead)
+		assert.Equal(t, 0, monitor.Stats().Missed)
+	})
+}
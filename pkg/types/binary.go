@@ -0,0 +1,414 @@
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// The binary payload encoding writes fields in declaration order. Integers are
+// big endian, strings and byte slices are prefixed with a 4-byte length, header
+// maps with a 4-byte count followed by sorted key/value pairs.
+
+// LayoutMarshaler is implemented by binary payloads with fields that are only
+// on the wire when the capability they belong to was negotiated, so a peer
+// that does not know them never sees them
+type LayoutMarshaler interface {
+	MarshalBinaryLayout(capabilities Capability) ([]byte, error)
+	UnmarshalBinaryLayout(data []byte, capabilities Capability) error
+}
+
+// binaryEncoder appends fields to a buffer
+type binaryEncoder struct {
+	buf []byte
+}
+
+// binaryDecoder reads fields from a buffer, remembering the first error
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (e *binaryEncoder) uint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *binaryEncoder) int64(v int64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *binaryEncoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *binaryEncoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *binaryEncoder) string(v string) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *binaryEncoder) headers(v map[string]string) {
+	keys := make([]string, 0, len(v))
+	for key := range v {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	e.uint32(uint32(len(keys)))
+	for _, key := range keys {
+		e.string(key)
+		e.string(v[key])
+	}
+}
+
+// headersSize returns the encoded size of a header map, used to size buffers up front
+func headersSize(headers map[string]string) int {
+	size := 4
+	for key, value := range headers {
+		size += 8 + len(key) + len(value)
+	}
+	return size
+}
+
+// take returns the next n bytes, aliasing the input
+func (d *binaryDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = fmt.Errorf("binary payload truncated: need %d bytes, have %d", n, len(d.data))
+		return nil
+	}
+	value := d.data[:n]
+	d.data = d.data[n:]
+	return value
+}
+
+func (d *binaryDecoder) uint32() uint32 {
+	value := d.take(4)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(value)
+}
+
+func (d *binaryDecoder) int64() int64 {
+	value := d.take(8)
+	if value == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(value))
+}
+
+func (d *binaryDecoder) bool() bool {
+	value := d.take(1)
+	return value != nil && value[0] != 0
+}
+
+func (d *binaryDecoder) bytes() []byte {
+	value := d.take(int(d.uint32()))
+	if len(value) == 0 {
+		return nil
+	}
+	return value
+}
+
+func (d *binaryDecoder) string() string {
+	return string(d.take(int(d.uint32())))
+}
+
+func (d *binaryDecoder) headers() map[string]string {
+	count := int(d.uint32())
+	if d.err != nil || count == 0 {
+		return nil
+	}
+	// Every pair needs at least 8 bytes, which caps what a bogus count can allocate
+	if count > len(d.data)/8 {
+		d.err = fmt.Errorf("binary payload truncated: %d headers do not fit in %d bytes", count, len(d.data))
+		return nil
+	}
+
+	headers := make(map[string]string, count)
+	for i := 0; i < count && d.err == nil; i++ {
+		key := d.string()
+		headers[key] = d.string()
+	}
+	return headers
+}
+
+// finish returns the decoding error, or an error when bytes are left over
+func (d *binaryDecoder) finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("binary payload has %d trailing bytes", len(d.data))
+	}
+	return nil
+}
+
+// MarshalBinary encodes the tunnel registration payload with every field
+func (p *TunnelRegistrationPayload) MarshalBinary() ([]byte, error) {
+	return p.MarshalBinaryLayout(AllCapabilities)
+}
+
+// UnmarshalBinary decodes the tunnel registration payload with every field
+func (p *TunnelRegistrationPayload) UnmarshalBinary(data []byte) error {
+	return p.UnmarshalBinaryLayout(data, AllCapabilities)
+}
+
+// MarshalBinaryLayout encodes the tunnel registration payload, the resume
+// token only with SessionResume
+func (p *TunnelRegistrationPayload) MarshalBinaryLayout(capabilities Capability) ([]byte, error) {
+	var e binaryEncoder
+	e.string(p.Protocol)
+	e.int64(int64(p.LocalPort))
+	e.string(p.Subdomain)
+	e.bool(p.PublicPort != nil)
+	if p.PublicPort != nil {
+		e.int64(int64(*p.PublicPort))
+	}
+	e.int64(int64(p.MaxConnections))
+	if capabilities.Has(CapabilitySessionResume) {
+		e.string(p.ResumeToken)
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinaryLayout decodes the tunnel registration payload, the resume
+// token only with SessionResume
+func (p *TunnelRegistrationPayload) UnmarshalBinaryLayout(data []byte, capabilities Capability) error {
+	d := binaryDecoder{data: data}
+	p.Protocol = d.string()
+	p.LocalPort = int(d.int64())
+	p.Subdomain = d.string()
+	p.PublicPort = nil
+	if d.bool() {
+		port := int(d.int64())
+		p.PublicPort = &port
+	}
+	p.MaxConnections = int(d.int64())
+	p.ResumeToken = ""
+	if capabilities.Has(CapabilitySessionResume) {
+		p.ResumeToken = d.string()
+	}
+	return d.finish()
+}
+
+// MarshalBinary encodes the tunnel registered payload
+func (p *TunnelRegisteredPayload) MarshalBinary() ([]byte, error) {
+	var e binaryEncoder
+	e.string(p.PublicURL)
+	e.string(p.Subdomain)
+	e.int64(int64(p.PublicPort))
+	e.string(p.ResumeToken)
+	e.bool(p.Resumed)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes the tunnel registered payload
+func (p *TunnelRegisteredPayload) UnmarshalBinary(data []byte) error {
+	d := binaryDecoder{data: data}
+	p.PublicURL = d.string()
+	p.Subdomain = d.string()
+	p.PublicPort = int(d.int64())
+	p.ResumeToken = d.string()
+	p.Resumed = d.bool()
+	return d.finish()
+}
+
+// MarshalBinary encodes the data forward payload
+func (p *DataForwardPayload) MarshalBinary() ([]byte, error) {
+	e := binaryEncoder{buf: make([]byte, 0, 64+len(p.ConnectionID)+len(p.RequestID)+len(p.Data)+headersSize(p.Headers)+len(p.Method)+len(p.Path))}
+	e.string(p.ConnectionID)
+	e.string(p.RequestID)
+	e.bytes(p.Data)
+	e.headers(p.Headers)
+	e.string(p.Method)
+	e.string(p.Path)
+	e.bool(p.Streaming)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes the data forward payload, Data aliases the input
+func (p *DataForwardPayload) UnmarshalBinary(data []byte) error {
+	d := binaryDecoder{data: data}
+	p.ConnectionID = d.string()
+	p.RequestID = d.string()
+	p.Data = d.bytes()
+	p.Headers = d.headers()
+	p.Method = d.string()
+	p.Path = d.string()
+	p.Streaming = d.bool()
+	return d.finish()
+}
+
+// MarshalBinary encodes the data response payload
+func (p *DataResponsePayload) MarshalBinary() ([]byte, error) {
+	e := binaryEncoder{buf: make([]byte, 0, 64+len(p.ConnectionID)+len(p.RequestID)+len(p.Data)+headersSize(p.Headers))}
+	e.string(p.ConnectionID)
+	e.string(p.RequestID)
+	e.bytes(p.Data)
+	e.int64(int64(p.StatusCode))
+	e.headers(p.Headers)
+	e.bool(p.Streaming)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes the data response payload, Data aliases the input
+func (p *DataResponsePayload) UnmarshalBinary(data []byte) error {
+	d := binaryDecoder{data: data}
+	p.ConnectionID = d.string()
+	p.RequestID = d.string()
+	p.Data = d.bytes()
+	p.StatusCode = int(d.int64())
+	p.Headers = d.headers()
+	p.Streaming = d.bool()
+	return d.finish()
+}
+
+// MarshalBinary encodes the data chunk payload
+func (p *DataChunkPayload) MarshalBinary() ([]byte, error) {
+	e := binaryEncoder{buf: make([]byte, 0, 32+len(p.ConnectionID)+len(p.RequestID)+len(p.Data))}
+	e.string(p.ConnectionID)
+	e.string(p.RequestID)
+	e.uint32(p.Sequence)
+	e.bytes(p.Data)
+	e.bool(p.End)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes the data chunk payload, Data aliases the input
+func (p *DataChunkPayload) UnmarshalBinary(data []byte) error {
+	d := binaryDecoder{data: data}
+	p.ConnectionID = d.string()
+	p.RequestID = d.string()
+	p.Sequence = d.uint32()
+	p.Data = d.bytes()
+	p.End = d.bool()
+	return d.finish()
+}
+
+// MarshalBinary encodes the heartbeat payload with every field
+func (p *HeartbeatPayload) MarshalBinary() ([]byte, error) {
+	return p.MarshalBinaryLayout(AllCapabilities)
+}
+
+// UnmarshalBinary decodes the heartbeat payload with every field
+func (p *HeartbeatPayload) UnmarshalBinary(data []byte) error {
+	return p.UnmarshalBinaryLayout(data, AllCapabilities)
+}
+
+// MarshalBinaryLayout encodes the heartbeat payload, the nonce and echo flag
+// only with HeartbeatEcho and the traffic counters only with TrafficCounters
+func (p *HeartbeatPayload) MarshalBinaryLayout(capabilities Capability) ([]byte, error) {
+	var e binaryEncoder
+	e.int64(p.Timestamp)
+	e.int64(int64(p.ActiveConns))
+	e.int64(int64(p.TotalRequests))
+	if capabilities.Has(CapabilityHeartbeatEcho) {
+		e.int64(int64(p.Nonce))
+		e.bool(p.Echo)
+	}
+	if capabilities.Has(CapabilityTrafficCounters) {
+		e.int64(int64(p.BytesIn))
+		e.int64(int64(p.BytesOut))
+		e.int64(int64(p.Errors))
+	}
+	return e.buf, nil
+}
+
+// UnmarshalBinaryLayout decodes the heartbeat payload, the nonce and echo flag
+// only with HeartbeatEcho and the traffic counters only with TrafficCounters
+func (p *HeartbeatPayload) UnmarshalBinaryLayout(data []byte, capabilities Capability) error {
+	d := binaryDecoder{data: data}
+	p.Timestamp = d.int64()
+	p.ActiveConns = int(d.int64())
+	p.TotalRequests = int(d.int64())
+	p.Nonce, p.Echo = 0, false
+	if capabilities.Has(CapabilityHeartbeatEcho) {
+		p.Nonce = uint64(d.int64())
+		p.Echo = d.bool()
+	}
+	p.BytesIn, p.BytesOut, p.Errors = 0, 0, 0
+	if capabilities.Has(CapabilityTrafficCounters) {
+		p.BytesIn = uint64(d.int64())
+		p.BytesOut = uint64(d.int64())
+		p.Errors = uint64(d.int64())
+	}
+	return d.finish()
+}
+
+// MarshalBinary encodes the error payload
+func (p *ErrorPayload) MarshalBinary() ([]byte, error) {
+	var e binaryEncoder
+	e.string(p.Code)
+	e.string(p.Message)
+	e.string(p.Details)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes the error payload
+func (p *ErrorPayload) UnmarshalBinary(data []byte) error {
+	d := binaryDecoder{data: data}
+	p.Code = d.string()
+	p.Message = d.string()
+	p.Details = d.string()
+	return d.finish()
+}
+
+// MarshalBinary encodes the acknowledgment payload
+func (p *AcknowledgePayload) MarshalBinary() ([]byte, error) {
+	var e binaryEncoder
+	e.string(p.MessageID)
+	e.string(p.Status)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes the acknowledgment payload
+func (p *AcknowledgePayload) UnmarshalBinary(data []byte) error {
+	d := binaryDecoder{data: data}
+	p.MessageID = d.string()
+	p.Status = d.string()
+	return d.finish()
+}
+
+// MarshalBinary encodes the connection close payload
+func (p *ConnectionClosePayload) MarshalBinary() ([]byte, error) {
+	var e binaryEncoder
+	e.string(p.ConnectionID)
+	e.string(p.Reason)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes the connection close payload
+func (p *ConnectionClosePayload) UnmarshalBinary(data []byte) error {
+	d := binaryDecoder{data: data}
+	p.ConnectionID = d.string()
+	p.Reason = d.string()
+	return d.finish()
+}
+
+// MarshalBinary encodes the GOAWAY payload
+func (p *GoAwayPayload) MarshalBinary() ([]byte, error) {
+	var e binaryEncoder
+	e.string(p.Reason)
+	e.int64(p.DrainTimeout)
+	return e.buf, nil
+}
+
+// UnmarshalBinary decodes the GOAWAY payload
+func (p *GoAwayPayload) UnmarshalBinary(data []byte) error {
+	d := binaryDecoder{data: data}
+	p.Reason = d.string()
+	p.DrainTimeout = d.int64()
+	return d.finish()
+}
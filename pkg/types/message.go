@@ -1,7 +1,7 @@
 package types
 
 import (
-	"bytes"
+	"encoding"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -26,6 +26,92 @@ const (
 	MessageTypeError MessageType = 0x06
 	// MessageTypeAcknowledge represents an acknowledgment message
 	MessageTypeAcknowledge MessageType = 0x07
+	// MessageTypeHello represents the first frame a client sends on a new connection
+	MessageTypeHello MessageType = 0x08
+	// MessageTypeHelloAck represents the server's answer to a hello
+	MessageTypeHelloAck MessageType = 0x09
+	// MessageTypeStreamOpen opens a multiplexed stream
+	MessageTypeStreamOpen MessageType = 0x0A
+	// MessageTypeStreamData carries bytes on a multiplexed stream
+	MessageTypeStreamData MessageType = 0x0B
+	// MessageTypeStreamFin half-closes a multiplexed stream, no more data follows from the sender
+	MessageTypeStreamFin MessageType = 0x0C
+	// MessageTypeStreamReset aborts a multiplexed stream in both directions
+	MessageTypeStreamReset MessageType = 0x0D
+	// MessageTypeWindowUpdate grants the peer more send credit on a multiplexed stream
+	MessageTypeWindowUpdate MessageType = 0x0E
+	// MessageTypeDataChunk carries one ordered piece of a streamed request or response body
+	MessageTypeDataChunk MessageType = 0x0F
+	// MessageTypeGoAway tells the peer to move to a new connection while this one drains
+	MessageTypeGoAway MessageType = 0x10
+	// MessageTypeTunnelRegistered represents the server's answer to a tunnel registration
+	MessageTypeTunnelRegistered MessageType = 0x11
+	// MessageTypeAuth carries the credentials of the client right after the handshake
+	MessageTypeAuth MessageType = 0x12
+)
+
+const (
+	// ProtocolVersion is the newest data plane protocol version this client speaks
+	ProtocolVersion uint8 = 1
+	// MinProtocolVersion is the oldest data plane protocol version this client accepts
+	MinProtocolVersion uint8 = 1
+)
+
+// Capability is a bitset of optional protocol features exchanged in the handshake
+type Capability uint32
+
+const (
+	// CapabilityCompression means compressed payloads are understood
+	CapabilityCompression Capability = 1 << iota
+	// CapabilityStreaming means request and response bodies can be streamed in chunks
+	CapabilityStreaming
+	// CapabilityMultiplexing means stream frames with per-stream flow control are understood
+	CapabilityMultiplexing
+	// CapabilityBinaryPayload means payloads may use the binary encoding
+	CapabilityBinaryPayload
+	// CapabilityReliableDelivery means frames may carry a message ID that the receiver acknowledges
+	CapabilityReliableDelivery
+	// CapabilityGoAway means a GOAWAY drains the connection instead of dropping it
+	CapabilityGoAway
+	// CapabilityHeartbeatEcho means heartbeats carrying a nonce are echoed back
+	CapabilityHeartbeatEcho
+	// CapabilitySessionResume means registrations are answered with a token that reclaims the tunnel later
+	CapabilitySessionResume
+	// CapabilityTrafficCounters means tunnel heartbeats carry byte and error counters
+	CapabilityTrafficCounters
+	// CapabilityAuth means the client authenticates with an AUTH frame right after the handshake
+	CapabilityAuth
+)
+
+// AllCapabilities selects every field of a binary payload, for messages that
+// are not tied to a negotiated connection
+const AllCapabilities = ^Capability(0)
+
+// Has returns whether every capability in other is set
+func (c Capability) Has(other Capability) bool {
+	return c&other == other
+}
+
+// Frame flags carried in the high bits of the type byte
+const (
+	// FlagCompressed marks a payload compressed with the algorithm negotiated for the connection
+	FlagCompressed uint8 = 0x80
+	// FlagBinaryPayload marks a payload in the compact binary encoding instead of JSON
+	FlagBinaryPayload uint8 = 0x40
+	// FlagMessageID marks a frame whose header is followed by an 8-byte message ID
+	FlagMessageID uint8 = 0x20
+	// typeMask selects the message type from the type byte
+	typeMask uint8 = 0x1F
+)
+
+// PayloadEncoding is the encoding of a message payload
+type PayloadEncoding uint8
+
+const (
+	// EncodingJSON encodes payloads as JSON, every peer understands it
+	EncodingJSON PayloadEncoding = iota
+	// EncodingBinary encodes payloads as length-prefixed binary fields
+	EncodingBinary
 )
 
 // Message represents a protocol message
@@ -34,8 +120,28 @@ type Message struct {
 	TunnelID  string     `json:"tunnel_id"`
 	Payload   []byte     `json:"payload"`
 	Timestamp time.Time  `json:"timestamp"`
+	// Encoding is the encoding of Payload, sent as a frame flag
+	Encoding PayloadEncoding `json:"encoding"`
+	// Compressed means Payload is still compressed, sent as a frame flag
+	Compressed bool `json:"compressed"`
+	// ID identifies a frame the receiver must acknowledge, zero for frames sent at most once
+	ID uint64 `json:"id,omitempty"`
+	// Capabilities are the ones negotiated on the connection, a binary payload
+	// only has the fields of capabilities set here. Never sent.
+	Capabilities Capability `json:"-"`
 }
 
+// MessageIDSize is the size of the optional message ID that follows the frame header
+const MessageIDSize = 8
+
+// Acknowledgment statuses sent in AcknowledgePayload.Status
+const (
+	// AckStatusReceived acknowledges the first delivery of a message
+	AckStatusReceived = "received"
+	// AckStatusDuplicate acknowledges a message that was delivered before and dropped
+	AckStatusDuplicate = "duplicate"
+)
+
 // TunnelRegistrationPayload represents tunnel registration data
 type TunnelRegistrationPayload struct {
 	Protocol      string `json:"protocol"`
@@ -43,6 +149,20 @@ type TunnelRegistrationPayload struct {
 	Subdomain     string `json:"subdomain,omitempty"`
 	PublicPort    *int   `json:"public_port,omitempty"`
 	MaxConnections int   `json:"max_connections"`
+	// ResumeToken reclaims the tunnel ID, subdomain and public port of an earlier registration
+	ResumeToken string `json:"resume_token,omitempty"`
+}
+
+// TunnelRegisteredPayload represents the server's answer to a registration. The
+// token it carries is presented in the next registration of the tunnel, after
+// a reconnect or a restart, to get the same public URL back.
+type TunnelRegisteredPayload struct {
+	PublicURL   string `json:"public_url"`
+	Subdomain   string `json:"subdomain,omitempty"`
+	PublicPort  int    `json:"public_port,omitempty"`
+	ResumeToken string `json:"resume_token"`
+	// Resumed means the registration reclaimed the tunnel with a resumption token
+	Resumed bool `json:"resumed,omitempty"`
 }
 
 // DataForwardPayload represents data forwarded from server
@@ -53,6 +173,8 @@ type DataForwardPayload struct {
 	Headers      map[string]string `json:"headers"`
 	Method       string            `json:"method"`
 	Path         string            `json:"path"`
+	// Streaming means Data is empty and the body follows in DATA_CHUNK frames
+	Streaming bool `json:"streaming,omitempty"`
 }
 
 // DataResponsePayload represents response data from client
@@ -62,13 +184,31 @@ type DataResponsePayload struct {
 	Data         []byte            `json:"data"`
 	StatusCode   int               `json:"status_code"`
 	Headers      map[string]string `json:"headers"`
+	// Streaming means Data is empty and the body follows in DATA_CHUNK frames
+	Streaming bool `json:"streaming,omitempty"`
 }
 
-// HeartbeatPayload represents heartbeat data
+// DataChunkPayload represents one piece of a streamed body. Chunks of a body
+// are numbered from zero and the last one has End set.
+type DataChunkPayload struct {
+	ConnectionID string `json:"connection_id"`
+	RequestID    string `json:"request_id"`
+	Sequence     uint32 `json:"sequence"`
+	Data         []byte `json:"data"`
+	End          bool   `json:"end,omitempty"`
+}
+
+// HeartbeatPayload represents heartbeat data. A heartbeat with a nonce is
+// answered with a heartbeat carrying the same nonce and Echo set.
 type HeartbeatPayload struct {
-	Timestamp    int64 `json:"timestamp"`
-	ActiveConns  int   `json:"active_conns"`
-	TotalRequests int  `json:"total_requests"`
+	Timestamp     int64  `json:"timestamp"`
+	ActiveConns   int    `json:"active_conns"`
+	TotalRequests int    `json:"total_requests"`
+	Nonce         uint64 `json:"nonce,omitempty"`
+	Echo          bool   `json:"echo,omitempty"`
+	BytesIn       uint64 `json:"bytes_in,omitempty"`
+	BytesOut      uint64 `json:"bytes_out,omitempty"`
+	Errors        uint64 `json:"errors,omitempty"`
 }
 
 // ErrorPayload represents error data
@@ -78,6 +218,97 @@ type ErrorPayload struct {
 	Details string `json:"details,omitempty"`
 }
 
+// Error codes sent in ErrorPayload.Code
+const (
+	// ErrorCodeUnknownTunnel means the tunnel is not registered on this client
+	ErrorCodeUnknownTunnel = "UNKNOWN_TUNNEL"
+	// ErrorCodeTunnelBusy means the tunnel's message queue is full
+	ErrorCodeTunnelBusy = "TUNNEL_BUSY"
+	// ErrorCodeLocalService means the local service could not be reached
+	ErrorCodeLocalService = "LOCAL_SERVICE_ERROR"
+	// ErrorCodeInvalidPayload means a payload could not be parsed
+	ErrorCodeInvalidPayload = "INVALID_PAYLOAD"
+	// ErrorCodeUnsupportedVersion means no common protocol version exists
+	ErrorCodeUnsupportedVersion = "UNSUPPORTED_VERSION"
+	// ErrorCodeUnknownRequest means a body chunk arrived for a request that is not streaming
+	ErrorCodeUnknownRequest = "UNKNOWN_REQUEST"
+	// ErrorCodeBodyOverflow means the local service fell too far behind a streamed request body and the request is aborted
+	ErrorCodeBodyOverflow = "BODY_OVERFLOW"
+	// ErrorCodeFrameTooLarge means a frame exceeded the receiver's max frame size and the connection is closed
+	ErrorCodeFrameTooLarge = "FRAME_TOO_LARGE"
+	// ErrorCodeInvalidResumeToken means a registration presented a resumption token the server does not accept
+	ErrorCodeInvalidResumeToken = "INVALID_RESUME_TOKEN"
+	// ErrorCodeAuthenticationFailed means the credentials of an AUTH frame were not accepted
+	ErrorCodeAuthenticationFailed = "AUTHENTICATION_FAILED"
+)
+
+// HelloPayload represents the versions and capabilities a client offers
+type HelloPayload struct {
+	ProtocolVersion    uint8      `json:"protocol_version"`
+	MinProtocolVersion uint8      `json:"min_protocol_version"`
+	ClientVersion      string     `json:"client_version"`
+	Capabilities       Capability `json:"capabilities"`
+	// Compression lists the compression algorithms the client accepts, most preferred first
+	Compression []string `json:"compression,omitempty"`
+}
+
+// HelloAckPayload represents the version and capabilities the server selected
+type HelloAckPayload struct {
+	ProtocolVersion uint8      `json:"protocol_version"`
+	ServerVersion   string     `json:"server_version"`
+	Capabilities    Capability `json:"capabilities"`
+	// Compression is the algorithm the server selected from the client's list
+	Compression string `json:"compression,omitempty"`
+	// SessionID names the server session, the message IDs the server sends are unique within it
+	SessionID string `json:"session_id,omitempty"`
+}
+
+// AuthPayload represents the credentials a client authenticates a data plane connection with
+type AuthPayload struct {
+	Method     string `json:"method"`
+	Credential string `json:"credential"`
+}
+
+const (
+	// AuthMethodAPIKey authenticates with the API key of the account
+	AuthMethodAPIKey = "api_key"
+	// AuthMethodToken authenticates with a short-lived data plane token issued by the control plane
+	AuthMethodToken = "token"
+)
+
+// StreamPayload represents a stream multiplexing frame. It is binary encoded as
+// stream_id(4) | window(4) | data so stream bytes are not inflated by JSON.
+type StreamPayload struct {
+	StreamID uint32
+	// Window is the initial receive window for OPEN and the granted credit for WINDOW_UPDATE
+	Window uint32
+	// Data is the stream bytes for DATA, optional metadata for OPEN and the reason for RST
+	Data []byte
+}
+
+// streamPayloadHeaderSize is the fixed part of an encoded StreamPayload
+const streamPayloadHeaderSize = 8
+
+// MarshalBinary encodes the stream payload
+func (p *StreamPayload) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, streamPayloadHeaderSize+len(p.Data))
+	binary.BigEndian.PutUint32(buf[0:4], p.StreamID)
+	binary.BigEndian.PutUint32(buf[4:8], p.Window)
+	copy(buf[streamPayloadHeaderSize:], p.Data)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the stream payload, Data aliases the input
+func (p *StreamPayload) UnmarshalBinary(data []byte) error {
+	if len(data) < streamPayloadHeaderSize {
+		return fmt.Errorf("stream payload too short: %d bytes", len(data))
+	}
+	p.StreamID = binary.BigEndian.Uint32(data[0:4])
+	p.Window = binary.BigEndian.Uint32(data[4:8])
+	p.Data = data[streamPayloadHeaderSize:]
+	return nil
+}
+
 // AcknowledgePayload represents acknowledgment data
 type AcknowledgePayload struct {
 	MessageID string `json:"message_id"`
@@ -90,31 +321,49 @@ type ConnectionClosePayload struct {
 	Reason       string `json:"reason"`
 }
 
+// GoAwayPayload represents a request to stop using a connection. The sender
+// opens no new streams on it and closes it once in-flight work finished or the
+// drain timeout passed.
+type GoAwayPayload struct {
+	Reason string `json:"reason"`
+	// DrainTimeout is how long in milliseconds the sender keeps the connection open, zero leaves it to the receiver
+	DrainTimeout int64 `json:"drain_timeout_ms,omitempty"`
+}
+
 // Serialize serializes a message to binary format
 func (m *Message) Serialize() ([]byte, error) {
 	// Calculate total size
 	payloadSize := len(m.Payload)
 	totalSize := 1 + 16 + 4 + payloadSize // type + tunnel_id + payload_size + payload
+	if m.ID != 0 {
+		totalSize += MessageIDSize
+	}
 	
 	// Create buffer
 	buf := make([]byte, totalSize)
 	offset := 0
 	
-	// Write message type (1 byte)
-	buf[offset] = uint8(m.Type)
+	// Write message type and flags (1 byte)
+	buf[offset] = m.EncodeTypeByte()
 	offset++
 	
-	// Write tunnel ID (16 bytes, padded with zeros)
-	tunnelIDBytes := []byte(m.TunnelID)
-	if len(tunnelIDBytes) > 16 {
-		tunnelIDBytes = tunnelIDBytes[:16]
+	// Write tunnel ID (16 raw UUID bytes)
+	tunnelID, err := ParseTunnelID(m.TunnelID)
+	if err != nil {
+		return nil, err
 	}
-	copy(buf[offset:offset+16], tunnelIDBytes)
-	offset += 16
+	copy(buf[offset:offset+TunnelIDSize], tunnelID[:])
+	offset += TunnelIDSize
 	
 	// Write payload size (4 bytes)
 	binary.BigEndian.PutUint32(buf[offset:offset+4], uint32(payloadSize))
 	offset += 4
+
+	// Write message ID (8 bytes, only when set)
+	if m.ID != 0 {
+		binary.BigEndian.PutUint64(buf[offset:offset+MessageIDSize], m.ID)
+		offset += MessageIDSize
+	}
 	
 	// Write payload
 	copy(buf[offset:], m.Payload)
@@ -130,36 +379,118 @@ func (m *Message) Deserialize(data []byte) error {
 	
 	offset := 0
 	
-	// Read message type
-	m.Type = MessageType(data[offset])
+	// Read message type and flags
+	m.DecodeTypeByte(data[offset])
 	offset++
 	
 	// Read tunnel ID
-	tunnelIDBytes := data[offset : offset+16]
-	m.TunnelID = string(bytes.TrimRight(tunnelIDBytes, "\x00"))
-	offset += 16
+	m.TunnelID = FormatTunnelID([TunnelIDSize]byte(data[offset : offset+TunnelIDSize]))
+	offset += TunnelIDSize
 	
 	// Read payload size
 	payloadSize := binary.BigEndian.Uint32(data[offset : offset+4])
 	offset += 4
+
+	// Read message ID
+	m.ID = 0
+	if HasMessageID(data[0]) {
+		if len(data) < offset+MessageIDSize {
+			return fmt.Errorf("message truncated: missing message ID")
+		}
+		m.ID = binary.BigEndian.Uint64(data[offset : offset+MessageIDSize])
+		offset += MessageIDSize
+	}
 	
 	// Read payload
 	if len(data) < offset+int(payloadSize) {
 		return fmt.Errorf("message truncated: expected %d bytes, got %d", offset+int(payloadSize), len(data))
 	}
 	m.Payload = data[offset : offset+int(payloadSize)]
+	// Outside a connection nothing narrows the binary layout
+	m.Capabilities = AllCapabilities
 	
 	return nil
 }
 
+// EncodeTypeByte returns the message type combined with the frame flags
+func (m *Message) EncodeTypeByte() uint8 {
+	typeByte := uint8(m.Type)
+	if m.Encoding == EncodingBinary {
+		typeByte |= FlagBinaryPayload
+	}
+	if m.Compressed {
+		typeByte |= FlagCompressed
+	}
+	if m.ID != 0 {
+		typeByte |= FlagMessageID
+	}
+	return typeByte
+}
+
+// HasMessageID returns whether a type byte announces a message ID after the header
+func HasMessageID(typeByte uint8) bool {
+	return typeByte&FlagMessageID != 0
+}
+
+// DecodeTypeByte sets the message type and the flags from a type byte
+func (m *Message) DecodeTypeByte(typeByte uint8) {
+	m.Type = MessageType(typeByte & typeMask)
+	m.Encoding = EncodingJSON
+	if typeByte&FlagBinaryPayload != 0 {
+		m.Encoding = EncodingBinary
+	}
+	m.Compressed = typeByte&FlagCompressed != 0
+}
+
 // NewMessage creates a new message
 func NewMessage(msgType MessageType, tunnelID string, payload []byte) *Message {
 	return &Message{
-		Type:      msgType,
-		TunnelID:  tunnelID,
-		Payload:   payload,
-		Timestamp: time.Now(),
+		Type:         msgType,
+		TunnelID:     tunnelID,
+		Payload:      payload,
+		Timestamp:    time.Now(),
+		Capabilities: AllCapabilities,
+	}
+}
+
+// NewEncodedMessage creates a message with its payload in the requested encoding.
+// Payloads without a binary form fall back to JSON.
+func NewEncodedMessage(msgType MessageType, tunnelID string, payload interface{}, payloadEncoding PayloadEncoding) (*Message, error) {
+	return NewNegotiatedMessage(msgType, tunnelID, payload, payloadEncoding, AllCapabilities)
+}
+
+// NewNegotiatedMessage creates a message for a connection that negotiated
+// capabilities, a binary payload leaves out the fields of the others
+func NewNegotiatedMessage(msgType MessageType, tunnelID string, payload interface{}, payloadEncoding PayloadEncoding, capabilities Capability) (*Message, error) {
+	data, used, err := EncodeNegotiatedPayload(payload, payloadEncoding, capabilities)
+	if err != nil {
+		return nil, err
 	}
+	message := NewMessage(msgType, tunnelID, data)
+	message.Encoding = used
+	message.Capabilities = capabilities
+	return message, nil
+}
+
+// EncodePayload encodes a payload and returns the encoding that was actually used
+func EncodePayload(payload interface{}, payloadEncoding PayloadEncoding) ([]byte, PayloadEncoding, error) {
+	return EncodeNegotiatedPayload(payload, payloadEncoding, AllCapabilities)
+}
+
+// EncodeNegotiatedPayload encodes a payload for a connection that negotiated
+// capabilities and returns the encoding that was actually used
+func EncodeNegotiatedPayload(payload interface{}, payloadEncoding PayloadEncoding, capabilities Capability) ([]byte, PayloadEncoding, error) {
+	if marshaler, ok := payload.(LayoutMarshaler); ok && payloadEncoding == EncodingBinary {
+		data, err := marshaler.MarshalBinaryLayout(capabilities)
+		return data, EncodingBinary, err
+	}
+	if marshaler, ok := payload.(encoding.BinaryMarshaler); ok && payloadEncoding == EncodingBinary {
+		data, err := marshaler.MarshalBinary()
+		return data, EncodingBinary, err
+	}
+
+	data, err := json.Marshal(payload)
+	return data, EncodingJSON, err
 }
 
 // NewTunnelRegistrationMessage creates a new tunnel registration message
@@ -189,6 +520,15 @@ func NewDataResponseMessage(tunnelID string, payload *DataResponsePayload) (*Mes
 	return NewMessage(MessageTypeDataResponse, tunnelID, data), nil
 }
 
+// NewDataChunkMessage creates a new data chunk message
+func NewDataChunkMessage(tunnelID string, payload *DataChunkPayload) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(MessageTypeDataChunk, tunnelID, data), nil
+}
+
 // NewHeartbeatMessage creates a new heartbeat message
 func NewHeartbeatMessage(tunnelID string, payload *HeartbeatPayload) (*Message, error) {
 	data, err := json.Marshal(payload)
@@ -225,40 +565,106 @@ func NewConnectionCloseMessage(tunnelID string, payload *ConnectionClosePayload)
 	return NewMessage(MessageTypeConnectionClose, tunnelID, data), nil
 }
 
-// ParsePayload parses the message payload based on message type
+// NewHelloMessage creates a new hello message
+func NewHelloMessage(payload *HelloPayload) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(MessageTypeHello, "", data), nil
+}
+
+// NewHelloAckMessage creates a new hello acknowledgment message
+func NewHelloAckMessage(payload *HelloAckPayload) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(MessageTypeHelloAck, "", data), nil
+}
+
+// NewAuthMessage creates a new authentication message
+func NewAuthMessage(payload *AuthPayload) (*Message, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(MessageTypeAuth, "", data), nil
+}
+
+// NewStreamMessage creates a new stream multiplexing message
+func NewStreamMessage(msgType MessageType, tunnelID string, payload *StreamPayload) (*Message, error) {
+	data, err := payload.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return NewMessage(msgType, tunnelID, data), nil
+}
+
+// IsStreamMessage returns whether a message type belongs to stream multiplexing
+func IsStreamMessage(msgType MessageType) bool {
+	return msgType >= MessageTypeStreamOpen && msgType <= MessageTypeWindowUpdate
+}
+
+// ParsePayload parses the message payload based on message type and encoding
 func (m *Message) ParsePayload() (interface{}, error) {
+	// The protocol reader decompresses payloads, a compressed one never reaches here from the wire
+	if m.Compressed {
+		return nil, fmt.Errorf("message type %d payload is still compressed", m.Type)
+	}
+
+	var payload interface{}
 	switch m.Type {
 	case MessageTypeTunnelRegistration:
-		var payload TunnelRegistrationPayload
-		err := json.Unmarshal(m.Payload, &payload)
-		return &payload, err
+		payload = &TunnelRegistrationPayload{}
+	case MessageTypeTunnelRegistered:
+		payload = &TunnelRegisteredPayload{}
 	case MessageTypeDataForward:
-		var payload DataForwardPayload
-		err := json.Unmarshal(m.Payload, &payload)
-		return &payload, err
+		payload = &DataForwardPayload{}
 	case MessageTypeDataResponse:
-		var payload DataResponsePayload
-		err := json.Unmarshal(m.Payload, &payload)
-		return &payload, err
+		payload = &DataResponsePayload{}
+	case MessageTypeDataChunk:
+		payload = &DataChunkPayload{}
 	case MessageTypeHeartbeat:
-		var payload HeartbeatPayload
-		err := json.Unmarshal(m.Payload, &payload)
-		return &payload, err
+		payload = &HeartbeatPayload{}
 	case MessageTypeError:
-		var payload ErrorPayload
-		err := json.Unmarshal(m.Payload, &payload)
-		return &payload, err
+		payload = &ErrorPayload{}
 	case MessageTypeAcknowledge:
-		var payload AcknowledgePayload
-		err := json.Unmarshal(m.Payload, &payload)
-		return &payload, err
+		payload = &AcknowledgePayload{}
 	case MessageTypeConnectionClose:
-		var payload ConnectionClosePayload
-		err := json.Unmarshal(m.Payload, &payload)
-		return &payload, err
+		payload = &ConnectionClosePayload{}
+	case MessageTypeGoAway:
+		payload = &GoAwayPayload{}
+	case MessageTypeHello:
+		payload = &HelloPayload{}
+	case MessageTypeHelloAck:
+		payload = &HelloAckPayload{}
+	case MessageTypeAuth:
+		payload = &AuthPayload{}
+	case MessageTypeStreamOpen, MessageTypeStreamData, MessageTypeStreamFin, MessageTypeStreamReset, MessageTypeWindowUpdate:
+		// Stream frames always use their own binary layout
+		var streamPayload StreamPayload
+		err := streamPayload.UnmarshalBinary(m.Payload)
+		return &streamPayload, err
 	default:
 		return nil, fmt.Errorf("unknown message type: %d", m.Type)
 	}
+
+	if m.Encoding == EncodingBinary {
+		if layout, ok := payload.(LayoutMarshaler); ok {
+			err := layout.UnmarshalBinaryLayout(m.Payload, m.Capabilities)
+			return payload, err
+		}
+		unmarshaler, ok := payload.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return nil, fmt.Errorf("message type %d has no binary encoding", m.Type)
+		}
+		err := unmarshaler.UnmarshalBinary(m.Payload)
+		return payload, err
+	}
+
+	err := json.Unmarshal(m.Payload, payload)
+	return payload, err
 }
 
 // String returns a string representation of the message
@@ -0,0 +1,89 @@
+package types
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// TunnelIDSize is the size of a tunnel ID in the frame header
+const TunnelIDSize = 16
+
+// ErrInvalidTunnelID is returned for tunnel IDs that are not canonical UUIDs
+var ErrInvalidTunnelID = errors.New("invalid tunnel ID")
+
+// Tunnel IDs are UUIDs issued by the control plane. In the frame header they are
+// the 16 raw UUID bytes; in memory they are the canonical lowercase text form
+// xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx, uppercase IDs are accepted and
+// normalized. The empty ID addresses the connection itself and is all zero
+// bytes on the wire, which is why the nil UUID is not a valid tunnel ID.
+
+// tunnelIDDashes are the positions of the dashes in the text form
+var tunnelIDDashes = [...]int{8, 13, 18, 23}
+
+// ParseTunnelID converts a tunnel ID to its 16-byte wire form
+func ParseTunnelID(id string) ([TunnelIDSize]byte, error) {
+	var raw [TunnelIDSize]byte
+	if id == "" {
+		return raw, nil
+	}
+
+	id = strings.ToLower(id)
+	if len(id) != 36 {
+		return raw, fmt.Errorf("%w %q: expected 36 characters, got %d", ErrInvalidTunnelID, id, len(id))
+	}
+	for _, position := range tunnelIDDashes {
+		if id[position] != '-' {
+			return raw, fmt.Errorf("%w %q: expected '-' at position %d", ErrInvalidTunnelID, id, position)
+		}
+	}
+
+	digits := id[0:8] + id[9:13] + id[14:18] + id[19:23] + id[24:36]
+	for i := 0; i < len(digits); i++ {
+		if c := digits[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return raw, fmt.Errorf("%w %q: expected hex digits", ErrInvalidTunnelID, id)
+		}
+	}
+	if _, err := hex.Decode(raw[:], []byte(digits)); err != nil {
+		return raw, fmt.Errorf("%w %q: %v", ErrInvalidTunnelID, id, err)
+	}
+
+	if raw == [TunnelIDSize]byte{} {
+		return raw, fmt.Errorf("%w: the nil UUID is reserved for connection-level frames", ErrInvalidTunnelID)
+	}
+	return raw, nil
+}
+
+// FormatTunnelID converts a tunnel ID from its 16-byte wire form, all zero bytes give the empty ID
+func FormatTunnelID(raw [TunnelIDSize]byte) string {
+	if raw == [TunnelIDSize]byte{} {
+		return ""
+	}
+
+	var text [36]byte
+	hex.Encode(text[0:8], raw[0:4])
+	text[8] = '-'
+	hex.Encode(text[9:13], raw[4:6])
+	text[13] = '-'
+	hex.Encode(text[14:18], raw[6:8])
+	text[18] = '-'
+	hex.Encode(text[19:23], raw[8:10])
+	text[23] = '-'
+	hex.Encode(text[24:36], raw[10:16])
+	return string(text[:])
+}
+
+// NormalizeTunnelID returns the canonical lowercase form of a tunnel ID, the form frames are read back in
+func NormalizeTunnelID(id string) string {
+	return strings.ToLower(id)
+}
+
+// ValidateTunnelID returns an error unless id is a tunnel ID that can be framed
+func ValidateTunnelID(id string) error {
+	if id == "" {
+		return fmt.Errorf("%w: empty", ErrInvalidTunnelID)
+	}
+	_, err := ParseTunnelID(id)
+	return err
+}